@@ -2,39 +2,120 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/borud/large-file-upload/pkg/transfer"
 )
 
 var opt struct {
-	ServerAddr string   `kong:"help='gRPC address of server',default=':4200'"`
-	QuitAfter  int      `kong:"help='prematurely quit upload',default='0'"`
-	Filenames  []string `kong:"arg,help='files to be uploaded',required"`
+	ServerAddr  string   `kong:"help='gRPC address of server',default=':4200'"`
+	QuitAfter   int      `kong:"help='prematurely quit upload',default='0'"`
+	Base        string   `kong:"help='upload files as delta uploads against this file ID'"`
+	Compression string   `kong:"help='compression to use for transfers',enum='none,gzip,zstd',default='none'"`
+	KeyFile     []string `kong:"help='encrypt uploads end to end with the first key and decrypt downloads with any of the keys'"`
+	TLS         bool     `kong:"help='connect using TLS'"`
+	TLSCA       string   `kong:"name='tls-ca',help='CA bundle for verifying the server, implies --tls'"`
+	TLSCert     string   `kong:"help='client certificate file, implies --tls'"`
+	TLSKey      string   `kong:"help='client key file'"`
+	TLSName     string   `kong:"help='server name to verify in the server certificate'"`
+	Token       string   `kong:"help='bearer token',env='TRANSFER_TOKEN'"`
+	APIKey      string   `kong:"help='API key',env='TRANSFER_API_KEY'"`
+	Capability  string   `kong:"help='capability token',env='TRANSFER_CAPABILITY'"`
+	Wait        bool     `kong:"help='wait for the server to finish processing uploaded files'"`
+	Bandwidth   string   `kong:"help='bytes per second for uploads and downloads, with an optional K, M or G suffix, 0 means no limit',default='0'"`
+	Window      []string `kong:"name='bandwidth-window',help='local time of day with a different bandwidth, <HH:MM>-<HH:MM>=<bandwidth>, or =pause to pause transfers'"`
+	Filenames   []string `kong:"arg,help='files to be uploaded',required"`
 }
 
 func main() {
 	kong.Parse(&opt)
 
+	compression, err := transfer.ParseCompression(opt.Compression)
+	if err != nil {
+		slog.Error("invalid compression", "err", err)
+		return
+	}
+
+	var keys []*transfer.MasterKey
+	for _, filename := range opt.KeyFile {
+		key, err := transfer.LoadMasterKey(filename)
+		if err != nil {
+			slog.Error("error loading key", "filename", filename, "err", err)
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	rate, err := transfer.ParseBandwidth(opt.Bandwidth)
+	if err != nil {
+		slog.Error("invalid bandwidth", "err", err)
+		return
+	}
+
+	bandwidth := transfer.BandwidthSchedule{Rate: rate}
+	for _, s := range opt.Window {
+		window, err := transfer.ParseBandwidthWindow(s)
+		if err != nil {
+			slog.Error("invalid bandwidth window", "err", err)
+			return
+		}
+		bandwidth.Windows = append(bandwidth.Windows, window)
+	}
+
+	var tlsConfig *transfer.TLSConfig
+	if opt.TLS || opt.TLSCA != "" || opt.TLSCert != "" {
+		tlsConfig = &transfer.TLSConfig{
+			CertFile:   opt.TLSCert,
+			KeyFile:    opt.TLSKey,
+			CAFile:     opt.TLSCA,
+			ServerName: opt.TLSName,
+		}
+	}
+
 	client, err := transfer.CreateClient(transfer.ClientConfig{
-		ServerAddr: opt.ServerAddr,
-		QuitAfter:  opt.QuitAfter,
+		ServerAddr:     opt.ServerAddr,
+		QuitAfter:      opt.QuitAfter,
+		UploadProgress: uploadProgress,
+		Compression:    compression,
+		EncryptionKeys: keys,
+		TLS:            tlsConfig,
+		Token:          opt.Token,
+		APIKey:         opt.APIKey,
+		Capability:     opt.Capability,
+		Bandwidth:      bandwidth,
 	})
 	if err != nil {
 		slog.Error("error creating client", "err", err)
 		return
 	}
+	defer client.Close()
 
 	id := ""
 
 	for _, filename := range opt.Filenames {
-		id, err = client.Upload(filename)
+		if opt.Base != "" {
+			id, err = client.UploadDelta(filename, transfer.ID(opt.Base))
+		} else {
+			id, err = client.Upload(filename)
+		}
 		if err != nil {
 			slog.Error("error uploading file", "filename", filename, "err", err)
 			return
 		}
 		slog.Info("uploaded file", "filename", filename, "id", id)
+
+		if opt.Wait {
+			_, err = client.WaitForProcessing(context.Background(), transfer.ID(id), time.Second)
+			if err != nil {
+				slog.Error("error processing file", "filename", filename, "id", id, "err", err)
+				return
+			}
+			slog.Info("processed file", "filename", filename, "id", id)
+		}
 	}
 
 	err = client.Download(transfer.ID(id), "outputfile")
@@ -42,3 +123,8 @@ func main() {
 		slog.Error("error downloading", "err", err)
 	}
 }
+
+func uploadProgress(id string, offset int64, size int64) {
+	percent := fmt.Sprintf("%.1f%%", float64(offset*100)/float64(size))
+	slog.Debug("acknowledged", "id", id, "offset", offset, "percent", percent)
+}
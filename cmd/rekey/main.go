@@ -0,0 +1,55 @@
+// Package main is the rekey tool which rotates the master key used for
+// encryption at rest.
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/alecthomas/kong"
+	"github.com/borud/large-file-upload/pkg/transfer"
+)
+
+var opt struct {
+	Generate bool     `kong:"help='generate a new master key, print it and exit'"`
+	Incoming string   `kong:"help='incoming dir',default='incoming'"`
+	KeyFile  string   `kong:"help='file holding the new master key'"`
+	OldKey   []string `kong:"help='files holding the old master keys'"`
+}
+
+func main() {
+	kong.Parse(&opt)
+
+	if opt.Generate {
+		key, err := transfer.GenerateMasterKey()
+		if err != nil {
+			slog.Error("error generating master key", "err", err)
+			os.Exit(1)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	if opt.KeyFile == "" {
+		slog.Error("--key-file is required unless generating a key")
+		os.Exit(1)
+	}
+
+	var keys []*transfer.MasterKey
+	for _, filename := range append([]string{opt.KeyFile}, opt.OldKey...) {
+		key, err := transfer.LoadMasterKey(filename)
+		if err != nil {
+			slog.Error("error loading master key", "filename", filename, "err", err)
+			os.Exit(1)
+		}
+		keys = append(keys, key)
+	}
+
+	count, err := transfer.RewrapKeys(opt.Incoming, keys...)
+	if err != nil {
+		slog.Error("error rewrapping keys", "incoming", opt.Incoming, "err", err)
+		os.Exit(1)
+	}
+	slog.Info("rewrapped data keys", "incoming", opt.Incoming, "files", count, "key", keys[0].ID())
+}
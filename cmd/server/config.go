@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/borud/large-file-upload/pkg/transfer"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the configuration of the server.  It is made from the command
+// line flags with the config file, if there is one, on top, so the file only
+// has to contain the settings that differ from the flags.  See example.yaml.
+type config struct {
+	Listen      string           `yaml:"listen"`
+	Metrics     string           `yaml:"metrics"`
+	StopTimeout time.Duration    `yaml:"stop_timeout"`
+	GRPC        grpcConfig       `yaml:"grpc"`
+	Storage     storageConfig    `yaml:"storage"`
+	TLS         tlsConfig        `yaml:"tls"`
+	Auth        authConfig       `yaml:"auth"`
+	Quotas      quotaConfig      `yaml:"quotas"`
+	Limits      limitConfig      `yaml:"limits"`
+	Retention   retentionConfig  `yaml:"retention"`
+	Hooks       hookConfig       `yaml:"hooks"`
+	Processing  processingConfig `yaml:"processing"`
+}
+
+type grpcConfig struct {
+	MaxRecvMsgSize          int           `yaml:"max_recv_msg_size"`
+	MaxSendMsgSize          int           `yaml:"max_send_msg_size"`
+	KeepaliveTime           time.Duration `yaml:"keepalive_time"`
+	KeepaliveTimeout        time.Duration `yaml:"keepalive_timeout"`
+	KeepaliveMinTime        time.Duration `yaml:"keepalive_min_time"`
+	MaxStreams              int           `yaml:"max_streams"`
+	MaxStreamsPerConnection uint32        `yaml:"max_streams_per_connection"`
+}
+
+type storageConfig struct {
+	Backend            string        `yaml:"backend"`
+	Dir                string        `yaml:"dir"`
+	BlockSize          int64         `yaml:"block_size"`
+	MinBlockSize       int64         `yaml:"min_block_size"`
+	MaxBlockSize       int64         `yaml:"max_block_size"`
+	Sync               string        `yaml:"sync"`
+	SyncBytes          int64         `yaml:"sync_bytes"`
+	SyncInterval       time.Duration `yaml:"sync_interval"`
+	Dedup              bool          `yaml:"dedup"`
+	DisableCompression bool          `yaml:"disable_compression"`
+	Quarantine         bool          `yaml:"quarantine"`
+	KeyEnv             string        `yaml:"key_env"`
+	KeyFiles           []string      `yaml:"key_files"`
+}
+
+type tlsConfig struct {
+	Cert          string `yaml:"cert"`
+	Key           string `yaml:"key"`
+	CA            string `yaml:"ca"`
+	VerifyClients bool   `yaml:"verify_clients"`
+}
+
+type authConfig struct {
+	TokenFile      string   `yaml:"token_file"`
+	APIKeyFile     string   `yaml:"api_key_file"`
+	MTLS           bool     `yaml:"mtls"`
+	CapabilityKeys []string `yaml:"capability_keys"`
+	Anonymous      bool     `yaml:"anonymous"`
+	Admins         []string `yaml:"admins"`
+}
+
+type quotaConfig struct {
+	Bytes   int64 `yaml:"bytes"`
+	Uploads int   `yaml:"uploads"`
+}
+
+type limitConfig struct {
+	MaxFileSize        int64 `yaml:"max_file_size"`
+	MinFree            int64 `yaml:"min_free"`
+	Bandwidth          int64 `yaml:"bandwidth"`
+	PrincipalBandwidth int64 `yaml:"principal_bandwidth"`
+	StreamBandwidth    int64 `yaml:"stream_bandwidth"`
+	Memory             int64 `yaml:"memory"`
+}
+
+type retentionConfig struct {
+	Quarantine time.Duration `yaml:"quarantine"`
+}
+
+type hookConfig struct {
+	Log       bool          `yaml:"log"`
+	QueueSize int           `yaml:"queue_size"`
+	Webhook   webhookConfig `yaml:"webhook"`
+}
+
+type webhookConfig struct {
+	URLs        []string      `yaml:"urls"`
+	KeyFile     string        `yaml:"key_file"`
+	Queue       string        `yaml:"queue"`
+	DeadLetter  string        `yaml:"dead_letter"`
+	Events      []string      `yaml:"events"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+type processingConfig struct {
+	Steps       []string      `yaml:"steps"`
+	Concurrency int           `yaml:"concurrency"`
+	Timeout     time.Duration `yaml:"timeout"`
+	Deliver     string        `yaml:"deliver"`
+}
+
+// storageBackend is the only storage backend there is so far.
+const storageBackend = "local"
+
+// flagConfig returns the configuration given by the command line flags.
+func flagConfig() config {
+	return config{
+		Listen:      opt.ListenAddr,
+		Metrics:     opt.MetricsAddr,
+		StopTimeout: opt.StopTimeout,
+		GRPC: grpcConfig{
+			MaxRecvMsgSize:          opt.MaxRecvMsg,
+			MaxSendMsgSize:          opt.MaxSendMsg,
+			KeepaliveTime:           opt.KATime,
+			KeepaliveTimeout:        opt.KATimeout,
+			KeepaliveMinTime:        opt.KAMinTime,
+			MaxStreams:              opt.MaxStreams,
+			MaxStreamsPerConnection: opt.ConnStreams,
+		},
+		Storage: storageConfig{
+			Backend:            storageBackend,
+			Dir:                opt.Incoming,
+			BlockSize:          opt.Blocksize,
+			MinBlockSize:       opt.MinBlocksize,
+			MaxBlockSize:       opt.MaxBlocksize,
+			Sync:               opt.Sync,
+			SyncBytes:          opt.SyncBytes,
+			SyncInterval:       opt.SyncInterval,
+			Dedup:              opt.Dedup,
+			DisableCompression: opt.NoCompress,
+			Quarantine:         opt.Quarantine,
+			KeyEnv:             opt.KeyEnv,
+			KeyFiles:           opt.KeyFile,
+		},
+		TLS: tlsConfig{
+			Cert:          opt.TLSCert,
+			Key:           opt.TLSKey,
+			CA:            opt.TLSCA,
+			VerifyClients: opt.TLSVerify,
+		},
+		Auth: authConfig{
+			TokenFile:      opt.TokenFile,
+			APIKeyFile:     opt.APIKeyFile,
+			MTLS:           opt.AuthMTLS,
+			CapabilityKeys: opt.CapKey,
+			Anonymous:      opt.Anonymous,
+			Admins:         opt.Admin,
+		},
+		Quotas: quotaConfig{
+			Bytes:   opt.Quota,
+			Uploads: opt.MaxUploads,
+		},
+		Limits: limitConfig{
+			MaxFileSize:        opt.MaxFileSize,
+			MinFree:            opt.MinFree,
+			Bandwidth:          opt.Bandwidth,
+			PrincipalBandwidth: opt.PrincipalBW,
+			StreamBandwidth:    opt.StreamBW,
+			Memory:             opt.MemoryLimit,
+		},
+		Retention: retentionConfig{
+			Quarantine: opt.Retention,
+		},
+		Hooks: hookConfig{
+			Log: true,
+			Webhook: webhookConfig{
+				URLs:    opt.Webhook,
+				KeyFile: opt.WebhookKey,
+				Queue:   opt.WebhookQueue,
+			},
+		},
+		Processing: processingConfig{
+			Steps:       opt.Process,
+			Concurrency: opt.ProcessLimit,
+			Timeout:     opt.ProcessTime,
+			Deliver:     opt.Deliver,
+		},
+	}
+}
+
+// loadConfig returns the configuration given by the flags and the config
+// file, if any.  An error is returned if the configuration isn't valid.
+func loadConfig() (*config, error) {
+	c := flagConfig()
+
+	if opt.Config != "" {
+		f, err := os.Open(opt.Config)
+		if err != nil {
+			return nil, fmt.Errorf("error opening config file: %w", err)
+		}
+		defer f.Close()
+
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+
+		err = decoder.Decode(&c)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error parsing config file [%s]: %w", opt.Config, err)
+		}
+	}
+
+	err := c.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return &c, nil
+}
+
+// problems collects what is wrong with a config.  Each problem is prefixed
+// with the key of the setting in the config file.
+type problems []error
+
+func (p *problems) add(key string, format string, args ...any) {
+	*p = append(*p, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+}
+
+// nonNegative adds a problem to p if v is negative.
+func nonNegative[T int | int64 | time.Duration](p *problems, key string, v T) {
+	if v < 0 {
+		p.add(key, "cannot be negative, got %v", v)
+	}
+}
+
+// validate checks the settings that can be checked without loading any
+// files, and returns all the problems it finds.
+func (c *config) validate() error {
+	var p problems
+
+	if c.Listen == "" {
+		p.add("listen", "listen address is required")
+	}
+
+	nonNegative(&p, "stop_timeout", c.StopTimeout)
+	nonNegative(&p, "grpc.max_recv_msg_size", c.GRPC.MaxRecvMsgSize)
+	nonNegative(&p, "grpc.max_send_msg_size", c.GRPC.MaxSendMsgSize)
+	nonNegative(&p, "grpc.keepalive_time", c.GRPC.KeepaliveTime)
+	nonNegative(&p, "grpc.keepalive_timeout", c.GRPC.KeepaliveTimeout)
+	nonNegative(&p, "grpc.keepalive_min_time", c.GRPC.KeepaliveMinTime)
+	nonNegative(&p, "grpc.max_streams", c.GRPC.MaxStreams)
+
+	if c.Storage.Backend != storageBackend {
+		p.add("storage.backend", "unknown backend [%s], the only backend is [%s]", c.Storage.Backend, storageBackend)
+	}
+
+	if c.Storage.Dir == "" {
+		p.add("storage.dir", "storage dir is required")
+	}
+
+	nonNegative(&p, "storage.min_block_size", c.Storage.MinBlockSize)
+	nonNegative(&p, "storage.max_block_size", c.Storage.MaxBlockSize)
+
+	if c.Storage.BlockSize <= 0 {
+		p.add("storage.block_size", "must be positive, got %d", c.Storage.BlockSize)
+	} else {
+		// the block sizes must fit in the messages
+		err := transfer.Config{
+			PreferredBlockSize: c.Storage.BlockSize,
+			MinBlockSize:       c.Storage.MinBlockSize,
+			MaxBlockSize:       c.Storage.MaxBlockSize,
+			MaxRecvMsgSize:     c.GRPC.MaxRecvMsgSize,
+			MaxSendMsgSize:     c.GRPC.MaxSendMsgSize,
+		}.Validate()
+		if err != nil {
+			p.add("storage.block_size", "%v", err)
+		}
+	}
+
+	_, err := transfer.ParseSyncMode(c.Storage.Sync)
+	if err != nil {
+		p.add("storage.sync", "%v", err)
+	}
+
+	nonNegative(&p, "storage.sync_bytes", c.Storage.SyncBytes)
+	nonNegative(&p, "storage.sync_interval", c.Storage.SyncInterval)
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		p.add("tls", "cert and key must be given together")
+	}
+
+	if c.TLS.VerifyClients && (c.TLS.Cert == "" || c.TLS.CA == "") {
+		p.add("tls.verify_clients", "requires cert, key and ca")
+	}
+
+	if c.Auth.MTLS && !c.TLS.VerifyClients {
+		p.add("auth.mtls", "requires tls.verify_clients")
+	}
+
+	nonNegative(&p, "quotas.bytes", c.Quotas.Bytes)
+	nonNegative(&p, "quotas.uploads", c.Quotas.Uploads)
+	nonNegative(&p, "limits.max_file_size", c.Limits.MaxFileSize)
+	nonNegative(&p, "limits.min_free", c.Limits.MinFree)
+	nonNegative(&p, "limits.bandwidth", c.Limits.Bandwidth)
+	nonNegative(&p, "limits.principal_bandwidth", c.Limits.PrincipalBandwidth)
+	nonNegative(&p, "limits.stream_bandwidth", c.Limits.StreamBandwidth)
+	nonNegative(&p, "limits.memory", c.Limits.Memory)
+	nonNegative(&p, "retention.quarantine", c.Retention.Quarantine)
+	nonNegative(&p, "hooks.queue_size", c.Hooks.QueueSize)
+
+	webhook := c.Hooks.Webhook
+	if len(webhook.URLs) > 0 && webhook.KeyFile == "" {
+		p.add("hooks.webhook.key_file", "required when there are webhook urls")
+	}
+
+	for _, u := range webhook.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			p.add("hooks.webhook.urls", "[%s] is not an http or https URL", u)
+		}
+	}
+
+	for _, e := range webhook.Events {
+		_, err := transfer.ParseEventType(e)
+		if err != nil {
+			p.add("hooks.webhook.events", "%v", err)
+		}
+	}
+
+	nonNegative(&p, "hooks.webhook.max_attempts", webhook.MaxAttempts)
+	nonNegative(&p, "hooks.webhook.timeout", webhook.Timeout)
+
+	for _, s := range c.Processing.Steps {
+		_, err := transfer.ParseProcessingStep(s)
+		if err != nil {
+			p.add("processing.steps", "%v", err)
+		}
+	}
+
+	nonNegative(&p, "processing.concurrency", c.Processing.Concurrency)
+	nonNegative(&p, "processing.timeout", c.Processing.Timeout)
+
+	return errors.Join(p...)
+}
+
+// authEnabled returns true if any authentication method is configured.
+func (c *config) authEnabled() bool {
+	return c.Auth.MTLS || c.Auth.TokenFile != "" || c.Auth.APIKeyFile != "" || len(c.Auth.CapabilityKeys) > 0
+}
+
+// limits returns the limits of the transfer service.
+func (c *config) limits() transfer.Limits {
+	return transfer.Limits{
+		MaxFileSize:           c.Limits.MaxFileSize,
+		Quota:                 c.Quotas.Bytes,
+		MaxConcurrentUploads:  c.Quotas.Uploads,
+		MinFreeSpace:          c.Limits.MinFree,
+		QuarantineRetention:   c.Retention.Quarantine,
+		MaxBandwidth:          c.Limits.Bandwidth,
+		MaxPrincipalBandwidth: c.Limits.PrincipalBandwidth,
+		MaxStreamBandwidth:    c.Limits.StreamBandwidth,
+		MemoryLimit:           c.Limits.Memory,
+	}
+}
+
+// restartRequired returns the keys of the settings that differ between c and
+// next and that only take effect when the server is restarted.
+func (c *config) restartRequired(next *config) []string {
+	var keys []string
+	for _, s := range []struct {
+		key  string
+		same bool
+	}{
+		{key: "listen", same: c.Listen == next.Listen},
+		{key: "metrics", same: c.Metrics == next.Metrics},
+		{key: "grpc", same: c.GRPC == next.GRPC},
+		{key: "storage", same: reflect.DeepEqual(c.Storage, next.Storage)},
+		{key: "tls", same: c.TLS == next.TLS},
+		{key: "hooks", same: reflect.DeepEqual(c.Hooks, next.Hooks)},
+		{key: "processing", same: reflect.DeepEqual(c.Processing, next.Processing)},
+		{key: "auth", same: c.authEnabled() == next.authEnabled()},
+	} {
+		if !s.same {
+			keys = append(keys, s.key)
+		}
+	}
+	return keys
+}
+
+// applyReloadable returns c with the settings of next that take effect when
+// the config is reloaded.
+func (c *config) applyReloadable(next *config) *config {
+	applied := *c
+	applied.StopTimeout = next.StopTimeout
+	applied.Quotas = next.Quotas
+	applied.Limits = next.Limits
+	applied.Retention = next.Retention
+
+	if c.authEnabled() == next.authEnabled() {
+		applied.Auth = next.Auth
+	}
+	return &applied
+}
+
+// reload reads the configuration again and applies the settings that can be
+// changed while the server is running, which are the quotas, limits,
+// retention and credentials.  Nothing is changed unless the whole new
+// configuration is valid and the credentials can be loaded.  Other changes
+// are logged and take effect when the server is restarted.  Returns the
+// configuration in effect.
+func reload(current *config, service *transfer.Service, auth *transfer.Authentication, authorizer *adminAuthorizer) *config {
+	next, err := loadConfig()
+	if err != nil {
+		slog.Error("config not reloaded", "err", err)
+		return current
+	}
+
+	var authenticators []transfer.Authenticator
+	if auth != nil && next.authEnabled() {
+		authenticators, err = loadAuthenticators(next)
+		if err != nil {
+			slog.Error("config not reloaded", "err", err)
+			return current
+		}
+	}
+
+	err = service.SetLimits(next.limits())
+	if err != nil {
+		slog.Error("config not reloaded", "err", err)
+		return current
+	}
+
+	if auth != nil && next.authEnabled() {
+		auth.Update(authenticators, next.Auth.Anonymous)
+		authorizer.setAdmins(next.Auth.Admins)
+	}
+
+	for _, key := range current.restartRequired(next) {
+		slog.Warn("setting changed, restart the server to apply it", "setting", key)
+	}
+
+	slog.Info("config reloaded", "file", opt.Config)
+	return current.applyReloadable(next)
+}
+
+// adminAuthorizer is a transfer.OwnerAuthorizer whose admins can be changed
+// when the config is reloaded.
+type adminAuthorizer struct {
+	mu         sync.RWMutex
+	authorizer transfer.OwnerAuthorizer
+}
+
+func newAdminAuthorizer(admins []string) *adminAuthorizer {
+	return &adminAuthorizer{authorizer: transfer.OwnerAuthorizer{Admins: admins}}
+}
+
+// Authorize implements transfer.Authorizer.
+func (a *adminAuthorizer) Authorize(ctx context.Context, action transfer.Action, id transfer.ID, owner string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.authorizer.Authorize(ctx, action, id, owner)
+}
+
+func (a *adminAuthorizer) setAdmins(admins []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.authorizer = transfer.OwnerAuthorizer{Admins: admins}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/alecthomas/kong"
+	"github.com/borud/large-file-upload/pkg/transfer"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+// parseFlags sets the flags as if the server was started with args.
+func parseFlags(t *testing.T, args ...string) {
+	parser, err := kong.New(&opt)
+	require.NoError(t, err)
+	_, err = parser.Parse(args)
+	require.NoError(t, err)
+}
+
+// writeFile writes content to name in dir and returns its path.
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	filename := path.Join(dir, name)
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0600))
+	return filename
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	// the file only overrides what it contains
+	filename := writeFile(t, dir, "config.yaml", `
+listen: :5200
+limits:
+  bandwidth: 1000
+storage:
+  sync: periodic
+`)
+	parseFlags(t, "--incoming", path.Join(dir, "incoming"), "--max-file-size", "500", "--config", filename)
+
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	require.Equal(t, ":5200", cfg.Listen)
+	require.Equal(t, int64(1000), cfg.Limits.Bandwidth)
+	require.Equal(t, int64(500), cfg.Limits.MaxFileSize)
+	require.Equal(t, "periodic", cfg.Storage.Sync)
+	require.Equal(t, path.Join(dir, "incoming"), cfg.Storage.Dir)
+
+	// an empty file changes nothing
+	writeFile(t, dir, "config.yaml", "")
+	cfg, err = loadConfig()
+	require.NoError(t, err)
+	require.Equal(t, ":4200", cfg.Listen)
+
+	// unknown settings are errors rather than silently ignored
+	writeFile(t, dir, "config.yaml", "limits:\n  bandwith: 1000\n")
+	_, err = loadConfig()
+	require.ErrorContains(t, err, "bandwith")
+
+	// every problem is reported along with its key
+	writeFile(t, dir, "config.yaml", "limits:\n  bandwidth: -1\nquotas:\n  uploads: -1\n")
+	_, err = loadConfig()
+	require.ErrorContains(t, err, "limits.bandwidth")
+	require.ErrorContains(t, err, "quotas.uploads")
+
+	require.NoError(t, os.Remove(filename))
+	_, err = loadConfig()
+	require.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	tokens := writeFile(t, dir, "tokens", "alice alice-token\n")
+	filename := writeFile(t, dir, "config.yaml", `
+auth:
+  token_file: `+tokens+`
+  admins: [alice]
+limits:
+  bandwidth: 1000
+`)
+	parseFlags(t, "--incoming", path.Join(dir, "incoming"), "--config", filename)
+
+	current, err := loadConfig()
+	require.NoError(t, err)
+
+	service, err := transfer.NewService(transfer.Config{IncomingDir: current.Storage.Dir})
+	require.NoError(t, err)
+	defer service.Shutdown()
+	require.NoError(t, service.SetLimits(current.limits()))
+
+	authenticators, err := loadAuthenticators(current)
+	require.NoError(t, err)
+	auth := &transfer.Authentication{Authenticators: authenticators}
+	authorizer := newAdminAuthorizer(current.Auth.Admins)
+
+	// capture the warnings
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// a bad file leaves everything as it was
+	writeFile(t, dir, "config.yaml", "limits:\n  bandwidth: -1\n")
+	next := reload(current, service, auth, authorizer)
+	require.Same(t, current, next)
+	require.Equal(t, int64(1000), service.Limits().MaxBandwidth)
+	require.Equal(t, "alice", authenticate(t, auth, "alice-token"))
+
+	// the credentials and limits change, the listen address only when the
+	// server is restarted
+	writeFile(t, dir, "tokens", "bob bob-token\n")
+	writeFile(t, dir, "config.yaml", `
+listen: :5200
+auth:
+  token_file: `+tokens+`
+  admins: [bob]
+limits:
+  bandwidth: 2000
+`)
+	logs.Reset()
+	next = reload(current, service, auth, authorizer)
+	require.Equal(t, int64(2000), next.Limits.Bandwidth)
+	require.Equal(t, int64(2000), service.Limits().MaxBandwidth)
+	require.Equal(t, "bob", authenticate(t, auth, "bob-token"))
+	require.Empty(t, authenticate(t, auth, "alice-token"))
+
+	bob := transfer.ContextWithPrincipal(context.Background(), &transfer.Principal{Name: "bob"})
+	require.NoError(t, authorizer.Authorize(bob, transfer.ActionAdmin, "", ""))
+
+	require.Equal(t, ":4200", next.Listen)
+	require.Contains(t, logs.String(), "restart the server")
+	require.Contains(t, logs.String(), "setting=listen")
+}
+
+// authenticate returns the name of the principal auth finds for token, or ""
+// if it is rejected.
+func authenticate(t *testing.T, auth *transfer.Authentication, token string) string {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	name, err := auth.UnaryInterceptor(ctx, nil, nil, func(ctx context.Context, _ any) (any, error) {
+		return transfer.PrincipalFromContext(ctx).Name, nil
+	})
+	if err != nil {
+		return ""
+	}
+	return name.(string)
+}
@@ -2,64 +2,420 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/borud/large-file-upload/pkg/transfer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 
 	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
 )
 
 var opt struct {
-	ListenAddr string `kong:"help='GRPC listen addr',default=':4200',required"`
-	Incoming   string `kong:"help='incoming dir',default='incoming',required"`
-	Blocksize  int64  `kong:"help='set preferred block size',default='1048576'"`
+	ListenAddr   string        `kong:"help='GRPC listen addr',default=':4200',required"`
+	MetricsAddr  string        `kong:"help='HTTP listen addr for Prometheus metrics at /metrics, empty to disable',default=':4201'"`
+	Incoming     string        `kong:"help='incoming dir',default='incoming',required"`
+	Blocksize    int64         `kong:"help='set preferred block size',default='1048576'"`
+	MinBlocksize int64         `kong:"help='smallest block size clients may use, 0 for the default'"`
+	MaxBlocksize int64         `kong:"help='largest block size clients may use, 0 for the largest that fits in a message'"`
+	MaxRecvMsg   int           `kong:"help='largest gRPC message received in bytes',default='4194304'"`
+	MaxSendMsg   int           `kong:"help='largest gRPC message sent in bytes',default='4194304'"`
+	KATime       time.Duration `kong:"name='keepalive-time',help='ping clients after a connection has been idle this long, 0 for the gRPC default'"`
+	KATimeout    time.Duration `kong:"name='keepalive-timeout',help='close connections that do not answer a ping within this time, 0 for the gRPC default'"`
+	KAMinTime    time.Duration `kong:"name='keepalive-min-time',help='disconnect clients that ping more often than this, 0 for the gRPC default'"`
+	MaxStreams   int           `kong:"help='uploads and downloads handled at the same time, 0 means no limit'"`
+	ConnStreams  uint32        `kong:"help='calls each connection can have in progress, 0 means no limit'"`
+	Sync         string        `kong:"help='when to flush uploads to disk, with none interrupted uploads start over',enum='always,periodic,finish,none',default='always'"`
+	SyncBytes    int64         `kong:"help='flush every N bytes in periodic sync mode',default='16777216'"`
+	SyncInterval time.Duration `kong:"help='flush at least this often in periodic sync mode',default='5s'"`
+	Quarantine   bool          `kong:"help='quarantine files that fail checksum verification instead of deleting them'"`
+	Retention    time.Duration `kong:"help='how long to keep quarantined files, 0 means forever',default='168h'"`
+	Dedup        bool          `kong:"help='store identical files only once'"`
+	NoCompress   bool          `kong:"help='do not accept or send compressed data'"`
+	KeyEnv       string        `kong:"help='environment variable holding the master key used to encrypt new files'"`
+	KeyFile      []string      `kong:"help='files holding master keys, the first is used to encrypt new files unless --key-env is set'"`
+	TLSCert      string        `kong:"help='TLS certificate file, reloaded when it changes'"`
+	TLSKey       string        `kong:"help='TLS key file, reloaded when it changes'"`
+	TLSCA        string        `kong:"name='tls-ca',help='CA bundle for verifying client certificates'"`
+	TLSVerify    bool          `kong:"help='require and verify client certificates'"`
+	TokenFile    string        `kong:"help='file with one <principal> <token> pair per line for bearer token authentication'"`
+	APIKeyFile   string        `kong:"help='file with one <principal> <key> pair per line for API key authentication'"`
+	AuthMTLS     bool          `kong:"help='authenticate clients by the common name of their verified certificate'"`
+	CapKey       []string      `kong:"name='capability-key',help='HMAC secret or Ed25519 PEM key files for verifying capability tokens'"`
+	Anonymous    bool          `kong:"help='allow unauthenticated clients when authentication is enabled'"`
+	Admin        []string      `kong:"help='principals that can access every file and the admin service'"`
+	MaxFileSize  int64         `kong:"help='largest file that can be uploaded in bytes, 0 means no limit'"`
+	Quota        int64         `kong:"help='bytes each principal can store, 0 means no limit'"`
+	MaxUploads   int           `kong:"help='uploads each principal can have in progress, 0 means no limit'"`
+	MinFree      int64         `kong:"help='bytes to keep free in the incoming dir'"`
+	Bandwidth    int64         `kong:"help='bytes per second of all uploads and downloads together, 0 means no limit'"`
+	PrincipalBW  int64         `kong:"name='principal-bandwidth',help='bytes per second of the uploads and downloads of each principal, 0 means no limit'"`
+	StreamBW     int64         `kong:"name='stream-bandwidth',help='bytes per second of each upload and download, 0 means no limit'"`
+	MemoryLimit  int64         `kong:"help='heap size in bytes at which clients are asked for the smallest blocks, 0 means no limit'"`
+	Process      []string      `kong:"help='processing step run on every uploaded file, <name>=<command> [<args>...]'"`
+	ProcessLimit int           `kong:"help='how many files to process at the same time',default='1'"`
+	ProcessTime  time.Duration `kong:"help='how long each processing step may run',default='10m'"`
+	Deliver      string        `kong:"help='dir each file is copied into, named by its ID, once the processing steps succeed'"`
+	Webhook      []string      `kong:"help='URLs to post upload events to'"`
+	WebhookKey   string        `kong:"help='file holding the secret used to sign webhook requests'"`
+	WebhookQueue string        `kong:"help='dir for webhook deliveries waiting to be retried, defaults to .webhooks in the incoming dir'"`
+	StopTimeout  time.Duration `kong:"help='how long to wait for transfers to stop on shutdown',default='30s'"`
+	Config       string        `kong:"help='YAML config file with settings that override the flags, reloaded on SIGHUP'"`
 }
 
 func main() {
 	kong.Parse(&opt)
 
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("error loading config", "err", err)
+		return
+	}
+
+	syncMode, err := transfer.ParseSyncMode(cfg.Storage.Sync)
+	if err != nil {
+		slog.Error("invalid sync mode", "err", err)
+		return
+	}
+
+	keys, err := loadKeys(cfg)
+	if err != nil {
+		slog.Error("error loading master keys", "err", err)
+		return
+	}
+
+	var auth *transfer.Authentication
+	var authorizer *adminAuthorizer
+	var serviceAuthorizer transfer.Authorizer
+	if cfg.authEnabled() {
+		authenticators, err := loadAuthenticators(cfg)
+		if err != nil {
+			slog.Error("error setting up authentication", "err", err)
+			return
+		}
+		auth = &transfer.Authentication{
+			Authenticators: authenticators,
+			AllowAnonymous: cfg.Auth.Anonymous,
+		}
+		authorizer = newAdminAuthorizer(cfg.Auth.Admins)
+		serviceAuthorizer = authorizer
+	}
+
+	var hooks []transfer.Hook
+	if cfg.Hooks.Log {
+		hooks = append(hooks, transfer.HookFunc(logEvent))
+	}
+
+	if len(cfg.Hooks.Webhook.URLs) > 0 {
+		webhook, err := loadWebhook(cfg)
+		if err != nil {
+			slog.Error("error setting up webhook", "err", err)
+			return
+		}
+		defer webhook.Close()
+		hooks = append(hooks, webhook)
+	}
+
+	var processing []transfer.ProcessingStep
+	for _, s := range cfg.Processing.Steps {
+		step, err := transfer.ParseProcessingStep(s)
+		if err != nil {
+			slog.Error("invalid processing step", "err", err)
+			return
+		}
+		step.Timeout = cfg.Processing.Timeout
+		processing = append(processing, step)
+	}
+
+	if cfg.Processing.Deliver != "" {
+		processing = append(processing, transfer.ProcessingStep{
+			Name:    "deliver",
+			Func:    transfer.DeliverTo(cfg.Processing.Deliver),
+			Timeout: cfg.Processing.Timeout,
+		})
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	limits := cfg.limits()
 	transferService, err := transfer.NewService(transfer.Config{
-		IncomingDir:        opt.Incoming,
-		PreferredBlockSize: opt.Blocksize,
-		UploadFinishedHook: uploadFinished,
-		UploadProgressHook: uploadProgress,
-		UploadCreatedHook:  uploadCreated,
+		IncomingDir:             cfg.Storage.Dir,
+		PreferredBlockSize:      cfg.Storage.BlockSize,
+		MinBlockSize:            cfg.Storage.MinBlockSize,
+		MaxBlockSize:            cfg.Storage.MaxBlockSize,
+		MaxRecvMsgSize:          cfg.GRPC.MaxRecvMsgSize,
+		MaxSendMsgSize:          cfg.GRPC.MaxSendMsgSize,
+		KeepaliveTime:           cfg.GRPC.KeepaliveTime,
+		KeepaliveTimeout:        cfg.GRPC.KeepaliveTimeout,
+		KeepaliveMinTime:        cfg.GRPC.KeepaliveMinTime,
+		MaxConcurrentStreams:    cfg.GRPC.MaxStreams,
+		MaxStreamsPerConnection: cfg.GRPC.MaxStreamsPerConnection,
+		SyncMode:                syncMode,
+		SyncBytes:               cfg.Storage.SyncBytes,
+		SyncInterval:            cfg.Storage.SyncInterval,
+		Quarantine:              cfg.Storage.Quarantine,
+		QuarantineRetention:     limits.QuarantineRetention,
+		Dedup:                   cfg.Storage.Dedup,
+		DisableCompression:      cfg.Storage.DisableCompression,
+		EncryptionKeys:          keys,
+		Authorizer:              serviceAuthorizer,
+		MaxFileSize:             limits.MaxFileSize,
+		Quota:                   limits.Quota,
+		MaxConcurrentUploads:    limits.MaxConcurrentUploads,
+		MinFreeSpace:            limits.MinFreeSpace,
+		MaxBandwidth:            limits.MaxBandwidth,
+		MaxPrincipalBandwidth:   limits.MaxPrincipalBandwidth,
+		MaxStreamBandwidth:      limits.MaxStreamBandwidth,
+		MemoryLimit:             limits.MemoryLimit,
+		Metrics:                 registry,
+		Processing:              processing,
+		ProcessingConcurrency:   cfg.Processing.Concurrency,
+		Hooks:                   hooks,
+		HookQueueSize:           cfg.Hooks.QueueSize,
 	})
 	if err != nil {
 		slog.Error("error creating transfer service", "err", err)
 		return
 	}
 
-	grpcServer := grpc.NewServer()
+	serverOpts := transferService.ServerOptions()
+	if cfg.TLS.Cert != "" {
+		creds, err := transfer.ServerCredentials(transfer.TLSConfig{
+			CertFile:          cfg.TLS.Cert,
+			KeyFile:           cfg.TLS.Key,
+			CAFile:            cfg.TLS.CA,
+			VerifyClientCerts: cfg.TLS.VerifyClients,
+		})
+		if err != nil {
+			slog.Error("error setting up TLS", "err", err)
+			return
+		}
+		serverOpts = append(serverOpts, grpc.Creds(creds))
+	}
+
+	if auth != nil {
+		serverOpts = append(serverOpts, auth.ServerOptions()...)
+	}
+
+	grpcServer := grpc.NewServer(serverOpts...)
 
 	tv1.RegisterTransferServiceServer(grpcServer, transferService)
-	grpcListener, err := net.Listen("tcp", opt.ListenAddr)
+	tv1.RegisterAdminServiceServer(grpcServer, transferService)
+	grpcListener, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
-		slog.Error("error creating listening socket", "listenAddr", opt.ListenAddr, "err", err)
+		slog.Error("error creating listening socket", "listenAddr", cfg.Listen, "err", err)
 		return
 	}
 
-	slog.Info("starting gRPC server", "listenAddr", opt.ListenAddr)
-	err = grpcServer.Serve(grpcListener)
+	if cfg.Metrics != "" {
+		go serveMetrics(cfg.Metrics, registry)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	served := make(chan error, 1)
+	go func() {
+		slog.Info("starting gRPC server", "listenAddr", cfg.Listen)
+		served <- grpcServer.Serve(grpcListener)
+	}()
+
+	for running := true; running; {
+		select {
+		case err = <-served:
+			if err != nil {
+				slog.Error("error exiting gRPC server", "listenAddr", cfg.Listen, "err", err)
+			}
+			running = false
+
+		case <-hup:
+			cfg = reload(cfg, transferService, auth, authorizer)
+
+		case <-ctx.Done():
+			slog.Info("shutting down")
+			stopServer(grpcServer, transferService, cfg.StopTimeout)
+			running = false
+		}
+	}
+
+	err = transferService.Shutdown()
 	if err != nil {
-		slog.Error("error exiting gRPC server", "listenAddr", opt.ListenAddr, "err", err)
+		slog.Error("error shutting down transfer service", "err", err)
 	}
 }
 
-func uploadCreated(filename string, size int64, offset int64, metadata []byte) {
-	slog.Info("upload created", "filename", filename, "size", size, "offset", offset, "metadata", hex.EncodeToString(metadata))
+// stopServer drains the transfer service and stops the gRPC server once the
+// calls in progress have returned, or when the stop timeout expires.  Stop
+// still waits for the calls to return, which the server options of the
+// transfer service ask for, so the service can be shut down safely after.
+func stopServer(grpcServer *grpc.Server, transferService *transfer.Service, timeout time.Duration) {
+	transferService.Drain()
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		slog.Warn("timed out waiting for calls to finish", "timeout", timeout)
+		grpcServer.Stop()
+	}
 }
 
-func uploadFinished(filename string, size int64, offset int64, _ []byte) {
-	slog.Info("upload finished", "filename", filename, "size", size, "offset", offset)
+// loadKeys loads the master keys.  The key from the environment, if any, goes
+// first so it is used for new files.
+func loadKeys(cfg *config) ([]*transfer.MasterKey, error) {
+	var keys []*transfer.MasterKey
+
+	if cfg.Storage.KeyEnv != "" {
+		key, err := transfer.MasterKeyFromEnv(cfg.Storage.KeyEnv)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	for _, filename := range cfg.Storage.KeyFiles {
+		key, err := transfer.LoadMasterKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// loadAuthenticators sets up the authentication methods that are enabled and
+// loads their credentials.
+func loadAuthenticators(cfg *config) ([]transfer.Authenticator, error) {
+	var authenticators []transfer.Authenticator
+
+	if cfg.Auth.MTLS {
+		authenticators = append(authenticators, transfer.NewMTLSAuthenticator())
+	}
+
+	if cfg.Auth.TokenFile != "" {
+		tokens, err := transfer.LoadKeyFile(cfg.Auth.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, transfer.NewBearerTokenAuthenticator(tokens))
+	}
+
+	if len(cfg.Auth.CapabilityKeys) > 0 {
+		var keys []*transfer.CapabilityKey
+		for _, filename := range cfg.Auth.CapabilityKeys {
+			key, err := transfer.LoadCapabilityKey(filename)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		authenticators = append(authenticators, transfer.NewCapabilityAuthenticator(keys...))
+	}
+
+	if cfg.Auth.APIKeyFile != "" {
+		keys, err := transfer.LoadKeyFile(cfg.Auth.APIKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, transfer.NewAPIKeyAuthenticator(keys))
+	}
+
+	return authenticators, nil
+}
+
+// serveMetrics serves the metrics in registry over HTTP.
+func serveMetrics(addr string, registry *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry}))
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	slog.Info("starting metrics server", "metricsAddr", addr)
+	err := server.ListenAndServe()
+	if err != nil {
+		slog.Error("error running metrics server", "metricsAddr", addr, "err", err)
+	}
 }
 
-func uploadProgress(filename string, size int64, offset int64, _ []byte) {
-	percent := fmt.Sprintf("%.1f%%", float64(offset*100)/float64(size))
-	slog.Info("progress", "filename", filename, "percent", percent)
+// loadWebhook sets up the webhook.
+func loadWebhook(cfg *config) (*transfer.Webhook, error) {
+	c := cfg.Hooks.Webhook
+
+	secret, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []transfer.EventType
+	for _, name := range c.Events {
+		e, err := transfer.ParseEventType(name)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	queue := c.Queue
+	if queue == "" {
+		queue = path.Join(cfg.Storage.Dir, ".webhooks")
+	}
+
+	return transfer.NewWebhook(transfer.WebhookConfig{
+		URLs:           c.URLs,
+		Secret:         bytes.TrimSpace(secret),
+		QueueDir:       queue,
+		DeadLetterFile: c.DeadLetter,
+		Events:         events,
+		MaxAttempts:    c.MaxAttempts,
+		Timeout:        c.Timeout,
+	})
+}
+
+// logEvent logs upload events.
+func logEvent(_ context.Context, e transfer.Event) {
+	switch e.Type {
+	case transfer.EventCreated:
+		slog.Info("upload created", "id", e.ID, "filename", e.Filename, "size", e.Size, "offset", e.Offset, "owner", e.Owner, "metadata", hex.EncodeToString(e.Metadata))
+
+	case transfer.EventProgress:
+		percent := fmt.Sprintf("%.1f%%", float64(e.Offset*100)/float64(e.Size))
+		slog.Info("progress", "id", e.ID, "filename", e.Filename, "percent", percent)
+
+	case transfer.EventFinished:
+		slog.Info("upload finished", "id", e.ID, "filename", e.Filename, "size", e.Size, "sha256", hex.EncodeToString(e.SHA256))
+
+	case transfer.EventFailed:
+		slog.Warn("upload failed", "id", e.ID, "offset", e.Offset, "size", e.Size, "peer", e.Peer, "err", e.Err)
+
+	default:
+		slog.Info("file "+e.Type.String(), "id", e.ID)
+	}
 }
@@ -0,0 +1,386 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: transfer/v1/admin.proto
+
+package transferv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// QuarantinedFile describes a file that failed whole-file checksum
+// verification and was moved into quarantine.  The full report, including the
+// log of the blocks received, is stored as JSON next to the file.
+type QuarantinedFile struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Id             string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Size           int64                  `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	ExpectedSha256 []byte                 `protobuf:"bytes,3,opt,name=expected_sha256,json=expectedSha256,proto3" json:"expected_sha256,omitempty"`
+	ActualSha256   []byte                 `protobuf:"bytes,4,opt,name=actual_sha256,json=actualSha256,proto3" json:"actual_sha256,omitempty"`
+	Peer           string                 `protobuf:"bytes,5,opt,name=peer,proto3" json:"peer,omitempty"`
+	QuarantinedAt  *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=quarantined_at,json=quarantinedAt,proto3" json:"quarantined_at,omitempty"`
+	NumBlocks      int64                  `protobuf:"varint,7,opt,name=num_blocks,json=numBlocks,proto3" json:"num_blocks,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *QuarantinedFile) Reset() {
+	*x = QuarantinedFile{}
+	mi := &file_transfer_v1_admin_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QuarantinedFile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QuarantinedFile) ProtoMessage() {}
+
+func (x *QuarantinedFile) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_admin_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QuarantinedFile.ProtoReflect.Descriptor instead.
+func (*QuarantinedFile) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_admin_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *QuarantinedFile) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *QuarantinedFile) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *QuarantinedFile) GetExpectedSha256() []byte {
+	if x != nil {
+		return x.ExpectedSha256
+	}
+	return nil
+}
+
+func (x *QuarantinedFile) GetActualSha256() []byte {
+	if x != nil {
+		return x.ActualSha256
+	}
+	return nil
+}
+
+func (x *QuarantinedFile) GetPeer() string {
+	if x != nil {
+		return x.Peer
+	}
+	return ""
+}
+
+func (x *QuarantinedFile) GetQuarantinedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.QuarantinedAt
+	}
+	return nil
+}
+
+func (x *QuarantinedFile) GetNumBlocks() int64 {
+	if x != nil {
+		return x.NumBlocks
+	}
+	return 0
+}
+
+// ListQuarantineRequest lists the files in quarantine.
+type ListQuarantineRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListQuarantineRequest) Reset() {
+	*x = ListQuarantineRequest{}
+	mi := &file_transfer_v1_admin_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListQuarantineRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListQuarantineRequest) ProtoMessage() {}
+
+func (x *ListQuarantineRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_admin_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListQuarantineRequest.ProtoReflect.Descriptor instead.
+func (*ListQuarantineRequest) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_admin_proto_rawDescGZIP(), []int{1}
+}
+
+// ListQuarantineResponse contains the files in quarantine.
+type ListQuarantineResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Files         []*QuarantinedFile     `protobuf:"bytes,1,rep,name=files,proto3" json:"files,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListQuarantineResponse) Reset() {
+	*x = ListQuarantineResponse{}
+	mi := &file_transfer_v1_admin_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListQuarantineResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListQuarantineResponse) ProtoMessage() {}
+
+func (x *ListQuarantineResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_admin_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListQuarantineResponse.ProtoReflect.Descriptor instead.
+func (*ListQuarantineResponse) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_admin_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListQuarantineResponse) GetFiles() []*QuarantinedFile {
+	if x != nil {
+		return x.Files
+	}
+	return nil
+}
+
+// PurgeQuarantineRequest removes the quarantined files identified by ids, or
+// every quarantined file if all is set.
+type PurgeQuarantineRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ids           []string               `protobuf:"bytes,1,rep,name=ids,proto3" json:"ids,omitempty"`
+	All           bool                   `protobuf:"varint,2,opt,name=all,proto3" json:"all,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PurgeQuarantineRequest) Reset() {
+	*x = PurgeQuarantineRequest{}
+	mi := &file_transfer_v1_admin_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PurgeQuarantineRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PurgeQuarantineRequest) ProtoMessage() {}
+
+func (x *PurgeQuarantineRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_admin_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PurgeQuarantineRequest.ProtoReflect.Descriptor instead.
+func (*PurgeQuarantineRequest) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_admin_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *PurgeQuarantineRequest) GetIds() []string {
+	if x != nil {
+		return x.Ids
+	}
+	return nil
+}
+
+func (x *PurgeQuarantineRequest) GetAll() bool {
+	if x != nil {
+		return x.All
+	}
+	return false
+}
+
+// PurgeQuarantineResponse contains the IDs of the files that were purged.
+type PurgeQuarantineResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ids           []string               `protobuf:"bytes,1,rep,name=ids,proto3" json:"ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PurgeQuarantineResponse) Reset() {
+	*x = PurgeQuarantineResponse{}
+	mi := &file_transfer_v1_admin_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PurgeQuarantineResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PurgeQuarantineResponse) ProtoMessage() {}
+
+func (x *PurgeQuarantineResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_admin_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PurgeQuarantineResponse.ProtoReflect.Descriptor instead.
+func (*PurgeQuarantineResponse) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_admin_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PurgeQuarantineResponse) GetIds() []string {
+	if x != nil {
+		return x.Ids
+	}
+	return nil
+}
+
+var File_transfer_v1_admin_proto protoreflect.FileDescriptor
+
+const file_transfer_v1_admin_proto_rawDesc = "" +
+	"\n" +
+	"\x17transfer/v1/admin.proto\x12\vtransfer.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xf9\x01\n" +
+	"\x0fQuarantinedFile\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x03R\x04size\x12'\n" +
+	"\x0fexpected_sha256\x18\x03 \x01(\fR\x0eexpectedSha256\x12#\n" +
+	"\ractual_sha256\x18\x04 \x01(\fR\factualSha256\x12\x12\n" +
+	"\x04peer\x18\x05 \x01(\tR\x04peer\x12A\n" +
+	"\x0equarantined_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\rquarantinedAt\x12\x1d\n" +
+	"\n" +
+	"num_blocks\x18\a \x01(\x03R\tnumBlocks\"\x17\n" +
+	"\x15ListQuarantineRequest\"L\n" +
+	"\x16ListQuarantineResponse\x122\n" +
+	"\x05files\x18\x01 \x03(\v2\x1c.transfer.v1.QuarantinedFileR\x05files\"<\n" +
+	"\x16PurgeQuarantineRequest\x12\x10\n" +
+	"\x03ids\x18\x01 \x03(\tR\x03ids\x12\x10\n" +
+	"\x03all\x18\x02 \x01(\bR\x03all\"+\n" +
+	"\x17PurgeQuarantineResponse\x12\x10\n" +
+	"\x03ids\x18\x01 \x03(\tR\x03ids2\xc7\x01\n" +
+	"\fAdminService\x12Y\n" +
+	"\x0eListQuarantine\x12\".transfer.v1.ListQuarantineRequest\x1a#.transfer.v1.ListQuarantineResponse\x12\\\n" +
+	"\x0fPurgeQuarantine\x12#.transfer.v1.PurgeQuarantineRequest\x1a$.transfer.v1.PurgeQuarantineResponseB\xa9\x01\n" +
+	"\x0fcom.transfer.v1B\n" +
+	"AdminProtoP\x01Z=github.com/borud/large-file-upload/gen/transfer/v1;transferv1\xa2\x02\x03TXX\xaa\x02\vTransfer.V1\xca\x02\vTransfer\\V1\xe2\x02\x17Transfer\\V1\\GPBMetadata\xea\x02\fTransfer::V1b\x06proto3"
+
+var (
+	file_transfer_v1_admin_proto_rawDescOnce sync.Once
+	file_transfer_v1_admin_proto_rawDescData []byte
+)
+
+func file_transfer_v1_admin_proto_rawDescGZIP() []byte {
+	file_transfer_v1_admin_proto_rawDescOnce.Do(func() {
+		file_transfer_v1_admin_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_transfer_v1_admin_proto_rawDesc), len(file_transfer_v1_admin_proto_rawDesc)))
+	})
+	return file_transfer_v1_admin_proto_rawDescData
+}
+
+var file_transfer_v1_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_transfer_v1_admin_proto_goTypes = []any{
+	(*QuarantinedFile)(nil),         // 0: transfer.v1.QuarantinedFile
+	(*ListQuarantineRequest)(nil),   // 1: transfer.v1.ListQuarantineRequest
+	(*ListQuarantineResponse)(nil),  // 2: transfer.v1.ListQuarantineResponse
+	(*PurgeQuarantineRequest)(nil),  // 3: transfer.v1.PurgeQuarantineRequest
+	(*PurgeQuarantineResponse)(nil), // 4: transfer.v1.PurgeQuarantineResponse
+	(*timestamppb.Timestamp)(nil),   // 5: google.protobuf.Timestamp
+}
+var file_transfer_v1_admin_proto_depIdxs = []int32{
+	5, // 0: transfer.v1.QuarantinedFile.quarantined_at:type_name -> google.protobuf.Timestamp
+	0, // 1: transfer.v1.ListQuarantineResponse.files:type_name -> transfer.v1.QuarantinedFile
+	1, // 2: transfer.v1.AdminService.ListQuarantine:input_type -> transfer.v1.ListQuarantineRequest
+	3, // 3: transfer.v1.AdminService.PurgeQuarantine:input_type -> transfer.v1.PurgeQuarantineRequest
+	2, // 4: transfer.v1.AdminService.ListQuarantine:output_type -> transfer.v1.ListQuarantineResponse
+	4, // 5: transfer.v1.AdminService.PurgeQuarantine:output_type -> transfer.v1.PurgeQuarantineResponse
+	4, // [4:6] is the sub-list for method output_type
+	2, // [2:4] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_transfer_v1_admin_proto_init() }
+func file_transfer_v1_admin_proto_init() {
+	if File_transfer_v1_admin_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_transfer_v1_admin_proto_rawDesc), len(file_transfer_v1_admin_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_transfer_v1_admin_proto_goTypes,
+		DependencyIndexes: file_transfer_v1_admin_proto_depIdxs,
+		MessageInfos:      file_transfer_v1_admin_proto_msgTypes,
+	}.Build()
+	File_transfer_v1_admin_proto = out.File
+	file_transfer_v1_admin_proto_goTypes = nil
+	file_transfer_v1_admin_proto_depIdxs = nil
+}
@@ -9,6 +9,7 @@ package transferv1
 import (
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	reflect "reflect"
 	sync "sync"
 	unsafe "unsafe"
@@ -21,15 +22,132 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// Compression is the compression used for the data blocks of a transfer.
+// COMPRESSION_UNSPECIFIED means the data is not compressed.
+type Compression int32
+
+const (
+	Compression_COMPRESSION_UNSPECIFIED Compression = 0
+	Compression_COMPRESSION_GZIP        Compression = 1
+	Compression_COMPRESSION_ZSTD        Compression = 2
+)
+
+// Enum value maps for Compression.
+var (
+	Compression_name = map[int32]string{
+		0: "COMPRESSION_UNSPECIFIED",
+		1: "COMPRESSION_GZIP",
+		2: "COMPRESSION_ZSTD",
+	}
+	Compression_value = map[string]int32{
+		"COMPRESSION_UNSPECIFIED": 0,
+		"COMPRESSION_GZIP":        1,
+		"COMPRESSION_ZSTD":        2,
+	}
+)
+
+func (x Compression) Enum() *Compression {
+	p := new(Compression)
+	*p = x
+	return p
+}
+
+func (x Compression) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Compression) Descriptor() protoreflect.EnumDescriptor {
+	return file_transfer_v1_transfer_proto_enumTypes[0].Descriptor()
+}
+
+func (Compression) Type() protoreflect.EnumType {
+	return &file_transfer_v1_transfer_proto_enumTypes[0]
+}
+
+func (x Compression) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Compression.Descriptor instead.
+func (Compression) EnumDescriptor() ([]byte, []int) {
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{0}
+}
+
+// ProcessingState is how far the server has come processing a finished file.
+type ProcessingState int32
+
+const (
+	ProcessingState_PROCESSING_STATE_UNSPECIFIED ProcessingState = 0
+	ProcessingState_PROCESSING_STATE_PENDING     ProcessingState = 1
+	ProcessingState_PROCESSING_STATE_RUNNING     ProcessingState = 2
+	ProcessingState_PROCESSING_STATE_COMPLETE    ProcessingState = 3
+	ProcessingState_PROCESSING_STATE_FAILED      ProcessingState = 4
+)
+
+// Enum value maps for ProcessingState.
+var (
+	ProcessingState_name = map[int32]string{
+		0: "PROCESSING_STATE_UNSPECIFIED",
+		1: "PROCESSING_STATE_PENDING",
+		2: "PROCESSING_STATE_RUNNING",
+		3: "PROCESSING_STATE_COMPLETE",
+		4: "PROCESSING_STATE_FAILED",
+	}
+	ProcessingState_value = map[string]int32{
+		"PROCESSING_STATE_UNSPECIFIED": 0,
+		"PROCESSING_STATE_PENDING":     1,
+		"PROCESSING_STATE_RUNNING":     2,
+		"PROCESSING_STATE_COMPLETE":    3,
+		"PROCESSING_STATE_FAILED":      4,
+	}
+)
+
+func (x ProcessingState) Enum() *ProcessingState {
+	p := new(ProcessingState)
+	*p = x
+	return p
+}
+
+func (x ProcessingState) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ProcessingState) Descriptor() protoreflect.EnumDescriptor {
+	return file_transfer_v1_transfer_proto_enumTypes[1].Descriptor()
+}
+
+func (ProcessingState) Type() protoreflect.EnumType {
+	return &file_transfer_v1_transfer_proto_enumTypes[1]
+}
+
+func (x ProcessingState) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ProcessingState.Descriptor instead.
+func (ProcessingState) EnumDescriptor() ([]byte, []int) {
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{1}
+}
+
 // CreateUploadRequest creates an upload. The server allocates an ID to the
 // upload and can optionally decide if it wants to accept a file of the
 // specified size. The metadata is an opaque byte blob into which the client
 // can serialize any application specific metadata.
+//
+// If base_id is set the upload is a delta upload of a new version of the file
+// identified by base_id.  The client then calls PlanDelta to find out which
+// blocks it needs to send.
+//
+// The compression is the compression the client would like to use for the
+// data blocks of the upload.  The server replies with the compression it
+// accepted in CreateUploadResponse.
 type CreateUploadRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Size          int64                  `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
 	FileSha256    []byte                 `protobuf:"bytes,2,opt,name=file_sha256,json=fileSha256,proto3" json:"file_sha256,omitempty"`
 	Metadata      []byte                 `protobuf:"bytes,3,opt,name=metadata,proto3" json:"metadata,omitempty"`
+	BaseId        string                 `protobuf:"bytes,4,opt,name=base_id,json=baseId,proto3" json:"base_id,omitempty"`
+	Compression   Compression            `protobuf:"varint,5,opt,name=compression,proto3,enum=transfer.v1.Compression" json:"compression,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -85,16 +203,46 @@ func (x *CreateUploadRequest) GetMetadata() []byte {
 	return nil
 }
 
+func (x *CreateUploadRequest) GetBaseId() string {
+	if x != nil {
+		return x.BaseId
+	}
+	return ""
+}
+
+func (x *CreateUploadRequest) GetCompression() Compression {
+	if x != nil {
+		return x.Compression
+	}
+	return Compression_COMPRESSION_UNSPECIFIED
+}
+
 // CreateUploadResponse returns the ID of the upload and the block size
 // preferred by the server.  Note that the client can choose to ingnore this
-// preferred block size, but you should not exceed the default gRPC message
-// size of 4Mb (currently) unless you know the server was configured to
-// handle greater message sizes.  You can set the maximum message size on the
-// server using the `grpc.MaxRecvMsgSize()` on the grpc.NewServer call.
+// preferred block size, but blocks must fit in the max message size of the
+// server.  That is the gRPC default of 4Mb (currently) unless the server was
+// configured with a larger MaxRecvMsgSize, and the preferred block size
+// always fits.
+//
+// If complete is set the server already has a file with the same checksum and
+// size, and the upload is finished without the client having to send any data.
+//
+// The compression is the compression the client may use for data blocks.  If
+// the server doesn't support the compression the client asked for this is
+// COMPRESSION_UNSPECIFIED and the client must send the data uncompressed.
+//
+// Clients that adapt their block size to the network keep it between
+// min_blocksize and max_blocksize.  The server lowers the max block size
+// when it is short of memory, and sends the new max in the acknowledgements
+// of UploadV2.
 type CreateUploadResponse struct {
 	state              protoimpl.MessageState `protogen:"open.v1"`
 	Id                 string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
 	PreferredBlocksize int64                  `protobuf:"varint,2,opt,name=preferred_blocksize,json=preferredBlocksize,proto3" json:"preferred_blocksize,omitempty"`
+	Complete           bool                   `protobuf:"varint,3,opt,name=complete,proto3" json:"complete,omitempty"`
+	Compression        Compression            `protobuf:"varint,4,opt,name=compression,proto3,enum=transfer.v1.Compression" json:"compression,omitempty"`
+	MinBlocksize       int64                  `protobuf:"varint,5,opt,name=min_blocksize,json=minBlocksize,proto3" json:"min_blocksize,omitempty"`
+	MaxBlocksize       int64                  `protobuf:"varint,6,opt,name=max_blocksize,json=maxBlocksize,proto3" json:"max_blocksize,omitempty"`
 	unknownFields      protoimpl.UnknownFields
 	sizeCache          protoimpl.SizeCache
 }
@@ -143,6 +291,34 @@ func (x *CreateUploadResponse) GetPreferredBlocksize() int64 {
 	return 0
 }
 
+func (x *CreateUploadResponse) GetComplete() bool {
+	if x != nil {
+		return x.Complete
+	}
+	return false
+}
+
+func (x *CreateUploadResponse) GetCompression() Compression {
+	if x != nil {
+		return x.Compression
+	}
+	return Compression_COMPRESSION_UNSPECIFIED
+}
+
+func (x *CreateUploadResponse) GetMinBlocksize() int64 {
+	if x != nil {
+		return x.MinBlocksize
+	}
+	return 0
+}
+
+func (x *CreateUploadResponse) GetMaxBlocksize() int64 {
+	if x != nil {
+		return x.MaxBlocksize
+	}
+	return 0
+}
+
 // GetOffsetRequest requests the offset for a upload in progress. This enables clients
 // to resume partial uploads by inquiring how much of the file has already been
 // uploaded.
@@ -191,11 +367,16 @@ func (x *GetOffsetRequest) GetId() string {
 }
 
 // GetOffsetResponse contains the current offset of the file (how much has been
-// uploaded) and the preferred transfer block size of the server.
+// uploaded and durably flushed to disk) and the preferred transfer block size
+// of the server, along with the block size bounds as in CreateUploadResponse.
+// The preferred block size is lowered along with the max block size when the
+// server is short of memory.
 type GetOffsetResponse struct {
 	state              protoimpl.MessageState `protogen:"open.v1"`
 	Offset             int64                  `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
 	PreferredBlocksize int64                  `protobuf:"varint,2,opt,name=preferred_blocksize,json=preferredBlocksize,proto3" json:"preferred_blocksize,omitempty"`
+	MinBlocksize       int64                  `protobuf:"varint,3,opt,name=min_blocksize,json=minBlocksize,proto3" json:"min_blocksize,omitempty"`
+	MaxBlocksize       int64                  `protobuf:"varint,4,opt,name=max_blocksize,json=maxBlocksize,proto3" json:"max_blocksize,omitempty"`
 	unknownFields      protoimpl.UnknownFields
 	sizeCache          protoimpl.SizeCache
 }
@@ -244,15 +425,35 @@ func (x *GetOffsetResponse) GetPreferredBlocksize() int64 {
 	return 0
 }
 
+func (x *GetOffsetResponse) GetMinBlocksize() int64 {
+	if x != nil {
+		return x.MinBlocksize
+	}
+	return 0
+}
+
+func (x *GetOffsetResponse) GetMaxBlocksize() int64 {
+	if x != nil {
+		return x.MaxBlocksize
+	}
+	return 0
+}
+
 // UploadRequest is the data structure that contains a block of data to be uploaded.
 // It specifies the upload ID, the offset, the checksum of the data and the data
 // itself.
+//
+// If compressed is set the data is compressed using the compression agreed on
+// in CreateUpload.  The offset and the checksum always refer to the
+// uncompressed data, so clients can choose to send incompressible blocks
+// uncompressed.
 type UploadRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
 	Offset        int64                  `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
 	Sha256        []byte                 `protobuf:"bytes,3,opt,name=sha256,proto3" json:"sha256,omitempty"`
 	Data          []byte                 `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	Compressed    bool                   `protobuf:"varint,5,opt,name=compressed,proto3" json:"compressed,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -315,6 +516,13 @@ func (x *UploadRequest) GetData() []byte {
 	return nil
 }
 
+func (x *UploadRequest) GetCompressed() bool {
+	if x != nil {
+		return x.Compressed
+	}
+	return false
+}
+
 // UploadResponse is an empty message.
 type UploadResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -352,6 +560,275 @@ func (*UploadResponse) Descriptor() ([]byte, []int) {
 	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{5}
 }
 
+// UploadV2Request carries a block of data on the bidirectional upload stream.
+// It has the same fields and semantics as UploadRequest.
+type UploadV2Request struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Offset        int64                  `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	Sha256        []byte                 `protobuf:"bytes,3,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	Data          []byte                 `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	Compressed    bool                   `protobuf:"varint,5,opt,name=compressed,proto3" json:"compressed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UploadV2Request) Reset() {
+	*x = UploadV2Request{}
+	mi := &file_transfer_v1_transfer_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UploadV2Request) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UploadV2Request) ProtoMessage() {}
+
+func (x *UploadV2Request) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_transfer_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UploadV2Request.ProtoReflect.Descriptor instead.
+func (*UploadV2Request) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *UploadV2Request) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *UploadV2Request) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *UploadV2Request) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
+func (x *UploadV2Request) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *UploadV2Request) GetCompressed() bool {
+	if x != nil {
+		return x.Compressed
+	}
+	return false
+}
+
+// UploadV2Response acknowledges how much of the upload the server has written
+// to disk.  The server sends one after every block it has written, and a final
+// one with complete set once the whole file has been received and verified.
+//
+// The offset is how much the server has durably flushed to disk and can be
+// used as the resume point if the stream breaks.  The written_offset is how
+// much the server has received and written, which may be ahead of the offset
+// depending on how the server syncs data to disk.  Clients should use the
+// written_offset for flow control.
+//
+// The max_blocksize is the largest block the server wants right now, which is
+// lower than the max block size of CreateUploadResponse when the server is
+// short of memory.  Clients should keep their blocks below it.
+type UploadV2Response struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Offset        int64                  `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Complete      bool                   `protobuf:"varint,2,opt,name=complete,proto3" json:"complete,omitempty"`
+	WrittenOffset int64                  `protobuf:"varint,3,opt,name=written_offset,json=writtenOffset,proto3" json:"written_offset,omitempty"`
+	MaxBlocksize  int64                  `protobuf:"varint,4,opt,name=max_blocksize,json=maxBlocksize,proto3" json:"max_blocksize,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UploadV2Response) Reset() {
+	*x = UploadV2Response{}
+	mi := &file_transfer_v1_transfer_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UploadV2Response) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UploadV2Response) ProtoMessage() {}
+
+func (x *UploadV2Response) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_transfer_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UploadV2Response.ProtoReflect.Descriptor instead.
+func (*UploadV2Response) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *UploadV2Response) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *UploadV2Response) GetComplete() bool {
+	if x != nil {
+		return x.Complete
+	}
+	return false
+}
+
+func (x *UploadV2Response) GetWrittenOffset() int64 {
+	if x != nil {
+		return x.WrittenOffset
+	}
+	return 0
+}
+
+func (x *UploadV2Response) GetMaxBlocksize() int64 {
+	if x != nil {
+		return x.MaxBlocksize
+	}
+	return 0
+}
+
+// PlanDeltaRequest contains the checksums of each block of the file the client
+// wants to upload as a delta upload, using the given block size.  Note that
+// the checksums have to fit in a single message, so large files need a large
+// block size.
+type PlanDeltaRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Blocksize     int64                  `protobuf:"varint,2,opt,name=blocksize,proto3" json:"blocksize,omitempty"`
+	BlockSha256   [][]byte               `protobuf:"bytes,3,rep,name=block_sha256,json=blockSha256,proto3" json:"block_sha256,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PlanDeltaRequest) Reset() {
+	*x = PlanDeltaRequest{}
+	mi := &file_transfer_v1_transfer_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PlanDeltaRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PlanDeltaRequest) ProtoMessage() {}
+
+func (x *PlanDeltaRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_transfer_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PlanDeltaRequest.ProtoReflect.Descriptor instead.
+func (*PlanDeltaRequest) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *PlanDeltaRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *PlanDeltaRequest) GetBlocksize() int64 {
+	if x != nil {
+		return x.Blocksize
+	}
+	return 0
+}
+
+func (x *PlanDeltaRequest) GetBlockSha256() [][]byte {
+	if x != nil {
+		return x.BlockSha256
+	}
+	return nil
+}
+
+// PlanDeltaResponse contains the indices of the blocks the client has to send.
+// Every other block is copied from the base file by the server.
+type PlanDeltaResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MissingBlocks []int64                `protobuf:"varint,1,rep,packed,name=missing_blocks,json=missingBlocks,proto3" json:"missing_blocks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PlanDeltaResponse) Reset() {
+	*x = PlanDeltaResponse{}
+	mi := &file_transfer_v1_transfer_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PlanDeltaResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PlanDeltaResponse) ProtoMessage() {}
+
+func (x *PlanDeltaResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_transfer_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PlanDeltaResponse.ProtoReflect.Descriptor instead.
+func (*PlanDeltaResponse) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *PlanDeltaResponse) GetMissingBlocks() []int64 {
+	if x != nil {
+		return x.MissingBlocks
+	}
+	return nil
+}
+
 // DownloadRequest specifies a file you want to download (by id), the offset from
 // which you want to start and the block size preferred by the client. The server
 // is not required to honor the requested block size, but unless the block size
@@ -360,18 +837,26 @@ func (*UploadResponse) Descriptor() ([]byte, []int) {
 // Downloading, unlike uploading, is a single call because the client will
 // have to keep track of the download in order to resume.  If you want to
 // be able to resume downloads.
+//
+// The compression is the compression the client would like the server to use
+// for the data blocks.  The server may send any block uncompressed.
+//
+// If length is set only that many bytes from the offset are sent, which makes
+// it possible to download a range of the file.
 type DownloadRequest struct {
 	state              protoimpl.MessageState `protogen:"open.v1"`
 	Id                 string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
 	Offset             int64                  `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
 	PreferredBlocksize int64                  `protobuf:"varint,3,opt,name=preferred_blocksize,json=preferredBlocksize,proto3" json:"preferred_blocksize,omitempty"`
+	Compression        Compression            `protobuf:"varint,4,opt,name=compression,proto3,enum=transfer.v1.Compression" json:"compression,omitempty"`
+	Length             int64                  `protobuf:"varint,5,opt,name=length,proto3" json:"length,omitempty"`
 	unknownFields      protoimpl.UnknownFields
 	sizeCache          protoimpl.SizeCache
 }
 
 func (x *DownloadRequest) Reset() {
 	*x = DownloadRequest{}
-	mi := &file_transfer_v1_transfer_proto_msgTypes[6]
+	mi := &file_transfer_v1_transfer_proto_msgTypes[10]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -383,7 +868,7 @@ func (x *DownloadRequest) String() string {
 func (*DownloadRequest) ProtoMessage() {}
 
 func (x *DownloadRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_transfer_v1_transfer_proto_msgTypes[6]
+	mi := &file_transfer_v1_transfer_proto_msgTypes[10]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -396,7 +881,7 @@ func (x *DownloadRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DownloadRequest.ProtoReflect.Descriptor instead.
 func (*DownloadRequest) Descriptor() ([]byte, []int) {
-	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{6}
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *DownloadRequest) GetId() string {
@@ -420,19 +905,36 @@ func (x *DownloadRequest) GetPreferredBlocksize() int64 {
 	return 0
 }
 
+func (x *DownloadRequest) GetCompression() Compression {
+	if x != nil {
+		return x.Compression
+	}
+	return Compression_COMPRESSION_UNSPECIFIED
+}
+
+func (x *DownloadRequest) GetLength() int64 {
+	if x != nil {
+		return x.Length
+	}
+	return 0
+}
+
 // DownloadResponse contains a block of data and its checksum. It is strongly
-// recommended that the client verify the checksum.
+// recommended that the client verify the checksum.  If compressed is set the
+// data is compressed using the compression from the DownloadRequest.  The
+// checksum is always computed over the uncompressed data.
 type DownloadResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Sha256        []byte                 `protobuf:"bytes,1,opt,name=sha256,proto3" json:"sha256,omitempty"`
 	Data          []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Compressed    bool                   `protobuf:"varint,3,opt,name=compressed,proto3" json:"compressed,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *DownloadResponse) Reset() {
 	*x = DownloadResponse{}
-	mi := &file_transfer_v1_transfer_proto_msgTypes[7]
+	mi := &file_transfer_v1_transfer_proto_msgTypes[11]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -444,7 +946,7 @@ func (x *DownloadResponse) String() string {
 func (*DownloadResponse) ProtoMessage() {}
 
 func (x *DownloadResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_transfer_v1_transfer_proto_msgTypes[7]
+	mi := &file_transfer_v1_transfer_proto_msgTypes[11]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -457,7 +959,7 @@ func (x *DownloadResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DownloadResponse.ProtoReflect.Descriptor instead.
 func (*DownloadResponse) Descriptor() ([]byte, []int) {
-	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{7}
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{11}
 }
 
 func (x *DownloadResponse) GetSha256() []byte {
@@ -474,42 +976,268 @@ func (x *DownloadResponse) GetData() []byte {
 	return nil
 }
 
+func (x *DownloadResponse) GetCompressed() bool {
+	if x != nil {
+		return x.Compressed
+	}
+	return false
+}
+
+// StatRequest asks for information about a finished file.
+type StatRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatRequest) Reset() {
+	*x = StatRequest{}
+	mi := &file_transfer_v1_transfer_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatRequest) ProtoMessage() {}
+
+func (x *StatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_transfer_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatRequest.ProtoReflect.Descriptor instead.
+func (*StatRequest) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *StatRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+// StatResponse describes a finished file.  The size and sha256 are those of
+// the file as it was uploaded, and the metadata is the metadata the client
+// supplied in CreateUploadRequest.
+type StatResponse struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Id           string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Size         int64                  `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	Sha256       []byte                 `protobuf:"bytes,3,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	Metadata     []byte                 `protobuf:"bytes,4,opt,name=metadata,proto3" json:"metadata,omitempty"`
+	Created      *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created,proto3" json:"created,omitempty"`
+	StorageClass string                 `protobuf:"bytes,6,opt,name=storage_class,json=storageClass,proto3" json:"storage_class,omitempty"`
+	// processing_state is UNSPECIFIED if the server doesn't process files.
+	// processing_step is the step that is running or that failed, and
+	// processing_error says why it failed.
+	ProcessingState ProcessingState `protobuf:"varint,7,opt,name=processing_state,json=processingState,proto3,enum=transfer.v1.ProcessingState" json:"processing_state,omitempty"`
+	ProcessingStep  string          `protobuf:"bytes,8,opt,name=processing_step,json=processingStep,proto3" json:"processing_step,omitempty"`
+	ProcessingError string          `protobuf:"bytes,9,opt,name=processing_error,json=processingError,proto3" json:"processing_error,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *StatResponse) Reset() {
+	*x = StatResponse{}
+	mi := &file_transfer_v1_transfer_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatResponse) ProtoMessage() {}
+
+func (x *StatResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_transfer_v1_transfer_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatResponse.ProtoReflect.Descriptor instead.
+func (*StatResponse) Descriptor() ([]byte, []int) {
+	return file_transfer_v1_transfer_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *StatResponse) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *StatResponse) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *StatResponse) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
+func (x *StatResponse) GetMetadata() []byte {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+func (x *StatResponse) GetCreated() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Created
+	}
+	return nil
+}
+
+func (x *StatResponse) GetStorageClass() string {
+	if x != nil {
+		return x.StorageClass
+	}
+	return ""
+}
+
+func (x *StatResponse) GetProcessingState() ProcessingState {
+	if x != nil {
+		return x.ProcessingState
+	}
+	return ProcessingState_PROCESSING_STATE_UNSPECIFIED
+}
+
+func (x *StatResponse) GetProcessingStep() string {
+	if x != nil {
+		return x.ProcessingStep
+	}
+	return ""
+}
+
+func (x *StatResponse) GetProcessingError() string {
+	if x != nil {
+		return x.ProcessingError
+	}
+	return ""
+}
+
 var File_transfer_v1_transfer_proto protoreflect.FileDescriptor
 
 const file_transfer_v1_transfer_proto_rawDesc = "" +
 	"\n" +
-	"\x1atransfer/v1/transfer.proto\x12\vtransfer.v1\"f\n" +
+	"\x1atransfer/v1/transfer.proto\x12\vtransfer.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xbb\x01\n" +
 	"\x13CreateUploadRequest\x12\x12\n" +
 	"\x04size\x18\x01 \x01(\x03R\x04size\x12\x1f\n" +
 	"\vfile_sha256\x18\x02 \x01(\fR\n" +
 	"fileSha256\x12\x1a\n" +
-	"\bmetadata\x18\x03 \x01(\fR\bmetadata\"W\n" +
+	"\bmetadata\x18\x03 \x01(\fR\bmetadata\x12\x17\n" +
+	"\abase_id\x18\x04 \x01(\tR\x06baseId\x12:\n" +
+	"\vcompression\x18\x05 \x01(\x0e2\x18.transfer.v1.CompressionR\vcompression\"\xf9\x01\n" +
 	"\x14CreateUploadResponse\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12/\n" +
-	"\x13preferred_blocksize\x18\x02 \x01(\x03R\x12preferredBlocksize\"\"\n" +
+	"\x13preferred_blocksize\x18\x02 \x01(\x03R\x12preferredBlocksize\x12\x1a\n" +
+	"\bcomplete\x18\x03 \x01(\bR\bcomplete\x12:\n" +
+	"\vcompression\x18\x04 \x01(\x0e2\x18.transfer.v1.CompressionR\vcompression\x12#\n" +
+	"\rmin_blocksize\x18\x05 \x01(\x03R\fminBlocksize\x12#\n" +
+	"\rmax_blocksize\x18\x06 \x01(\x03R\fmaxBlocksize\"\"\n" +
 	"\x10GetOffsetRequest\x12\x0e\n" +
-	"\x02id\x18\x01 \x01(\tR\x02id\"\\\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\xa6\x01\n" +
 	"\x11GetOffsetResponse\x12\x16\n" +
 	"\x06offset\x18\x01 \x01(\x03R\x06offset\x12/\n" +
-	"\x13preferred_blocksize\x18\x02 \x01(\x03R\x12preferredBlocksize\"c\n" +
+	"\x13preferred_blocksize\x18\x02 \x01(\x03R\x12preferredBlocksize\x12#\n" +
+	"\rmin_blocksize\x18\x03 \x01(\x03R\fminBlocksize\x12#\n" +
+	"\rmax_blocksize\x18\x04 \x01(\x03R\fmaxBlocksize\"\x83\x01\n" +
 	"\rUploadRequest\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
 	"\x06offset\x18\x02 \x01(\x03R\x06offset\x12\x16\n" +
 	"\x06sha256\x18\x03 \x01(\fR\x06sha256\x12\x12\n" +
-	"\x04data\x18\x04 \x01(\fR\x04data\"\x10\n" +
-	"\x0eUploadResponse\"j\n" +
+	"\x04data\x18\x04 \x01(\fR\x04data\x12\x1e\n" +
+	"\n" +
+	"compressed\x18\x05 \x01(\bR\n" +
+	"compressed\"\x10\n" +
+	"\x0eUploadResponse\"\x85\x01\n" +
+	"\x0fUploadV2Request\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
+	"\x06offset\x18\x02 \x01(\x03R\x06offset\x12\x16\n" +
+	"\x06sha256\x18\x03 \x01(\fR\x06sha256\x12\x12\n" +
+	"\x04data\x18\x04 \x01(\fR\x04data\x12\x1e\n" +
+	"\n" +
+	"compressed\x18\x05 \x01(\bR\n" +
+	"compressed\"\x92\x01\n" +
+	"\x10UploadV2Response\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x03R\x06offset\x12\x1a\n" +
+	"\bcomplete\x18\x02 \x01(\bR\bcomplete\x12%\n" +
+	"\x0ewritten_offset\x18\x03 \x01(\x03R\rwrittenOffset\x12#\n" +
+	"\rmax_blocksize\x18\x04 \x01(\x03R\fmaxBlocksize\"c\n" +
+	"\x10PlanDeltaRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x1c\n" +
+	"\tblocksize\x18\x02 \x01(\x03R\tblocksize\x12!\n" +
+	"\fblock_sha256\x18\x03 \x03(\fR\vblockSha256\":\n" +
+	"\x11PlanDeltaResponse\x12%\n" +
+	"\x0emissing_blocks\x18\x01 \x03(\x03R\rmissingBlocks\"\xbe\x01\n" +
 	"\x0fDownloadRequest\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
 	"\x06offset\x18\x02 \x01(\x03R\x06offset\x12/\n" +
-	"\x13preferred_blocksize\x18\x03 \x01(\x03R\x12preferredBlocksize\">\n" +
+	"\x13preferred_blocksize\x18\x03 \x01(\x03R\x12preferredBlocksize\x12:\n" +
+	"\vcompression\x18\x04 \x01(\x0e2\x18.transfer.v1.CompressionR\vcompression\x12\x16\n" +
+	"\x06length\x18\x05 \x01(\x03R\x06length\"^\n" +
 	"\x10DownloadResponse\x12\x16\n" +
 	"\x06sha256\x18\x01 \x01(\fR\x06sha256\x12\x12\n" +
-	"\x04data\x18\x02 \x01(\fR\x04data2\xc2\x02\n" +
+	"\x04data\x18\x02 \x01(\fR\x04data\x12\x1e\n" +
+	"\n" +
+	"compressed\x18\x03 \x01(\bR\n" +
+	"compressed\"\x1d\n" +
+	"\vStatRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\xde\x02\n" +
+	"\fStatResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x03R\x04size\x12\x16\n" +
+	"\x06sha256\x18\x03 \x01(\fR\x06sha256\x12\x1a\n" +
+	"\bmetadata\x18\x04 \x01(\fR\bmetadata\x124\n" +
+	"\acreated\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\acreated\x12#\n" +
+	"\rstorage_class\x18\x06 \x01(\tR\fstorageClass\x12G\n" +
+	"\x10processing_state\x18\a \x01(\x0e2\x1c.transfer.v1.ProcessingStateR\x0fprocessingState\x12'\n" +
+	"\x0fprocessing_step\x18\b \x01(\tR\x0eprocessingStep\x12)\n" +
+	"\x10processing_error\x18\t \x01(\tR\x0fprocessingError*V\n" +
+	"\vCompression\x12\x1b\n" +
+	"\x17COMPRESSION_UNSPECIFIED\x10\x00\x12\x14\n" +
+	"\x10COMPRESSION_GZIP\x10\x01\x12\x14\n" +
+	"\x10COMPRESSION_ZSTD\x10\x02*\xab\x01\n" +
+	"\x0fProcessingState\x12 \n" +
+	"\x1cPROCESSING_STATE_UNSPECIFIED\x10\x00\x12\x1c\n" +
+	"\x18PROCESSING_STATE_PENDING\x10\x01\x12\x1c\n" +
+	"\x18PROCESSING_STATE_RUNNING\x10\x02\x12\x1d\n" +
+	"\x19PROCESSING_STATE_COMPLETE\x10\x03\x12\x1b\n" +
+	"\x17PROCESSING_STATE_FAILED\x10\x042\x98\x04\n" +
 	"\x0fTransferService\x12S\n" +
 	"\fCreateUpload\x12 .transfer.v1.CreateUploadRequest\x1a!.transfer.v1.CreateUploadResponse\x12J\n" +
 	"\tGetOffset\x12\x1d.transfer.v1.GetOffsetRequest\x1a\x1e.transfer.v1.GetOffsetResponse\x12C\n" +
-	"\x06Upload\x12\x1a.transfer.v1.UploadRequest\x1a\x1b.transfer.v1.UploadResponse(\x01\x12I\n" +
-	"\bDownload\x12\x1c.transfer.v1.DownloadRequest\x1a\x1d.transfer.v1.DownloadResponse0\x01B\xac\x01\n" +
+	"\x06Upload\x12\x1a.transfer.v1.UploadRequest\x1a\x1b.transfer.v1.UploadResponse(\x01\x12K\n" +
+	"\bUploadV2\x12\x1c.transfer.v1.UploadV2Request\x1a\x1d.transfer.v1.UploadV2Response(\x010\x01\x12J\n" +
+	"\tPlanDelta\x12\x1d.transfer.v1.PlanDeltaRequest\x1a\x1e.transfer.v1.PlanDeltaResponse\x12I\n" +
+	"\bDownload\x12\x1c.transfer.v1.DownloadRequest\x1a\x1d.transfer.v1.DownloadResponse0\x01\x12;\n" +
+	"\x04Stat\x12\x18.transfer.v1.StatRequest\x1a\x19.transfer.v1.StatResponseB\xac\x01\n" +
 	"\x0fcom.transfer.v1B\rTransferProtoP\x01Z=github.com/borud/large-file-upload/gen/transfer/v1;transferv1\xa2\x02\x03TXX\xaa\x02\vTransfer.V1\xca\x02\vTransfer\\V1\xe2\x02\x17Transfer\\V1\\GPBMetadata\xea\x02\fTransfer::V1b\x06proto3"
 
 var (
@@ -524,31 +1252,52 @@ func file_transfer_v1_transfer_proto_rawDescGZIP() []byte {
 	return file_transfer_v1_transfer_proto_rawDescData
 }
 
-var file_transfer_v1_transfer_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_transfer_v1_transfer_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_transfer_v1_transfer_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
 var file_transfer_v1_transfer_proto_goTypes = []any{
-	(*CreateUploadRequest)(nil),  // 0: transfer.v1.CreateUploadRequest
-	(*CreateUploadResponse)(nil), // 1: transfer.v1.CreateUploadResponse
-	(*GetOffsetRequest)(nil),     // 2: transfer.v1.GetOffsetRequest
-	(*GetOffsetResponse)(nil),    // 3: transfer.v1.GetOffsetResponse
-	(*UploadRequest)(nil),        // 4: transfer.v1.UploadRequest
-	(*UploadResponse)(nil),       // 5: transfer.v1.UploadResponse
-	(*DownloadRequest)(nil),      // 6: transfer.v1.DownloadRequest
-	(*DownloadResponse)(nil),     // 7: transfer.v1.DownloadResponse
+	(Compression)(0),              // 0: transfer.v1.Compression
+	(ProcessingState)(0),          // 1: transfer.v1.ProcessingState
+	(*CreateUploadRequest)(nil),   // 2: transfer.v1.CreateUploadRequest
+	(*CreateUploadResponse)(nil),  // 3: transfer.v1.CreateUploadResponse
+	(*GetOffsetRequest)(nil),      // 4: transfer.v1.GetOffsetRequest
+	(*GetOffsetResponse)(nil),     // 5: transfer.v1.GetOffsetResponse
+	(*UploadRequest)(nil),         // 6: transfer.v1.UploadRequest
+	(*UploadResponse)(nil),        // 7: transfer.v1.UploadResponse
+	(*UploadV2Request)(nil),       // 8: transfer.v1.UploadV2Request
+	(*UploadV2Response)(nil),      // 9: transfer.v1.UploadV2Response
+	(*PlanDeltaRequest)(nil),      // 10: transfer.v1.PlanDeltaRequest
+	(*PlanDeltaResponse)(nil),     // 11: transfer.v1.PlanDeltaResponse
+	(*DownloadRequest)(nil),       // 12: transfer.v1.DownloadRequest
+	(*DownloadResponse)(nil),      // 13: transfer.v1.DownloadResponse
+	(*StatRequest)(nil),           // 14: transfer.v1.StatRequest
+	(*StatResponse)(nil),          // 15: transfer.v1.StatResponse
+	(*timestamppb.Timestamp)(nil), // 16: google.protobuf.Timestamp
 }
 var file_transfer_v1_transfer_proto_depIdxs = []int32{
-	0, // 0: transfer.v1.TransferService.CreateUpload:input_type -> transfer.v1.CreateUploadRequest
-	2, // 1: transfer.v1.TransferService.GetOffset:input_type -> transfer.v1.GetOffsetRequest
-	4, // 2: transfer.v1.TransferService.Upload:input_type -> transfer.v1.UploadRequest
-	6, // 3: transfer.v1.TransferService.Download:input_type -> transfer.v1.DownloadRequest
-	1, // 4: transfer.v1.TransferService.CreateUpload:output_type -> transfer.v1.CreateUploadResponse
-	3, // 5: transfer.v1.TransferService.GetOffset:output_type -> transfer.v1.GetOffsetResponse
-	5, // 6: transfer.v1.TransferService.Upload:output_type -> transfer.v1.UploadResponse
-	7, // 7: transfer.v1.TransferService.Download:output_type -> transfer.v1.DownloadResponse
-	4, // [4:8] is the sub-list for method output_type
-	0, // [0:4] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	0,  // 0: transfer.v1.CreateUploadRequest.compression:type_name -> transfer.v1.Compression
+	0,  // 1: transfer.v1.CreateUploadResponse.compression:type_name -> transfer.v1.Compression
+	0,  // 2: transfer.v1.DownloadRequest.compression:type_name -> transfer.v1.Compression
+	16, // 3: transfer.v1.StatResponse.created:type_name -> google.protobuf.Timestamp
+	1,  // 4: transfer.v1.StatResponse.processing_state:type_name -> transfer.v1.ProcessingState
+	2,  // 5: transfer.v1.TransferService.CreateUpload:input_type -> transfer.v1.CreateUploadRequest
+	4,  // 6: transfer.v1.TransferService.GetOffset:input_type -> transfer.v1.GetOffsetRequest
+	6,  // 7: transfer.v1.TransferService.Upload:input_type -> transfer.v1.UploadRequest
+	8,  // 8: transfer.v1.TransferService.UploadV2:input_type -> transfer.v1.UploadV2Request
+	10, // 9: transfer.v1.TransferService.PlanDelta:input_type -> transfer.v1.PlanDeltaRequest
+	12, // 10: transfer.v1.TransferService.Download:input_type -> transfer.v1.DownloadRequest
+	14, // 11: transfer.v1.TransferService.Stat:input_type -> transfer.v1.StatRequest
+	3,  // 12: transfer.v1.TransferService.CreateUpload:output_type -> transfer.v1.CreateUploadResponse
+	5,  // 13: transfer.v1.TransferService.GetOffset:output_type -> transfer.v1.GetOffsetResponse
+	7,  // 14: transfer.v1.TransferService.Upload:output_type -> transfer.v1.UploadResponse
+	9,  // 15: transfer.v1.TransferService.UploadV2:output_type -> transfer.v1.UploadV2Response
+	11, // 16: transfer.v1.TransferService.PlanDelta:output_type -> transfer.v1.PlanDeltaResponse
+	13, // 17: transfer.v1.TransferService.Download:output_type -> transfer.v1.DownloadResponse
+	15, // 18: transfer.v1.TransferService.Stat:output_type -> transfer.v1.StatResponse
+	12, // [12:19] is the sub-list for method output_type
+	5,  // [5:12] is the sub-list for method input_type
+	5,  // [5:5] is the sub-list for extension type_name
+	5,  // [5:5] is the sub-list for extension extendee
+	0,  // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_transfer_v1_transfer_proto_init() }
@@ -561,13 +1310,14 @@ func file_transfer_v1_transfer_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_transfer_v1_transfer_proto_rawDesc), len(file_transfer_v1_transfer_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   8,
+			NumEnums:      2,
+			NumMessages:   14,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_transfer_v1_transfer_proto_goTypes,
 		DependencyIndexes: file_transfer_v1_transfer_proto_depIdxs,
+		EnumInfos:         file_transfer_v1_transfer_proto_enumTypes,
 		MessageInfos:      file_transfer_v1_transfer_proto_msgTypes,
 	}.Build()
 	File_transfer_v1_transfer_proto = out.File
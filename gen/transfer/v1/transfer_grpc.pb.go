@@ -22,7 +22,10 @@ const (
 	TransferService_CreateUpload_FullMethodName = "/transfer.v1.TransferService/CreateUpload"
 	TransferService_GetOffset_FullMethodName    = "/transfer.v1.TransferService/GetOffset"
 	TransferService_Upload_FullMethodName       = "/transfer.v1.TransferService/Upload"
+	TransferService_UploadV2_FullMethodName     = "/transfer.v1.TransferService/UploadV2"
+	TransferService_PlanDelta_FullMethodName    = "/transfer.v1.TransferService/PlanDelta"
 	TransferService_Download_FullMethodName     = "/transfer.v1.TransferService/Download"
+	TransferService_Stat_FullMethodName         = "/transfer.v1.TransferService/Stat"
 )
 
 // TransferServiceClient is the client API for TransferService service.
@@ -46,9 +49,20 @@ type TransferServiceClient interface {
 	// Upload creates an upload stream used for writing the data to the server one
 	// block at a time.
 	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadResponse], error)
+	// UploadV2 is a bidirectional version of Upload where the server acknowledges
+	// the offset it has written as the upload progresses.  This gives the client
+	// accurate progress, lets it limit how much data it has in flight and tells
+	// it where to resume without having to call GetOffset.
+	UploadV2(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[UploadV2Request, UploadV2Response], error)
+	// PlanDelta compares the blocks of a delta upload with the blocks of its
+	// base file and returns the blocks the client needs to send.  The client
+	// must send the missing blocks in order, using the block size of the plan.
+	PlanDelta(ctx context.Context, in *PlanDeltaRequest, opts ...grpc.CallOption) (*PlanDeltaResponse, error)
 	// Download creates a download stream that downloads a file identified by the ID
 	// one block at a time.
 	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadResponse], error)
+	// Stat returns information about a finished file, including its metadata.
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
 }
 
 type transferServiceClient struct {
@@ -92,9 +106,32 @@ func (c *transferServiceClient) Upload(ctx context.Context, opts ...grpc.CallOpt
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type TransferService_UploadClient = grpc.ClientStreamingClient[UploadRequest, UploadResponse]
 
+func (c *transferServiceClient) UploadV2(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[UploadV2Request, UploadV2Response], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &TransferService_ServiceDesc.Streams[1], TransferService_UploadV2_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadV2Request, UploadV2Response]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type TransferService_UploadV2Client = grpc.BidiStreamingClient[UploadV2Request, UploadV2Response]
+
+func (c *transferServiceClient) PlanDelta(ctx context.Context, in *PlanDeltaRequest, opts ...grpc.CallOption) (*PlanDeltaResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PlanDeltaResponse)
+	err := c.cc.Invoke(ctx, TransferService_PlanDelta_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *transferServiceClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadResponse], error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
-	stream, err := c.cc.NewStream(ctx, &TransferService_ServiceDesc.Streams[1], TransferService_Download_FullMethodName, cOpts...)
+	stream, err := c.cc.NewStream(ctx, &TransferService_ServiceDesc.Streams[2], TransferService_Download_FullMethodName, cOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -111,6 +148,16 @@ func (c *transferServiceClient) Download(ctx context.Context, in *DownloadReques
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type TransferService_DownloadClient = grpc.ServerStreamingClient[DownloadResponse]
 
+func (c *transferServiceClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatResponse)
+	err := c.cc.Invoke(ctx, TransferService_Stat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TransferServiceServer is the server API for TransferService service.
 // All implementations should embed UnimplementedTransferServiceServer
 // for forward compatibility.
@@ -132,9 +179,20 @@ type TransferServiceServer interface {
 	// Upload creates an upload stream used for writing the data to the server one
 	// block at a time.
 	Upload(grpc.ClientStreamingServer[UploadRequest, UploadResponse]) error
+	// UploadV2 is a bidirectional version of Upload where the server acknowledges
+	// the offset it has written as the upload progresses.  This gives the client
+	// accurate progress, lets it limit how much data it has in flight and tells
+	// it where to resume without having to call GetOffset.
+	UploadV2(grpc.BidiStreamingServer[UploadV2Request, UploadV2Response]) error
+	// PlanDelta compares the blocks of a delta upload with the blocks of its
+	// base file and returns the blocks the client needs to send.  The client
+	// must send the missing blocks in order, using the block size of the plan.
+	PlanDelta(context.Context, *PlanDeltaRequest) (*PlanDeltaResponse, error)
 	// Download creates a download stream that downloads a file identified by the ID
 	// one block at a time.
 	Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadResponse]) error
+	// Stat returns information about a finished file, including its metadata.
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
 }
 
 // UnimplementedTransferServiceServer should be embedded to have
@@ -153,9 +211,18 @@ func (UnimplementedTransferServiceServer) GetOffset(context.Context, *GetOffsetR
 func (UnimplementedTransferServiceServer) Upload(grpc.ClientStreamingServer[UploadRequest, UploadResponse]) error {
 	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
 }
+func (UnimplementedTransferServiceServer) UploadV2(grpc.BidiStreamingServer[UploadV2Request, UploadV2Response]) error {
+	return status.Errorf(codes.Unimplemented, "method UploadV2 not implemented")
+}
+func (UnimplementedTransferServiceServer) PlanDelta(context.Context, *PlanDeltaRequest) (*PlanDeltaResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PlanDelta not implemented")
+}
 func (UnimplementedTransferServiceServer) Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadResponse]) error {
 	return status.Errorf(codes.Unimplemented, "method Download not implemented")
 }
+func (UnimplementedTransferServiceServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
 func (UnimplementedTransferServiceServer) testEmbeddedByValue() {}
 
 // UnsafeTransferServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -219,6 +286,31 @@ func _TransferService_Upload_Handler(srv interface{}, stream grpc.ServerStream)
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type TransferService_UploadServer = grpc.ClientStreamingServer[UploadRequest, UploadResponse]
 
+func _TransferService_UploadV2_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TransferServiceServer).UploadV2(&grpc.GenericServerStream[UploadV2Request, UploadV2Response]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type TransferService_UploadV2Server = grpc.BidiStreamingServer[UploadV2Request, UploadV2Response]
+
+func _TransferService_PlanDelta_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PlanDeltaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).PlanDelta(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TransferService_PlanDelta_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).PlanDelta(ctx, req.(*PlanDeltaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _TransferService_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(DownloadRequest)
 	if err := stream.RecvMsg(m); err != nil {
@@ -230,6 +322,24 @@ func _TransferService_Download_Handler(srv interface{}, stream grpc.ServerStream
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type TransferService_DownloadServer = grpc.ServerStreamingServer[DownloadResponse]
 
+func _TransferService_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TransferService_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // TransferService_ServiceDesc is the grpc.ServiceDesc for TransferService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -245,6 +355,14 @@ var TransferService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetOffset",
 			Handler:    _TransferService_GetOffset_Handler,
 		},
+		{
+			MethodName: "PlanDelta",
+			Handler:    _TransferService_PlanDelta_Handler,
+		},
+		{
+			MethodName: "Stat",
+			Handler:    _TransferService_Stat_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -252,6 +370,12 @@ var TransferService_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _TransferService_Upload_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "UploadV2",
+			Handler:       _TransferService_UploadV2_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 		{
 			StreamName:    "Download",
 			Handler:       _TransferService_Download_Handler,
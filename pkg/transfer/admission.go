@@ -0,0 +1,80 @@
+package transfer
+
+import (
+	"context"
+	"net"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// AdmissionRequest describes an upload that is about to be created.
+// Principal is nil for anonymous uploads and Peer is nil if the address of
+// the client is unknown.
+type AdmissionRequest struct {
+	Size      int64
+	SHA256    []byte
+	Metadata  []byte
+	BaseID    string
+	Principal *Principal
+	Peer      net.Addr
+}
+
+// Admission is what an AdmissionFunc decides about an upload it accepts.  If
+// Metadata is non-nil it replaces the metadata sent by the client.
+// StorageClass is recorded with the file and returned by Stat.
+type Admission struct {
+	Metadata     []byte
+	StorageClass string
+}
+
+// AdmissionFunc is called before an upload is created and decides if it is
+// accepted.  It returns an error to reject the upload.  If the error is a gRPC
+// status it is returned to the client as is, otherwise the client gets
+// PermissionDenied.  A nil Admission accepts the upload unchanged.
+//
+// Note that replacing the metadata of uploads encrypted by the client makes
+// them impossible to decrypt, since the client keeps the wrapped key there.
+type AdmissionFunc func(ctx context.Context, req AdmissionRequest) (*Admission, error)
+
+// admitRequest runs the admission hook, if there is one, and returns the
+// request with the metadata it picked along with the storage class.
+func (s *Service) admitRequest(ctx context.Context, req *tv1.CreateUploadRequest) (*tv1.CreateUploadRequest, string, error) {
+	if s.config.AdmissionHook == nil {
+		return req, "", nil
+	}
+
+	ar := AdmissionRequest{
+		Size:      req.Size,
+		SHA256:    req.FileSha256,
+		Metadata:  req.Metadata,
+		BaseID:    req.BaseId,
+		Principal: PrincipalFromContext(ctx),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		ar.Peer = p.Addr
+	}
+
+	hookCtx, span := startChildSpan(ctx, "AdmissionHook")
+	admission, err := s.config.AdmissionHook(hookCtx, ar)
+	endSpan(span, err)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, "", err
+		}
+		return nil, "", status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if admission == nil {
+		return req, "", nil
+	}
+
+	if admission.Metadata != nil {
+		req = proto.Clone(req).(*tv1.CreateUploadRequest)
+		req.Metadata = admission.Metadata
+	}
+	return req, admission.StorageClass, nil
+}
@@ -0,0 +1,81 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sync"
+	"testing"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdmissionHook(t *testing.T) {
+	var mu sync.Mutex
+	var seen []AdmissionRequest
+
+	hook := func(_ context.Context, req AdmissionRequest) (*Admission, error) {
+		mu.Lock()
+		seen = append(seen, req)
+		mu.Unlock()
+
+		switch string(req.Metadata) {
+		case "bad":
+			return nil, status.Error(codes.InvalidArgument, "metadata not allowed")
+		case "deny":
+			return nil, errors.New("go away")
+		case "keep":
+			return nil, nil
+		}
+		return &Admission{Metadata: []byte("rewritten"), StorageClass: "cold"}, nil
+	}
+
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		AdmissionHook:      hook,
+	})
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	raw := tv1.NewTransferServiceClient(conn)
+
+	_, err = raw.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 10, Metadata: []byte("bad")})
+	requireCode(t, codes.InvalidArgument, err)
+
+	_, err = raw.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 10, Metadata: []byte("deny")})
+	requireCode(t, codes.PermissionDenied, err)
+	require.Empty(t, service.UploadManager.GetUploads())
+
+	resp, err := raw.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 10, Metadata: []byte("keep")})
+	require.NoError(t, err)
+	up := service.UploadManager.GetUpload(ID(resp.Id))
+	require.Equal(t, []byte("keep"), up.Metadata)
+	require.Empty(t, up.StorageClass)
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id, err := client.Upload(randomFile(t, minBlockSize))
+	require.NoError(t, err)
+
+	stat, err := raw.Stat(context.Background(), &tv1.StatRequest{Id: id})
+	require.NoError(t, err)
+	require.Equal(t, []byte("rewritten"), stat.Metadata)
+	require.Equal(t, "cold", stat.StorageClass)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, seen, 4)
+	require.Equal(t, int64(minBlockSize), seen[3].Size)
+	require.Len(t, seen[3].SHA256, 32)
+	require.Nil(t, seen[3].Principal)
+	require.NotNil(t, seen[3].Peer)
+}
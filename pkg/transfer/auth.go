@@ -0,0 +1,398 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Principal is an authenticated identity.  The name is recorded as the owner
+// of the files the principal uploads.  Method is the authentication method
+// that was used.  If the principal was authenticated by a capability token
+// Capability is what the token allows.
+type Principal struct {
+	Name       string
+	Method     string
+	Capability *Capability
+}
+
+// Authenticator authenticates the caller of an RPC.  It returns nil if the
+// call doesn't carry the kind of credentials it handles, so several
+// authenticators can be combined, and an error if the credentials are invalid.
+type Authenticator interface {
+	Authenticate(ctx context.Context) (*Principal, error)
+}
+
+// authentication methods
+const (
+	AuthBearerToken = "bearer"
+	AuthAPIKey      = "api-key"
+	AuthMTLS        = "mtls"
+	AuthCapability  = "capability"
+)
+
+const (
+	authorizationHeader = "authorization"
+	apiKeyHeader        = "x-api-key"
+	bearerPrefix        = "bearer "
+)
+
+// errors
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrPermissionDenied   = errors.New("permission denied")
+)
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal authenticated for the call, or
+// nil if the call is anonymous.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// ContextWithPrincipal returns a context carrying principal.
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalName returns the name of the principal of the call or "" if it is
+// anonymous.
+func principalName(ctx context.Context) string {
+	p := PrincipalFromContext(ctx)
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+// secretAuthenticator authenticates calls carrying one of a fixed set of
+// secrets in a metadata header.
+type secretAuthenticator struct {
+	header  string
+	prefix  string
+	method  string
+	secrets map[string]string
+}
+
+// NewBearerTokenAuthenticator authenticates calls with an
+// "authorization: Bearer <token>" header.  Tokens maps each token to the name
+// of its principal.
+func NewBearerTokenAuthenticator(tokens map[string]string) Authenticator {
+	return &secretAuthenticator{
+		header:  authorizationHeader,
+		prefix:  bearerPrefix,
+		method:  AuthBearerToken,
+		secrets: tokens,
+	}
+}
+
+// NewAPIKeyAuthenticator authenticates calls with an "x-api-key" header.  Keys
+// maps each API key to the name of its principal.
+func NewAPIKeyAuthenticator(keys map[string]string) Authenticator {
+	return &secretAuthenticator{
+		header:  apiKeyHeader,
+		method:  AuthAPIKey,
+		secrets: keys,
+	}
+}
+
+func (a *secretAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	values := md.Get(a.header)
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	value := values[0]
+	if a.prefix != "" {
+		if len(value) < len(a.prefix) || !strings.EqualFold(value[:len(a.prefix)], a.prefix) {
+			return nil, nil
+		}
+		value = value[len(a.prefix):]
+	}
+
+	// compare against every secret so the time taken doesn't reveal anything
+	var name string
+	for secret, principal := range a.secrets {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(value)) == 1 {
+			name = principal
+		}
+	}
+
+	if name == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: name, Method: a.method}, nil
+}
+
+// LoadKeyFile loads secrets such as API keys or bearer tokens from a file
+// with one "<principal> <secret>" pair per line.  Empty lines and lines
+// starting with # are ignored.  It returns a map from secret to principal.
+func LoadKeyFile(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	secrets := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <principal> <secret>", filename, line)
+		}
+
+		if _, ok := secrets[fields[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate secret", filename, line)
+		}
+		secrets[fields[1]] = fields[0]
+	}
+	return secrets, scanner.Err()
+}
+
+// mtlsAuthenticator authenticates calls using the verified client certificate.
+type mtlsAuthenticator struct{}
+
+// NewMTLSAuthenticator authenticates calls by the client certificate verified
+// during the TLS handshake.  The principal is the common name of the
+// certificate subject.  The server must verify client certificates.
+func NewMTLSAuthenticator() Authenticator {
+	return mtlsAuthenticator{}
+}
+
+func (mtlsAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	name := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return nil, fmt.Errorf("%w: client certificate has no common name", ErrInvalidCredentials)
+	}
+	return &Principal{Name: name, Method: AuthMTLS}, nil
+}
+
+// Authentication authenticates every call to the server using gRPC
+// interceptors.  The first authenticator that recognizes the credentials of a
+// call decides who the caller is.  Calls without credentials are rejected
+// unless AllowAnonymous is set.  Use Update to change the fields once the
+// server is running.
+type Authentication struct {
+	mu             sync.RWMutex
+	Authenticators []Authenticator
+	AllowAnonymous bool
+}
+
+// Update replaces the authenticators and the anonymous setting.  Calls in
+// progress are not affected.
+func (a *Authentication) Update(authenticators []Authenticator, allowAnonymous bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.Authenticators = authenticators
+	a.AllowAnonymous = allowAnonymous
+}
+
+// ServerOptions returns the interceptors for the gRPC server.
+func (a *Authentication) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(a.UnaryInterceptor),
+		grpc.ChainStreamInterceptor(a.StreamInterceptor),
+	}
+}
+
+// UnaryInterceptor authenticates unary calls.
+func (a *Authentication) UnaryInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor authenticates streaming calls.
+func (a *Authentication) StreamInterceptor(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+func (a *Authentication) authenticate(ctx context.Context) (context.Context, error) {
+	a.mu.RLock()
+	authenticators := a.Authenticators
+	allowAnonymous := a.AllowAnonymous
+	a.mu.RUnlock()
+
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(ctx)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		if principal != nil {
+			return ContextWithPrincipal(ctx, principal), nil
+		}
+	}
+
+	if allowAnonymous {
+		return ctx, nil
+	}
+	return nil, status.Error(codes.Unauthenticated, "no credentials")
+}
+
+// authenticatedStream is a server stream with the authenticated context.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// Action is an operation on a file that needs to be authorized.
+type Action int
+
+// actions
+const (
+	ActionRead Action = iota + 1
+	ActionWrite
+	ActionDelete
+	ActionList
+	ActionAdmin
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionRead:
+		return "read"
+	case ActionWrite:
+		return "write"
+	case ActionDelete:
+		return "delete"
+	case ActionList:
+		return "list"
+	case ActionAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+}
+
+// Authorizer decides if the principal of the call, if any, may perform action
+// on the file identified by id, which is owned by owner.  ActionAdmin is used
+// for the admin calls, which don't concern a single file, so id and owner are
+// empty.  An error means the call is denied.  If the error is a gRPC status it
+// is returned to the client as is, otherwise the client gets PermissionDenied.
+type Authorizer interface {
+	Authorize(ctx context.Context, action Action, id ID, owner string) error
+}
+
+// OwnerAuthorizer lets principals access the files they own and nothing else.
+// Admins can access every file and use the admin calls.  Files without an
+// owner, which were uploaded anonymously, can be accessed by everyone.
+type OwnerAuthorizer struct {
+	Admins []string
+}
+
+// Authorize implements Authorizer.
+func (o OwnerAuthorizer) Authorize(ctx context.Context, action Action, id ID, owner string) error {
+	name := principalName(ctx)
+
+	if name != "" && slices.Contains(o.Admins, name) {
+		return nil
+	}
+
+	if action == ActionAdmin {
+		return fmt.Errorf("%w: admin access required", ErrPermissionDenied)
+	}
+
+	if owner == "" || owner == name {
+		return nil
+	}
+	return fmt.Errorf("%w: %s access to [%s]", ErrPermissionDenied, action, id)
+}
+
+// authorize consults the authorizer, if there is one, and returns a gRPC
+// status error if the call is denied.  Without an authorizer every call is
+// allowed except the admin calls.  Calls authenticated by a capability
+// token are allowed exactly what the token allows.
+func (s *Service) authorize(ctx context.Context, action Action, id ID, owner string) error {
+	if c := capabilityFromContext(ctx); c != nil {
+		err := s.checkCapability(c, action, id)
+		if err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		return nil
+	}
+
+	// the admin calls reach beyond the files of the caller, so without an
+	// authorizer to tell who the admins are nobody may use them
+	if s.config.Authorizer == nil {
+		if action == ActionAdmin {
+			return status.Error(codes.PermissionDenied, "admin access requires an authorizer")
+		}
+		return nil
+	}
+
+	err := s.config.Authorizer.Authorize(ctx, action, id, owner)
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.PermissionDenied, err.Error())
+}
+
+// callCredentials sends a secret in a metadata header with every call.
+type callCredentials struct {
+	header string
+	value  string
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (c callCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{c.header: c.value}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials.  We
+// allow credentials on unencrypted connections for use on trusted networks,
+// but anywhere else they should only be used with TLS.
+func (c callCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,228 @@
+package transfer
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoadKeyFile(t *testing.T) {
+	filename := path.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(filename, []byte("# comment\n\nalice secret1\n  bob   secret2  \n"), 0600))
+
+	keys, err := LoadKeyFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"secret1": "alice", "secret2": "bob"}, keys)
+
+	require.NoError(t, os.WriteFile(filename, []byte("alice\n"), 0600))
+	_, err = LoadKeyFile(filename)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filename, []byte("alice secret\nbob secret\n"), 0600))
+	_, err = LoadKeyFile(filename)
+	require.Error(t, err)
+}
+
+func TestOwnerAuthorizer(t *testing.T) {
+	authorizer := OwnerAuthorizer{Admins: []string{"root"}}
+	alice := ContextWithPrincipal(context.Background(), &Principal{Name: "alice"})
+	root := ContextWithPrincipal(context.Background(), &Principal{Name: "root"})
+	anonymous := context.Background()
+
+	require.NoError(t, authorizer.Authorize(alice, ActionRead, "a", "alice"))
+	require.ErrorIs(t, authorizer.Authorize(alice, ActionRead, "b", "bob"), ErrPermissionDenied)
+	require.NoError(t, authorizer.Authorize(alice, ActionRead, "c", ""))
+	require.ErrorIs(t, authorizer.Authorize(alice, ActionAdmin, "", ""), ErrPermissionDenied)
+
+	require.NoError(t, authorizer.Authorize(root, ActionDelete, "b", "bob"))
+	require.NoError(t, authorizer.Authorize(root, ActionAdmin, "", ""))
+
+	require.ErrorIs(t, authorizer.Authorize(anonymous, ActionRead, "a", "alice"), ErrPermissionDenied)
+	require.NoError(t, authorizer.Authorize(anonymous, ActionRead, "c", ""))
+}
+
+func TestAuthentication(t *testing.T) {
+	auth := &Authentication{
+		Authenticators: []Authenticator{
+			NewBearerTokenAuthenticator(map[string]string{"alice-token": "alice", "root-token": "root"}),
+			NewAPIKeyAuthenticator(map[string]string{"bob-key": "bob"}),
+		},
+	}
+
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		Authorizer:         OwnerAuthorizer{Admins: []string{"root"}},
+		Quarantine:         true,
+	}, auth.ServerOptions()...)
+
+	filename := randomFile(t, 3*minBlockSize)
+
+	newClient := func(config ClientConfig) *Client {
+		config.ServerAddr = addr
+		client, err := CreateClient(config)
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+
+	alice := newClient(ClientConfig{Token: "alice-token"})
+	bob := newClient(ClientConfig{APIKey: "bob-key"})
+	root := newClient(ClientConfig{Token: "root-token"})
+	anonymous := newClient(ClientConfig{})
+	impostor := newClient(ClientConfig{Token: "wrong"})
+
+	id, err := alice.Upload(filename)
+	require.NoError(t, err)
+
+	info, err := service.fileStore.ReadInfo(ID(id))
+	require.NoError(t, err)
+	require.Equal(t, "alice", info.Owner)
+
+	require.NoError(t, alice.Download(ID(id), path.Join(t.TempDir(), "alice")))
+	require.NoError(t, root.Download(ID(id), path.Join(t.TempDir(), "root")))
+	requireCode(t, codes.PermissionDenied, bob.Download(ID(id), path.Join(t.TempDir(), "bob")))
+
+	_, err = bob.client.Stat(context.Background(), &tv1.StatRequest{Id: id})
+	requireCode(t, codes.PermissionDenied, err)
+
+	_, err = anonymous.Upload(randomFile(t, minBlockSize))
+	requireCode(t, codes.Unauthenticated, err)
+
+	_, err = impostor.Upload(randomFile(t, minBlockSize))
+	requireCode(t, codes.Unauthenticated, err)
+
+	// bob can't continue alice's upload
+	resp, err := alice.client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 100})
+	require.NoError(t, err)
+
+	_, err = bob.client.GetOffset(context.Background(), &tv1.GetOffsetRequest{Id: resp.Id})
+	requireCode(t, codes.PermissionDenied, err)
+
+	stream, err := bob.client.UploadV2(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&tv1.UploadV2Request{Id: resp.Id}))
+	_, err = stream.Recv()
+	requireCode(t, codes.PermissionDenied, err)
+
+	_, err = alice.client.GetOffset(context.Background(), &tv1.GetOffsetRequest{Id: resp.Id})
+	require.NoError(t, err)
+
+	// bob can't use alice's file as a base either
+	_, err = bob.client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 100, BaseId: id})
+	requireCode(t, codes.PermissionDenied, err)
+
+	// only admins can use the admin service
+	admin := tv1.NewAdminServiceClient(alice.conn)
+	_, err = admin.ListQuarantine(context.Background(), &tv1.ListQuarantineRequest{})
+	requireCode(t, codes.PermissionDenied, err)
+
+	admin = tv1.NewAdminServiceClient(root.conn)
+	_, err = admin.ListQuarantine(context.Background(), &tv1.ListQuarantineRequest{})
+	require.NoError(t, err)
+}
+
+func TestAuthenticationUpdate(t *testing.T) {
+	auth := &Authentication{
+		Authenticators: []Authenticator{NewBearerTokenAuthenticator(map[string]string{"old-token": "alice"})},
+	}
+
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+	}, auth.ServerOptions()...)
+
+	newClient := func(config ClientConfig) *Client {
+		config.ServerAddr = addr
+		client, err := CreateClient(config)
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+
+	old := newClient(ClientConfig{Token: "old-token"})
+	rotated := newClient(ClientConfig{Token: "new-token"})
+	anonymous := newClient(ClientConfig{})
+
+	_, err := old.Upload(randomFile(t, minBlockSize))
+	require.NoError(t, err)
+	_, err = rotated.Upload(randomFile(t, minBlockSize))
+	requireCode(t, codes.Unauthenticated, err)
+
+	auth.Update([]Authenticator{NewBearerTokenAuthenticator(map[string]string{"new-token": "alice"})}, true)
+
+	_, err = old.Upload(randomFile(t, minBlockSize))
+	requireCode(t, codes.Unauthenticated, err)
+	_, err = rotated.Upload(randomFile(t, minBlockSize))
+	require.NoError(t, err)
+	_, err = anonymous.Upload(randomFile(t, minBlockSize))
+	require.NoError(t, err)
+}
+
+func TestAdminWithoutAuthorizer(t *testing.T) {
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		Quarantine:         true,
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	// everyone can upload, but nobody is an admin
+	_, err = client.Upload(randomFile(t, minBlockSize))
+	require.NoError(t, err)
+
+	admin := tv1.NewAdminServiceClient(client.conn)
+	_, err = admin.ListQuarantine(context.Background(), &tv1.ListQuarantineRequest{})
+	requireCode(t, codes.PermissionDenied, err)
+	_, err = admin.PurgeQuarantine(context.Background(), &tv1.PurgeQuarantineRequest{All: true})
+	requireCode(t, codes.PermissionDenied, err)
+}
+
+func TestMTLSAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	certFile, keyFile := ca.issue(t, dir, "server")
+	clientCert, clientKey := ca.issue(t, dir, "carol")
+
+	creds, err := ServerCredentials(TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: ca.file, VerifyClientCerts: true})
+	require.NoError(t, err)
+
+	auth := &Authentication{Authenticators: []Authenticator{NewMTLSAuthenticator()}}
+	opts := append(auth.ServerOptions(), grpc.Creds(creds))
+
+	service, addr := startServer(t, Config{
+		IncomingDir: path.Join(dir, "incoming"),
+		Authorizer:  OwnerAuthorizer{},
+	}, opts...)
+
+	client, err := CreateClient(ClientConfig{
+		ServerAddr: addr,
+		TLS:        &TLSConfig{CAFile: ca.file, CertFile: clientCert, KeyFile: clientKey},
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id, err := client.Upload(randomFile(t, minBlockSize))
+	require.NoError(t, err)
+
+	info, err := service.fileStore.ReadInfo(ID(id))
+	require.NoError(t, err)
+	require.Equal(t, "carol", info.Owner)
+}
+
+// requireCode requires err to be a gRPC status error with code.
+func requireCode(t *testing.T, code codes.Code, err error) {
+	t.Helper()
+	require.Error(t, err)
+	require.Equal(t, code, status.Code(err), err.Error())
+}
@@ -0,0 +1,145 @@
+package transfer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// bucket is a token bucket that holds up to a second worth of bytes.  Bytes
+// are reserved before they are transferred, so the bucket can go into debt,
+// and the stream waits until the debt is paid.  A bucket starts out empty so
+// new streams can't burst past the limit.  It isn't safe for concurrent use,
+// the buckets shared between streams are protected by the bandwidth mutex.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n bytes from the bucket when it fills at rate bytes per
+// second and returns how long to wait before transferring them.  A rate of
+// zero means no limit.
+func (b *bucket) reserve(rate int64, n int, now time.Time) time.Duration {
+	// without a limit the bucket starts over empty once there is one
+	if rate <= 0 {
+		b.tokens = 0
+		b.last = time.Time{}
+		return 0
+	}
+
+	r := float64(rate)
+	if !b.last.IsZero() {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*r, r)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / r * float64(time.Second))
+}
+
+// bandwidth enforces the bandwidth limits of the uploads and downloads in
+// progress.  All streams share one bucket for the global limit and the
+// streams of each principal share one for the principal limit.  Streams
+// queue up for the bytes they reserve, so the bandwidth is shared fairly and
+// whatever an idle stream doesn't use is there for the others.
+type bandwidth struct {
+	mu         sync.Mutex
+	streams    int
+	global     bucket
+	principals map[string]*principalBandwidth
+}
+
+// principalBandwidth is the bandwidth shared by the streams of a principal.
+type principalBandwidth struct {
+	streams int
+	bucket  bucket
+}
+
+// streamBandwidth is the bandwidth of a single stream.
+type streamBandwidth struct {
+	bandwidth *bandwidth
+	principal string
+	bucket    bucket
+}
+
+func newBandwidth() *bandwidth {
+	return &bandwidth{principals: map[string]*principalBandwidth{}}
+}
+
+// open adds a stream for principal.  Close it when the stream is done.
+func (b *bandwidth) open(principal string) *streamBandwidth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, ok := b.principals[principal]
+	if !ok {
+		p = &principalBandwidth{}
+		b.principals[principal] = p
+	}
+
+	b.streams++
+	p.streams++
+	return &streamBandwidth{bandwidth: b, principal: principal}
+}
+
+// active returns the number of streams in progress.
+func (b *bandwidth) active() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.streams
+}
+
+// reserve reserves n bytes for the stream under limits l and returns how long
+// to wait before transferring them.
+func (sb *streamBandwidth) reserve(l Limits, n int, now time.Time) time.Duration {
+	wait := sb.bucket.reserve(l.MaxStreamBandwidth, n, now)
+
+	b := sb.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wait = max(wait, b.global.reserve(l.MaxBandwidth, n, now))
+	wait = max(wait, b.principals[sb.principal].bucket.reserve(l.MaxPrincipalBandwidth, n, now))
+	return wait
+}
+
+// close removes the stream.
+func (sb *streamBandwidth) close() {
+	b := sb.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.streams--
+	p := b.principals[sb.principal]
+	p.streams--
+	if p.streams == 0 {
+		delete(b.principals, sb.principal)
+	}
+}
+
+// throttle waits until the stream may transfer n more bytes under the
+// current limits.  If the service is draining we stop waiting so that the
+// block in flight can be handled before the stream stops.
+func (s *Service) throttle(ctx context.Context, sb *streamBandwidth, n int) error {
+	wait := sb.reserve(s.Limits(), n, time.Now())
+	if wait == 0 {
+		return nil
+	}
+	s.metrics.throttled.Add(wait.Seconds())
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-s.draining:
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	return nil
+}
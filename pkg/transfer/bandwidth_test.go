@@ -0,0 +1,106 @@
+package transfer
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket(t *testing.T) {
+	var b bucket
+	now := time.Now()
+
+	// unlimited
+	require.Zero(t, b.reserve(0, 1000, now))
+
+	// the bucket starts out empty, so there is no burst
+	require.Equal(t, time.Second, b.reserve(1000, 1000, now))
+
+	// time pays the debt
+	now = now.Add(time.Second)
+	require.Equal(t, 500*time.Millisecond, b.reserve(1000, 500, now))
+	require.Equal(t, time.Second, b.reserve(1000, 500, now))
+
+	// the bucket doesn't hold more than a second worth of bytes
+	now = now.Add(time.Hour)
+	require.Zero(t, b.reserve(1000, 1000, now))
+	require.Equal(t, 100*time.Millisecond, b.reserve(1000, 100, now))
+}
+
+func TestBandwidthShared(t *testing.T) {
+	b := newBandwidth()
+	limits := Limits{MaxBandwidth: 1000, MaxPrincipalBandwidth: 500}
+	now := time.Now()
+
+	alice := b.open("alice")
+	alice2 := b.open("alice")
+	bob := b.open("bob")
+	require.Equal(t, 3, b.active())
+
+	// alice's streams queue up for her bandwidth, bob only waits for the
+	// global bandwidth alice used
+	require.Equal(t, 500*time.Millisecond, alice.reserve(limits, 250, now))
+	require.Equal(t, time.Second, alice2.reserve(limits, 250, now))
+	require.Equal(t, 750*time.Millisecond, bob.reserve(limits, 250, now))
+
+	// the per stream limit applies on top
+	limits.MaxStreamBandwidth = 100
+	require.Equal(t, 2500*time.Millisecond, bob.reserve(limits, 250, now))
+
+	// while the others are idle, carol gets all of the bandwidth rather
+	// than a quarter of it
+	now = now.Add(time.Hour)
+	carol := b.open("carol")
+	require.Equal(t, time.Second, carol.reserve(Limits{MaxBandwidth: 1000}, 2000, now))
+
+	alice.close()
+	alice2.close()
+	bob.close()
+	carol.close()
+	require.Zero(t, b.active())
+	require.Empty(t, b.principals)
+}
+
+func TestThrottle(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		MaxStreamBandwidth: 20 * minBlockSize,
+		Metrics:            registry,
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	// half a second worth of blocks takes half a second, with no burst at
+	// the start
+	start := time.Now()
+	id, err := client.Upload(randomFile(t, 10*minBlockSize))
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	require.Greater(t, testutil.ToFloat64(service.metrics.throttled), 0.4)
+
+	// lifting the limit applies right away
+	limits := service.Limits()
+	limits.MaxStreamBandwidth = 0
+	require.NoError(t, service.SetLimits(limits))
+
+	start = time.Now()
+	require.NoError(t, client.Download(ID(id), path.Join(t.TempDir(), "download")))
+	require.Less(t, time.Since(start), 400*time.Millisecond)
+
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP transfer_bandwidth_limit_bytes_per_second Bandwidth limits of uploads and downloads, 0 means no limit.
+# TYPE transfer_bandwidth_limit_bytes_per_second gauge
+transfer_bandwidth_limit_bytes_per_second{scope="global"} 0
+transfer_bandwidth_limit_bytes_per_second{scope="principal"} 0
+transfer_bandwidth_limit_bytes_per_second{scope="stream"} 0
+`), "transfer_bandwidth_limit_bytes_per_second"))
+}
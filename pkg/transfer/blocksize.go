@@ -1,16 +1,183 @@
 package transfer
 
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
 const (
 	minBlockSize     = 10 * 1024
-	maxBlockSize     = 2 * 1024 * 1024
-	defaultBlockSize = maxBlockSize / 2
+	defaultBlockSize = 1024 * 1024
+
+	// defaultMaxMsgSize is the largest message gRPC receives unless told
+	// otherwise.
+	defaultMaxMsgSize = 4 * 1024 * 1024
+
+	// blockOverhead is the room we leave in each message for the fields
+	// that are sent along with the data of a block.
+	blockOverhead = 1024
 )
 
-// clampBlockSize returns block size clamped between minBlockSize and
-// maxBlockSize.  If bs is zero we use default block size.
-func clampBlockSize(bs int64) int64 {
+// blockBounds are the smallest and largest block sizes we use.
+type blockBounds struct {
+	min int64
+	max int64
+}
+
+// defaultBlockBounds are the block bounds when using the default message size.
+var defaultBlockBounds = blockBounds{min: minBlockSize, max: maxBlockSizeFor(defaultMaxMsgSize)}
+
+// maxBlockSizeFor returns the largest block that fits in a message of msgSize
+// bytes.
+func maxBlockSizeFor(msgSize int) int64 {
+	return int64(msgSize) - blockOverhead
+}
+
+// newBlockBounds returns the block bounds for messages of msgSize bytes,
+// which defaults to defaultMaxMsgSize if zero.  If minSize or maxSize are
+// non-zero they replace minBlockSize and the largest block that fits in a
+// message.
+func newBlockBounds(msgSize int, minSize int64, maxSize int64) (blockBounds, error) {
+	if msgSize < 0 || minSize < 0 || maxSize < 0 {
+		return blockBounds{}, fmt.Errorf("message and block sizes cannot be negative")
+	}
+
+	if msgSize == 0 {
+		msgSize = defaultMaxMsgSize
+	}
+
+	fits := maxBlockSizeFor(msgSize)
+	if fits < 1 {
+		return blockBounds{}, fmt.Errorf("messages of %d bytes are too small for blocks", msgSize)
+	}
+
+	b := blockBounds{min: minSize, max: maxSize}
+	if b.min == 0 {
+		b.min = min(minBlockSize, fits)
+	}
+
+	if b.max == 0 {
+		b.max = fits
+	}
+
+	if b.max > fits {
+		return blockBounds{}, fmt.Errorf("max block size %d does not fit in messages of %d bytes, it can be at most %d", b.max, msgSize, fits)
+	}
+
+	if b.min < 1 || b.min > b.max {
+		return blockBounds{}, fmt.Errorf("min block size %d must be between 1 and the max block size %d", b.min, b.max)
+	}
+
+	return b, nil
+}
+
+// clamp returns block size clamped between the bounds.  If bs is zero we use
+// default block size.
+func (b blockBounds) clamp(bs int64) int64 {
 	if bs == 0 {
-		return defaultBlockSize
+		bs = defaultBlockSize
+	}
+	return min(max(bs, b.min), b.max)
+}
+
+const (
+	// sizerInterval is how often the block sizer measures the throughput and
+	// picks a new block size.
+	sizerInterval = 250 * time.Millisecond
+
+	// targetBlockTime is the shortest time we want each block to take to
+	// send, so the overhead of each block stays small.
+	targetBlockTime = 100 * time.Millisecond
+)
+
+// blockSizer adapts the block size of an upload to the throughput and round
+// trip time measured from the acknowledgements of the server.  Blocks are
+// sized to take targetBlockTime to send, or longer on links with a long
+// round trip time so that the upload window holds a round trip worth of
+// data.  The size changes by at most a factor of two at a time, and stays
+// within the bounds, whose max the server can lower while we upload.
+type blockSizer struct {
+	size   int64
+	bounds blockBounds
+	limit  int64
+
+	// the blocks waiting to be acknowledged
+	pending []sentBlock
+	rtt     time.Duration
+
+	// the start of the current throughput measurement
+	sampleStart  time.Time
+	sampleOffset int64
+}
+
+// sentBlock is the end offset of a block and when it was sent.
+type sentBlock struct {
+	end int64
+	at  time.Time
+}
+
+// newBlockSizer returns a sizer starting at size.  If the bounds are the same
+// the block size is fixed.
+func newBlockSizer(size int64, bounds blockBounds) *blockSizer {
+	return &blockSizer{size: bounds.clamp(size), bounds: bounds, limit: bounds.max}
+}
+
+// sent records that the block ending at end was sent.
+func (b *blockSizer) sent(end int64, now time.Time) {
+	b.pending = append(b.pending, sentBlock{end: end, at: now})
+}
+
+// acked records that the server has written everything up to written, and
+// picks a new block size once there is a new throughput measurement.
+func (b *blockSizer) acked(written int64, now time.Time) {
+	var last *sentBlock
+	for len(b.pending) > 0 && b.pending[0].end <= written {
+		last = &b.pending[0]
+		b.pending = b.pending[1:]
+	}
+
+	if last != nil {
+		rtt := now.Sub(last.at)
+		if b.rtt == 0 {
+			b.rtt = rtt
+		} else {
+			b.rtt = (3*b.rtt + rtt) / 4
+		}
+	}
+
+	if b.sampleStart.IsZero() {
+		b.sampleStart, b.sampleOffset = now, written
+		return
+	}
+
+	elapsed := now.Sub(b.sampleStart)
+	if elapsed < sizerInterval {
+		return
+	}
+
+	throughput := float64(written-b.sampleOffset) / elapsed.Seconds()
+	blockTime := max(b.rtt/defaultUploadWindowBlocks, targetBlockTime)
+	target := int64(throughput * blockTime.Seconds())
+	b.resize(min(max(target, b.size/2), 2*b.size))
+	b.sampleStart, b.sampleOffset = now, written
+}
+
+// setMax changes the max block size to what the server asks for now, but
+// never above the max we started with.  Zero leaves it as it is.
+func (b *blockSizer) setMax(size int64) {
+	if size <= 0 {
+		return
+	}
+	b.bounds.max = max(min(size, b.limit), b.bounds.min)
+	b.resize(b.size)
+}
+
+// resize changes the block size to size within the bounds.
+func (b *blockSizer) resize(size int64) {
+	size = b.bounds.clamp(max(size, 1))
+	if size != b.size {
+		slog.Debug("block size changed", "from", b.size, "to", size, "rtt", b.rtt)
+		b.size = size
 	}
-	return min(max(bs, minBlockSize), maxBlockSize)
 }
@@ -0,0 +1,126 @@
+package transfer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBlockBounds(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		msgSize int
+		min     int64
+		max     int64
+		want    blockBounds
+		wantErr bool
+	}{
+		{name: "default", want: defaultBlockBounds},
+		{name: "derived from message size", msgSize: 16 << 20, want: blockBounds{min: minBlockSize, max: 16<<20 - blockOverhead}},
+		{name: "explicit", min: 4096, max: 65536, want: blockBounds{min: 4096, max: 65536}},
+		{name: "small messages", msgSize: 5 * 1024, want: blockBounds{min: 4 * 1024, max: 4 * 1024}},
+		{name: "max does not fit", msgSize: 1 << 20, max: 1 << 20, wantErr: true},
+		{name: "min above max", min: 65536, max: 4096, wantErr: true},
+		{name: "message too small", msgSize: 100, wantErr: true},
+		{name: "negative", msgSize: -1, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := newBlockBounds(tc.msgSize, tc.min, tc.max)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, b)
+		})
+	}
+}
+
+func TestBlockBoundsClamp(t *testing.T) {
+	b := blockBounds{min: minBlockSize, max: 2 * defaultBlockSize}
+	require.Equal(t, int64(defaultBlockSize), b.clamp(0))
+	require.Equal(t, int64(minBlockSize), b.clamp(1))
+	require.Equal(t, int64(2*defaultBlockSize), b.clamp(10*defaultBlockSize))
+	require.Equal(t, int64(3*minBlockSize), b.clamp(3*minBlockSize))
+
+	// the default is clamped too
+	b = blockBounds{min: minBlockSize, max: 2 * minBlockSize}
+	require.Equal(t, int64(2*minBlockSize), b.clamp(0))
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "zero", config: Config{}},
+		{name: "preferred block size", config: Config{PreferredBlockSize: minBlockSize}},
+		{name: "preferred block size too large", config: Config{PreferredBlockSize: defaultMaxMsgSize}, wantErr: true},
+		{name: "preferred block size fits larger messages", config: Config{PreferredBlockSize: defaultMaxMsgSize, MaxRecvMsgSize: 8 << 20, MaxSendMsgSize: 8 << 20}},
+		{name: "limited by send size", config: Config{PreferredBlockSize: defaultMaxMsgSize, MaxRecvMsgSize: 8 << 20}, wantErr: true},
+		{name: "preferred block size below min", config: Config{PreferredBlockSize: 1024}, wantErr: true},
+		{name: "preferred block size with min", config: Config{PreferredBlockSize: 1024, MinBlockSize: 1024}},
+		{name: "negative keepalive", config: Config{KeepaliveTime: -1}, wantErr: true},
+		{name: "negative streams", config: Config{MaxConcurrentStreams: -1}, wantErr: true},
+		{name: "negative quota", config: Config{Quota: -1}, wantErr: true},
+		{name: "negative memory limit", config: Config{MemoryLimit: -1}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestBlockSizer(t *testing.T) {
+	bounds := blockBounds{min: minBlockSize, max: 64 * minBlockSize}
+	now := time.Now()
+
+	// sends a block of the current size every step and has it acknowledged
+	// right away
+	run := func(b *blockSizer, step time.Duration, steps int) {
+		var offset int64
+		for range steps {
+			offset += b.size
+			b.sent(offset, now)
+			now = now.Add(step)
+			b.acked(offset, now)
+		}
+	}
+
+	// fast links get larger blocks, but they grow at most two times at a time
+	b := newBlockSizer(4*minBlockSize, bounds)
+	run(b, 5*time.Millisecond, 300)
+	require.Equal(t, bounds.max, b.size)
+	require.Equal(t, 5*time.Millisecond, b.rtt)
+
+	// slow links get smaller blocks
+	b = newBlockSizer(32*minBlockSize, bounds)
+	run(b, time.Second, 10)
+	require.Equal(t, bounds.min, b.size)
+
+	// the server can lower the max, but not raise it above the bounds
+	b = newBlockSizer(32*minBlockSize, bounds)
+	b.setMax(2 * minBlockSize)
+	require.Equal(t, int64(2*minBlockSize), b.size)
+	run(b, time.Millisecond, 20)
+	require.Equal(t, int64(2*minBlockSize), b.size)
+	b.setMax(1)
+	require.Equal(t, bounds.min, b.size)
+	b.setMax(1000 * minBlockSize)
+	require.Equal(t, bounds.max, b.bounds.max)
+	b.setMax(0)
+	require.Equal(t, bounds.max, b.bounds.max)
+
+	// fixed block sizes stay fixed
+	b = newBlockSizer(3*minBlockSize, blockBounds{min: 3 * minBlockSize, max: 3 * minBlockSize})
+	run(b, time.Millisecond, 20)
+	b.setMax(minBlockSize)
+	require.Equal(t, int64(3*minBlockSize), b.size)
+}
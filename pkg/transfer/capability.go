@@ -0,0 +1,446 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Capability tokens let a trusted backend hand out narrowly scoped access to
+// the service without giving out general credentials.  A token is
+//
+//	<algorithm>.<base64 payload>.<base64 signature>
+//
+// where the payload is the JSON encoded Capability and the signature is an
+// HMAC-SHA256 or an Ed25519 signature over "<algorithm>.<base64 payload>".
+// Clients send the token in the x-capability header.
+//
+// An upload token can be used to create exactly one upload, and then to
+// upload to and resume that upload until it expires.  Which tokens have been
+// used is saved in the incoming dir so this holds across restarts.  A
+// download token can be used to download and stat the files it lists until it
+// expires.
+
+// capability scopes
+const (
+	CapabilityUpload   = "upload"
+	CapabilityDownload = "download"
+)
+
+const (
+	capabilityHeader    = "x-capability"
+	capabilityHMAC      = "hs256"
+	capabilityEd25519   = "ed25519"
+	minCapabilitySecret = 32
+
+	// capabilityUsesFile is the file in the incoming dir where the upload
+	// tokens that have been used are saved.
+	capabilityUsesFile = ".capabilities.json"
+)
+
+// errors
+var (
+	ErrInvalidCapability = errors.New("invalid capability token")
+	ErrCapabilityExpired = errors.New("capability token expired")
+	ErrCapabilityUsed    = errors.New("capability token already used")
+)
+
+// Capability is what a capability token allows.  Subject is the principal the
+// token is issued to, which becomes the owner of uploaded files, so upload
+// tokens must have one.  IDs are the
+// files a download token allows access to, and MaxSize is the largest file an
+// upload token allows.  ID uniquely identifies the token and is generated when
+// the token is minted if it is empty.
+type Capability struct {
+	ID      string    `json:"jti"`
+	Subject string    `json:"sub,omitempty"`
+	Scope   string    `json:"scope"`
+	IDs     []ID      `json:"ids,omitempty"`
+	MaxSize int64     `json:"max_size,omitempty"`
+	Expires time.Time `json:"exp"`
+}
+
+// CapabilityKey signs or verifies capability tokens.
+type CapabilityKey struct {
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// NewHMACCapabilityKey creates a key that signs and verifies tokens using
+// HMAC-SHA256 with a shared secret of at least 32 bytes.
+func NewHMACCapabilityKey(secret []byte) (*CapabilityKey, error) {
+	if len(secret) < minCapabilitySecret {
+		return nil, fmt.Errorf("capability secret must be at least %d bytes", minCapabilitySecret)
+	}
+	return &CapabilityKey{secret: secret}, nil
+}
+
+// NewEd25519CapabilityKey creates a key that signs and verifies tokens using
+// an Ed25519 private key.
+func NewEd25519CapabilityKey(private ed25519.PrivateKey) *CapabilityKey {
+	return &CapabilityKey{private: private, public: private.Public().(ed25519.PublicKey)}
+}
+
+// NewEd25519VerifyKey creates a key that only verifies tokens, which is all
+// the server needs.
+func NewEd25519VerifyKey(public ed25519.PublicKey) *CapabilityKey {
+	return &CapabilityKey{public: public}
+}
+
+// LoadCapabilityKey loads a capability key from a file.  A PEM encoded
+// Ed25519 public key gives a key that only verifies tokens, a PEM encoded
+// PKCS #8 Ed25519 private key gives a key that signs and verifies tokens, and
+// anything else is used as the HMAC secret.
+func LoadCapabilityKey(filename string) (*CapabilityKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return NewHMACCapabilityKey(bytes.TrimSpace(data))
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("[%s] is not an Ed25519 public key", filename)
+		}
+		return NewEd25519VerifyKey(public), nil
+
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("[%s] is not an Ed25519 private key", filename)
+		}
+		return NewEd25519CapabilityKey(private), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported PEM block [%s] in [%s]", block.Type, filename)
+	}
+}
+
+func (k *CapabilityKey) algorithm() string {
+	if k.secret != nil {
+		return capabilityHMAC
+	}
+	return capabilityEd25519
+}
+
+// MintCapability creates a capability token signed by key.
+func MintCapability(key *CapabilityKey, c Capability) (string, error) {
+	if c.Scope != CapabilityUpload && c.Scope != CapabilityDownload {
+		return "", fmt.Errorf("unknown capability scope [%s]", c.Scope)
+	}
+
+	if c.Expires.IsZero() {
+		return "", errors.New("capability must expire")
+	}
+
+	if c.Scope == CapabilityUpload && c.Subject == "" {
+		return "", errors.New("upload capability must have a subject to own the files")
+	}
+
+	if key.secret == nil && key.private == nil {
+		return "", errors.New("key cannot sign capabilities")
+	}
+
+	if c.ID == "" {
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return "", err
+		}
+		c.ID = hex.EncodeToString(id)
+	}
+
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	signed := key.algorithm() + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(key.sign([]byte(signed))), nil
+}
+
+func (k *CapabilityKey) sign(data []byte) []byte {
+	if k.secret != nil {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.private, data)
+}
+
+func (k *CapabilityKey) verify(data []byte, signature []byte) bool {
+	if k.secret != nil {
+		return hmac.Equal(k.sign(data), signature)
+	}
+	return ed25519.Verify(k.public, data, signature)
+}
+
+// VerifyCapability verifies token with any of keys and returns the capability
+// if the token is valid and hasn't expired.
+func VerifyCapability(token string, now time.Time, keys ...*CapabilityKey) (*Capability, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCapability
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCapability
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	valid := slices.ContainsFunc(keys, func(k *CapabilityKey) bool {
+		return k.algorithm() == parts[0] && k.verify(signed, signature)
+	})
+	if !valid {
+		return nil, ErrInvalidCapability
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidCapability
+	}
+
+	var c Capability
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCapability, err)
+	}
+
+	if !now.Before(c.Expires) {
+		return nil, ErrCapabilityExpired
+	}
+	return &c, nil
+}
+
+// capabilityAuthenticator authenticates calls carrying a capability token.
+type capabilityAuthenticator struct {
+	keys []*CapabilityKey
+}
+
+// NewCapabilityAuthenticator authenticates calls with a capability token in
+// the x-capability header, signed by any of keys.  The principal of the call
+// is the subject of the token and the service restricts what the call can do
+// to what the token allows.
+func NewCapabilityAuthenticator(keys ...*CapabilityKey) Authenticator {
+	return &capabilityAuthenticator{keys: keys}
+}
+
+func (a *capabilityAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	values := md.Get(capabilityHeader)
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	c, err := VerifyCapability(values[0], time.Now(), a.keys...)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{Name: c.Subject, Method: AuthCapability, Capability: c}, nil
+}
+
+// capabilityFromContext returns the capability of the call, or nil if the call
+// wasn't authenticated by a capability.
+func capabilityFromContext(ctx context.Context) *Capability {
+	p := PrincipalFromContext(ctx)
+	if p == nil {
+		return nil
+	}
+	return p.Capability
+}
+
+// capabilityUses keeps track of which upload each upload token was used to
+// create, so a token can't be used for more than one upload.  Entries are
+// kept until the token expires, and saved to filename on every change so
+// they survive a restart.
+type capabilityUses struct {
+	mu       sync.Mutex
+	filename string
+	uses     map[string]capabilityUse
+}
+
+type capabilityUse struct {
+	Upload  ID        `json:"upload,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// newCapabilityUses loads the uses saved in filename, if it exists.
+func newCapabilityUses(filename string) (*capabilityUses, error) {
+	u := &capabilityUses{filename: filename, uses: map[string]capabilityUse{}}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return u, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("path %s: %w", filename, err)
+	}
+
+	err = json.Unmarshal(data, &u.uses)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", filename, err)
+	}
+	return u, nil
+}
+
+// reserve marks c as used.  It fails if c has been used before or if the use
+// can't be saved.
+func (u *capabilityUses) reserve(c *Capability) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	for id, use := range u.uses {
+		if now.After(use.Expires) {
+			delete(u.uses, id)
+		}
+	}
+
+	if _, ok := u.uses[c.ID]; ok {
+		return ErrCapabilityUsed
+	}
+
+	u.uses[c.ID] = capabilityUse{Expires: c.Expires}
+	err := u.save()
+	if err != nil {
+		delete(u.uses, c.ID)
+		return err
+	}
+	return nil
+}
+
+// bind records that c was used to create upload.
+func (u *capabilityUses) bind(c *Capability, upload ID) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.uses[c.ID] = capabilityUse{Upload: upload, Expires: c.Expires}
+	err := u.save()
+	if err != nil {
+		slog.Error("error saving capability use", "upload", upload, "err", err)
+	}
+}
+
+// release makes c usable again if creating the upload failed.
+func (u *capabilityUses) release(c *Capability) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.uses, c.ID)
+	err := u.save()
+	if err != nil {
+		slog.Error("error saving capability uses", "err", err)
+	}
+}
+
+// save writes the uses to the file.  Must be called with the mutex held.
+func (u *capabilityUses) save() error {
+	data, err := json.Marshal(u.uses)
+	if err != nil {
+		return err
+	}
+
+	tmp := u.filename + ".tmp"
+	err = os.WriteFile(tmp, data, filePermissions)
+	if err != nil {
+		return fmt.Errorf("path %s: %w", u.filename, err)
+	}
+
+	err = os.Rename(tmp, u.filename)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("path %s: %w", u.filename, err)
+	}
+	return nil
+}
+
+// upload returns the upload c was used to create.
+func (u *capabilityUses) upload(c *Capability) ID {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.uses[c.ID].Upload
+}
+
+// checkCapability restricts calls authenticated by a capability to what the
+// capability allows.  Uploads in progress are only accessible with the token
+// that created them.
+func (s *Service) checkCapability(c *Capability, action Action, id ID) error {
+	switch action {
+	case ActionRead:
+		if c.Scope == CapabilityDownload && slices.Contains(c.IDs, id) {
+			return nil
+		}
+
+	case ActionWrite:
+		if c.Scope == CapabilityUpload && id != "" && s.capabilityUses.upload(c) == id {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: capability does not allow %s access to [%s]", ErrPermissionDenied, action, id)
+}
+
+// checkCreateCapability checks that c allows creating an upload of size
+// bytes and reserves it.  The caller must either bind or release the
+// capability.
+func (s *Service) checkCreateCapability(c *Capability, size int64, base string) error {
+	if c.Scope != CapabilityUpload {
+		return fmt.Errorf("%w: capability does not allow uploads", ErrPermissionDenied)
+	}
+
+	// the files would have no owner, and so be readable by everyone
+	if c.Subject == "" {
+		return fmt.Errorf("%w: upload capability has no subject", ErrPermissionDenied)
+	}
+
+	if c.MaxSize > 0 && size > c.MaxSize {
+		return fmt.Errorf("%w: capability allows uploads of up to %d bytes", ErrPermissionDenied, c.MaxSize)
+	}
+
+	if base != "" {
+		return fmt.Errorf("%w: capability does not allow delta uploads", ErrPermissionDenied)
+	}
+
+	return s.capabilityUses.reserve(c)
+}
@@ -0,0 +1,225 @@
+package transfer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func newTestCapabilityKey(t *testing.T) *CapabilityKey {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+
+	key, err := NewHMACCapabilityKey(secret)
+	require.NoError(t, err)
+	return key
+}
+
+func TestCapabilityTokens(t *testing.T) {
+	_, err := NewHMACCapabilityKey([]byte("too short"))
+	require.Error(t, err)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	hmacKey := newTestCapabilityKey(t)
+	edKey := NewEd25519CapabilityKey(private)
+	verifyKey := NewEd25519VerifyKey(public)
+
+	c := Capability{
+		Subject: "device-1",
+		Scope:   CapabilityDownload,
+		IDs:     []ID{"abc", "def"},
+		Expires: time.Now().Add(10 * time.Minute),
+	}
+
+	for _, key := range []*CapabilityKey{hmacKey, edKey} {
+		token, err := MintCapability(key, c)
+		require.NoError(t, err)
+
+		got, err := VerifyCapability(token, time.Now(), newTestCapabilityKey(t), verifyKey, hmacKey)
+		require.NoError(t, err)
+		require.Equal(t, c.Subject, got.Subject)
+		require.Equal(t, c.IDs, got.IDs)
+		require.NotEmpty(t, got.ID)
+
+		// expired
+		_, err = VerifyCapability(token, c.Expires, verifyKey, hmacKey)
+		require.ErrorIs(t, err, ErrCapabilityExpired)
+
+		// wrong key
+		_, err = VerifyCapability(token, time.Now(), newTestCapabilityKey(t))
+		require.ErrorIs(t, err, ErrInvalidCapability)
+
+		// tampered payload
+		parts := strings.Split(token, ".")
+		other, err := MintCapability(key, Capability{Scope: CapabilityDownload, IDs: []ID{"xyz"}, Expires: c.Expires})
+		require.NoError(t, err)
+		parts[1] = strings.Split(other, ".")[1]
+		_, err = VerifyCapability(strings.Join(parts, "."), time.Now(), verifyKey, hmacKey)
+		require.ErrorIs(t, err, ErrInvalidCapability)
+	}
+
+	_, err = MintCapability(verifyKey, c)
+	require.Error(t, err)
+
+	_, err = MintCapability(hmacKey, Capability{Scope: "everything", Expires: c.Expires})
+	require.Error(t, err)
+
+	_, err = MintCapability(hmacKey, Capability{Scope: CapabilityUpload})
+	require.Error(t, err)
+
+	// upload tokens need a subject to own the files
+	_, err = MintCapability(hmacKey, Capability{Scope: CapabilityUpload, Expires: c.Expires})
+	require.Error(t, err)
+}
+
+func TestCapabilityService(t *testing.T) {
+	key := newTestCapabilityKey(t)
+	auth := &Authentication{Authenticators: []Authenticator{NewCapabilityAuthenticator(key)}}
+
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		Authorizer:         OwnerAuthorizer{},
+	}, auth.ServerOptions()...)
+
+	mint := func(c Capability) string {
+		c.Expires = time.Now().Add(10 * time.Minute)
+		token, err := MintCapability(key, c)
+		require.NoError(t, err)
+		return token
+	}
+
+	newClient := func(config ClientConfig) *Client {
+		config.ServerAddr = addr
+		client, err := CreateClient(config)
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+
+	filename := randomFile(t, 4*minBlockSize)
+	uploadToken := mint(Capability{Subject: "device-1", Scope: CapabilityUpload, MaxSize: 4 * minBlockSize})
+
+	// the token can be used for creating an upload and resuming it
+	partial := newClient(ClientConfig{Capability: uploadToken, QuitAfter: 2})
+	id, err := partial.Upload(filename)
+	require.NoError(t, err)
+
+	uploader := newClient(ClientConfig{Capability: uploadToken})
+	resumedID, err := uploader.Upload(filename)
+	require.NoError(t, err)
+	require.Equal(t, id, resumedID)
+
+	info, err := service.fileStore.ReadInfo(ID(id))
+	require.NoError(t, err)
+	require.Equal(t, "device-1", info.Owner)
+
+	// but only for one upload
+	_, err = uploader.Upload(randomFile(t, minBlockSize))
+	requireCode(t, codes.PermissionDenied, err)
+
+	// and not for downloading
+	requireCode(t, codes.PermissionDenied, uploader.Download(ID(id), path.Join(t.TempDir(), "upload-token")))
+
+	// size limit
+	limited := newClient(ClientConfig{Capability: mint(Capability{Subject: "device-2", Scope: CapabilityUpload, MaxSize: minBlockSize})})
+	_, err = limited.Upload(filename)
+	requireCode(t, codes.PermissionDenied, err)
+
+	// download tokens only allow downloading the listed files
+	downloader := newClient(ClientConfig{Capability: mint(Capability{Scope: CapabilityDownload, IDs: []ID{ID(id)}})})
+	require.NoError(t, downloader.Download(ID(id), path.Join(t.TempDir(), "download-token")))
+
+	other := newClient(ClientConfig{Capability: mint(Capability{Scope: CapabilityDownload, IDs: []ID{"other"}})})
+	requireCode(t, codes.PermissionDenied, other.Download(ID(id), path.Join(t.TempDir(), "other-token")))
+
+	_, err = downloader.Upload(randomFile(t, minBlockSize))
+	requireCode(t, codes.PermissionDenied, err)
+
+	// expired and forged tokens are refused
+	expired, err := MintCapability(key, Capability{Scope: CapabilityDownload, IDs: []ID{ID(id)}, Expires: time.Now().Add(-time.Second)})
+	require.NoError(t, err)
+	requireCode(t, codes.Unauthenticated, newClient(ClientConfig{Capability: expired}).Download(ID(id), path.Join(t.TempDir(), "expired")))
+
+	forged, err := MintCapability(newTestCapabilityKey(t), Capability{Scope: CapabilityDownload, IDs: []ID{ID(id)}, Expires: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	requireCode(t, codes.Unauthenticated, newClient(ClientConfig{Capability: forged}).Download(ID(id), path.Join(t.TempDir(), "forged")))
+
+	// upload tokens without a subject, which MintCapability won't create,
+	// would give files without an owner
+	payload, err := json.Marshal(Capability{ID: "no-subject", Scope: CapabilityUpload, Expires: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	signed := key.algorithm() + "." + base64.RawURLEncoding.EncodeToString(payload)
+	anonymous := signed + "." + base64.RawURLEncoding.EncodeToString(key.sign([]byte(signed)))
+	_, err = newClient(ClientConfig{Capability: anonymous}).Upload(randomFile(t, minBlockSize))
+	requireCode(t, codes.PermissionDenied, err)
+}
+
+func TestCapabilityUsesSaved(t *testing.T) {
+	filename := path.Join(t.TempDir(), capabilityUsesFile)
+	c := &Capability{ID: "token", Subject: "device-1", Scope: CapabilityUpload, Expires: time.Now().Add(time.Minute)}
+
+	uses, err := newCapabilityUses(filename)
+	require.NoError(t, err)
+	require.NoError(t, uses.reserve(c))
+	uses.bind(c, "upload")
+
+	// the token stays used after a restart
+	restarted, err := newCapabilityUses(filename)
+	require.NoError(t, err)
+	require.ErrorIs(t, restarted.reserve(c), ErrCapabilityUsed)
+	require.Equal(t, ID("upload"), restarted.upload(c))
+
+	restarted.release(c)
+	restarted, err = newCapabilityUses(filename)
+	require.NoError(t, err)
+	require.NoError(t, restarted.reserve(c))
+}
+
+func TestLoadCapabilityKey(t *testing.T) {
+	dir := t.TempDir()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+
+	publicFile := path.Join(dir, "public.pem")
+	privateFile := path.Join(dir, "private.pem")
+	secretFile := path.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0600))
+	require.NoError(t, os.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600))
+	require.NoError(t, os.WriteFile(secretFile, []byte("0123456789abcdef0123456789abcdef\n"), 0600))
+
+	signer, err := LoadCapabilityKey(privateFile)
+	require.NoError(t, err)
+	verifier, err := LoadCapabilityKey(publicFile)
+	require.NoError(t, err)
+	secret, err := LoadCapabilityKey(secretFile)
+	require.NoError(t, err)
+
+	c := Capability{Subject: "device-1", Scope: CapabilityUpload, Expires: time.Now().Add(time.Minute)}
+	for _, key := range []*CapabilityKey{signer, secret} {
+		token, err := MintCapability(key, c)
+		require.NoError(t, err)
+		_, err = VerifyCapability(token, time.Now(), verifier, secret)
+		require.NoError(t, err)
+	}
+}
@@ -13,8 +13,12 @@ func checksumFile(filename string) ([]byte, error) {
 	}
 	defer f.Close()
 
+	return checksumReader(f)
+}
+
+func checksumReader(r io.Reader) ([]byte, error) {
 	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+	if _, err := io.Copy(h, r); err != nil {
 		return nil, err
 	}
 	return h.Sum(nil), nil
@@ -2,6 +2,7 @@ package transfer
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/sha256"
 	"encoding/json"
@@ -10,59 +11,212 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"time"
 
 	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
 // Client for the transfer service.
 type Client struct {
-	config ClientConfig
-	conn   *grpc.ClientConn
-	client tv1.TransferServiceClient
+	config    ClientConfig
+	conn      *grpc.ClientConn
+	client    tv1.TransferServiceClient
+	tracer    trace.Tracer
+	blocks    blockBounds
+	bandwidth *clientBandwidth
 }
 
 // ClientConfig is the configuration parameters for the client.
 type ClientConfig struct {
 	ServerAddr string
 	QuitAfter  int
+
+	// UploadWindow is the maximum number of bytes we send before we wait for
+	// the server to acknowledge them.  If zero it defaults to
+	// defaultUploadWindowBlocks blocks.
+	UploadWindow int64
+
+	// UploadProgress, if set, is called every time the server acknowledges
+	// a block.
+	UploadProgress ProgressFunc
+
+	// Compression is the compression we ask the server to use for uploads
+	// and downloads.  Blocks that don't compress are sent uncompressed.
+	Compression tv1.Compression
+
+	// EncryptionKeys turns on end to end encryption.  Uploads are encrypted
+	// with the first key before they leave the client, and encrypted files
+	// are decrypted on download with whichever key wrapped their data key.
+	EncryptionKeys []*MasterKey
+
+	// EncryptionBlockSize is the block size used for encrypted uploads.  Each
+	// block is an encrypted chunk, so the block size is chosen by the client
+	// rather than the server.  If zero it defaults to defaultBlockSize.
+	EncryptionBlockSize int64
+
+	// Bandwidth limits the bytes per second of uploads and downloads, and
+	// can vary with the time of day.  Transfers that are paused by the
+	// schedule resume where they left off once the pause is over.  The zero
+	// value means no limit.
+	Bandwidth BandwidthSchedule
+
+	// MaxMsgSize is the largest gRPC message the client sends and receives.
+	// Blocks are kept small enough to fit.  If zero it defaults to the gRPC
+	// default of 4 MiB.  It should match the max message sizes of the
+	// server.
+	MaxMsgSize int
+
+	// TLS turns on TLS if set.  Otherwise the connection is unencrypted.
+	TLS *TLSConfig
+
+	// Token is a bearer token sent with every call.
+	Token string
+
+	// APIKey is an API key sent with every call.
+	APIKey string
+
+	// Capability is a capability token sent with every call.
+	Capability string
+
+	// TracerProvider is used for tracing uploads and downloads.  If nil the
+	// global OpenTelemetry tracer provider is used.
+	TracerProvider trace.TracerProvider
 }
 
+// ProgressFunc is called with the acknowledged offset of an upload.
+type ProgressFunc func(id string, offset int64, size int64)
+
 // uploadState is the upload state tracked throughout the upload and partially
-// saved to disk in order to be able to resume uploads.
+// saved to disk in order to be able to resume uploads.  The saved offset is
+// the last offset acknowledged by the server, which is where we resume.  The
+// FileSize is the size of the data we upload, which for encrypted uploads is
+// the size of the ciphertext.
 type uploadState struct {
-	ID        string `json:"id"`
-	FileSize  int64  `json:"-"`
-	Offset    int64  `json:"-"`
-	BlockSize int64  `json:"-"`
+	ID           string          `json:"id"`
+	FileSize     int64           `json:"-"`
+	FileSHA256   []byte          `json:"sha256,omitempty"`
+	Offset       int64           `json:"offset"`
+	BlockSize    int64           `json:"blocksize"`
+	MinBlockSize int64           `json:"minblocksize,omitempty"`
+	MaxBlockSize int64           `json:"maxblocksize,omitempty"`
+	Compression  tv1.Compression `json:"compression"`
+	Encryption   *e2eHeader      `json:"encryption,omitempty"`
+	Complete     bool            `json:"-"`
 }
 
 const (
-	stateFileSuffix      = "upload"
-	stateFilePermissions = 0600
+	stateFileSuffix           = "upload"
+	stateFilePermissions      = 0600
+	defaultUploadWindowBlocks = 4
 )
 
 // CreateClient creates a new transfer client.
 func CreateClient(c ClientConfig) (*Client, error) {
-	conn, err := grpc.NewClient(c.ServerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	blocks, err := newBlockBounds(c.MaxMsgSize, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Bandwidth.Validate()
+	if err != nil {
+		return nil, err
+	}
+	msgSize := cmp.Or(c.MaxMsgSize, defaultMaxMsgSize)
+
+	creds := insecure.NewCredentials()
+	if c.TLS != nil {
+		creds, err = ClientCredentials(*c.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithChainUnaryInterceptor(tracingUnaryInterceptor),
+		grpc.WithChainStreamInterceptor(tracingStreamInterceptor),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(msgSize), grpc.MaxCallSendMsgSize(msgSize)),
+	}
+	if c.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(callCredentials{header: authorizationHeader, value: "Bearer " + c.Token}))
+	}
+
+	if c.APIKey != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(callCredentials{header: apiKeyHeader, value: c.APIKey}))
+	}
+
+	if c.Capability != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(callCredentials{header: capabilityHeader, value: c.Capability}))
+	}
+
+	conn, err := grpc.NewClient(c.ServerAddr, opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Client{
-		client: tv1.NewTransferServiceClient(conn),
-		conn:   conn,
-		config: c,
+		client:    tv1.NewTransferServiceClient(conn),
+		conn:      conn,
+		config:    c,
+		tracer:    newTracer(c.TracerProvider),
+		blocks:    blocks,
+		bandwidth: &clientBandwidth{schedule: c.Bandwidth},
 	}, nil
 }
 
+// Close the connection to the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
 // Upload a file to the transfer server.
 func (c *Client) Upload(filename string) (string, error) {
-	state, err := c.createOrResumeUpload(filename, []byte{0})
+	return c.upload(filename, "")
+}
+
+// UploadDelta uploads filename as a new version of the file base on the
+// server.  Only the blocks that differ from base are sent.
+func (c *Client) UploadDelta(filename string, base ID) (string, error) {
+	return c.upload(filename, base)
+}
+
+func (c *Client) upload(filename string, base ID) (_ string, err error) {
+	ctx, span := c.startSpan(context.Background(), "Upload", attrBaseID.String(base.String()))
+	defer func() { endSpan(span, err) }()
+
+	// uploads that are paused by the bandwidth schedule are resumed from the
+	// state file once the pause is over
+	for {
+		err = c.bandwidth.resumed(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		id, err := c.uploadStream(ctx, filename, base)
+		var paused *pausedError
+		if !errors.As(err, &paused) {
+			return id, err
+		}
+		slog.Info("upload paused", "filename", filename, "id", id, "until", paused.until)
+	}
+}
+
+// uploadStream uploads what is left of filename in a single upload stream.
+func (c *Client) uploadStream(ctx context.Context, filename string, base ID) (string, error) {
+	state, err := c.createOrResumeUpload(ctx, filename, []byte{0}, base)
 	if err != nil {
 		return "", err
 	}
+	trace.SpanFromContext(ctx).SetAttributes(attrID.String(state.ID), attrSize.Int64(state.FileSize), attrOffset.Int64(state.Offset))
+
+	// the server already had the file
+	if state.Complete {
+		slog.Info("upload deduplicated by server", "filename", filename, "id", state.ID)
+		return state.ID, nil
+	}
 
 	in, err := os.Open(filename)
 	if err != nil {
@@ -70,69 +224,239 @@ func (c *Client) Upload(filename string) (string, error) {
 	}
 	defer in.Close()
 
-	offset, err := in.Seek(state.Offset, io.SeekStart)
-	if err != nil {
-		return "", fmt.Errorf("failed to seek to correct offset: %w", err)
+	// encrypted uploads send the ciphertext of the file
+	var src io.ReaderAt = in
+	if state.Encryption != nil {
+		e2e, err := openE2ECipher(*state.Encryption, c.config.EncryptionKeys)
+		if err != nil {
+			return "", fmt.Errorf("error setting up encryption: %w", err)
+		}
+		src = &e2eReader{cipher: e2e, r: in}
 	}
 
-	if offset != state.Offset {
-		// this shouldn't happen unless something is really wrong
-		return "", fmt.Errorf("offset mismatch, state=%d file=%d", state.Offset, offset)
+	// delta uploads send the blocks the server doesn't have, other uploads
+	// everything from the offset
+	var offsets []int64
+	if base != "" {
+		offsets, err = c.planDelta(ctx, in, state)
+		if err != nil {
+			return "", err
+		}
 	}
+	sizer := c.newBlockSizer(state, base)
+
+	// create upload stream, which is cancelled if we stop before the end
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// create upload stream
-	stream, err := c.client.Upload(context.Background())
+	stream, err := c.client.UploadV2(ctx)
 	if err != nil {
 		return "", fmt.Errorf("error connecting to server [%s]: %w", c.config.ServerAddr, err)
 	}
 
-	buffer := make([]byte, state.BlockSize)
+	var sent int64
+	written := state.Offset
+	next := state.Offset
+	buffer := make([]byte, sizer.limit)
 	for i := 0; ; i++ {
-		n, err := in.Read(buffer)
-		if err == io.EOF {
+		offset := next
+		if base != "" {
+			if i == len(offsets) {
+				break
+			}
+			offset = offsets[i]
+		} else if offset >= state.FileSize {
 			break
 		}
 
+		n := min(sizer.size, state.FileSize-offset)
+		next = offset + n
+
+		_, err := src.ReadAt(buffer[:n], offset)
+		if err != nil {
+			return "", fmt.Errorf("error reading [%s]: %w", filename, err)
+		}
+
 		checksum := sha256.Sum256(buffer[:n])
-		err = stream.Send(&tv1.UploadRequest{
-			Id:     state.ID,
-			Offset: state.Offset,
-			Data:   buffer[:n],
-			Sha256: checksum[:],
+
+		data, compressed, err := compressBlock(state.Compression, buffer[:n])
+		if err != nil {
+			return "", fmt.Errorf("error compressing block: %w", err)
+		}
+
+		err = c.bandwidth.wait(ctx, len(data))
+		var paused *pausedError
+		if errors.As(err, &paused) {
+			// wait for what we have sent to be acknowledged so we can
+			// resume from there
+			for written < sent {
+				ack, err := c.receiveAck(stream, &state, filename)
+				if err != nil {
+					return "", err
+				}
+				written = ack.WrittenOffset
+			}
+			return state.ID, err
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		err = stream.Send(&tv1.UploadV2Request{
+			Id:         state.ID,
+			Offset:     offset,
+			Data:       data,
+			Sha256:     checksum[:],
+			Compressed: compressed,
 		})
 		if err != nil {
 			return "", fmt.Errorf("upload failed: %w", err)
 		}
 
-		state.Offset += int64(n)
+		sent = offset + n
+		sizer.sent(sent, time.Now())
 
 		// this is just for testing purposes
 		if c.config.QuitAfter > 0 && i == c.config.QuitAfter-1 {
 			slog.Info("quitting after QuitAfter blocks", "quitAfter", c.config.QuitAfter)
 			return state.ID, nil
 		}
-		slog.Debug("->", "id", state.ID, "block", i, "offset", state.Offset)
+		slog.Debug("->", "id", state.ID, "block", i, "offset", sent)
+
+		// wait for acknowledgements if we have too much data in flight
+		for sent-written > c.uploadWindow(sizer.size) {
+			ack, err := c.receiveAck(stream, &state, filename)
+			if err != nil {
+				return "", err
+			}
+			written = ack.WrittenOffset
+			sizer.setMax(ack.MaxBlocksize)
+			sizer.acked(written, time.Now())
+		}
 	}
 
-	// remove the state file since we're done uploading, but do this after we have
-	// closed the stream and received the result.  If there is an error there isn't
-	// anything sensible we can do about it.
-	defer func() {
-		stateFilename := c.stateFilename(filename)
-		err := os.Remove(stateFilename)
+	// if there was nothing left to send we still have to tell the server which
+	// upload the stream belongs to.  By now the server has everything.
+	if sent == 0 {
+		empty := sha256.Sum256(nil)
+		err = stream.Send(&tv1.UploadV2Request{Id: state.ID, Offset: state.FileSize, Sha256: empty[:]})
 		if err != nil {
-			slog.Error("error removing state file", "stateFilename", stateFilename, "err", err)
+			return "", fmt.Errorf("upload failed: %w", err)
 		}
-	}()
+	}
 
-	_, err = stream.CloseAndRecv()
+	err = stream.CloseSend()
 	if err != nil {
-		return "", fmt.Errorf("error closing connection: %w", err)
+		return "", fmt.Errorf("error closing upload stream: %w", err)
+	}
+
+	for {
+		ack, err := c.receiveAck(stream, &state, filename)
+		if err != nil {
+			return "", err
+		}
+
+		if ack.Complete {
+			break
+		}
+	}
+
+	// remove the state file since we're done uploading.  If there is an error
+	// there isn't anything sensible we can do about it.
+	stateFilename := c.stateFilename(filename)
+	err = os.Remove(stateFilename)
+	if err != nil {
+		slog.Error("error removing state file", "stateFilename", stateFilename, "err", err)
 	}
 
 	return state.ID, nil
 }
 
+// uploadWindow returns how many bytes we send before we wait for the server
+// to acknowledge them, when sending blocks of blockSize bytes.
+func (c *Client) uploadWindow(blockSize int64) int64 {
+	if c.config.UploadWindow > 0 {
+		return c.config.UploadWindow
+	}
+	return defaultUploadWindowBlocks * blockSize
+}
+
+// newBlockSizer returns the block sizer for an upload.  Delta uploads keep the
+// block size they were planned with and encrypted uploads the size of their
+// chunks, so only the block size of other uploads adapts to the link, within
+// the bounds of both the server and the client.
+func (c *Client) newBlockSizer(state uploadState, base ID) *blockSizer {
+	bounds := blockBounds{min: state.BlockSize, max: state.BlockSize}
+	if base == "" && state.Encryption == nil && state.MaxBlockSize > 0 {
+		bounds.max = min(state.MaxBlockSize, c.blocks.max)
+		bounds.min = min(max(state.MinBlockSize, 1), bounds.max)
+	}
+	return newBlockSizer(state.BlockSize, bounds)
+}
+
+// planDelta sends the block checksums of the file to the server and returns
+// the offsets of the blocks the server doesn't have.
+func (c *Client) planDelta(ctx context.Context, in io.ReadSeeker, state uploadState) ([]int64, error) {
+	_, err := in.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seek to start of file: %w", err)
+	}
+
+	hashes, err := blockHashes(in, state.BlockSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum blocks: %w", err)
+	}
+
+	resp, err := c.client.PlanDelta(ctx, &tv1.PlanDeltaRequest{
+		Id:          state.ID,
+		Blocksize:   state.BlockSize,
+		BlockSha256: hashes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error planning delta upload: %w", err)
+	}
+
+	var offsets []int64
+	for _, block := range resp.MissingBlocks {
+		offset := block * state.BlockSize
+		if offset >= state.Offset {
+			offsets = append(offsets, offset)
+		}
+	}
+
+	slog.Info("delta upload", "id", state.ID, "blocks", len(hashes), "missing", len(resp.MissingBlocks))
+	return offsets, nil
+}
+
+// receiveAck receives an acknowledgement from the server and records the
+// acknowledged offset in the state file so we can resume from it.
+func (c *Client) receiveAck(stream tv1.TransferService_UploadV2Client, state *uploadState, filename string) (*tv1.UploadV2Response, error) {
+	ack, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("upload stream ended before upload was complete")
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("upload failed: %w", err)
+	}
+
+	if ack.Offset != state.Offset {
+		state.Offset = ack.Offset
+
+		err = c.saveState(*state, filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.config.UploadProgress != nil {
+		c.config.UploadProgress(state.ID, state.Offset, state.FileSize)
+	}
+
+	return ack, nil
+}
+
 // Download file by id and place it in file named dstFile.  If the destination file exists
 // an error is returned.
 func (c *Client) Download(id ID, dstFile string) error {
@@ -144,14 +468,160 @@ func (c *Client) Download(id ID, dstFile string) error {
 	}
 	defer out.Close()
 
-	stream, err := c.client.Download(context.Background(), &tv1.DownloadRequest{
-		Id:     id.String(),
-		Offset: 0,
-	})
+	return c.tracedDownload(id, out, 0, 0)
+}
+
+// ResumeDownload downloads the rest of file id into dstFile, continuing from
+// where an interrupted download left off.  If dstFile doesn't exist the whole
+// file is downloaded.
+func (c *Client) ResumeDownload(id ID, dstFile string) error {
+	out, err := os.OpenFile(dstFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open output file [%s]: %w", dstFile, err)
+	}
+	defer out.Close()
+
+	info, err := out.Stat()
+	if err != nil {
+		return fmt.Errorf("file error for [%s]: %w", dstFile, err)
+	}
+
+	slog.Info("resuming download", "id", id, "filename", dstFile, "offset", info.Size())
+	return c.tracedDownload(id, out, info.Size(), 0)
+}
+
+// DownloadRange writes length bytes of file id starting at offset to w.  If
+// length is zero everything from offset to the end of the file is written.
+func (c *Client) DownloadRange(id ID, w io.Writer, offset int64, length int64) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("offset and length cannot be negative")
+	}
+	return c.tracedDownload(id, w, offset, length)
+}
+
+// Stat returns information about the finished file id.
+func (c *Client) Stat(id ID) (*tv1.StatResponse, error) {
+	return c.client.Stat(context.Background(), &tv1.StatRequest{Id: id.String()})
+}
+
+// WaitForProcessing polls the server every interval until it is done
+// processing file id and returns the final status.  If processing failed the
+// status is returned along with an error wrapping ErrProcessingFailed.
+func (c *Client) WaitForProcessing(ctx context.Context, id ID, interval time.Duration) (*tv1.StatResponse, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		stat, err := c.client.Stat(ctx, &tv1.StatRequest{Id: id.String()})
+		if err != nil {
+			return nil, err
+		}
+
+		switch stat.ProcessingState {
+		case tv1.ProcessingState_PROCESSING_STATE_PENDING, tv1.ProcessingState_PROCESSING_STATE_RUNNING:
+		case tv1.ProcessingState_PROCESSING_STATE_FAILED:
+			return stat, fmt.Errorf("%w: step [%s]: %s", ErrProcessingFailed, stat.ProcessingStep, stat.ProcessingError)
+		default:
+			return stat, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tracedDownload is download in a span of its own.
+func (c *Client) tracedDownload(id ID, w io.Writer, offset int64, length int64) error {
+	ctx, span := c.startSpan(context.Background(), "Download",
+		attrID.String(id.String()), attrOffset.Int64(offset), attrLength.Int64(length))
+
+	err := c.download(ctx, id, w, offset, length)
+	endSpan(span, err)
+	return err
+}
+
+// download writes length bytes of file id from offset to w, decrypting the
+// file if it was encrypted by the client.
+func (c *Client) download(ctx context.Context, id ID, w io.Writer, offset int64, length int64) error {
+	// we only need to know if the file is encrypted if we are able to decrypt it
+	if len(c.config.EncryptionKeys) == 0 {
+		return c.downloadBlocks(ctx, id, w, offset, length)
+	}
+
+	stat, err := c.client.Stat(ctx, &tv1.StatRequest{Id: id.String()})
 	if err != nil {
 		return err
 	}
 
+	header := parseClientMetadata(stat.Metadata)
+	if header == nil {
+		return c.downloadBlocks(ctx, id, w, offset, length)
+	}
+
+	e2e, err := openE2ECipher(*header, c.config.EncryptionKeys)
+	if err != nil {
+		return fmt.Errorf("error setting up decryption: %w", err)
+	}
+
+	decrypter, cipherOffset, cipherLength := e2e.newDecrypter(w, offset, length)
+	if cipherLength == 0 {
+		return nil
+	}
+
+	err = c.downloadBlocks(ctx, id, decrypter, cipherOffset, cipherLength)
+	if err != nil {
+		return err
+	}
+	return decrypter.Close()
+}
+
+// downloadBlocks downloads length bytes from offset as stored on the server
+// and writes them to w.  Downloads that are paused by the bandwidth schedule
+// continue from where they stopped once the pause is over.
+func (c *Client) downloadBlocks(ctx context.Context, id ID, w io.Writer, offset int64, length int64) error {
+	for {
+		err := c.bandwidth.resumed(ctx)
+		if err != nil {
+			return err
+		}
+
+		n, err := c.downloadStream(ctx, id, w, offset, length)
+		var paused *pausedError
+		if !errors.As(err, &paused) {
+			return err
+		}
+		slog.Info("download paused", "id", id, "offset", offset+n, "until", paused.until)
+
+		// the block that was paused wasn't written, so there is always
+		// something left to download
+		offset += n
+		if length > 0 {
+			length -= n
+		}
+	}
+}
+
+// downloadStream downloads length bytes from offset in a single download
+// stream and returns the number of bytes written to w.
+func (c *Client) downloadStream(ctx context.Context, id ID, w io.Writer, offset int64, length int64) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.client.Download(ctx, &tv1.DownloadRequest{
+		Id:                 id.String(),
+		Offset:             offset,
+		Length:             length,
+		Compression:        c.config.Compression,
+		PreferredBlocksize: c.blocks.clamp(0),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
 	for {
 		res, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
@@ -159,23 +629,50 @@ func (c *Client) Download(id ID, dstFile string) error {
 		}
 
 		if err != nil {
-			return err
+			return written, err
 		}
 
-		checksum := sha256.Sum256(res.Data)
+		err = c.bandwidth.wait(ctx, len(res.Data))
+		if err != nil {
+			return written, err
+		}
+
+		data := res.Data
+		if res.Compressed {
+			data, err = decompressBlock(c.config.Compression, data, c.blocks.max)
+			if err != nil {
+				return written, fmt.Errorf("error decompressing block: %w", err)
+			}
+		}
+
+		checksum := sha256.Sum256(data)
 		if !bytes.Equal(checksum[:], res.Sha256) {
-			return fmt.Errorf("checsum verification failed")
+			return written, fmt.Errorf("checsum verification failed")
 		}
 
-		_, err = out.Write(res.Data)
+		_, err = w.Write(data)
 		if err != nil {
-			return err
+			return written, err
 		}
+		written += int64(len(data))
 	}
-	return nil
+	return written, nil
 }
 
-func (c *Client) createOrResumeUpload(filename string, meta []byte) (uploadState, error) {
+func (c *Client) createOrResumeUpload(ctx context.Context, filename string, meta []byte, base ID) (_ uploadState, err error) {
+	stateFilename := c.stateFilename(filename)
+
+	// if there is a state file we resume the upload
+	_, statErr := os.Stat(stateFilename)
+	resume := statErr == nil
+
+	spanName := "CreateUpload"
+	if resume {
+		spanName = "ResumeUpload"
+	}
+	ctx, span := c.startSpan(ctx, spanName)
+	defer func() { endSpan(span, err) }()
+
 	info, err := os.Stat(filename)
 	if err != nil {
 		return uploadState{}, fmt.Errorf("file error for [%s]: %w", filename, err)
@@ -187,12 +684,7 @@ func (c *Client) createOrResumeUpload(filename string, meta []byte) (uploadState
 		return uploadState{}, fmt.Errorf("failed to checksum file: %w", err)
 	}
 
-	stateFilename := c.stateFilename(filename)
-
-	_, err = os.Stat(stateFilename)
-
-	// if err is nil the file exists
-	if err == nil {
+	if resume {
 		slog.Info("resuming upload", "filename", filename)
 
 		data, err := os.ReadFile(stateFilename)
@@ -206,47 +698,143 @@ func (c *Client) createOrResumeUpload(filename string, meta []byte) (uploadState
 			return uploadState{}, fmt.Errorf("unable to parse state file [%s]: %w", stateFilename, err)
 		}
 
-		// now we need to get the offset from the server
+		// resuming with different data would corrupt the upload, and for
+		// encrypted uploads it would reuse nonces.
+		if len(state.FileSHA256) > 0 && !bytes.Equal(state.FileSHA256, checksum) {
+			return uploadState{}, fmt.Errorf("file [%s] has changed since the upload started, remove [%s] to start over", filename, stateFilename)
+		}
+
+		fileSize := info.Size()
+		if state.Encryption != nil {
+			fileSize = state.Encryption.cipherSize()
+		}
+
+		// the server accepts resuming from any offset it has already written, so
+		// if we have the last acknowledged offset we can just continue from there.
+		if state.BlockSize > 0 {
+			slog.Info("->", "filename", filename, "offset", state.Offset)
+			span.SetAttributes(attrID.String(state.ID), attrOffset.Int64(state.Offset))
+
+			return uploadState{
+				ID:           state.ID,
+				Offset:       state.Offset,
+				FileSize:     fileSize,
+				FileSHA256:   state.FileSHA256,
+				BlockSize:    c.blocks.clamp(state.BlockSize),
+				MinBlockSize: state.MinBlockSize,
+				MaxBlockSize: state.MaxBlockSize,
+				Compression:  state.Compression,
+				Encryption:   state.Encryption,
+			}, nil
+		}
+
+		// state files without acknowledged offset need to get the offset from the server
 		slog.Info("getting offset from server")
-		resp, err := c.client.GetOffset(context.Background(), &tv1.GetOffsetRequest{Id: state.ID})
+		resp, err := c.client.GetOffset(ctx, &tv1.GetOffsetRequest{Id: state.ID})
 		if err != nil {
 			return uploadState{}, fmt.Errorf("error getting offset from server: %w", err)
 		}
 		slog.Info("->", "filename", filename, "offset", resp.Offset)
+		span.SetAttributes(attrID.String(state.ID), attrOffset.Int64(resp.Offset))
 
 		return uploadState{
-			ID:        state.ID,
-			Offset:    resp.Offset,
-			FileSize:  info.Size(),
-			BlockSize: clampBlockSize(resp.PreferredBlocksize),
+			ID:           state.ID,
+			Offset:       resp.Offset,
+			FileSize:     fileSize,
+			BlockSize:    c.blocks.clamp(resp.PreferredBlocksize),
+			MinBlockSize: resp.MinBlocksize,
+			MaxBlockSize: resp.MaxBlocksize,
 		}, err
 	}
 
 	// if we are here there was no existing file upload so we need to create
 	// a new upload.
+	req := &tv1.CreateUploadRequest{
+		Size:        info.Size(),
+		Metadata:    meta,
+		FileSha256:  checksum,
+		BaseId:      base.String(),
+		Compression: c.config.Compression,
+	}
 
-	resp, err := c.client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{
-		Size:       info.Size(),
-		Metadata:   meta,
-		FileSha256: checksum,
-	})
+	var encryption *e2eHeader
+	if len(c.config.EncryptionKeys) > 0 {
+		if base != "" {
+			return uploadState{}, fmt.Errorf("delta uploads cannot be encrypted end to end")
+		}
+
+		encryption, err = c.encryptUpload(filename, info.Size(), req)
+		if err != nil {
+			return uploadState{}, err
+		}
+	}
+
+	resp, err := c.client.CreateUpload(ctx, req)
 	if err != nil {
 		return uploadState{}, fmt.Errorf("unable to create new upload: %w", err)
 	}
+	span.SetAttributes(attrID.String(resp.Id), attrSize.Int64(req.Size))
+
+	state := uploadState{
+		ID:           resp.Id,
+		FileSize:     req.Size,
+		FileSHA256:   checksum,
+		Offset:       0,
+		BlockSize:    c.blocks.clamp(resp.PreferredBlocksize),
+		MinBlockSize: resp.MinBlocksize,
+		MaxBlockSize: resp.MaxBlocksize,
+		Compression:  resp.Compression,
+		Encryption:   encryption,
+	}
 
-	// we only need the ID in the saved state so to avoid future confusion
-	// we explicitly only save the ID.
-	err = c.saveState(uploadState{ID: resp.Id}, filename)
+	if encryption != nil {
+		state.BlockSize = encryption.ChunkSize
+	}
+
+	if resp.Complete {
+		state.Offset = state.FileSize
+		state.Complete = true
+		return state, nil
+	}
+
+	err = c.saveState(state, filename)
 	if err != nil {
 		return uploadState{}, err
 	}
 
-	return uploadState{
-		ID:        resp.Id,
-		FileSize:  info.Size(),
-		Offset:    0,
-		BlockSize: clampBlockSize(resp.PreferredBlocksize),
-	}, nil
+	return state, nil
+}
+
+// encryptUpload sets up end to end encryption of filename and updates req to
+// describe the ciphertext we are going to upload.  The ciphertext is
+// compressed poorly, so we don't ask for compression.
+func (c *Client) encryptUpload(filename string, size int64, req *tv1.CreateUploadRequest) (*e2eHeader, error) {
+	e2e, err := newE2ECipher(c.config.EncryptionKeys[0], c.blocks.clamp(c.config.EncryptionBlockSize), size)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up encryption: %w", err)
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file [%s]: %w", filename, err)
+	}
+	defer in.Close()
+
+	checksum, err := e2e.checksum(in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum encrypted file: %w", err)
+	}
+
+	meta, err := json.Marshal(clientMetadata{Encryption: &e2e.header})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize metadata: %w", err)
+	}
+
+	req.Size = e2e.header.cipherSize()
+	req.FileSha256 = checksum
+	req.Metadata = meta
+	req.Compression = tv1.Compression_COMPRESSION_UNSPECIFIED
+	return &e2e.header, nil
 }
 
 func (c *Client) saveState(state uploadState, filename string) error {
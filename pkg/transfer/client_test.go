@@ -0,0 +1,121 @@
+package transfer
+
+import (
+	"crypto/rand"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// startServer starts a transfer service on a random local port and returns
+// the service and its address.
+func startServer(t *testing.T, c Config, opts ...grpc.ServerOption) (*Service, string) {
+	service, err := NewService(c)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer(append(service.ServerOptions(), opts...)...)
+	tv1.RegisterTransferServiceServer(server, service)
+	tv1.RegisterAdminServiceServer(server, service)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return service, listener.Addr().String()
+}
+
+// randomFile creates a file with size bytes of random data.
+func randomFile(t *testing.T, size int) string {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	filename := path.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(filename, data, 0600))
+	return filename
+}
+
+func TestClientUploadDownload(t *testing.T) {
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+	})
+
+	filename := randomFile(t, 7*minBlockSize+123)
+
+	var acked []int64
+	client, err := CreateClient(ClientConfig{
+		ServerAddr: addr,
+		UploadProgress: func(_ string, offset int64, _ int64) {
+			acked = append(acked, offset)
+		},
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id, err := client.Upload(filename)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+	require.NoFileExists(t, filename+"."+stateFileSuffix)
+	require.Len(t, acked, 9)
+	require.Equal(t, int64(7*minBlockSize+123), acked[len(acked)-1])
+
+	dst := path.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.Download(ID(id), dst))
+
+	expect, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, expect, got)
+}
+
+func TestClientResumeUpload(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncPeriodic, SyncOnFinish} {
+		t.Run(mode.String(), func(t *testing.T) {
+			testClientResumeUpload(t, mode)
+		})
+	}
+}
+
+func testClientResumeUpload(t *testing.T, mode SyncMode) {
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		SyncMode:           mode,
+		SyncBytes:          3 * minBlockSize,
+	})
+
+	filename := randomFile(t, 10*minBlockSize)
+
+	// quit prematurely, leaving the state file behind
+	client, err := CreateClient(ClientConfig{ServerAddr: addr, QuitAfter: 6, UploadWindow: 2 * minBlockSize})
+	require.NoError(t, err)
+	id, err := client.Upload(filename)
+	require.NoError(t, err)
+	require.FileExists(t, filename+"."+stateFileSuffix)
+	require.NoError(t, client.Close())
+
+	client, err = CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	resumedID, err := client.Upload(filename)
+	require.NoError(t, err)
+	require.Equal(t, id, resumedID)
+
+	dst := path.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.Download(ID(id), dst))
+
+	expect, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, expect, got)
+}
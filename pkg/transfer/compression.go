@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The zstd encoder and decoder are safe for concurrent use through EncodeAll
+// and DecodeAll so we only need one of each.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecodeAllCapLimit(true))
+)
+
+var compressionNames = map[string]tv1.Compression{
+	"none": tv1.Compression_COMPRESSION_UNSPECIFIED,
+	"gzip": tv1.Compression_COMPRESSION_GZIP,
+	"zstd": tv1.Compression_COMPRESSION_ZSTD,
+}
+
+// ParseCompression parses the name of a compression, which is one of "none",
+// "gzip" and "zstd".
+func ParseCompression(s string) (tv1.Compression, error) {
+	c, ok := compressionNames[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown compression [%s]", s)
+	}
+	return c, nil
+}
+
+// supportedCompression returns c if we support it and no compression if we
+// don't.
+func supportedCompression(c tv1.Compression) tv1.Compression {
+	switch c {
+	case tv1.Compression_COMPRESSION_GZIP, tv1.Compression_COMPRESSION_ZSTD:
+		return c
+	default:
+		return tv1.Compression_COMPRESSION_UNSPECIFIED
+	}
+}
+
+// compressBlock compresses data using c.  If compressing doesn't make the
+// data smaller the data is returned as is and compressed is false.
+func compressBlock(c tv1.Compression, data []byte) (out []byte, compressed bool, err error) {
+	switch c {
+	case tv1.Compression_COMPRESSION_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err = w.Write(data)
+		if err != nil {
+			return nil, false, err
+		}
+
+		err = w.Close()
+		if err != nil {
+			return nil, false, err
+		}
+		out = buf.Bytes()
+
+	case tv1.Compression_COMPRESSION_ZSTD:
+		out = zstdEncoder.EncodeAll(data, nil)
+
+	default:
+		return data, false, nil
+	}
+
+	if len(out) >= len(data) {
+		return data, false, nil
+	}
+	return out, true, nil
+}
+
+// decompressBlock decompresses data that was compressed using c.  The
+// decompressed data may not be larger than limit bytes.
+func decompressBlock(c tv1.Compression, data []byte, limit int64) ([]byte, error) {
+	switch c {
+	case tv1.Compression_COMPRESSION_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		out, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			return nil, err
+		}
+
+		if int64(len(out)) > limit {
+			return nil, fmt.Errorf("decompressed block exceeds %d bytes", limit)
+		}
+		return out, nil
+
+	case tv1.Compression_COMPRESSION_ZSTD:
+		// the decoder doesn't decode more than the capacity of the buffer
+		out, err := zstdDecoder.DecodeAll(data, make([]byte, 0, limit))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing block of at most %d bytes: %w", limit, err)
+		}
+		return out, nil
+
+	default:
+		return nil, fmt.Errorf("block is compressed but no compression was negotiated")
+	}
+}
@@ -0,0 +1,80 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path"
+	"testing"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressBlock(t *testing.T) {
+	compressible := bytes.Repeat([]byte("log line that repeats itself\n"), 1000)
+	incompressible := make([]byte, 1000)
+	_, err := rand.Read(incompressible)
+	require.NoError(t, err)
+
+	for _, name := range []string{"gzip", "zstd"} {
+		c, err := ParseCompression(name)
+		require.NoError(t, err)
+
+		out, compressed, err := compressBlock(c, compressible)
+		require.NoError(t, err)
+		require.True(t, compressed)
+		require.Less(t, len(out), len(compressible))
+
+		back, err := decompressBlock(c, out, int64(len(compressible)))
+		require.NoError(t, err)
+		require.Equal(t, compressible, back)
+
+		// blocks that decompress to more than the limit are rejected
+		_, err = decompressBlock(c, out, int64(len(compressible)-1))
+		require.Error(t, err)
+
+		out, compressed, err = compressBlock(c, incompressible)
+		require.NoError(t, err)
+		require.False(t, compressed)
+		require.Equal(t, incompressible, out)
+	}
+
+	_, err = ParseCompression("lzma")
+	require.Error(t, err)
+
+	_, err = decompressBlock(tv1.Compression_COMPRESSION_UNSPECIFIED, compressible, minBlockSize)
+	require.Error(t, err)
+}
+
+func TestClientCompression(t *testing.T) {
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+	})
+
+	// half compressible and half random data
+	data := bytes.Repeat([]byte("0123456789"), 2*minBlockSize/10)
+	random := make([]byte, 2*minBlockSize)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	data = append(data, random...)
+
+	filename := path.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(filename, data, 0600))
+
+	for _, c := range []tv1.Compression{tv1.Compression_COMPRESSION_GZIP, tv1.Compression_COMPRESSION_ZSTD} {
+		client, err := CreateClient(ClientConfig{ServerAddr: addr, Compression: c})
+		require.NoError(t, err)
+		defer client.Close()
+
+		id, err := client.Upload(filename)
+		require.NoError(t, err)
+
+		dst := path.Join(t.TempDir(), "downloaded")
+		require.NoError(t, client.Download(ID(id), dst))
+		got, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+	}
+}
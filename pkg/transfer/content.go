@@ -0,0 +1,228 @@
+package transfer
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// The content index makes it possible to share the content of identical files
+// between IDs.  Every verified file with a SHA256 checksum is hard linked into
+// the content directory under its checksum, and each ID referring to it has a
+// reference file alongside it:
+//
+//	.content/<sha256>/data
+//	.content/<sha256>/refs/<id>
+//
+// When the last reference is released the content is removed.
+const (
+	contentDir      = ".content"
+	contentDataName = "data"
+	contentRefsDir  = "refs"
+)
+
+// AddContent adds the finished file id with checksum sha to the content
+// index. If the index already holds the same content, the file is replaced by
+// a link to it so the data is only stored once.
+func (f *FileStore) AddContent(id ID, sha []byte) error {
+	src, err := f.Map(id)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir := f.contentPath(sha)
+	data := path.Join(dir, contentDataName)
+
+	err = os.MkdirAll(path.Join(dir, contentRefsDir), dirPermissions)
+	if err != nil {
+		return fmt.Errorf("path %s: %w", dir, err)
+	}
+
+	_, err = os.Stat(data)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		err = os.Link(src, data)
+		if err != nil {
+			return fmt.Errorf("error adding [%s] to content index: %w", id, err)
+		}
+
+	case err == nil:
+		// the same content was uploaded concurrently, so share that unless
+		// one of them is encrypted and the other isn't
+		info, err := f.ReadInfo(id)
+		if err != nil {
+			return err
+		}
+
+		content, err := f.contentInfo(sha)
+		if err != nil || content.Encrypted != info.Encrypted {
+			return nil
+		}
+
+		tmp := src + ".tmp"
+		err = os.Link(data, tmp)
+		if err != nil {
+			return fmt.Errorf("error linking [%s] to content: %w", id, err)
+		}
+
+		err = os.Rename(tmp, src)
+		if err != nil {
+			return fmt.Errorf("error linking [%s] to content: %w", id, err)
+		}
+
+	default:
+		return fmt.Errorf("path %s: %w", data, err)
+	}
+
+	return f.addContentRef(sha, id)
+}
+
+// HasContent returns true if the content index holds a file with checksum
+// sha that is size bytes long.
+func (f *FileStore) HasContent(sha []byte, size int64) bool {
+	_, err := os.Stat(path.Join(f.contentPath(sha), contentDataName))
+	if err != nil {
+		return false
+	}
+
+	info, err := f.contentInfo(sha)
+	return err == nil && info.Size == size
+}
+
+// contentInfo returns the FileInfo of one of the files sharing the content
+// with checksum sha.
+func (f *FileStore) contentInfo(sha []byte) (FileInfo, error) {
+	ids, err := f.contentRefs(sha)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	for _, id := range ids {
+		info, err := f.ReadInfo(id)
+		if err == nil {
+			return info, nil
+		}
+	}
+	return FileInfo{}, fmt.Errorf("no file info for content %x: %w", sha, fs.ErrNotExist)
+}
+
+// ContentRefs returns the IDs of the files sharing the content with checksum
+// sha.
+func (f *FileStore) ContentRefs(sha []byte) ([]ID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.contentRefs(sha)
+}
+
+func (f *FileStore) contentRefs(sha []byte) ([]ID, error) {
+	entries, err := os.ReadDir(path.Join(f.contentPath(sha), contentRefsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]ID, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, ID(entry.Name()))
+	}
+	return ids, nil
+}
+
+// LinkContent creates a finished file id that shares the content with checksum
+// sha and stores info for it.  The content is stored the way it was first
+// stored, so info.Encrypted is set to match.
+func (f *FileStore) LinkContent(sha []byte, id ID, info FileInfo) error {
+	dst, err := f.Map(id)
+	if err != nil {
+		return err
+	}
+
+	// hold the lock from the lookup on so the content can't be released
+	// under our feet
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	content, err := f.contentInfo(sha)
+	if err != nil {
+		return err
+	}
+	info.Encrypted = content.Encrypted
+
+	data := path.Join(f.contentPath(sha), contentDataName)
+
+	err = os.MkdirAll(filepath.Dir(dst), dirPermissions)
+	if err != nil {
+		return fmt.Errorf("path %s: %w", dst, err)
+	}
+
+	err = f.addContentRef(sha, id)
+	if err != nil {
+		return err
+	}
+
+	err = f.writeInfo(dst, info)
+	if err != nil {
+		return err
+	}
+
+	err = os.Link(data, dst)
+	if err != nil {
+		return fmt.Errorf("error linking [%s] to content: %w", id, err)
+	}
+
+	return nil
+}
+
+// releaseContent drops the reference id holds to the content with checksum
+// sha and removes the content if this was the last reference.  Must be called
+// with the mutex held.
+func (f *FileStore) releaseContent(sha []byte, id ID) error {
+	dir := f.contentPath(sha)
+	refs := path.Join(dir, contentRefsDir)
+
+	err := os.Remove(path.Join(refs, id.String()))
+	if errors.Is(err, fs.ErrNotExist) {
+		// the file was never added to the content index
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("error releasing content for [%s]: %w", id, err)
+	}
+
+	empty, err := isDirEmpty(refs)
+	if err != nil || !empty {
+		return err
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return fmt.Errorf("error removing content %s: %w", dir, err)
+	}
+
+	return removeEmptyDirsUpTo(filepath.Dir(dir), f.content)
+}
+
+func (f *FileStore) addContentRef(sha []byte, id ID) error {
+	ref := path.Join(f.contentPath(sha), contentRefsDir, id.String())
+
+	err := os.WriteFile(ref, nil, filePermissions)
+	if err != nil {
+		return fmt.Errorf("error adding content reference for [%s]: %w", id, err)
+	}
+	return nil
+}
+
+// contentPath returns the content directory for checksum sha.  We use the
+// first byte of the checksum as an extra directory level to keep directories
+// reasonably small.
+func (f *FileStore) contentPath(sha []byte) string {
+	name := hex.EncodeToString(sha)
+	return path.Join(f.content, name[:2], name)
+}
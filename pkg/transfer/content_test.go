@@ -0,0 +1,124 @@
+package transfer
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedup(t *testing.T) {
+	incoming := path.Join(t.TempDir(), "incoming")
+	service, addr := startServer(t, Config{
+		IncomingDir:        incoming,
+		PreferredBlockSize: minBlockSize,
+		Dedup:              true,
+	})
+
+	filename := randomFile(t, 3*minBlockSize+1)
+	expect, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id1, err := client.Upload(filename)
+	require.NoError(t, err)
+
+	// the second upload should be complete without sending any data
+	var acks int
+	client2, err := CreateClient(ClientConfig{
+		ServerAddr:     addr,
+		UploadProgress: func(string, int64, int64) { acks++ },
+	})
+	require.NoError(t, err)
+	defer client2.Close()
+
+	id2, err := client2.Upload(filename)
+	require.NoError(t, err)
+	require.NotEqual(t, id1, id2)
+	require.Zero(t, acks)
+	require.NoFileExists(t, filename+"."+stateFileSuffix)
+
+	info, err := service.fileStore.ReadInfo(ID(id2))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(expect)), info.Size)
+
+	// removing the first file must not remove the shared content
+	require.NoError(t, service.fileStore.Remove(ID(id1)))
+
+	dst := path.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.Download(ID(id2), dst))
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, expect, got)
+
+	// removing the last reference removes the content
+	require.NoError(t, service.fileStore.Remove(ID(id2)))
+	require.False(t, service.fileStore.HasContent(info.SHA256, info.Size))
+	empty, err := isDirEmpty(path.Join(incoming, contentDir))
+	require.NoError(t, err)
+	require.True(t, empty)
+}
+
+func TestDedupAuthorization(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		authorizer Authorizer
+	}{
+		{name: "authorizer", authorizer: OwnerAuthorizer{}},
+		{name: "no authorizer"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			auth := &Authentication{
+				Authenticators: []Authenticator{
+					NewBearerTokenAuthenticator(map[string]string{"alice-token": "alice", "bob-token": "bob"}),
+				},
+			}
+
+			service, addr := startServer(t, Config{
+				IncomingDir:        path.Join(t.TempDir(), "incoming"),
+				PreferredBlockSize: minBlockSize,
+				Authorizer:         tc.authorizer,
+				Dedup:              true,
+			}, auth.ServerOptions()...)
+
+			alice, err := CreateClient(ClientConfig{ServerAddr: addr, Token: "alice-token"})
+			require.NoError(t, err)
+			defer alice.Close()
+
+			bob, err := CreateClient(ClientConfig{ServerAddr: addr, Token: "bob-token"})
+			require.NoError(t, err)
+			defer bob.Close()
+
+			id, err := alice.Upload(randomFile(t, 3*minBlockSize))
+			require.NoError(t, err)
+
+			info, err := service.fileStore.ReadInfo(ID(id))
+			require.NoError(t, err)
+
+			// alice can share her own content
+			resp, err := alice.client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: info.Size, FileSha256: info.SHA256})
+			require.NoError(t, err)
+			require.True(t, resp.Complete)
+
+			// bob only knowing the checksum gets a regular upload that he
+			// can't download before sending the data himself
+			resp, err = bob.client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: info.Size, FileSha256: info.SHA256})
+			require.NoError(t, err)
+			require.False(t, resp.Complete)
+
+			err = bob.Download(ID(resp.Id), path.Join(t.TempDir(), "bob"))
+			require.Error(t, err)
+
+			refs, err := service.fileStore.ContentRefs(info.SHA256)
+			require.NoError(t, err)
+			require.Len(t, refs, 2)
+			require.NotContains(t, refs, ID(resp.Id))
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// deltaPlan describes which blocks of a delta upload are identical to the
+// blocks at the same offset in the base file.  The server copies those blocks
+// from the base file and the client only sends the rest.
+type deltaPlan struct {
+	blockSize int64
+	have      []bool
+}
+
+// blockHashes computes the SHA256 checksum of every blockSize block read from
+// r.  The last block may be shorter.
+func blockHashes(r io.Reader, blockSize int64) ([][]byte, error) {
+	var hashes [][]byte
+
+	buffer := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buffer)
+		if n > 0 {
+			sum := sha256.Sum256(buffer[:n])
+			hashes = append(hashes, sum[:])
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return hashes, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// planDelta compares the block checksums sent by the client with the
+// checksums of the blocks in base.
+func planDelta(base io.Reader, blockSize int64, blockSHA256 [][]byte) (*deltaPlan, error) {
+	baseHashes, err := blockHashes(base, blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("error computing checksums of base: %w", err)
+	}
+
+	plan := &deltaPlan{
+		blockSize: blockSize,
+		have:      make([]bool, len(blockSHA256)),
+	}
+
+	for i, sum := range blockSHA256 {
+		plan.have[i] = i < len(baseHashes) && string(baseHashes[i]) == string(sum)
+	}
+
+	return plan, nil
+}
+
+// missing returns the indices of the blocks the client has to send.
+func (p *deltaPlan) missing() []int64 {
+	missing := []int64{}
+	for i, have := range p.have {
+		if !have {
+			missing = append(missing, int64(i))
+		}
+	}
+	return missing
+}
+
+// fillFromBase copies the blocks we have in the base file into a delta upload,
+// starting at the current offset and stopping at the first block the client
+// has to send.
+func (s *Service) fillFromBase(up *upload) error {
+	plan := up.DeltaPlan()
+	if plan == nil {
+		return nil
+	}
+
+	var base io.ReaderAt
+	buffer := make([]byte, plan.blockSize)
+
+	for {
+		offset := up.Offset()
+		block := offset / plan.blockSize
+
+		if offset >= up.Size || offset%plan.blockSize != 0 || block >= int64(len(plan.have)) || !plan.have[block] {
+			return nil
+		}
+
+		if base == nil {
+			in, err := s.fileStore.OpenReadOnly(up.BaseID)
+			if err != nil {
+				return fmt.Errorf("error opening base [%s]: %w", up.BaseID, err)
+			}
+			defer in.Close()
+			base = in
+		}
+
+		n := min(plan.blockSize, up.Size-offset)
+		_, err := base.ReadAt(buffer[:n], offset)
+		if err != nil {
+			return fmt.Errorf("error reading base [%s] at %d: %w", up.BaseID, offset, err)
+		}
+
+		_, err = up.Write(buffer[:n])
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(buffer[:n])
+		up.LogBlock(offset, int(n), sum[:])
+	}
+}
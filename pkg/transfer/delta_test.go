@@ -0,0 +1,60 @@
+package transfer
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeltaUpload(t *testing.T) {
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	baseFilename := randomFile(t, 10*minBlockSize+17)
+	baseID, err := client.Upload(baseFilename)
+	require.NoError(t, err)
+
+	// change block 3 and append some data to the file
+	data, err := os.ReadFile(baseFilename)
+	require.NoError(t, err)
+	data[3*minBlockSize+5] ^= 0xff
+	data = append(data, []byte("some more data")...)
+
+	filename := path.Join(t.TempDir(), "new")
+	require.NoError(t, os.WriteFile(filename, data, 0600))
+
+	var acks int
+	deltaClient, err := CreateClient(ClientConfig{
+		ServerAddr:     addr,
+		UploadProgress: func(string, int64, int64) { acks++ },
+	})
+	require.NoError(t, err)
+	defer deltaClient.Close()
+
+	id, err := deltaClient.UploadDelta(filename, ID(baseID))
+	require.NoError(t, err)
+
+	// block 3 and the last block plus the final ack
+	require.Equal(t, 3, acks)
+
+	dst := path.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.Download(ID(id), dst))
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// an identical file needs no data at all, just the empty block that
+	// identifies the upload and the final ack
+	acks = 0
+	_, err = deltaClient.UploadDelta(filename, ID(id))
+	require.NoError(t, err)
+	require.Equal(t, 2, acks)
+}
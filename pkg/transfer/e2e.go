@@ -0,0 +1,320 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Clients can encrypt files end to end so the server only ever sees
+// ciphertext.  The file is split into chunks that are sealed with AES-GCM
+// using a random data key, and each sealed chunk is exactly one upload block.
+// The block and file checksums the server verifies are therefore computed
+// over the ciphertext and work as before.
+//
+// The nonce of each chunk is derived from a random base nonce and the chunk
+// index, which makes the encryption deterministic for a given data key.  This
+// lets the client checksum the ciphertext before the upload is created and
+// encrypt the same blocks again when resuming.  The additional data of each
+// chunk is the chunk index, the chunk size and the plaintext size, so chunks
+// can't be moved around and the file can't be truncated.
+//
+// The data key is wrapped by the client key in the same way as the data keys
+// of files encrypted at rest, and stored in the upload metadata along with
+// the base nonce and the sizes.
+const e2eScheme = "aes-256-gcm-chunked"
+
+// clientMetadata is the metadata blob the client stores with end to end
+// encrypted uploads.
+type clientMetadata struct {
+	Encryption *e2eHeader `json:"encryption,omitempty"`
+}
+
+// e2eHeader describes how the client encrypted a file.  ChunkSize is the
+// size of an encrypted chunk and Size is the size of the plaintext.
+type e2eHeader struct {
+	Scheme     string `json:"scheme"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce"`
+	ChunkSize  int64  `json:"chunk_size"`
+	Size       int64  `json:"size"`
+}
+
+// parseClientMetadata returns the encryption header in metadata, or nil if
+// the file wasn't encrypted by the client.
+func parseClientMetadata(metadata []byte) *e2eHeader {
+	var meta clientMetadata
+	err := json.Unmarshal(metadata, &meta)
+	if err != nil {
+		return nil
+	}
+	return meta.Encryption
+}
+
+// plainChunkSize returns how much plaintext each chunk holds.
+func (h *e2eHeader) plainChunkSize() int64 {
+	return h.ChunkSize - gcmTagSize
+}
+
+// cipherSize returns the size of the encrypted file.
+func (h *e2eHeader) cipherSize() int64 {
+	chunks := (h.Size + h.plainChunkSize() - 1) / h.plainChunkSize()
+	return h.Size + chunks*gcmTagSize
+}
+
+// e2eCipher encrypts and decrypts the chunks of a file.
+type e2eCipher struct {
+	header e2eHeader
+	aead   cipher.AEAD
+}
+
+// newE2ECipher creates a cipher with a new data key wrapped by key for a file
+// of size bytes.
+func newE2ECipher(key *MasterKey, chunkSize int64, size int64) (*e2eCipher, error) {
+	if chunkSize <= gcmTagSize {
+		return nil, fmt.Errorf("chunk size %d is too small", chunkSize)
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcmNonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := key.wrap(dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e2eCipher{
+		header: e2eHeader{
+			Scheme:     e2eScheme,
+			WrappedKey: wrapped,
+			Nonce:      nonce,
+			ChunkSize:  chunkSize,
+			Size:       size,
+		},
+		aead: aead,
+	}, nil
+}
+
+// openE2ECipher unwraps the data key in header using one of keys.
+func openE2ECipher(header e2eHeader, keys []*MasterKey) (*e2eCipher, error) {
+	if header.Scheme != e2eScheme {
+		return nil, fmt.Errorf("unsupported encryption scheme [%s]", header.Scheme)
+	}
+
+	if len(header.Nonce) != gcmNonceSize || header.ChunkSize <= gcmTagSize || header.Size < 0 {
+		return nil, fmt.Errorf("%w: invalid encryption header", ErrCorruptFile)
+	}
+
+	dataKey, _, err := unwrapDataKey(header.WrappedKey, keys, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e2eCipher{header: header, aead: aead}, nil
+}
+
+// nonce returns the nonce of chunk.
+func (e *e2eCipher) nonce(chunk int64) []byte {
+	nonce := bytes.Clone(e.header.Nonce)
+	for i, b := range binary.BigEndian.AppendUint64(nil, uint64(chunk)) {
+		nonce[gcmNonceSize-8+i] ^= b
+	}
+	return nonce
+}
+
+// ad returns the additional data of chunk.
+func (e *e2eCipher) ad(chunk int64) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, uint64(chunk))
+	ad = binary.BigEndian.AppendUint64(ad, uint64(e.header.ChunkSize))
+	return binary.BigEndian.AppendUint64(ad, uint64(e.header.Size))
+}
+
+func (e *e2eCipher) seal(dst []byte, plain []byte, chunk int64) []byte {
+	return e.aead.Seal(dst, e.nonce(chunk), plain, e.ad(chunk))
+}
+
+func (e *e2eCipher) open(dst []byte, sealed []byte, chunk int64) ([]byte, error) {
+	plain, err := e.aead.Open(dst, e.nonce(chunk), sealed, e.ad(chunk))
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk %d: %v", ErrCorruptFile, chunk, err)
+	}
+	return plain, nil
+}
+
+// checksum returns the SHA256 of the ciphertext of r.
+func (e *e2eCipher) checksum(r io.ReaderAt) ([]byte, error) {
+	h := sha256.New()
+
+	// read whole chunks so each chunk is only encrypted once
+	buffer := make([]byte, e.header.ChunkSize)
+	_, err := io.CopyBuffer(h, io.NewSectionReader(&e2eReader{cipher: e, r: r}, 0, e.header.cipherSize()), buffer)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// e2eReader encrypts a plaintext file on the fly so it can be read as the
+// ciphertext that is uploaded.  Reads should be aligned with the chunks since
+// every chunk that is touched is encrypted.
+type e2eReader struct {
+	cipher *e2eCipher
+	r      io.ReaderAt
+}
+
+func (e *e2eReader) ReadAt(p []byte, off int64) (int, error) {
+	header := e.cipher.header
+	size := header.cipherSize()
+	plain := make([]byte, header.plainChunkSize())
+
+	var sealed []byte
+	n := 0
+	for n < len(p) && off < size {
+		chunk := off / header.ChunkSize
+		start := chunk * header.plainChunkSize()
+		length := min(header.plainChunkSize(), header.Size-start)
+
+		m, err := e.r.ReadAt(plain[:length], start)
+		if int64(m) < length {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+
+		sealed = e.cipher.seal(sealed[:0], plain[:length], chunk)
+		c := copy(p[n:], sealed[off-chunk*header.ChunkSize:])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// e2eDecrypter decrypts ciphertext written to it, which has to start at a
+// chunk boundary, and writes a range of the plaintext to w.
+type e2eDecrypter struct {
+	cipher    *e2eCipher
+	w         io.Writer
+	chunk     int64
+	skip      int64
+	remaining int64
+	buf       []byte
+	plain     []byte
+}
+
+// newDecrypter returns a decrypter that writes length bytes of plaintext from
+// offset to w, along with the range of the ciphertext it needs.  If length is
+// zero everything from offset is written.
+func (e *e2eCipher) newDecrypter(w io.Writer, offset int64, length int64) (*e2eDecrypter, int64, int64) {
+	header := e.header
+
+	end := header.Size
+	if length > 0 {
+		end = min(offset+length, header.Size)
+	}
+
+	d := &e2eDecrypter{
+		cipher: e,
+		w:      w,
+		buf:    make([]byte, 0, header.ChunkSize),
+	}
+
+	if offset >= end {
+		return d, 0, 0
+	}
+
+	first := offset / header.plainChunkSize()
+	last := (end - 1) / header.plainChunkSize()
+
+	d.chunk = first
+	d.skip = offset - first*header.plainChunkSize()
+	d.remaining = end - offset
+
+	cipherOffset := first * header.ChunkSize
+	cipherEnd := min((last+1)*header.ChunkSize, header.cipherSize())
+	return d, cipherOffset, cipherEnd - cipherOffset
+}
+
+func (d *e2eDecrypter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		c := copy(d.buf[len(d.buf):cap(d.buf)], p)
+		d.buf = d.buf[:len(d.buf)+c]
+		p = p[c:]
+
+		if len(d.buf) == cap(d.buf) {
+			err := d.flush()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush decrypts the buffered chunk and writes the part of it that is in
+// range.
+func (d *e2eDecrypter) flush() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+
+	plain, err := d.cipher.open(d.plain[:0], d.buf, d.chunk)
+	if err != nil {
+		return err
+	}
+	d.plain = plain
+	d.buf = d.buf[:0]
+	d.chunk++
+
+	plain = plain[min(d.skip, int64(len(plain))):]
+	plain = plain[:min(d.remaining, int64(len(plain)))]
+	d.skip = 0
+	d.remaining -= int64(len(plain))
+
+	_, err = d.w.Write(plain)
+	return err
+}
+
+// Close decrypts the last chunk and makes sure the whole range was written.
+func (d *e2eDecrypter) Close() error {
+	err := d.flush()
+	if err != nil {
+		return err
+	}
+
+	if d.remaining > 0 {
+		return fmt.Errorf("%w: file is truncated", ErrCorruptFile)
+	}
+	return nil
+}
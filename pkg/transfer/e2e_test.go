@@ -0,0 +1,164 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestE2ECipher(t *testing.T) {
+	key := newTestKey(t)
+
+	plain := make([]byte, 3*minBlockSize+100)
+	_, err := rand.Read(plain)
+	require.NoError(t, err)
+
+	e2e, err := newE2ECipher(key, minBlockSize, int64(len(plain)))
+	require.NoError(t, err)
+
+	// encryption is deterministic so the checksum matches what we upload
+	reader := &e2eReader{cipher: e2e, r: bytes.NewReader(plain)}
+	ciphertext, err := io.ReadAll(io.NewSectionReader(reader, 0, e2e.header.cipherSize()))
+	require.NoError(t, err)
+	require.Len(t, ciphertext, int(e2e.header.cipherSize()))
+	require.False(t, bytes.Contains(ciphertext, plain[:1024]))
+
+	checksum, err := e2e.checksum(bytes.NewReader(plain))
+	require.NoError(t, err)
+	expect, err := checksumReader(bytes.NewReader(ciphertext))
+	require.NoError(t, err)
+	require.Equal(t, expect, checksum)
+
+	// a cipher opened from the header decrypts any range
+	opened, err := openE2ECipher(e2e.header, []*MasterKey{key})
+	require.NoError(t, err)
+
+	ranges := []struct{ offset, length int64 }{
+		{0, 0},
+		{0, 1},
+		{100, minBlockSize},
+		{minBlockSize - gcmTagSize - 1, 2},
+		{int64(len(plain)) - 10, 0},
+		{int64(len(plain)) - 10, 1000},
+	}
+	for _, r := range ranges {
+		var out bytes.Buffer
+		d, cipherOffset, cipherLength := opened.newDecrypter(&out, r.offset, r.length)
+		_, err = d.Write(ciphertext[cipherOffset : cipherOffset+cipherLength])
+		require.NoError(t, err)
+		require.NoError(t, d.Close())
+
+		end := int64(len(plain))
+		if r.length > 0 {
+			end = min(r.offset+r.length, end)
+		}
+		require.Equal(t, plain[r.offset:end], out.Bytes(), "offset %d length %d", r.offset, r.length)
+	}
+
+	// truncation and tampering are detected
+	d, _, _ := opened.newDecrypter(io.Discard, 0, 0)
+	_, err = d.Write(ciphertext[:2*minBlockSize])
+	require.NoError(t, err)
+	require.ErrorIs(t, d.Close(), ErrCorruptFile)
+
+	tampered := bytes.Clone(ciphertext)
+	tampered[minBlockSize+1] ^= 1
+	d, _, _ = opened.newDecrypter(io.Discard, 0, 0)
+	_, err = d.Write(tampered)
+	require.ErrorIs(t, err, ErrCorruptFile)
+
+	// changing the size in the header breaks decryption
+	header := e2e.header
+	header.Size -= 100
+	truncated, err := openE2ECipher(header, []*MasterKey{key})
+	require.NoError(t, err)
+	d, _, _ = truncated.newDecrypter(io.Discard, 0, 0)
+	_, err = d.Write(ciphertext[:minBlockSize])
+	require.ErrorIs(t, err, ErrCorruptFile)
+
+	_, err = openE2ECipher(e2e.header, []*MasterKey{newTestKey(t)})
+	require.ErrorIs(t, err, ErrUnknownMasterKey)
+}
+
+func TestClientE2E(t *testing.T) {
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+	})
+
+	filename := randomFile(t, 10*minBlockSize+123)
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	config := ClientConfig{
+		ServerAddr:          addr,
+		EncryptionKeys:      []*MasterKey{newTestKey(t)},
+		EncryptionBlockSize: minBlockSize,
+		QuitAfter:           4,
+		UploadWindow:        minBlockSize,
+	}
+
+	// quit prematurely and resume
+	client, err := CreateClient(config)
+	require.NoError(t, err)
+	id, err := client.Upload(filename)
+	require.NoError(t, err)
+	require.FileExists(t, filename+"."+stateFileSuffix)
+	require.NoError(t, client.Close())
+
+	config.QuitAfter = 0
+	client, err = CreateClient(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	resumedID, err := client.Upload(filename)
+	require.NoError(t, err)
+	require.Equal(t, id, resumedID)
+
+	// the server only has the ciphertext
+	stored, err := service.fileStore.Map(ID(id))
+	require.NoError(t, err)
+	ciphertext, err := os.ReadFile(stored)
+	require.NoError(t, err)
+	require.Greater(t, len(ciphertext), len(data))
+	require.False(t, bytes.Contains(ciphertext, data[:1024]))
+
+	dst := path.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.Download(ID(id), dst))
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// ranged download
+	var buf bytes.Buffer
+	require.NoError(t, client.DownloadRange(ID(id), &buf, 3*minBlockSize-7, 2*minBlockSize))
+	require.Equal(t, data[3*minBlockSize-7:5*minBlockSize-7], buf.Bytes())
+
+	// resume a partial download
+	partial := path.Join(t.TempDir(), "partial")
+	require.NoError(t, os.WriteFile(partial, data[:4*minBlockSize+5], 0600))
+	require.NoError(t, client.ResumeDownload(ID(id), partial))
+	got, err = os.ReadFile(partial)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// a client without the key downloads the ciphertext
+	plainClient, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer plainClient.Close()
+
+	buf.Reset()
+	require.NoError(t, plainClient.DownloadRange(ID(id), &buf, 0, 0))
+	require.Equal(t, ciphertext, buf.Bytes())
+
+	// a client with the wrong key can't decrypt it
+	wrongClient, err := CreateClient(ClientConfig{ServerAddr: addr, EncryptionKeys: []*MasterKey{newTestKey(t)}})
+	require.NoError(t, err)
+	defer wrongClient.Close()
+	require.ErrorIs(t, wrongClient.DownloadRange(ID(id), io.Discard, 0, 0), ErrUnknownMasterKey)
+}
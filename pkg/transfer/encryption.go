@@ -0,0 +1,740 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Files in the file store can be encrypted at rest using envelope encryption.
+// Each file gets its own random AES-256 data key, which is wrapped by a master
+// key and stored in the file header along with the size of the plaintext:
+//
+//	magic (8) | master key ID (8) | nonce (12) | wrapped data key (32+16) | size (8)
+//
+// The header is followed by chunks that each hold up to encryptedChunkSize
+// bytes of plaintext sealed with AES-GCM using the data key:
+//
+//	nonce (12) | ciphertext | tag (16)
+//
+// The chunk index and the size are used as additional data for the chunks,
+// and the size for the wrapped data key, so chunks can't be moved around and
+// the file can't be truncated.  Since each chunk can be decrypted on its own
+// we can read from any offset, and since the header has a fixed size,
+// rotating master keys only means rewriting the header.
+//
+// Whether a file is encrypted is recorded along with the file rather than
+// detected from its content, since plaintext can start with anything.
+const (
+	encryptionMagic        = "LFUENC01"
+	keyIDSize              = 8
+	dataKeySize            = 32
+	gcmNonceSize           = 12
+	gcmTagSize             = 16
+	keyEnvelopeSize        = len(encryptionMagic) + keyIDSize + gcmNonceSize + dataKeySize + gcmTagSize
+	encryptedHeaderSize    = keyEnvelopeSize + 8
+	encryptedChunkSize     = 64 * 1024
+	encryptedChunkOverhead = gcmNonceSize + gcmTagSize
+	masterKeySize          = 32
+)
+
+// errors
+var (
+	ErrUnknownMasterKey = errors.New("file is encrypted with an unknown master key")
+	ErrCorruptFile      = errors.New("encrypted file is corrupt")
+)
+
+// MasterKey is a key used to wrap the data keys of encrypted files.
+type MasterKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// NewMasterKey creates a master key from 32 bytes of key material.
+func NewMasterKey(key []byte) (*MasterKey, error) {
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", masterKeySize, len(key))
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(key)
+	return &MasterKey{id: sum[:keyIDSize], aead: aead}, nil
+}
+
+// ParseMasterKey parses a hex encoded master key.
+func ParseMasterKey(s string) (*MasterKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("master key must be hex encoded: %w", err)
+	}
+	return NewMasterKey(key)
+}
+
+// LoadMasterKey loads a hex encoded master key from a file.
+func LoadMasterKey(filename string) (*MasterKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading master key: %w", err)
+	}
+	return ParseMasterKey(string(data))
+}
+
+// MasterKeyFromEnv reads a hex encoded master key from the environment
+// variable name.
+func MasterKeyFromEnv(name string) (*MasterKey, error) {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return ParseMasterKey(s)
+}
+
+// GenerateMasterKey generates a new random hex encoded master key.
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, masterKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// ID returns the ID of the key, which is stored in the header of the files
+// using it.
+func (k *MasterKey) ID() string {
+	return hex.EncodeToString(k.id)
+}
+
+// wrap encrypts dataKey and returns the key envelope.  The additional data
+// ad, if any, has to be given again to unwrap the key.
+func (k *MasterKey) wrap(dataKey []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, gcmNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 0, keyEnvelopeSize)
+	envelope = append(envelope, encryptionMagic...)
+	envelope = append(envelope, k.id...)
+	envelope = append(envelope, nonce...)
+	return k.aead.Seal(envelope, nonce, dataKey, append([]byte(encryptionMagic), ad...)), nil
+}
+
+// unwrapDataKey finds the master key for envelope and decrypts the data key.
+func unwrapDataKey(envelope []byte, keys []*MasterKey, ad []byte) ([]byte, *MasterKey, error) {
+	if len(envelope) != keyEnvelopeSize || string(envelope[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, nil, ErrCorruptFile
+	}
+
+	id := envelope[len(encryptionMagic) : len(encryptionMagic)+keyIDSize]
+	nonce := envelope[len(encryptionMagic)+keyIDSize : len(encryptionMagic)+keyIDSize+gcmNonceSize]
+	wrapped := envelope[len(encryptionMagic)+keyIDSize+gcmNonceSize:]
+
+	for _, key := range keys {
+		if !bytes.Equal(key.id, id) {
+			continue
+		}
+
+		dataKey, err := key.aead.Open(nil, nonce, wrapped, append([]byte(encryptionMagic), ad...))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: cannot unwrap data key", ErrCorruptFile)
+		}
+		return dataKey, key, nil
+	}
+
+	return nil, nil, fmt.Errorf("%w: %x", ErrUnknownMasterKey, id)
+}
+
+// encryptedHeader is the header of a file encrypted at rest.
+type encryptedHeader struct {
+	dataKey []byte
+	key     *MasterKey
+	size    int64
+}
+
+// newEncryptedHeader returns the header of a file of size bytes with a data
+// key wrapped by key.
+func newEncryptedHeader(dataKey []byte, key *MasterKey, size int64) ([]byte, error) {
+	sizeAD := binary.BigEndian.AppendUint64(nil, uint64(size))
+	envelope, err := key.wrap(dataKey, sizeAD)
+	if err != nil {
+		return nil, err
+	}
+	return append(envelope, sizeAD...), nil
+}
+
+// readEncryptedHeader reads the header of r and unwraps the data key using
+// one of keys.
+func readEncryptedHeader(r io.ReaderAt, keys []*MasterKey) (encryptedHeader, error) {
+	header := make([]byte, encryptedHeaderSize)
+	_, err := r.ReadAt(header, 0)
+	if errors.Is(err, io.EOF) {
+		return encryptedHeader{}, fmt.Errorf("%w: short header", ErrCorruptFile)
+	}
+
+	if err != nil {
+		return encryptedHeader{}, fmt.Errorf("error reading header: %w", err)
+	}
+
+	sizeAD := header[keyEnvelopeSize:]
+	dataKey, key, err := unwrapDataKey(header[:keyEnvelopeSize], keys, sizeAD)
+	if err != nil {
+		return encryptedHeader{}, err
+	}
+
+	size := int64(binary.BigEndian.Uint64(sizeAD))
+	if size < 0 {
+		return encryptedHeader{}, fmt.Errorf("%w: negative size", ErrCorruptFile)
+	}
+	return encryptedHeader{dataKey: dataKey, key: key, size: size}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkOffset returns the file offset of chunk.
+func chunkOffset(chunk int64) int64 {
+	return int64(encryptedHeaderSize) + chunk*(encryptedChunkSize+encryptedChunkOverhead)
+}
+
+// chunkAD returns the additional data for chunk of a file of size bytes.
+func chunkAD(chunk int64, size int64) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, uint64(chunk))
+	return binary.BigEndian.AppendUint64(ad, uint64(size))
+}
+
+// encryptedPlainSize returns the size of the plaintext in an encrypted file
+// that is fileSize bytes long, which is less than the size in the header if
+// the file is still being written.
+func encryptedPlainSize(fileSize int64) (int64, error) {
+	if fileSize < int64(encryptedHeaderSize) {
+		return 0, ErrCorruptFile
+	}
+
+	rest := fileSize - int64(encryptedHeaderSize)
+	full := rest / (encryptedChunkSize + encryptedChunkOverhead)
+	partial := rest % (encryptedChunkSize + encryptedChunkOverhead)
+
+	if partial > 0 && partial <= encryptedChunkOverhead {
+		return 0, ErrCorruptFile
+	}
+
+	return full*encryptedChunkSize + max(partial-encryptedChunkOverhead, 0), nil
+}
+
+// encryptedWriter encrypts data written to a file in the staging tree.  Data
+// is buffered until we have a full chunk, so Sync and Close write the partial
+// chunk we have so far.  A partial chunk is rewritten with a new nonce once it
+// grows.
+type encryptedWriter struct {
+	file       *os.File
+	aead       cipher.AEAD
+	size       int64
+	syncWrites bool
+	chunk      int64
+	buf        []byte
+}
+
+// newEncryptedWriter writes a header with a new data key wrapped by key to
+// file and returns a writer that encrypts everything written to it.  The
+// file will hold size bytes of plaintext and must be opened for reading and
+// writing.
+func newEncryptedWriter(file *os.File, key *MasterKey, size int64, syncWrites bool) (*encryptedWriter, error) {
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := newEncryptedHeader(dataKey, key, size)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.WriteAt(header, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedWriter{
+		file:       file,
+		aead:       aead,
+		size:       size,
+		syncWrites: syncWrites,
+		buf:        make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+// openEncryptedWriter returns a writer that continues writing to an existing
+// encrypted file using the data key unwrapped by one of keys.  The writer has
+// to be rewound to where writing should continue before it is used.
+func openEncryptedWriter(file *os.File, keys []*MasterKey, syncWrites bool) (*encryptedWriter, error) {
+	header, err := readEncryptedHeader(file, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(header.dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedWriter{
+		file:       file,
+		aead:       aead,
+		size:       header.size,
+		syncWrites: syncWrites,
+		chunk:      -1,
+		buf:        make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (e *encryptedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		c := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+
+		if len(e.buf) == encryptedChunkSize {
+			err := e.writeChunk()
+			if err != nil {
+				return 0, err
+			}
+
+			e.chunk++
+			e.buf = e.buf[:0]
+		}
+	}
+
+	// when every write has to be durable we can't keep anything in the buffer
+	if e.syncWrites && len(e.buf) > 0 {
+		err := e.writeChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// Sync writes the partial chunk and flushes the file to disk.
+func (e *encryptedWriter) Sync() error {
+	if len(e.buf) > 0 {
+		err := e.writeChunk()
+		if err != nil {
+			return err
+		}
+	}
+	return e.file.Sync()
+}
+
+// Rewind truncates the plaintext to offset.
+func (e *encryptedWriter) Rewind(offset int64) error {
+	chunk := offset / encryptedChunkSize
+	keep := offset % encryptedChunkSize
+
+	var prefix []byte
+	if keep > 0 {
+		if chunk == e.chunk {
+			prefix = append(prefix, e.buf[:keep]...)
+		} else {
+			plain, err := readChunk(e.file, e.aead, chunk, e.size)
+			if err != nil {
+				return err
+			}
+			prefix = plain[:keep]
+		}
+	}
+
+	err := e.file.Truncate(chunkOffset(chunk))
+	if err != nil {
+		return err
+	}
+
+	e.chunk = chunk
+	e.buf = append(e.buf[:0], prefix...)
+
+	// make sure the kept part of the chunk is still on disk
+	return e.Sync()
+}
+
+// Close writes the partial chunk and closes the file.
+func (e *encryptedWriter) Close() error {
+	if len(e.buf) > 0 {
+		err := e.writeChunk()
+		if err != nil {
+			e.file.Close()
+			return err
+		}
+	}
+	return e.file.Close()
+}
+
+// Name returns the name of the underlying file.
+func (e *encryptedWriter) Name() string {
+	return e.file.Name()
+}
+
+// writeChunk seals the buffer and writes it at the position of the current
+// chunk.
+func (e *encryptedWriter) writeChunk() error {
+	nonce := make([]byte, gcmNonceSize, encryptedChunkOverhead+len(e.buf))
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	sealed := e.aead.Seal(nonce, nonce, e.buf, chunkAD(e.chunk, e.size))
+	_, err = e.file.WriteAt(sealed, chunkOffset(e.chunk))
+	return err
+}
+
+// readChunk reads and decrypts chunk of a file of size bytes.
+func readChunk(r io.ReaderAt, aead cipher.AEAD, chunk int64, size int64) ([]byte, error) {
+	sealed := make([]byte, encryptedChunkSize+encryptedChunkOverhead)
+	n, err := r.ReadAt(sealed, chunkOffset(chunk))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if n <= encryptedChunkOverhead {
+		return nil, ErrCorruptFile
+	}
+
+	sealed = sealed[:n]
+	plain, err := aead.Open(nil, sealed[:gcmNonceSize], sealed[gcmNonceSize:], chunkAD(chunk, size))
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk %d: %v", ErrCorruptFile, chunk, err)
+	}
+	return plain, nil
+}
+
+// encryptedReader decrypts an encrypted file.  It caches the last chunk it
+// decrypted since reads are usually sequential.
+type encryptedReader struct {
+	mu     sync.Mutex
+	file   *os.File
+	aead   cipher.AEAD
+	size   int64
+	offset int64
+	chunk  int64
+	plain  []byte
+}
+
+// newEncryptedReader returns a reader that decrypts file using the data key
+// unwrapped by one of keys.  The file must hold all the plaintext the header
+// says it has.
+func newEncryptedReader(file *os.File, keys []*MasterKey) (*encryptedReader, error) {
+	header, err := readEncryptedHeader(file, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(header.dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := encryptedPlainSize(stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	if size != header.size {
+		return nil, fmt.Errorf("%w: has %d of %d bytes", ErrCorruptFile, size, header.size)
+	}
+
+	return &encryptedReader{
+		file:  file,
+		aead:  aead,
+		size:  size,
+		chunk: -1,
+	}, nil
+}
+
+// ReadAt reads plaintext at offset off.
+func (e *encryptedReader) ReadAt(p []byte, off int64) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off >= e.size {
+			return n, io.EOF
+		}
+
+		chunk := off / encryptedChunkSize
+		if chunk != e.chunk {
+			plain, err := readChunk(e.file, e.aead, chunk, e.size)
+			if err != nil {
+				return n, err
+			}
+			e.chunk = chunk
+			e.plain = plain
+		}
+
+		c := copy(p[n:], e.plain[off%encryptedChunkSize:])
+		n += c
+		off += int64(c)
+	}
+
+	return n, nil
+}
+
+func (e *encryptedReader) Read(p []byte) (int, error) {
+	n, err := e.ReadAt(p, e.offset)
+	e.offset += int64(n)
+
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (e *encryptedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += e.offset
+	case io.SeekEnd:
+		offset += e.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+
+	e.offset = offset
+	return offset, nil
+}
+
+func (e *encryptedReader) Close() error {
+	return e.file.Close()
+}
+
+// Name returns the name of the underlying file.
+func (e *encryptedReader) Name() string {
+	return e.file.Name()
+}
+
+// RewrapKeys rewraps the data keys of every encrypted file under root with
+// keys[0].  That is the finished files, the uploads saved by the last service
+// and the quarantined files.  The remaining keys are used to unwrap data keys
+// wrapped by older master keys.  Only the file headers are rewritten.  It
+// returns the number of files that were rewrapped.  The service should not be
+// running while doing this, and if it is interrupted it must be run again
+// before the service is started.
+func RewrapKeys(root string, keys ...*MasterKey) (int, error) {
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("no master keys")
+	}
+
+	store, err := CreateFileStore(root)
+	if err != nil {
+		return 0, err
+	}
+
+	var filenames []string
+	ids, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		info, err := store.ReadInfo(id)
+		if err != nil {
+			return 0, err
+		}
+
+		if info.Encrypted {
+			filename, _ := store.Map(id)
+			filenames = append(filenames, filename)
+		}
+	}
+
+	records, err := store.readUploads()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range records {
+		if r.Encrypted {
+			filename, _ := store.MapStaging(r.ID)
+			filenames = append(filenames, filename)
+		}
+	}
+
+	q := &quarantine{dir: path.Join(root, quarantineDir)}
+	reports, err := q.List()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+
+	for _, report := range reports {
+		if report.Encrypted {
+			filenames = append(filenames, q.filename(report.ID))
+		}
+	}
+
+	// finish the rewraps that were interrupted first, since hard linked
+	// files share the header and may be visited before the one that has the
+	// saved header
+	for _, filename := range filenames {
+		err := finishRewrap(filename)
+		if err != nil {
+			return 0, fmt.Errorf("path %s: %w", filename, err)
+		}
+	}
+
+	count := 0
+	for _, filename := range filenames {
+		rewrapped, err := rewrapFile(filename, keys)
+		if err != nil {
+			return count, fmt.Errorf("path %s: %w", filename, err)
+		}
+
+		if rewrapped {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// rewrapSuffix is added to the name of a file for the copy of its new header
+// that is kept while the header is rewritten.
+const rewrapSuffix = ".rewrap"
+
+// rewrapFile rewraps the data key of the encrypted file filename if it is
+// encrypted with a key other than keys[0].  The new header is saved next to
+// the file before it overwrites the old one, so if we crash halfway through
+// finishRewrap can complete the header.
+func rewrapFile(filename string, keys []*MasterKey) (bool, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header, err := readEncryptedHeader(file, keys)
+	if err != nil {
+		return false, err
+	}
+
+	// hard linked files share the header so they may already be done
+	if header.key == keys[0] {
+		return false, nil
+	}
+
+	rewrapped, err := newEncryptedHeader(header.dataKey, keys[0], header.size)
+	if err != nil {
+		return false, err
+	}
+
+	saved := filename + rewrapSuffix
+	tmp := saved + ".tmp"
+	err = writeFileSync(tmp, rewrapped)
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	err = os.Rename(tmp, saved)
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	err = syncDir(path.Dir(filename))
+	if err != nil {
+		return false, err
+	}
+
+	return true, writeHeader(file, rewrapped)
+}
+
+// finishRewrap writes the header saved by an interrupted rewrapFile to the
+// file filename, if there is one.
+func finishRewrap(filename string) error {
+	header, err := os.ReadFile(filename + rewrapSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return writeHeader(file, header)
+}
+
+// writeHeader overwrites the header of file with header, makes sure it is on
+// disk and removes the copy saved by rewrapFile.
+func writeHeader(file *os.File, header []byte) error {
+	_, err := file.WriteAt(header, 0)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(file.Name() + rewrapSuffix)
+}
+
+// writeFileSync writes data to a new file at path and flushes it to disk.
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermissions)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	return errors.Join(err, file.Close())
+}
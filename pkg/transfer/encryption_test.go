@@ -0,0 +1,279 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T) *MasterKey {
+	s, err := GenerateMasterKey()
+	require.NoError(t, err)
+	key, err := ParseMasterKey(s)
+	require.NoError(t, err)
+	return key
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	key := newTestKey(t)
+	root := t.TempDir()
+
+	fs, err := CreateFileStore(root, key)
+	require.NoError(t, err)
+
+	id, err := NewID()
+	require.NoError(t, err)
+
+	data := make([]byte, 3*encryptedChunkSize+1234)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	f, err := fs.Create(id, int64(len(data)), false)
+	require.NoError(t, err)
+
+	// write some garbage, rewind into the middle of a chunk and write the
+	// real data from there.
+	_, err = f.Write(data[:encryptedChunkSize+100])
+	require.NoError(t, err)
+	_, err = f.Write(bytes.Repeat([]byte{0xff}, encryptedChunkSize))
+	require.NoError(t, err)
+	require.NoError(t, f.Rewind(encryptedChunkSize+100))
+	_, err = f.Write(data[encryptedChunkSize+100:])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the data on disk is encrypted
+	stagingPath, err := fs.MapStaging(id)
+	require.NoError(t, err)
+	raw, err := os.ReadFile(stagingPath)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, data[:1024]))
+
+	require.NoError(t, fs.Commit(id, FileInfo{ID: id, Size: int64(len(data)), Encrypted: true}))
+
+	rf, err := fs.OpenReadOnly(id)
+	require.NoError(t, err)
+	defer rf.Close()
+
+	got, err := io.ReadAll(rf)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// ranged reads across chunk boundaries
+	buf := make([]byte, encryptedChunkSize)
+	n, err := rf.ReadAt(buf, encryptedChunkSize/2)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, data[encryptedChunkSize/2:encryptedChunkSize/2+encryptedChunkSize], buf)
+
+	_, err = rf.Seek(int64(len(data)-10), io.SeekStart)
+	require.NoError(t, err)
+	got, err = io.ReadAll(rf)
+	require.NoError(t, err)
+	require.Equal(t, data[len(data)-10:], got)
+
+	// a store without the key cannot read the file
+	other, err := CreateFileStore(root, newTestKey(t))
+	require.NoError(t, err)
+	_, err = other.OpenReadOnly(id)
+	require.ErrorIs(t, err, ErrUnknownMasterKey)
+
+	// tampering is detected
+	full, err := fs.Map(id)
+	require.NoError(t, err)
+	raw, err = os.ReadFile(full)
+	require.NoError(t, err)
+	tampered := bytes.Clone(raw)
+	tampered[len(tampered)-1] ^= 1
+	require.NoError(t, os.WriteFile(full, tampered, 0600))
+
+	rf, err = fs.OpenReadOnly(id)
+	require.NoError(t, err)
+	defer rf.Close()
+	_, err = io.ReadAll(rf)
+	require.ErrorIs(t, err, ErrCorruptFile)
+
+	// and so is cutting off chunks at the end, even if the size in the header
+	// is changed to match
+	truncated := raw[:chunkOffset(3)]
+	require.NoError(t, os.WriteFile(full, truncated, 0600))
+	_, err = fs.OpenReadOnly(id)
+	require.ErrorIs(t, err, ErrCorruptFile)
+
+	binary.BigEndian.PutUint64(truncated[keyEnvelopeSize:], 3*encryptedChunkSize)
+	require.NoError(t, os.WriteFile(full, truncated, 0600))
+	_, err = fs.OpenReadOnly(id)
+	require.ErrorIs(t, err, ErrCorruptFile)
+}
+
+func TestPlaintextLooksEncrypted(t *testing.T) {
+	root := t.TempDir()
+	fs, err := CreateFileStore(root)
+	require.NoError(t, err)
+
+	id, err := NewID()
+	require.NoError(t, err)
+
+	data := append([]byte(encryptionMagic), make([]byte, encryptedHeaderSize)...)
+	f, err := fs.Create(id, int64(len(data)), false)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, fs.Commit(id, FileInfo{ID: id, Size: int64(len(data))}))
+
+	// the file is read as stored, also once the store has a key
+	for _, keys := range [][]*MasterKey{nil, {newTestKey(t)}} {
+		fs, err := CreateFileStore(root, keys...)
+		require.NoError(t, err)
+
+		rf, err := fs.OpenReadOnly(id)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rf)
+		require.NoError(t, err)
+		require.NoError(t, rf.Close())
+		require.Equal(t, data, got)
+	}
+}
+
+func TestRewrapKeys(t *testing.T) {
+	oldKey := newTestKey(t)
+	newKey := newTestKey(t)
+	root := t.TempDir()
+
+	fs, err := CreateFileStore(root, oldKey)
+	require.NoError(t, err)
+
+	id, err := NewID()
+	require.NoError(t, err)
+
+	f, err := fs.Create(id, 21, false)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello encrypted world"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, fs.Commit(id, FileInfo{ID: id, Size: 21, Encrypted: true}))
+
+	count, err := RewrapKeys(root, newKey, oldKey)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// files that already use the new key are left alone
+	count, err = RewrapKeys(root, newKey, oldKey)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	fs, err = CreateFileStore(root, newKey)
+	require.NoError(t, err)
+	rf, err := fs.OpenReadOnly(id)
+	require.NoError(t, err)
+	defer rf.Close()
+	got, err := io.ReadAll(rf)
+	require.NoError(t, err)
+	require.Equal(t, "hello encrypted world", string(got))
+
+	fs, err = CreateFileStore(root, oldKey)
+	require.NoError(t, err)
+	_, err = fs.OpenReadOnly(id)
+	require.ErrorIs(t, err, ErrUnknownMasterKey)
+}
+
+func TestRewrapInterrupted(t *testing.T) {
+	oldKey := newTestKey(t)
+	newKey := newTestKey(t)
+	root := t.TempDir()
+
+	fs, err := CreateFileStore(root, oldKey)
+	require.NoError(t, err)
+
+	id, err := NewID()
+	require.NoError(t, err)
+
+	f, err := fs.Create(id, 21, false)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello encrypted world"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, fs.Commit(id, FileInfo{ID: id, Size: 21, Encrypted: true}))
+
+	filename, err := fs.Map(id)
+	require.NoError(t, err)
+
+	// crash after saving the new header and writing half of it
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.NoError(t, err)
+	header, err := readEncryptedHeader(file, []*MasterKey{oldKey})
+	require.NoError(t, err)
+	rewrapped, err := newEncryptedHeader(header.dataKey, newKey, header.size)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filename+rewrapSuffix, rewrapped, 0600))
+	_, err = file.WriteAt(rewrapped[:len(rewrapped)/2], 0)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// the next run completes the header
+	_, err = RewrapKeys(root, newKey, oldKey)
+	require.NoError(t, err)
+	require.NoFileExists(t, filename+rewrapSuffix)
+
+	fs, err = CreateFileStore(root, newKey)
+	require.NoError(t, err)
+	rf, err := fs.OpenReadOnly(id)
+	require.NoError(t, err)
+	defer rf.Close()
+	got, err := io.ReadAll(rf)
+	require.NoError(t, err)
+	require.Equal(t, "hello encrypted world", string(got))
+}
+
+func TestEncryptedService(t *testing.T) {
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		EncryptionKeys:     []*MasterKey{newTestKey(t)},
+	})
+
+	filename := randomFile(t, 5*minBlockSize+17)
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id, err := client.Upload(filename)
+	require.NoError(t, err)
+
+	dst := path.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.Download(ID(id), dst))
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// ranged download
+	stream, err := client.client.Download(context.Background(), &tv1.DownloadRequest{
+		Id:     id,
+		Offset: minBlockSize + 123,
+		Length: 2 * minBlockSize,
+	})
+	require.NoError(t, err)
+
+	var ranged []byte
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		ranged = append(ranged, res.Data...)
+	}
+	require.Equal(t, data[minBlockSize+123:3*minBlockSize+123], ranged)
+}
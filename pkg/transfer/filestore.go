@@ -1,39 +1,124 @@
 package transfer
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 // FileStore is a file store for the transfer service. If multiple
 // implementations are required this can be turned into an interface.
+//
+// Uploads in progress are written to a separate staging tree and are only
+// moved into the main tree by Commit once they are complete, so everything
+// in the main tree is a finished file.
+//
+// If the file store has master keys, new files are encrypted at rest using
+// the first key.  Files that were stored without encryption can still be read.
+// Whether a file is encrypted is recorded in its FileInfo, and by the caller
+// for files in the staging tree.
 type FileStore struct {
-	root string
+	mu      sync.Mutex
+	root    string
+	staging string
+	content string
+	keys    []*MasterKey
+}
+
+// WriteFile is a file being written to the staging tree.
+type WriteFile interface {
+	io.WriteCloser
+
+	// Sync flushes what has been written to disk.
+	Sync() error
+
+	// Rewind truncates the file to offset and continues writing from there.
+	Rewind(offset int64) error
+
+	Name() string
+}
+
+// ReadFile is a file opened for reading.
+type ReadFile interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+
+	Name() string
+}
+
+// plainFile is an unencrypted WriteFile.
+type plainFile struct {
+	*os.File
+}
+
+// FileInfo is the information stored alongside each finished file.
+type FileInfo struct {
+	ID           ID                `json:"id"`
+	Size         int64             `json:"size"`
+	SHA256       []byte            `json:"sha256,omitempty"`
+	Metadata     []byte            `json:"metadata,omitempty"`
+	Owner        string            `json:"owner,omitempty"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	Created      time.Time         `json:"created"`
+	Encrypted    bool              `json:"encrypted,omitempty"`
+	Processing   *ProcessingStatus `json:"processing,omitempty"`
 }
 
 const (
 	dirPermissions  = 0700
 	filePermissions = 0600
+
+	// stagingDir is the directory under the root where uploads in progress are
+	// kept. It starts with a dot so it can never collide with the directories
+	// generated from IDs.
+	stagingDir = ".staging"
+
+	// infoSuffix is appended to the filename of a finished file to get the
+	// name of the file holding its FileInfo.
+	infoSuffix = ".json"
+
+	// uploadsFile is the file in the staging tree where the uploads in
+	// progress are saved when the server shuts down.
+	uploadsFile = ".uploads.json"
 )
 
 // CreateFileStore creates a new FileStore instance.  If the root directory does
-// not already exist it will be created.
-func CreateFileStore(root string) (*FileStore, error) {
+// not already exist it will be created.  If any master keys are given files
+// are encrypted using the first key, and the other keys can be used to read
+// files encrypted with older keys.
+func CreateFileStore(root string, keys ...*MasterKey) (*FileStore, error) {
 	// this is a no-op if the directory already exists
 	err := os.MkdirAll(root, dirPermissions)
 	if err != nil {
 		return nil, fmt.Errorf("error creating filestore root directory: %w", err)
 	}
 
-	return &FileStore{root: root}, err
+	return &FileStore{
+		root:    root,
+		staging: path.Join(root, stagingDir),
+		content: path.Join(root, contentDir),
+		keys:    keys,
+	}, err
 }
 
-// Create file for append only.
-func (f *FileStore) Create(id ID) (*os.File, error) {
-	path, err := f.Map(id)
+// Encrypts returns true if new files are encrypted.
+func (f *FileStore) Encrypts() bool {
+	return len(f.keys) > 0
+}
+
+// Create file for append only in the staging tree.  The file will hold size
+// bytes, and is encrypted if Encrypts returns true.  If syncWrites is true the
+// file is opened with O_SYNC so that every write is flushed to disk.
+func (f *FileStore) Create(id ID, size int64, syncWrites bool) (WriteFile, error) {
+	path, err := f.MapStaging(id)
 	if err != nil {
 		return nil, err
 	}
@@ -43,25 +128,173 @@ func (f *FileStore) Create(id ID) (*os.File, error) {
 		return nil, fmt.Errorf("path %s: %w", path, err)
 	}
 
-	fd, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_SYNC, filePermissions)
+	flags := os.O_CREATE | os.O_EXCL | os.O_WRONLY
+	if len(f.keys) > 0 {
+		// encrypted files need to read back partial chunks when rewinding
+		flags = os.O_CREATE | os.O_EXCL | os.O_RDWR
+	}
+
+	if syncWrites {
+		flags |= os.O_SYNC
+	}
+
+	fd, err := os.OpenFile(path, flags, filePermissions)
+	if err != nil {
+		return nil, fmt.Errorf("path %s: %w", path, err)
+	}
+
+	if len(f.keys) == 0 {
+		return plainFile{fd}, nil
+	}
+
+	w, err := newEncryptedWriter(fd, f.keys[0], size, syncWrites)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("path %s: %w", path, err)
+	}
+	return w, nil
+}
+
+// Reopen opens an unfinished file in the staging tree so that writing can
+// continue at offset.  Anything after offset is truncated.  Encrypted is
+// whether the file was created encrypted.
+func (f *FileStore) Reopen(id ID, offset int64, encrypted bool, syncWrites bool) (WriteFile, error) {
+	path, err := f.MapStaging(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// we can only continue from data we actually have
+	size, err := plainSize(path, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	if size < offset {
+		return nil, fmt.Errorf("path %s: has %d bytes, expected at least %d", path, size, offset)
+	}
+
+	flags := os.O_RDWR
+	if syncWrites {
+		flags |= os.O_SYNC
+	}
+
+	fd, err := os.OpenFile(path, flags, filePermissions)
 	if err != nil {
 		return nil, fmt.Errorf("path %s: %w", path, err)
 	}
-	return fd, nil
+
+	var w WriteFile = plainFile{fd}
+	if encrypted {
+		w, err = openEncryptedWriter(fd, f.keys, syncWrites)
+		if err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("path %s: %w", path, err)
+		}
+	}
+
+	err = w.Rewind(offset)
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("path %s: unable to rewind to offset %d: %w", path, offset, err)
+	}
+	return w, nil
+}
+
+// Commit atomically moves a finished file from the staging tree into the
+// main tree and stores its FileInfo.
+func (f *FileStore) Commit(id ID, info FileInfo) error {
+	src, err := f.MapStaging(id)
+	if err != nil {
+		return err
+	}
+
+	dst, err := f.Map(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), dirPermissions)
+	if err != nil {
+		return fmt.Errorf("path %s: %w", dst, err)
+	}
+
+	// the info is written first so finished files always have one
+	err = f.writeInfo(dst, info)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(src, dst)
+	if err != nil {
+		os.Remove(dst + infoSuffix)
+		return fmt.Errorf("commit %s: %w", id, err)
+	}
+
+	// make sure the rename itself is durable
+	err = syncDir(filepath.Dir(dst))
+	if err != nil {
+		return fmt.Errorf("path %s: %w", dst, err)
+	}
+
+	return removeEmptyDirsUpTo(filepath.Dir(src), f.staging)
 }
 
 // OpenReadOnly open file for read only
-func (f *FileStore) OpenReadOnly(id ID) (*os.File, error) {
+func (f *FileStore) OpenReadOnly(id ID) (ReadFile, error) {
 	path, err := f.Map(id)
 	if err != nil {
 		return nil, err
 	}
 
+	info, err := f.ReadInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	return f.open(path, info.Encrypted)
+}
+
+// OpenStaging opens an unfinished file that has been written in full for
+// reading.  Encrypted is whether the file was created encrypted.
+func (f *FileStore) OpenStaging(id ID, encrypted bool) (ReadFile, error) {
+	path, err := f.MapStaging(id)
+	if err != nil {
+		return nil, err
+	}
+	return f.open(path, encrypted)
+}
+
+// open the file at path for reading, decrypting it if it is encrypted.
+func (f *FileStore) open(path string, encrypted bool) (ReadFile, error) {
 	fd, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("path %s: %w", path, err)
 	}
-	return fd, nil
+
+	if !encrypted {
+		return fd, nil
+	}
+
+	r, err := newEncryptedReader(fd, f.keys)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("path %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// plainSize returns the size of the plaintext written to the file at path so
+// far.
+func plainSize(path string, encrypted bool) (int64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if !encrypted {
+		return stat.Size(), nil
+	}
+	return encryptedPlainSize(stat.Size())
 }
 
 // Map id to filename
@@ -74,21 +307,213 @@ func (f *FileStore) Map(id ID) (string, error) {
 	return path.Join(f.root, pathComponents, id.String()), nil
 }
 
-// Remove file by id.
+// MapStaging maps id to the filename used while the upload is in progress.
+func (f *FileStore) MapStaging(id ID) (string, error) {
+	pathComponents, err := id.LowerBitPathComponents()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(f.staging, pathComponents, id.String()), nil
+}
+
+// List the IDs of all finished files.
+func (f *FileStore) List() ([]ID, error) {
+	var ids []ID
+
+	err := filepath.WalkDir(f.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// skip the staging tree and anything else that isn't part of the main tree
+		if d.IsDir() && path != f.root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		id, err := ParseID(d.Name())
+		if err != nil {
+			return nil
+		}
+
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", f.root, err)
+	}
+
+	return ids, nil
+}
+
+// ReadInfo returns the FileInfo of a finished file.
+func (f *FileStore) ReadInfo(id ID) (FileInfo, error) {
+	path, err := f.Map(id)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	data, err := os.ReadFile(path + infoSuffix)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("path %s: %w", path, err)
+	}
+
+	var info FileInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("error parsing info for [%s]: %w", id, err)
+	}
+	return info, nil
+}
+
+// UpdateInfo atomically replaces the FileInfo of a finished file with what
+// update makes of it.
+func (f *FileStore) UpdateInfo(id ID, update func(*FileInfo)) error {
+	path, err := f.Map(id)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := f.ReadInfo(id)
+	if err != nil {
+		return err
+	}
+
+	update(&info)
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to serialize info for [%s]: %w", id, err)
+	}
+
+	tmp := path + infoSuffix + ".tmp"
+	err = os.WriteFile(tmp, data, filePermissions)
+	if err != nil {
+		return fmt.Errorf("path %s: %w", path, err)
+	}
+
+	err = os.Rename(tmp, path+infoSuffix)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("path %s: %w", path, err)
+	}
+	return nil
+}
+
+// saveUploads saves the records of the uploads in progress, replacing any
+// records saved earlier.  Saving no records removes them.
+func (f *FileStore) saveUploads(records []uploadRecord) error {
+	name := path.Join(f.staging, uploadsFile)
+	if len(records) == 0 {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("path %s: %w", name, err)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("failed to serialize uploads: %w", err)
+	}
+
+	err = os.MkdirAll(f.staging, dirPermissions)
+	if err != nil {
+		return fmt.Errorf("path %s: %w", f.staging, err)
+	}
+
+	tmp := name + ".tmp"
+	err = os.WriteFile(tmp, data, filePermissions)
+	if err != nil {
+		return fmt.Errorf("path %s: %w", name, err)
+	}
+
+	err = os.Rename(tmp, name)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("path %s: %w", name, err)
+	}
+	return syncDir(f.staging)
+}
+
+// readUploads returns the upload records saved by saveUploads.
+func (f *FileStore) readUploads() ([]uploadRecord, error) {
+	name := path.Join(f.staging, uploadsFile)
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("path %s: %w", name, err)
+	}
+
+	var records []uploadRecord
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", name, err)
+	}
+	return records, nil
+}
+
+// Remove file by id.  If the file shares its content with other files the
+// content is only removed along with the last file referring to it.
 func (f *FileStore) Remove(id ID) error {
 	path, err := f.Map(id)
 	if err != nil {
 		return err
 	}
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := f.ReadInfo(id)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
 	err = os.Remove(path)
 	if err != nil {
 		return fmt.Errorf("path %s: %w", path, err)
 	}
 
+	err = os.Remove(path + infoSuffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("path %s: %w", path, err)
+	}
+
+	if len(info.SHA256) > 0 {
+		err = f.releaseContent(info.SHA256, id)
+		if err != nil {
+			return err
+		}
+	}
+
 	return removeEmptyDirsUpTo(filepath.Dir(path), f.root)
 }
 
+// RemoveStaging removes an unfinished file by id.
+func (f *FileStore) RemoveStaging(id ID) error {
+	path, err := f.MapStaging(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("path %s: %w", path, err)
+	}
+
+	return removeEmptyDirsUpTo(filepath.Dir(path), f.staging)
+}
+
 // removeEmptyDirsUpTo removes all empty directories up to, but not including, root.
 func removeEmptyDirsUpTo(path, root string) error {
 	path = filepath.Clean(path)
@@ -114,6 +539,42 @@ func removeEmptyDirsUpTo(path, root string) error {
 	return nil
 }
 
+// Rewind truncates the file to offset and continues writing from there.
+func (p plainFile) Rewind(offset int64) error {
+	err := p.Truncate(offset)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.Seek(offset, io.SeekStart)
+	return err
+}
+
+// writeInfo writes info next to the file at path.
+func (f *FileStore) writeInfo(path string, info FileInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to serialize info for [%s]: %w", info.ID, err)
+	}
+
+	err = os.WriteFile(path+infoSuffix, data, filePermissions)
+	if err != nil {
+		return fmt.Errorf("path %s: %w", path, err)
+	}
+	return nil
+}
+
+// syncDir flushes the directory entries of path to disk.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
 func isDirEmpty(path string) (bool, error) {
 	f, err := os.Open(path)
 	if err != nil {
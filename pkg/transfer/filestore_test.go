@@ -25,7 +25,7 @@ func TestFileStore(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, fullpath)
 
-	f, err := fs.Create(id)
+	f, err := fs.Create(id, 1024, true)
 	require.NoError(t, err)
 	require.NotNil(t, f)
 
@@ -41,6 +41,33 @@ func TestFileStore(t *testing.T) {
 	require.Equal(t, 1024, nn)
 	require.NoError(t, f.Close())
 
+	// the file is not visible until it has been committed
+	_, err = fs.OpenReadOnly(id)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	ids, err := fs.List()
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	stagingPath, err := fs.MapStaging(id)
+	require.NoError(t, err)
+	require.FileExists(t, stagingPath)
+
+	require.NoError(t, fs.Commit(id, FileInfo{ID: id, Size: 1024}))
+	require.NoFileExists(t, stagingPath)
+
+	// committing cleans up the staging directories
+	empty, err := isDirEmpty(path.Join(root, stagingDir))
+	require.NoError(t, err)
+	require.True(t, empty)
+
+	ids, err = fs.List()
+	require.NoError(t, err)
+	require.Equal(t, []ID{id}, ids)
+
+	info, err := fs.ReadInfo(id)
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), info.Size)
+
 	// read the data
 	readbuf := make([]byte, 1024)
 	rf, err := fs.OpenReadOnly(id)
@@ -62,6 +89,7 @@ func TestFileStore(t *testing.T) {
 	require.NoError(t, fs.Remove(id))
 
 	require.NoFileExists(t, fullpath)
+	require.NoFileExists(t, fullpath+infoSuffix)
 	require.NoDirExists(t, strings.Join(full[:len(full)-1], string(os.PathSeparator)))
 	require.DirExists(t, target)
 
@@ -0,0 +1,324 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of thing that happened to an upload.
+type EventType int
+
+// event types
+const (
+	// EventCreated is sent when an upload has been created.
+	EventCreated EventType = iota + 1
+	// EventProgress is sent after every block written to an upload.
+	EventProgress
+	// EventFinished is sent when the whole file has been received and
+	// verified.  If there is a processing pipeline the file can't be
+	// downloaded until EventProcessed.
+	EventFinished
+	// EventFailed is sent when an upload stream ends without finishing the
+	// upload, either because the stream broke, because the client closed it
+	// early, because a block was rejected, because the service is shutting
+	// down or because the file failed checksum verification.  Err says what
+	// went wrong.  Only checksum failures are final, the client can resume the
+	// upload after the others.
+	EventFailed
+	// EventExpired is sent when a quarantined file has been removed because
+	// it was kept longer than the quarantine retention period.  Other files
+	// are kept until they are removed by something outside the service.
+	EventExpired
+	// EventDeleted is sent when a quarantined file has been purged on
+	// request.
+	EventDeleted
+	// EventProcessed is sent when the processing pipeline has finished with
+	// a file, which can be downloaded from then on.
+	EventProcessed
+	// EventProcessingFailed is sent when a processing step failed.  Err says
+	// what went wrong.  The file stays stored but can't be downloaded.
+	EventProcessingFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCreated:
+		return "created"
+	case EventProgress:
+		return "progress"
+	case EventFinished:
+		return "finished"
+	case EventFailed:
+		return "failed"
+	case EventExpired:
+		return "expired"
+	case EventDeleted:
+		return "deleted"
+	case EventProcessed:
+		return "processed"
+	case EventProcessingFailed:
+		return "processing-failed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// ParseEventType parses the name of an event type as returned by String().
+func ParseEventType(s string) (EventType, error) {
+	for t := EventCreated; t <= EventProcessingFailed; t++ {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event type [%s]", s)
+}
+
+// Event describes something that happened to an upload or a file.  Filename
+// is where the file is stored, if it is stored.  Owner is the principal that
+// created the upload and Principal is the principal of the call that caused
+// the event, which is nil for anonymous calls and events caused by the server
+// itself.  Peer is the address of the client, if any.
+type Event struct {
+	Type         EventType
+	ID           ID
+	Filename     string
+	Size         int64
+	Offset       int64
+	SHA256       []byte
+	Metadata     []byte
+	StorageClass string
+	Owner        string
+	Principal    *Principal
+	Peer         string
+	Err          error
+	Time         time.Time
+}
+
+// Hook is notified of upload events.  Hooks are called from a goroutine of
+// their own, one event at a time in the order the events happened.  The
+// context carries the values of the call that caused the event, such as the
+// principal, but is not canceled when the call ends.
+type Hook interface {
+	HandleEvent(ctx context.Context, e Event)
+}
+
+// HookFunc lets an ordinary function be used as a Hook.
+type HookFunc func(ctx context.Context, e Event)
+
+// HandleEvent implements Hook.
+func (f HookFunc) HandleEvent(ctx context.Context, e Event) {
+	f(ctx, e)
+}
+
+const (
+	defaultHookQueueSize = 1024
+	hookDrainTimeout     = 5 * time.Second
+)
+
+// hookRunner runs a hook from its own goroutine.  The queue is bounded so a
+// slow hook never holds up the uploads or uses up memory.  When it is full
+// EventCreated and EventProgress are dropped first, since the other events
+// tell the hook how an upload or file ended up, and those are only dropped
+// when the queue holds nothing else.
+type hookRunner struct {
+	hook  Hook
+	size  int
+	mu    sync.Mutex
+	queue []queuedEvent
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+type queuedEvent struct {
+	ctx   context.Context
+	event Event
+}
+
+// hooks dispatches events to all the hooks.
+type hooks struct {
+	mu      sync.RWMutex
+	closed  bool
+	runners []*hookRunner
+	dropped atomic.Int64
+}
+
+func newHooks(hs []Hook, queueSize int) *hooks {
+	if queueSize <= 0 {
+		queueSize = defaultHookQueueSize
+	}
+
+	h := &hooks{}
+	for _, hook := range hs {
+		r := &hookRunner{
+			hook: hook,
+			size: queueSize,
+			wake: make(chan struct{}, 1),
+			done: make(chan struct{}),
+		}
+		go r.run()
+		h.runners = append(h.runners, r)
+	}
+	return h
+}
+
+// droppable returns true for the events that may be dropped when a hook falls
+// behind.
+func (t EventType) droppable() bool {
+	return t == EventCreated || t == EventProgress
+}
+
+// push queues q and returns the number of events dropped to stay within the
+// size of the queue.  When the queue is full, the oldest event that may be
+// dropped makes room for an event that may not, and only if there is none is
+// that event dropped too.
+func (r *hookRunner) push(q queuedEvent) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dropped := 0
+	if len(r.queue) >= r.size {
+		if q.event.Type.droppable() {
+			return 1
+		}
+
+		i := slices.IndexFunc(r.queue, func(q queuedEvent) bool { return q.event.Type.droppable() })
+		if i < 0 {
+			return 1
+		}
+		r.queue = slices.Delete(r.queue, i, i+1)
+		dropped++
+	}
+
+	r.queue = append(r.queue, q)
+	r.signal()
+	return dropped
+}
+
+// pop returns the next event, or false once the queue has been closed and
+// emptied.
+func (r *hookRunner) pop() (queuedEvent, bool) {
+	for {
+		r.mu.Lock()
+		if len(r.queue) > 0 {
+			q := r.queue[0]
+			r.queue[0] = queuedEvent{}
+			r.queue = r.queue[1:]
+			r.mu.Unlock()
+			return q, true
+		}
+		r.mu.Unlock()
+
+		_, ok := <-r.wake
+		if !ok {
+			return queuedEvent{}, false
+		}
+	}
+}
+
+func (r *hookRunner) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *hookRunner) run() {
+	defer close(r.done)
+	for {
+		q, ok := r.pop()
+		if !ok {
+			return
+		}
+		r.handle(q)
+	}
+}
+
+func (r *hookRunner) handle(q queuedEvent) {
+	ctx, span := startChildSpan(q.ctx, "hook "+q.event.Type.String(),
+		attrEvent.String(q.event.Type.String()), attrID.String(q.event.ID.String()))
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("hook panicked", "event", q.event.Type, "id", q.event.ID, "err", err)
+			endSpan(span, fmt.Errorf("hook panicked: %v", err))
+			return
+		}
+		span.End()
+	}()
+	r.hook.HandleEvent(ctx, q.event)
+}
+
+// send queues e for every hook.
+func (h *hooks) send(ctx context.Context, e Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.closed || len(h.runners) == 0 {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	q := queuedEvent{ctx: context.WithoutCancel(ctx), event: e}
+	for _, r := range h.runners {
+		dropped := r.push(q)
+		if dropped > 0 {
+			h.dropped.Add(int64(dropped))
+			slog.Warn("hook queue full, dropped events", "event", e.Type, "id", e.ID, "dropped", dropped)
+		}
+	}
+}
+
+// close stops accepting events and waits for the hooks to handle the events
+// they have queued, but no longer than timeout.
+func (h *hooks) close(timeout time.Duration) {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	for _, r := range h.runners {
+		close(r.wake)
+	}
+	h.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for _, r := range h.runners {
+		select {
+		case <-r.done:
+		case <-deadline:
+			slog.Warn("gave up waiting for hooks to finish")
+			return
+		}
+	}
+}
+
+// uploadEvent creates an event for up caused by the call in ctx.
+func (s *Service) uploadEvent(ctx context.Context, t EventType, up *upload, err error) Event {
+	filename := up.Filename()
+	if t == EventFinished {
+		filename, _ = s.fileStore.Map(up.ID)
+	}
+
+	return Event{
+		Type:         t,
+		ID:           up.ID,
+		Filename:     filename,
+		Size:         up.Size,
+		Offset:       up.Offset(),
+		SHA256:       up.FileSHA256,
+		Metadata:     up.Metadata,
+		StorageClass: up.StorageClass,
+		Owner:        up.Owner,
+		Principal:    PrincipalFromContext(ctx),
+		Peer:         peerAddress(ctx),
+		Err:          err,
+	}
+}
@@ -0,0 +1,241 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"path"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// eventRecorder is a hook that records the events it gets.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) HandleEvent(_ context.Context, e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// types waits until the recorder has seen n events and returns their types.
+func (r *eventRecorder) types(t *testing.T, n int) []EventType {
+	var types []EventType
+	require.Eventually(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		types = nil
+		for _, e := range r.events {
+			types = append(types, e.Type)
+		}
+		return len(types) >= n
+	}, 5*time.Second, 10*time.Millisecond)
+	return types
+}
+
+// waitFor waits until the recorder has seen an event of type typ.
+func (r *eventRecorder) waitFor(t *testing.T, typ EventType) {
+	require.Eventually(t, func() bool {
+		return slices.Contains(r.typesExcept(), typ)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// typesExcept returns the types of the events seen so far, leaving out skip.
+func (r *eventRecorder) typesExcept(skip ...EventType) []EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var types []EventType
+	for _, e := range r.events {
+		if !slices.Contains(skip, e.Type) {
+			types = append(types, e.Type)
+		}
+	}
+	return types
+}
+
+func (r *eventRecorder) last() Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[len(r.events)-1]
+}
+
+func TestHooks(t *testing.T) {
+	recorder := &eventRecorder{}
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		Quarantine:         true,
+		Hooks:              []Hook{recorder},
+		Authorizer:         OwnerAuthorizer{Admins: []string{"root"}},
+	})
+	root := ContextWithPrincipal(context.Background(), &Principal{Name: "root"})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id, err := client.Upload(randomFile(t, 3*minBlockSize))
+	require.NoError(t, err)
+
+	require.Equal(t, []EventType{EventCreated, EventProgress, EventProgress, EventProgress, EventFinished}, recorder.types(t, 5))
+	finished := recorder.last()
+	require.Equal(t, ID(id), finished.ID)
+	require.Equal(t, int64(3*minBlockSize), finished.Size)
+	require.Equal(t, finished.Size, finished.Offset)
+	require.Len(t, finished.SHA256, sha256.Size)
+	require.NotEmpty(t, finished.Peer)
+	require.FileExists(t, finished.Filename)
+	require.NoError(t, finished.Err)
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	raw := tv1.NewTransferServiceClient(conn)
+
+	// the client closes the stream before sending the whole file
+	data := []byte("not all of it")
+	resp, err := raw.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 100})
+	require.NoError(t, err)
+
+	stream, err := raw.Upload(context.Background())
+	require.NoError(t, err)
+	checksum := sha256.Sum256(data)
+	require.NoError(t, stream.Send(&tv1.UploadRequest{Id: resp.Id, Data: data, Sha256: checksum[:]}))
+	_, err = stream.CloseAndRecv()
+	requireCode(t, codes.FailedPrecondition, err)
+
+	recorder.types(t, 8)
+	failed := recorder.last()
+	require.Equal(t, EventFailed, failed.Type)
+	require.Equal(t, ID(resp.Id), failed.ID)
+	require.Equal(t, int64(len(data)), failed.Offset)
+	require.Error(t, failed.Err)
+
+	// the file fails checksum verification
+	bogus := sha256.Sum256([]byte("something else"))
+	resp, err = raw.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: int64(len(data)), FileSha256: bogus[:]})
+	require.NoError(t, err)
+
+	stream, err = raw.Upload(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&tv1.UploadRequest{Id: resp.Id, Data: data, Sha256: checksum[:]}))
+	_, err = stream.CloseAndRecv()
+	requireCode(t, codes.FailedPrecondition, err)
+
+	recorder.types(t, 11)
+	failed = recorder.last()
+	require.Equal(t, EventFailed, failed.Type)
+	var mismatch *ChecksumMismatchError
+	require.True(t, errors.As(failed.Err, &mismatch))
+
+	_, err = service.PurgeQuarantine(root, &tv1.PurgeQuarantineRequest{Ids: []string{resp.Id}})
+	require.NoError(t, err)
+
+	recorder.types(t, 12)
+	deleted := recorder.last()
+	require.Equal(t, EventDeleted, deleted.Type)
+	require.Equal(t, ID(resp.Id), deleted.ID)
+
+	// a block is rejected
+	resp, err = raw.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 100})
+	require.NoError(t, err)
+
+	stream, err = raw.Upload(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&tv1.UploadRequest{Id: resp.Id, Data: data, Sha256: bogus[:]}))
+	_, err = stream.CloseAndRecv()
+	requireCode(t, codes.DataLoss, err)
+
+	recorder.types(t, 14)
+	failed = recorder.last()
+	require.Equal(t, EventFailed, failed.Type)
+	require.Equal(t, ID(resp.Id), failed.ID)
+	requireCode(t, codes.DataLoss, failed.Err)
+}
+
+func TestSlowHook(t *testing.T) {
+	release := make(chan struct{})
+	var handled []EventType
+	slow := HookFunc(func(_ context.Context, e Event) {
+		<-release
+		handled = append(handled, e.Type)
+	})
+
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		Hooks:              []Hook{slow},
+		HookQueueSize:      2,
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the hook is stuck, but the upload isn't
+	_, err = client.Upload(randomFile(t, 10*minBlockSize))
+	require.NoError(t, err)
+
+	close(release)
+	service.hooks.close(time.Second)
+	// created, 10 x progress and finished, of which only the progress
+	// events that fit in the queue were kept, but never the finished event
+	require.GreaterOrEqual(t, len(handled), 2)
+	require.Less(t, len(handled), 12)
+	require.Equal(t, EventFinished, handled[len(handled)-1])
+	require.Equal(t, int64(12-len(handled)), service.hooks.dropped.Load())
+}
+
+func TestHookQueueBounded(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handled []EventType
+	stuck := HookFunc(func(_ context.Context, e Event) {
+		if len(handled) == 0 {
+			close(started)
+			<-release
+		}
+		handled = append(handled, e.Type)
+	})
+
+	h := newHooks([]Hook{stuck}, 2)
+	h.send(context.Background(), Event{Type: EventFinished})
+	<-started
+
+	// progress events make way for the others, but the queue never grows
+	// beyond its size
+	h.send(context.Background(), Event{Type: EventProgress})
+	h.send(context.Background(), Event{Type: EventProgress})
+	h.send(context.Background(), Event{Type: EventFailed})
+	h.send(context.Background(), Event{Type: EventDeleted})
+	h.send(context.Background(), Event{Type: EventExpired})
+	require.Equal(t, int64(3), h.dropped.Load())
+
+	close(release)
+	h.close(time.Second)
+	require.Equal(t, []EventType{EventFinished, EventFailed, EventDeleted}, handled)
+}
+
+func TestParseEventType(t *testing.T) {
+	for e := EventCreated; e <= EventProcessingFailed; e++ {
+		parsed, err := ParseEventType(e.String())
+		require.NoError(t, err)
+		require.Equal(t, e, parsed)
+	}
+
+	_, err := ParseEventType("exploded")
+	require.Error(t, err)
+}
@@ -2,30 +2,58 @@ package transfer
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"sync"
+	"time"
 )
 
 // uploadManager takes care of managing uploads that are in progress
 type uploadManager struct {
+	mu        sync.Mutex
 	uploads   map[ID]*upload
 	fileStore *FileStore
+	sync      syncPolicy
+
+	// records of saved uploads that couldn't be restored, kept so that
+	// they can be retried after the next restart
+	unrestored []uploadRecord
 }
 
 // newManager creates a new upload manager
-func newManager(fileStore *FileStore) (*uploadManager, error) {
+func newManager(fileStore *FileStore, sync syncPolicy) (*uploadManager, error) {
 	return &uploadManager{
 		uploads:   map[ID]*upload{},
 		fileStore: fileStore,
+		sync:      sync,
 	}, nil
 }
 
 // errors
 var (
 	ErrChecksumForFileMismatch = errors.New("checksum mismatch for whole file")
+	ErrUploadIncomplete        = errors.New("upload incomplete")
 )
 
+// ChecksumMismatchError is returned from Finish when the checksum of the
+// whole file does not match the expected checksum.  It wraps
+// ErrChecksumForFileMismatch.
+type ChecksumMismatchError struct {
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%v: expected %x, got %x", ErrChecksumForFileMismatch, e.Expected, e.Actual)
+}
+
+func (e *ChecksumMismatchError) Unwrap() error {
+	return ErrChecksumForFileMismatch
+}
+
 // CreateUpload creates a new upload
 func (m *uploadManager) CreateUpload(size int64, fileSHA256 []byte, meta []byte) (*upload, error) {
 	id, err := NewID()
@@ -33,12 +61,15 @@ func (m *uploadManager) CreateUpload(size int64, fileSHA256 []byte, meta []byte)
 		return nil, err
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	_, ok := m.uploads[id]
 	if ok {
 		return nil, fmt.Errorf("inconsistency: id [%s] already exists", id)
 	}
 
-	uploadFile, err := m.fileStore.Create(id)
+	uploadFile, err := m.fileStore.Create(id, size, m.sync.mode == SyncAlways)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create incoming file: %w", err)
 	}
@@ -49,6 +80,10 @@ func (m *uploadManager) CreateUpload(size int64, fileSHA256 []byte, meta []byte)
 		file:       uploadFile,
 		Metadata:   meta,
 		FileSHA256: fileSHA256,
+		Encrypted:  m.fileStore.Encrypts(),
+		sync:       m.sync,
+		lastSync:   time.Now(),
+		created:    time.Now(),
 	}
 
 	m.uploads[id] = upload
@@ -58,11 +93,16 @@ func (m *uploadManager) CreateUpload(size int64, fileSHA256 []byte, meta []byte)
 
 // GetUpload by id.  Returns nil if the upload does not exist.
 func (m *uploadManager) GetUpload(id ID) *upload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.uploads[id]
 }
 
 // GetUploads returns a slice of all the uploads currently in progress.
 func (m *uploadManager) GetUploads() []*upload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	var uploads []*upload
 	for _, v := range m.uploads {
 		uploads = append(uploads, v)
@@ -72,43 +112,235 @@ func (m *uploadManager) GetUploads() []*upload {
 }
 
 // Finish upload and close file.  If the FileSHA256 is set in the checksum we
-// check that this is correct.
-func (m *uploadManager) Finish(id ID) error {
+// check that this is correct.  Only complete uploads with a correct checksum
+// are committed to the file store, anything else is left in staging.  The
+// upload is only removed once it has been committed or has failed checksum
+// verification, so that finishing it can be retried after other errors.
+func (m *uploadManager) Finish(ctx context.Context, id ID) error {
 	slog.Debug("finishing", "id", id)
 
+	m.mu.Lock()
 	upload, ok := m.uploads[id]
+	if ok && upload.finishing {
+		m.mu.Unlock()
+		return fmt.Errorf("upload [%s] is already being finished", id)
+	}
+
+	if ok {
+		upload.finishing = true
+	}
+	m.mu.Unlock()
+
 	if !ok {
 		return fmt.Errorf("upload [%s] does not exist", id)
 	}
 
+	if upload.Offset() != upload.Size {
+		m.mu.Lock()
+		upload.finishing = false
+		m.mu.Unlock()
+		return fmt.Errorf("%w: [%s] has %d of %d bytes", ErrUploadIncomplete, id, upload.Offset(), upload.Size)
+	}
+
+	err := m.finish(ctx, upload)
+
+	var mismatch *ChecksumMismatchError
+	if err != nil && !errors.As(err, &mismatch) {
+		reopenErr := m.reopen(upload)
+		if reopenErr != nil {
+			return errors.Join(err, reopenErr)
+		}
+		return err
+	}
+
+	m.mu.Lock()
 	delete(m.uploads, id)
+	m.mu.Unlock()
+	return err
+}
+
+// finish closes the file of upload, verifies its checksum and commits it.
+func (m *uploadManager) finish(ctx context.Context, upload *upload) error {
+	id := upload.ID
 
-	err := upload.file.Close()
+	err := upload.Sync()
+	if err != nil {
+		upload.file.Close()
+		return fmt.Errorf("failed to sync upload file [%s]: %w", upload.Filename(), err)
+	}
+
+	err = upload.file.Close()
 	if err != nil {
 		return fmt.Errorf("failed to close upload file [%s]: %w", upload.Filename(), err)
 	}
 
 	// If a checksum is present, verify it
 	if len(upload.FileSHA256) > 0 {
-		sum, err := checksumFile(upload.Filename())
+		_, span := startChildSpan(ctx, "VerifyChecksum", attrID.String(id.String()), attrSize.Int64(upload.Size))
+		sum, err := m.checksumStaging(upload)
 		if err != nil {
-			return fmt.Errorf("checksum failed: %w", err)
+			err = fmt.Errorf("checksum failed: %w", err)
+			endSpan(span, err)
+			return err
 		}
 
 		if !bytes.Equal(sum, upload.FileSHA256) {
-			return ErrChecksumForFileMismatch
+			err := &ChecksumMismatchError{Expected: upload.FileSHA256, Actual: sum}
+			endSpan(span, err)
+			return err
 		}
+		endSpan(span, nil)
+	}
+
+	err = m.fileStore.Commit(id, FileInfo{
+		ID:           id,
+		Size:         upload.Size,
+		SHA256:       upload.FileSHA256,
+		Metadata:     upload.Metadata,
+		Owner:        upload.Owner,
+		StorageClass: upload.StorageClass,
+		Created:      time.Now(),
+		Encrypted:    upload.Encrypted,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to commit upload [%s]: %w", id, err)
 	}
 
 	return nil
 }
 
-// Shutdown the manager.  Closes any remaining unclosed files.
+// reopen reopens the staged file of an upload that couldn't be finished, so
+// that it can be finished later.  If that isn't possible the upload is
+// removed.
+func (m *uploadManager) reopen(up *upload) error {
+	file, err := m.fileStore.Reopen(up.ID, up.Offset(), up.Encrypted, m.sync.mode == SyncAlways)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	up.finishing = false
+	if err != nil {
+		delete(m.uploads, up.ID)
+		return fmt.Errorf("unable to reopen upload [%s]: %w", up.ID, err)
+	}
+
+	up.mu.Lock()
+	up.file = file
+	up.mu.Unlock()
+	return nil
+}
+
+// checksumStaging computes the checksum of the staged file of up.
+func (m *uploadManager) checksumStaging(up *upload) ([]byte, error) {
+	r, err := m.fileStore.OpenStaging(up.ID, up.Encrypted)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return checksumReader(r)
+}
+
+// Shutdown the manager.  The uploads in progress are flushed to disk, closed
+// and saved without being finished, so that they can be resumed by restore
+// after a restart.
 func (m *uploadManager) Shutdown() error {
+	m.mu.Lock()
+	uploads := m.uploads
+	m.uploads = map[ID]*upload{}
+	records := m.unrestored
+	m.mu.Unlock()
+
 	var errs error
-	for key := range m.uploads {
-		errs = errors.Join(errs, m.Finish(key))
+	for _, upload := range uploads {
+		record, err := upload.suspend()
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failed to save upload [%s]: %w", upload.ID, err))
+			continue
+		}
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return errs
 	}
 
+	err := m.fileStore.saveUploads(records)
+	if err != nil {
+		return errors.Join(errs, err)
+	}
+
+	slog.Info("saved uploads in progress", "uploads", len(records))
 	return errs
 }
+
+// restore the uploads saved by Shutdown.  Uploads whose staged file is gone
+// are dropped, while the records of uploads that can't be reopened for other
+// reasons are kept.  The saved records are only replaced once every upload has
+// been reopened, so if restore fails they are left as they were.
+func (m *uploadManager) restore() error {
+	records, err := m.fileStore.readUploads()
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uploads := map[ID]*upload{}
+	var unrestored []uploadRecord
+	for _, r := range records {
+		file, err := m.fileStore.Reopen(r.ID, r.Offset, r.Encrypted, m.sync.mode == SyncAlways)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("dropping saved upload without staged file", "id", r.ID)
+			continue
+		}
+
+		if err != nil {
+			slog.Error("unable to resume upload", "id", r.ID, "err", err)
+			unrestored = append(unrestored, r)
+			continue
+		}
+
+		up := &upload{
+			ID:           r.ID,
+			BaseID:       r.BaseID,
+			Owner:        r.Owner,
+			StorageClass: r.StorageClass,
+			Compression:  r.Compression,
+			Size:         r.Size,
+			Metadata:     r.Metadata,
+			FileSHA256:   r.FileSHA256,
+			Encrypted:    r.Encrypted,
+			file:         file,
+			writeOffset:  r.Offset,
+			syncedOffset: r.Offset,
+			sync:         m.sync,
+			lastSync:     time.Now(),
+			created:      r.Created,
+			blocks:       r.Blocks,
+		}
+
+		if r.DeltaHave != nil {
+			up.delta = &deltaPlan{blockSize: r.DeltaBlock, have: r.DeltaHave}
+		}
+
+		uploads[r.ID] = up
+	}
+
+	err = m.fileStore.saveUploads(unrestored)
+	if err != nil {
+		for _, up := range uploads {
+			up.file.Close()
+		}
+		return err
+	}
+
+	for id, up := range uploads {
+		m.uploads[id] = up
+	}
+	m.unrestored = unrestored
+
+	slog.Info("restored uploads in progress", "uploads", len(uploads), "failed", len(unrestored))
+	return nil
+}
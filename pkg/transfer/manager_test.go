@@ -1,10 +1,16 @@
 package transfer
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"os"
 	"path"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -16,7 +22,7 @@ func TestManager(t *testing.T) {
 	fs, err := CreateFileStore(incoming)
 	require.NoError(t, err)
 
-	m, err := newManager(fs)
+	m, err := newManager(fs, syncPolicy{mode: SyncAlways})
 	require.NoError(t, err)
 
 	wg := sync.WaitGroup{}
@@ -28,7 +34,7 @@ func TestManager(t *testing.T) {
 			upload, err := m.CreateUpload(1000, []byte{}, []byte{0, 0})
 			require.NoError(t, err)
 
-			defer m.Finish(upload.ID)
+			defer m.Finish(context.Background(), upload.ID)
 
 			buf := make([]byte, 100)
 
@@ -53,3 +59,157 @@ func TestManager(t *testing.T) {
 
 	require.NoError(t, m.Shutdown())
 }
+
+func TestManagerRestore(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		keys []*MasterKey
+	}{
+		{name: "plain"},
+		{name: "encrypted", keys: []*MasterKey{newTestKey(t)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			incoming := path.Join(t.TempDir(), "incoming")
+			fs, err := CreateFileStore(incoming, tc.keys...)
+			require.NoError(t, err)
+
+			policy := syncPolicy{mode: SyncPeriodic, bytes: defaultSyncBytes, interval: time.Hour}
+			m, err := newManager(fs, policy)
+			require.NoError(t, err)
+
+			data := make([]byte, 150000)
+			_, err = rand.Read(data)
+			require.NoError(t, err)
+			sum := sha256.Sum256(data)
+
+			up, err := m.CreateUpload(int64(len(data)), sum[:], []byte("meta"))
+			require.NoError(t, err)
+			up.Owner = "alice"
+
+			// stop in the middle of an encrypted chunk
+			_, err = up.Write(data[:100000])
+			require.NoError(t, err)
+			up.LogBlock(0, 100000, nil)
+
+			require.NoError(t, m.Shutdown())
+			require.Nil(t, m.GetUpload(up.ID))
+
+			// a new manager picks up where we left off
+			m, err = newManager(fs, policy)
+			require.NoError(t, err)
+			require.NoError(t, m.restore())
+
+			restored := m.GetUpload(up.ID)
+			require.NotNil(t, restored)
+			require.Equal(t, int64(100000), restored.Offset())
+			require.Equal(t, int64(100000), restored.SyncedOffset())
+			require.Equal(t, "alice", restored.Owner)
+			require.Equal(t, []byte("meta"), restored.Metadata)
+			require.Len(t, restored.Blocks(), 1)
+
+			_, err = restored.Write(data[100000:])
+			require.NoError(t, err)
+			require.NoError(t, m.Finish(context.Background(), up.ID))
+
+			r, err := fs.OpenReadOnly(up.ID)
+			require.NoError(t, err)
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, data, got)
+
+			// uploads are only restored once
+			m, err = newManager(fs, policy)
+			require.NoError(t, err)
+			require.NoError(t, m.restore())
+			require.Empty(t, m.GetUploads())
+		})
+	}
+}
+
+func TestManagerRestoreFailed(t *testing.T) {
+	fs, err := CreateFileStore(path.Join(t.TempDir(), "incoming"))
+	require.NoError(t, err)
+
+	policy := syncPolicy{mode: SyncPeriodic, bytes: defaultSyncBytes, interval: time.Hour}
+	m, err := newManager(fs, policy)
+	require.NoError(t, err)
+
+	data := make([]byte, 1000)
+	var ids []ID
+	for range 2 {
+		up, err := m.CreateUpload(int64(len(data)), nil, nil)
+		require.NoError(t, err)
+		_, err = up.Write(data)
+		require.NoError(t, err)
+		ids = append(ids, up.ID)
+	}
+	require.NoError(t, m.Shutdown())
+
+	// the first upload lost its staged file, the second some of its data
+	gone, err := fs.MapStaging(ids[0])
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(gone))
+	truncated, err := fs.MapStaging(ids[1])
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(truncated, 500))
+
+	m, err = newManager(fs, policy)
+	require.NoError(t, err)
+	require.NoError(t, m.restore())
+	require.Empty(t, m.GetUploads())
+
+	// the record of the upload that couldn't be reopened is kept
+	records, err := fs.readUploads()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, ids[1], records[0].ID)
+
+	require.NoError(t, m.Shutdown())
+	records, err = fs.readUploads()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, ids[1], records[0].ID)
+}
+
+func TestManagerFinishRetry(t *testing.T) {
+	fs, err := CreateFileStore(path.Join(t.TempDir(), "incoming"), newTestKey(t))
+	require.NoError(t, err)
+
+	m, err := newManager(fs, syncPolicy{mode: SyncOnFinish})
+	require.NoError(t, err)
+
+	data := make([]byte, 100000)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+
+	up, err := m.CreateUpload(int64(len(data)), sum[:], nil)
+	require.NoError(t, err)
+	_, err = up.Write(data)
+	require.NoError(t, err)
+
+	// a file where the directory of the finished file goes makes the commit
+	// fail
+	dst, err := fs.Map(up.ID)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Dir(dst)), 0700))
+	require.NoError(t, os.WriteFile(filepath.Dir(dst), nil, 0600))
+
+	require.Error(t, m.Finish(context.Background(), up.ID))
+	require.Same(t, up, m.GetUpload(up.ID))
+	_, err = fs.ReadInfo(up.ID)
+	require.Error(t, err)
+
+	// once the problem is gone the upload can be finished
+	require.NoError(t, os.Remove(filepath.Dir(dst)))
+	require.NoError(t, m.Finish(context.Background(), up.ID))
+	require.Nil(t, m.GetUpload(up.ID))
+
+	r, err := fs.OpenReadOnly(up.ID)
+	require.NoError(t, err)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
@@ -0,0 +1,64 @@
+package transfer
+
+import (
+	rtmetrics "runtime/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	// heapMetric is the runtime metric for the memory used by live objects
+	// and objects that haven't been collected yet.
+	heapMetric = "/memory/classes/heap/objects:bytes"
+
+	// heapSampleInterval is how long we use a heap size before reading it
+	// again.
+	heapSampleInterval = 100 * time.Millisecond
+)
+
+// heapSampler reads the size of the heap.  The size is read at most every
+// heapSampleInterval since we need it for every block.
+type heapSampler struct {
+	mu     sync.Mutex
+	sample []rtmetrics.Sample
+	last   time.Time
+}
+
+func newHeapSampler() *heapSampler {
+	return &heapSampler{sample: []rtmetrics.Sample{{Name: heapMetric}}}
+}
+
+// size returns the size of the heap in bytes.
+func (h *heapSampler) size() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if time.Since(h.last) >= heapSampleInterval {
+		rtmetrics.Read(h.sample)
+		h.last = time.Now()
+	}
+
+	if h.sample[0].Value.Kind() != rtmetrics.KindUint64 {
+		return 0
+	}
+	return int64(h.sample[0].Value.Uint64())
+}
+
+// maxBlockSize returns the largest block we want clients to send right now.
+// Without a memory limit that is the max block size.  With one it shrinks as
+// the heap grows towards the limit, down to the min block size at the limit.
+func (s *Service) maxBlockSize() int64 {
+	limit := s.Limits().MemoryLimit
+	if limit == 0 {
+		return s.blocks.max
+	}
+
+	free := max(limit-s.heapSize(), 0)
+	return s.blocks.clamp(max(s.blocks.max*free/limit, 1))
+}
+
+// preferredBlockSize returns the block size we ask clients to use right now,
+// which is the preferred block size unless we are short of memory.
+func (s *Service) preferredBlockSize() int64 {
+	return min(s.config.PreferredBlockSize, s.maxBlockSize())
+}
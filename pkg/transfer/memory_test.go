@@ -0,0 +1,103 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestHeapSampler(t *testing.T) {
+	require.Positive(t, newHeapSampler().size())
+}
+
+func TestMaxBlockSize(t *testing.T) {
+	const limit = 1 << 30
+
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: 16 * minBlockSize,
+		MaxBlockSize:       64 * minBlockSize,
+		MemoryLimit:        limit,
+	})
+
+	var heap atomic.Int64
+	service.heapSize = heap.Load
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := tv1.NewTransferServiceClient(conn)
+
+	// plenty of memory
+	resp, err := client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 2 * minBlockSize})
+	require.NoError(t, err)
+	require.Equal(t, int64(16*minBlockSize), resp.PreferredBlocksize)
+	require.Equal(t, int64(minBlockSize), resp.MinBlocksize)
+	require.Equal(t, int64(64*minBlockSize), resp.MaxBlocksize)
+
+	// the max shrinks as the heap grows, taking the preferred size with it
+	heap.Store(limit * 7 / 8)
+	offset, err := client.GetOffset(context.Background(), &tv1.GetOffsetRequest{Id: resp.Id})
+	require.NoError(t, err)
+	require.Equal(t, int64(8*minBlockSize), offset.MaxBlocksize)
+	require.Equal(t, int64(8*minBlockSize), offset.PreferredBlocksize)
+
+	// acknowledgements have the max at the time
+	heap.Store(limit)
+	stream, err := client.UploadV2(context.Background())
+	require.NoError(t, err)
+
+	block := make([]byte, minBlockSize)
+	sum := sha256.Sum256(block)
+	require.NoError(t, stream.Send(&tv1.UploadV2Request{Id: resp.Id, Data: block, Sha256: sum[:]}))
+	ack, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(minBlockSize), ack.MaxBlocksize)
+}
+
+func TestAdaptiveUpload(t *testing.T) {
+	const limit = 1 << 30
+
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: 8 * minBlockSize,
+		MemoryLimit:        limit,
+	})
+
+	// the server runs short of memory halfway through the upload, so the
+	// rest of it is sent in smaller blocks
+	var heap atomic.Int64
+	service.heapSize = heap.Load
+
+	filename := randomFile(t, 100*minBlockSize)
+	client, err := CreateClient(ClientConfig{
+		ServerAddr: addr,
+		UploadProgress: func(_ string, offset int64, size int64) {
+			if offset > size/2 {
+				heap.Store(limit)
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id, err := client.Upload(filename)
+	require.NoError(t, err)
+
+	dst := path.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.Download(ID(id), dst))
+
+	expect, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, expect, got)
+}
@@ -0,0 +1,173 @@
+package transfer
+
+import (
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+const metricsNamespace = "transfer"
+
+// metrics are the Prometheus metrics of the service.  Byte counts are what
+// was sent over the wire, so they are after compression.
+type metrics struct {
+	receivedBytes         prometheus.Counter
+	sentBytes             prometheus.Counter
+	blockChecksumFailures prometheus.Counter
+	fileChecksumFailures  prometheus.Counter
+	resumes               prometheus.Counter
+	uploadDuration        prometheus.Histogram
+	uploadSize            prometheus.Histogram
+	downloadErrors        *prometheus.CounterVec
+	throttled             prometheus.Counter
+}
+
+// newMetrics creates the metrics of s and registers them with reg, if it
+// isn't nil.
+func newMetrics(s *Service, reg prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		receivedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "received_bytes_total",
+			Help:      "Bytes of file data received in uploads.",
+		}),
+		sentBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sent_bytes_total",
+			Help:      "Bytes of file data sent in downloads.",
+		}),
+		blockChecksumFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "block_checksum_failures_total",
+			Help:      "Uploaded blocks that didn't match their checksum.",
+		}),
+		fileChecksumFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "file_checksum_failures_total",
+			Help:      "Uploaded files that didn't match their checksum.",
+		}),
+		resumes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "resumes_total",
+			Help:      "Calls to GetOffset, which clients make to resume uploads.",
+		}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_duration_seconds",
+			Help:      "Time from creating an upload to finishing it.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 12),
+		}),
+		uploadSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_size_bytes",
+			Help:      "Size of finished uploads.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 16),
+		}),
+		downloadErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "download_errors_total",
+			Help:      "Failed downloads by gRPC status code.",
+		}, []string{"code"}),
+		throttled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "throttled_seconds_total",
+			Help:      "Time uploads and downloads were made to wait by the bandwidth limits.",
+		}),
+	}
+
+	if reg == nil {
+		return m, nil
+	}
+
+	activeUploads := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_uploads",
+		Help:      "Uploads in progress.",
+	}, func() float64 {
+		return float64(len(s.UploadManager.GetUploads()))
+	})
+
+	freeBytes := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_free_bytes",
+		Help:      "Free space on the file system holding the incoming dir.",
+	}, func() float64 {
+		free, err := diskFree(s.config.IncomingDir)
+		if err != nil {
+			slog.Debug("unable to check free disk space", "dir", s.config.IncomingDir, "err", err)
+			return -1
+		}
+		return float64(free)
+	})
+
+	activeStreams := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_streams",
+		Help:      "Upload and download streams sharing the bandwidth.",
+	}, func() float64 {
+		return float64(s.bandwidth.active())
+	})
+
+	maxBlockSize := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "max_block_size_bytes",
+		Help:      "Largest block clients are asked to send, which shrinks when memory is short.",
+	}, func() float64 {
+		return float64(s.maxBlockSize())
+	})
+
+	droppedEvents := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hook_events_dropped_total",
+		Help:      "Events dropped because a hook fell behind.",
+	}, func() float64 {
+		return float64(s.hooks.dropped.Load())
+	})
+
+	collectors := []prometheus.Collector{
+		m.receivedBytes,
+		m.sentBytes,
+		m.blockChecksumFailures,
+		m.fileChecksumFailures,
+		m.resumes,
+		m.uploadDuration,
+		m.uploadSize,
+		m.downloadErrors,
+		m.throttled,
+		activeUploads,
+		activeStreams,
+		maxBlockSize,
+		freeBytes,
+		droppedEvents,
+	}
+
+	// the bandwidth limits, labeled by what they apply to
+	for scope, limit := range map[string]func(Limits) int64{
+		"global":    func(l Limits) int64 { return l.MaxBandwidth },
+		"principal": func(l Limits) int64 { return l.MaxPrincipalBandwidth },
+		"stream":    func(l Limits) int64 { return l.MaxStreamBandwidth },
+	} {
+		collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "bandwidth_limit_bytes_per_second",
+			Help:        "Bandwidth limits of uploads and downloads, 0 means no limit.",
+			ConstLabels: prometheus.Labels{"scope": scope},
+		}, func() float64 {
+			return float64(limit(s.Limits()))
+		}))
+	}
+
+	for _, c := range collectors {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// downloadFailed counts a download that failed with code.
+func (m *metrics) downloadFailed(code codes.Code) {
+	m.downloadErrors.WithLabelValues(code.String()).Inc()
+}
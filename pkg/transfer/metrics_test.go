@@ -0,0 +1,89 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"path"
+	"strings"
+	"testing"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		Metrics:            registry,
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id, err := client.Upload(randomFile(t, 2*minBlockSize))
+	require.NoError(t, err)
+	require.NoError(t, client.Download(ID(id), path.Join(t.TempDir(), "download")))
+
+	m := service.metrics
+	require.Equal(t, float64(2*minBlockSize), testutil.ToFloat64(m.receivedBytes))
+	require.Equal(t, float64(2*minBlockSize), testutil.ToFloat64(m.sentBytes))
+	require.Equal(t, 1, testutil.CollectAndCount(m.uploadSize))
+	require.Equal(t, 1, testutil.CollectAndCount(m.uploadDuration))
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	raw := tv1.NewTransferServiceClient(conn)
+
+	// an upload in progress with a bad block
+	resp, err := raw.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 100})
+	require.NoError(t, err)
+
+	_, err = raw.GetOffset(context.Background(), &tv1.GetOffsetRequest{Id: resp.Id})
+	require.NoError(t, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(m.resumes))
+
+	stream, err := raw.Upload(context.Background())
+	require.NoError(t, err)
+	bogus := sha256.Sum256([]byte("something else"))
+	require.NoError(t, stream.Send(&tv1.UploadRequest{Id: resp.Id, Data: []byte("data"), Sha256: bogus[:]}))
+	_, err = stream.CloseAndRecv()
+	requireCode(t, codes.DataLoss, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(m.blockChecksumFailures))
+
+	// a download of a file that doesn't exist
+	download, err := raw.Download(context.Background(), &tv1.DownloadRequest{Id: "1234"})
+	require.NoError(t, err)
+	_, err = download.Recv()
+	requireCode(t, codes.NotFound, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(m.downloadErrors.WithLabelValues(codes.NotFound.String())))
+
+	err = testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP transfer_active_uploads Uploads in progress.
+# TYPE transfer_active_uploads gauge
+transfer_active_uploads 1
+`), "transfer_active_uploads")
+	require.NoError(t, err)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	require.Contains(t, names, "transfer_storage_free_bytes")
+	require.Contains(t, names, "transfer_file_checksum_failures_total")
+
+	// metrics can only be registered once
+	_, err = NewService(Config{IncomingDir: path.Join(t.TempDir(), "incoming"), Metrics: registry})
+	require.Error(t, err)
+}
@@ -0,0 +1,450 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProcessingState is how far the processing of a file has come.  The values
+// match the ProcessingState enum of the API.
+type ProcessingState int
+
+// processing states
+const (
+	ProcessingPending ProcessingState = iota + 1
+	ProcessingRunning
+	ProcessingComplete
+	ProcessingFailed
+)
+
+func (s ProcessingState) String() string {
+	switch s {
+	case ProcessingPending:
+		return "pending"
+	case ProcessingRunning:
+		return "running"
+	case ProcessingComplete:
+		return "complete"
+	case ProcessingFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("ProcessingState(%d)", int(s))
+	}
+}
+
+// ProcessingStatus is stored with each file when processing is enabled.  Step
+// is the step that is running or that failed.
+type ProcessingStatus struct {
+	State    ProcessingState `json:"state"`
+	Step     string          `json:"step,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+}
+
+// ProcessingJob is the file a processing step works on.  Filename is the
+// plaintext of the file, which is a temporary copy if the file is encrypted
+// at rest.  Files that were deduplicated share their content with other
+// files, so steps must not modify the file.  Steps that move the file into
+// place copy it instead, like DeliverTo does.
+type ProcessingJob struct {
+	ID           ID
+	Filename     string
+	Size         int64
+	SHA256       []byte
+	Metadata     []byte
+	Owner        string
+	StorageClass string
+}
+
+// ProcessFunc is a processing step implemented in Go.  Returning an error
+// fails the processing of the file.  The context is canceled when the step
+// times out or the service shuts down.
+type ProcessFunc func(ctx context.Context, job ProcessingJob) error
+
+// ProcessingStep is a step of the processing pipeline.  It runs Func if set,
+// otherwise Command if set, otherwise the processor registered under Name.
+//
+// Commands get the filename as their last argument, the metadata on stdin and
+// the rest of the job in the environment variables TRANSFER_ID,
+// TRANSFER_FILE, TRANSFER_SIZE, TRANSFER_SHA256, TRANSFER_OWNER and
+// TRANSFER_STORAGE_CLASS.  A non-zero exit status fails the processing.
+type ProcessingStep struct {
+	Name    string
+	Command []string
+	Func    ProcessFunc
+
+	// Timeout is how long the step may run, 10 minutes if zero.
+	Timeout time.Duration
+}
+
+const (
+	defaultProcessingTimeout = 10 * time.Minute
+
+	// processingDir is the directory under the file store root where
+	// decrypted copies of files are kept while they are processed.
+	processingDir = ".processing"
+
+	// maxProcessingOutput is how much output of a failed command is kept as
+	// the error.
+	maxProcessingOutput = 1024
+)
+
+// ErrProcessingFailed is returned by Client.WaitForProcessing if the server
+// failed to process the file.
+var ErrProcessingFailed = errors.New("processing failed")
+
+var (
+	processorsMu sync.RWMutex
+	processors   = map[string]ProcessFunc{}
+)
+
+// RegisterProcessor registers f so processing steps can refer to it by name.
+func RegisterProcessor(name string, f ProcessFunc) {
+	processorsMu.Lock()
+	defer processorsMu.Unlock()
+	processors[name] = f
+}
+
+func lookupProcessor(name string) ProcessFunc {
+	processorsMu.RLock()
+	defer processorsMu.RUnlock()
+	return processors[name]
+}
+
+// pipeline runs the processing steps for finished files in the background.
+// Done is called with the final status of each file processed.
+type pipeline struct {
+	steps     []ProcessingStep
+	fileStore *FileStore
+	done      func(id ID, status ProcessingStatus)
+	slots     chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func newPipeline(steps []ProcessingStep, concurrency int, fileStore *FileStore, done func(ID, ProcessingStatus)) (*pipeline, error) {
+	if len(steps) == 0 {
+		return nil, nil
+	}
+
+	resolved := make([]ProcessingStep, len(steps))
+	for i, step := range steps {
+		if step.Func == nil && len(step.Command) == 0 {
+			step.Func = lookupProcessor(step.Name)
+			if step.Func == nil {
+				return nil, fmt.Errorf("processing step [%s] has no command and no processor is registered with that name", step.Name)
+			}
+		}
+
+		if step.Name == "" {
+			step.Name = strconv.Itoa(i + 1)
+			if len(step.Command) > 0 {
+				step.Name = path.Base(step.Command[0])
+			}
+		}
+
+		if step.Timeout == 0 {
+			step.Timeout = defaultProcessingTimeout
+		}
+		resolved[i] = step
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pipeline{
+		steps:     resolved,
+		fileStore: fileStore,
+		done:      done,
+		slots:     make(chan struct{}, concurrency),
+		ctx:       ctx,
+		cancel:    cancel,
+	}, nil
+}
+
+// submit marks the file id as pending and processes it in the background.
+func (p *pipeline) submit(id ID) error {
+	err := p.fileStore.UpdateInfo(id, func(info *FileInfo) {
+		info.Processing = &ProcessingStatus{State: ProcessingPending}
+	})
+	if err != nil {
+		return err
+	}
+
+	p.start(id)
+	return nil
+}
+
+func (p *pipeline) start(id ID) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.ctx.Done():
+			return
+		}
+		defer func() { <-p.slots }()
+
+		p.process(id)
+	}()
+}
+
+// resume restarts processing of files that hadn't finished processing when
+// the service was last stopped.
+func (p *pipeline) resume() error {
+	ids, err := p.fileStore.List()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		info, err := p.fileStore.ReadInfo(id)
+		if err != nil || info.Processing == nil {
+			continue
+		}
+
+		if info.Processing.State == ProcessingPending || info.Processing.State == ProcessingRunning {
+			slog.Info("resuming processing", "id", id)
+			p.start(id)
+		}
+	}
+	return nil
+}
+
+// shutdown cancels running steps and waits for them to stop.  Files that were
+// being processed are processed again from the start by the next service.
+func (p *pipeline) shutdown() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+func (p *pipeline) process(id ID) {
+	info, err := p.fileStore.ReadInfo(id)
+	if err != nil {
+		slog.Error("error reading file info for processing", "id", id, "err", err)
+		return
+	}
+
+	status := ProcessingStatus{State: ProcessingRunning, Started: time.Now()}
+	p.update(id, status)
+
+	filename, cleanup, err := p.plaintext(id)
+	if err != nil {
+		status.State = ProcessingFailed
+		status.Error = err.Error()
+		status.Finished = time.Now()
+		p.finish(id, status)
+		return
+	}
+	defer cleanup()
+
+	job := ProcessingJob{
+		ID:           id,
+		Filename:     filename,
+		Size:         info.Size,
+		SHA256:       info.SHA256,
+		Metadata:     info.Metadata,
+		Owner:        info.Owner,
+		StorageClass: info.StorageClass,
+	}
+
+	for _, step := range p.steps {
+		status.Step = step.Name
+		p.update(id, status)
+
+		err := p.run(step, job)
+		if p.ctx.Err() != nil {
+			// shutting down, leave the file as running so it is resumed
+			return
+		}
+
+		if err != nil {
+			slog.Warn("processing failed", "id", id, "step", step.Name, "err", err)
+			status.State = ProcessingFailed
+			status.Error = err.Error()
+			status.Finished = time.Now()
+			p.finish(id, status)
+			return
+		}
+	}
+
+	slog.Info("processing complete", "id", id)
+	status.State = ProcessingComplete
+	status.Step = ""
+	status.Finished = time.Now()
+	p.finish(id, status)
+}
+
+// finish records the final status of id and reports it.
+func (p *pipeline) finish(id ID, status ProcessingStatus) {
+	p.update(id, status)
+	if p.done != nil {
+		p.done(id, status)
+	}
+}
+
+func (p *pipeline) update(id ID, status ProcessingStatus) {
+	err := p.fileStore.UpdateInfo(id, func(info *FileInfo) { info.Processing = &status })
+	if err != nil {
+		slog.Error("error updating processing status", "id", id, "state", status.State, "err", err)
+	}
+}
+
+// run runs step on job.
+func (p *pipeline) run(step ProcessingStep, job ProcessingJob) error {
+	ctx, cancel := context.WithTimeout(p.ctx, step.Timeout)
+	defer cancel()
+
+	if step.Func != nil {
+		return step.Func(ctx, job)
+	}
+
+	args := append(step.Command[1:len(step.Command):len(step.Command)], job.Filename)
+	cmd := exec.CommandContext(ctx, step.Command[0], args...)
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(job.Metadata)
+	cmd.Env = append(os.Environ(),
+		"TRANSFER_ID="+job.ID.String(),
+		"TRANSFER_FILE="+job.Filename,
+		"TRANSFER_SIZE="+strconv.FormatInt(job.Size, 10),
+		"TRANSFER_SHA256="+hex.EncodeToString(job.SHA256),
+		"TRANSFER_OWNER="+job.Owner,
+		"TRANSFER_STORAGE_CLASS="+job.StorageClass,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", step.Timeout)
+	}
+
+	if err != nil {
+		output = bytes.TrimSpace(output)
+		if len(output) > maxProcessingOutput {
+			output = output[len(output)-maxProcessingOutput:]
+		}
+
+		if len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+// plaintext returns the name of a file holding the plaintext of id, which
+// is the file itself unless it is encrypted, and a function that removes any
+// temporary copy.
+func (p *pipeline) plaintext(id ID) (string, func(), error) {
+	r, err := p.fileStore.OpenReadOnly(id)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+
+	if _, ok := r.(*os.File); ok {
+		return r.Name(), func() {}, nil
+	}
+
+	dir := path.Join(p.fileStore.root, processingDir)
+	err = os.MkdirAll(dir, dirPermissions)
+	if err != nil {
+		return "", nil, err
+	}
+
+	filename := path.Join(dir, id.String())
+	w, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, filePermissions)
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, err = io.Copy(w, r)
+	err = errors.Join(err, w.Close())
+	if err != nil {
+		os.Remove(filename)
+		return "", nil, fmt.Errorf("error decrypting [%s] for processing: %w", id, err)
+	}
+
+	return filename, func() { os.Remove(filename) }, nil
+}
+
+// DeliverTo returns a processing step that copies each file into dir, named
+// by its ID.  The copy is written to a temporary file that is renamed into
+// place, so other programs never see a partial file.  Make it the last step
+// so only files that pass the other steps are delivered.  The service keeps
+// its own copy until the file is deleted.
+func DeliverTo(dir string) ProcessFunc {
+	return func(ctx context.Context, job ProcessingJob) error {
+		err := os.MkdirAll(dir, dirPermissions)
+		if err != nil {
+			return err
+		}
+
+		in, err := os.Open(job.Filename)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.CreateTemp(dir, "."+job.ID.String()+"-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(out.Name())
+
+		_, err = io.Copy(out, in)
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err == nil {
+			err = out.Sync()
+		}
+		err = errors.Join(err, out.Close())
+		if err != nil {
+			return fmt.Errorf("error copying [%s] to %s: %w", job.ID, dir, err)
+		}
+
+		err = os.Chmod(out.Name(), filePermissions)
+		if err != nil {
+			return err
+		}
+		return os.Rename(out.Name(), path.Join(dir, job.ID.String()))
+	}
+}
+
+// ParseProcessingStep parses a processing step in the form
+// "<name>=<command> [<args>...]", or just "<name>" for a registered processor.
+func ParseProcessingStep(s string) (ProcessingStep, error) {
+	name, command, found := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ProcessingStep{}, fmt.Errorf("processing step [%s] has no name", s)
+	}
+
+	if !found {
+		return ProcessingStep{Name: name}, nil
+	}
+
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return ProcessingStep{}, fmt.Errorf("processing step [%s] has no command", name)
+	}
+	return ProcessingStep{Name: name, Command: args}, nil
+}
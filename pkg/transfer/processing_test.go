@@ -0,0 +1,214 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestProcessing(t *testing.T) {
+	out := t.TempDir()
+	t.Setenv("PROCESSING_OUT", out)
+
+	var mu sync.Mutex
+	var jobs []ProcessingJob
+	RegisterProcessor("test-record", func(_ context.Context, job ProcessingJob) error {
+		data, err := os.ReadFile(job.Filename)
+		if err != nil {
+			return err
+		}
+
+		if int64(len(data)) != job.Size {
+			return errors.New("wrong size")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		jobs = append(jobs, job)
+		return nil
+	})
+
+	delivered := t.TempDir()
+	recorder := &eventRecorder{}
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		EncryptionKeys:     []*MasterKey{newTestKey(t)},
+		Processing: []ProcessingStep{
+			{Name: "test-record"},
+			{Name: "copy", Command: []string{"sh", "-c", `cp "$0" "$PROCESSING_OUT/$TRANSFER_ID"`}},
+			{Name: "deliver", Func: DeliverTo(delivered)},
+		},
+		Hooks: []Hook{recorder},
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	filename := randomFile(t, 2*minBlockSize)
+	id, err := client.Upload(filename)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stat, err := client.WaitForProcessing(ctx, ID(id), 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, tv1.ProcessingState_PROCESSING_STATE_COMPLETE, stat.ProcessingState)
+
+	// the steps got the plaintext even though the file is encrypted at rest
+	original, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	processed, err := os.ReadFile(path.Join(out, id))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(original, processed))
+
+	processed, err = os.ReadFile(path.Join(delivered, id))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(original, processed))
+
+	entries, err := os.ReadDir(delivered)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	recorder.waitFor(t, EventProcessed)
+	require.Equal(t, []EventType{EventCreated, EventFinished, EventProcessed}, recorder.typesExcept(EventProgress))
+	require.NoError(t, client.Download(ID(id), path.Join(t.TempDir(), "downloaded")))
+
+	mu.Lock()
+	require.Len(t, jobs, 1)
+	require.Equal(t, ID(id), jobs[0].ID)
+	require.Len(t, jobs[0].SHA256, 32)
+	mu.Unlock()
+
+	// the decrypted copy is gone
+	require.NoFileExists(t, jobs[0].Filename)
+}
+
+func TestProcessingFailure(t *testing.T) {
+	delivered := t.TempDir()
+	recorder := &eventRecorder{}
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		Processing: []ProcessingStep{
+			{Name: "scan", Command: []string{"sh", "-c", "echo infected >&2; exit 1"}},
+			{Name: "deliver", Func: DeliverTo(delivered)},
+		},
+		Hooks: []Hook{recorder},
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id, err := client.Upload(randomFile(t, minBlockSize))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stat, err := client.WaitForProcessing(ctx, ID(id), 10*time.Millisecond)
+	require.ErrorIs(t, err, ErrProcessingFailed)
+	require.Equal(t, tv1.ProcessingState_PROCESSING_STATE_FAILED, stat.ProcessingState)
+	require.Equal(t, "scan", stat.ProcessingStep)
+	require.Contains(t, stat.ProcessingError, "infected")
+
+	// the file is neither delivered nor served
+	entries, err := os.ReadDir(delivered)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	requireCode(t, codes.FailedPrecondition, client.Download(ID(id), path.Join(t.TempDir(), "downloaded")))
+
+	recorder.waitFor(t, EventProcessingFailed)
+	require.Equal(t, []EventType{EventCreated, EventFinished, EventProcessingFailed}, recorder.typesExcept(EventProgress))
+	failed := recorder.last()
+	require.ErrorIs(t, failed.Err, ErrProcessingFailed)
+	require.Contains(t, failed.Err.Error(), "infected")
+}
+
+func TestProcessingTimeoutAndResume(t *testing.T) {
+	incoming := path.Join(t.TempDir(), "incoming")
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	stuck := func(ctx context.Context, _ ProcessingJob) error {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+
+		<-ctx.Done()
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return ctx.Err()
+	}
+
+	service, addr := startServer(t, Config{
+		IncomingDir:           incoming,
+		PreferredBlockSize:    minBlockSize,
+		Processing:            []ProcessingStep{{Name: "stuck", Func: stuck, Timeout: time.Hour}},
+		ProcessingConcurrency: 2,
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	var ids []string
+	for range 3 {
+		id, err := client.Upload(randomFile(t, minBlockSize))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// shutting down leaves the files to be processed by the next service
+	require.NoError(t, service.Shutdown())
+	require.Equal(t, 2, maxRunning)
+
+	for _, id := range ids {
+		info, err := service.fileStore.ReadInfo(ID(id))
+		require.NoError(t, err)
+		require.Contains(t, []ProcessingState{ProcessingPending, ProcessingRunning}, info.Processing.State)
+	}
+
+	restarted, err := NewService(Config{
+		IncomingDir: incoming,
+		Processing:  []ProcessingStep{{Name: "slow", Func: stuck, Timeout: 10 * time.Millisecond}},
+	})
+	require.NoError(t, err)
+	defer restarted.Shutdown()
+
+	for _, id := range ids {
+		require.Eventually(t, func() bool {
+			info, err := restarted.fileStore.ReadInfo(ID(id))
+			return err == nil && info.Processing.State == ProcessingFailed
+		}, 5*time.Second, 10*time.Millisecond)
+
+		info, err := restarted.fileStore.ReadInfo(ID(id))
+		require.NoError(t, err)
+		require.Equal(t, "slow", info.Processing.Step)
+		require.Contains(t, info.Processing.Error, "deadline exceeded")
+	}
+
+	_, err = NewService(Config{IncomingDir: incoming, Processing: []ProcessingStep{{Name: "no-such-processor"}}})
+	require.Error(t, err)
+}
@@ -0,0 +1,208 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuarantineReport is written next to a quarantined file and describes why
+// the file was quarantined and how it was received.
+type QuarantineReport struct {
+	ID             ID              `json:"id"`
+	Size           int64           `json:"size"`
+	ExpectedSHA256 []byte          `json:"expected_sha256"`
+	ActualSHA256   []byte          `json:"actual_sha256"`
+	Peer           string          `json:"peer"`
+	Metadata       []byte          `json:"metadata"`
+	QuarantinedAt  time.Time       `json:"quarantined_at"`
+	Blocks         []BlockLogEntry `json:"blocks"`
+	Encrypted      bool            `json:"encrypted,omitempty"`
+}
+
+// quarantine keeps files that failed whole-file checksum verification so that
+// they can be investigated.  Files older than the retention period are purged
+// periodically.  A retention of zero means files are kept until they are
+// purged explicitly.
+type quarantine struct {
+	mu        sync.Mutex
+	dir       string
+	retention time.Duration
+}
+
+const (
+	// quarantineDir is the directory under the file store root where
+	// quarantined files are kept.
+	quarantineDir          = ".quarantine"
+	quarantineReportSuffix = ".json"
+	quarantineExpiryPeriod = 10 * time.Minute
+)
+
+// newQuarantine creates a quarantine in dir.
+func newQuarantine(dir string, retention time.Duration) (*quarantine, error) {
+	err := os.MkdirAll(dir, dirPermissions)
+	if err != nil {
+		return nil, fmt.Errorf("error creating quarantine directory: %w", err)
+	}
+
+	return &quarantine{
+		dir:       dir,
+		retention: retention,
+	}, nil
+}
+
+// setRetention changes the retention period.
+func (q *quarantine) setRetention(retention time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.retention = retention
+}
+
+// Add moves the file at filename into quarantine and writes the report.
+func (q *quarantine) Add(filename string, report QuarantineReport) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize quarantine report: %w", err)
+	}
+
+	err = os.WriteFile(q.reportFilename(report.ID), data, filePermissions)
+	if err != nil {
+		return fmt.Errorf("failed to write quarantine report: %w", err)
+	}
+
+	err = os.Rename(filename, q.filename(report.ID))
+	if err != nil {
+		return fmt.Errorf("failed to move [%s] into quarantine: %w", filename, err)
+	}
+
+	return nil
+}
+
+// List the reports of all quarantined files, oldest first.
+func (q *quarantine) List() ([]QuarantineReport, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing quarantine: %w", err)
+	}
+
+	var reports []QuarantineReport
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), quarantineReportSuffix) {
+			continue
+		}
+
+		data, err := os.ReadFile(path.Join(q.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading quarantine report: %w", err)
+		}
+
+		var report QuarantineReport
+		err = json.Unmarshal(data, &report)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing quarantine report [%s]: %w", entry.Name(), err)
+		}
+
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].QuarantinedAt.Before(reports[j].QuarantinedAt)
+	})
+
+	return reports, nil
+}
+
+// Purge removes a file and its report from quarantine.
+func (q *quarantine) Purge(id ID) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := os.Remove(q.filename(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return os.Remove(q.reportFilename(id))
+}
+
+// PurgeExpired removes files that have been in quarantine longer than the
+// retention period and returns their IDs.
+func (q *quarantine) PurgeExpired(now time.Time) ([]ID, error) {
+	q.mu.Lock()
+	retention := q.retention
+	q.mu.Unlock()
+
+	if retention == 0 {
+		return nil, nil
+	}
+
+	reports, err := q.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []ID
+	for _, report := range reports {
+		if now.Sub(report.QuarantinedAt) < retention {
+			continue
+		}
+
+		err := q.Purge(report.ID)
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, report.ID)
+	}
+
+	return purged, nil
+}
+
+// expireLoop purges expired files periodically until done is closed.  The
+// IDs of purged files are passed to expired.
+func (q *quarantine) expireLoop(done <-chan struct{}, expired func(ID)) {
+	ticker := time.NewTicker(quarantineExpiryPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case now := <-ticker.C:
+			purged, err := q.PurgeExpired(now)
+			if err != nil {
+				slog.Error("error purging expired quarantined files", "err", err)
+			}
+
+			if len(purged) > 0 {
+				slog.Info("purged expired quarantined files", "ids", purged)
+			}
+
+			for _, id := range purged {
+				expired(id)
+			}
+		}
+	}
+}
+
+func (q *quarantine) filename(id ID) string {
+	return path.Join(q.dir, id.String())
+}
+
+func (q *quarantine) reportFilename(id ID) string {
+	return q.filename(id) + quarantineReportSuffix
+}
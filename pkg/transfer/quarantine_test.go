@@ -0,0 +1,78 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"path"
+	"testing"
+	"time"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuarantine(t *testing.T) {
+	incoming := path.Join(t.TempDir(), "incoming")
+	service, addr := startServer(t, Config{
+		IncomingDir:         incoming,
+		PreferredBlockSize:  minBlockSize,
+		Quarantine:          true,
+		QuarantineRetention: time.Hour,
+		Authorizer:          OwnerAuthorizer{Admins: []string{"root"}},
+	})
+	root := ContextWithPrincipal(context.Background(), &Principal{Name: "root"})
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := tv1.NewTransferServiceClient(conn)
+
+	data := []byte("this is not what the checksum says")
+	bogus := sha256.Sum256([]byte("something else"))
+
+	resp, err := client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{
+		Size:       int64(len(data)),
+		FileSha256: bogus[:],
+	})
+	require.NoError(t, err)
+
+	stream, err := client.UploadV2(context.Background())
+	require.NoError(t, err)
+
+	checksum := sha256.Sum256(data)
+	require.NoError(t, stream.Send(&tv1.UploadV2Request{Id: resp.Id, Data: data, Sha256: checksum[:]}))
+	require.NoError(t, stream.CloseSend())
+
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	list, err := service.ListQuarantine(root, &tv1.ListQuarantineRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Files, 1)
+	require.Equal(t, resp.Id, list.Files[0].Id)
+	require.Equal(t, bogus[:], list.Files[0].ExpectedSha256)
+	require.Equal(t, checksum[:], list.Files[0].ActualSha256)
+	require.Equal(t, int64(1), list.Files[0].NumBlocks)
+	require.NotEmpty(t, list.Files[0].Peer)
+	require.FileExists(t, path.Join(incoming, quarantineDir, resp.Id))
+	require.FileExists(t, path.Join(incoming, quarantineDir, resp.Id+quarantineReportSuffix))
+
+	// not expired yet
+	purged, err := service.quarantine.PurgeExpired(time.Now())
+	require.NoError(t, err)
+	require.Empty(t, purged)
+
+	purged, err = service.quarantine.PurgeExpired(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []ID{ID(resp.Id)}, purged)
+	require.NoFileExists(t, path.Join(incoming, quarantineDir, resp.Id))
+
+	_, err = service.PurgeQuarantine(root, &tv1.PurgeQuarantineRequest{Ids: []string{resp.Id}})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,185 @@
+package transfer
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// usage keeps track of how many bytes each principal stores in finished
+// files.  Anonymous uploads are counted for the principal "".
+type usage struct {
+	mu    sync.Mutex
+	bytes map[string]int64
+}
+
+// newUsage computes the usage of every principal from the files in the store.
+func newUsage(fileStore *FileStore) (*usage, error) {
+	ids, err := fileStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &usage{bytes: map[string]int64{}}
+	for _, id := range ids {
+		info, err := fileStore.ReadInfo(id)
+		if err != nil {
+			slog.Error("error reading file info, not counting it towards quota", "id", id, "err", err)
+			continue
+		}
+		u.bytes[info.Owner] += info.Size
+	}
+	return u, nil
+}
+
+func (u *usage) add(owner string, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bytes[owner] += n
+}
+
+func (u *usage) get(owner string) int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.bytes[owner]
+}
+
+// principalLabel returns a name for owner fit for error messages.
+func principalLabel(owner string) string {
+	if owner == "" {
+		return "anonymous"
+	}
+	return owner
+}
+
+// Limits are the settings of the service that can be changed while it is
+// running.  They start out as the fields of the same name in Config.
+type Limits struct {
+	MaxFileSize          int64
+	Quota                int64
+	MaxConcurrentUploads int
+	MinFreeSpace         int64
+
+	// QuarantineRetention only has an effect if quarantine is enabled.
+	QuarantineRetention time.Duration
+
+	// MaxBandwidth, MaxPrincipalBandwidth and MaxStreamBandwidth are the
+	// bytes per second of uploads and downloads, for all of them together,
+	// for each principal and for each stream.
+	MaxBandwidth          int64
+	MaxPrincipalBandwidth int64
+	MaxStreamBandwidth    int64
+
+	// MemoryLimit is the heap size at which clients are asked for the
+	// smallest blocks.
+	MemoryLimit int64
+}
+
+// Validate checks that none of the limits are negative.
+func (l Limits) Validate() error {
+	switch {
+	case l.MaxFileSize < 0:
+		return fmt.Errorf("max file size cannot be negative")
+	case l.Quota < 0:
+		return fmt.Errorf("quota cannot be negative")
+	case l.MaxConcurrentUploads < 0:
+		return fmt.Errorf("max concurrent uploads cannot be negative")
+	case l.MinFreeSpace < 0:
+		return fmt.Errorf("min free space cannot be negative")
+	case l.QuarantineRetention < 0:
+		return fmt.Errorf("quarantine retention cannot be negative")
+	case l.MaxBandwidth < 0 || l.MaxPrincipalBandwidth < 0 || l.MaxStreamBandwidth < 0:
+		return fmt.Errorf("bandwidth cannot be negative")
+	case l.MemoryLimit < 0:
+		return fmt.Errorf("memory limit cannot be negative")
+	}
+	return nil
+}
+
+// Limits returns the limits currently in effect.
+func (s *Service) Limits() Limits {
+	s.limitsMu.RLock()
+	defer s.limitsMu.RUnlock()
+	return s.limits
+}
+
+// SetLimits replaces the limits of the service.  Uploads in progress are not
+// affected, the new limits apply to uploads created from now on.  The
+// bandwidth limits are the exception, they apply to the transfers in
+// progress right away.
+func (s *Service) SetLimits(l Limits) error {
+	err := l.Validate()
+	if err != nil {
+		return err
+	}
+
+	s.limitsMu.Lock()
+	s.limits = l
+	s.limitsMu.Unlock()
+
+	if s.quarantine != nil {
+		s.quarantine.setRetention(l.QuarantineRetention)
+	}
+
+	slog.Info("limits updated", "maxFileSize", l.MaxFileSize, "quota", l.Quota, "maxConcurrentUploads", l.MaxConcurrentUploads,
+		"minFreeSpace", l.MinFreeSpace, "quarantineRetention", l.QuarantineRetention, "maxBandwidth", l.MaxBandwidth,
+		"maxPrincipalBandwidth", l.MaxPrincipalBandwidth, "maxStreamBandwidth", l.MaxStreamBandwidth, "memoryLimit", l.MemoryLimit)
+	return nil
+}
+
+// admit checks if owner may create an upload of size bytes.  Uploads in
+// progress count towards the quota with their full size, and towards the disk
+// space with what they still need.  Uploads that are satisfied from the
+// content store don't use any disk space or upload slots, so those checks are
+// skipped if dedup is set.  The caller must hold s.admission so concurrent
+// calls don't both get the last of something.
+func (s *Service) admit(owner string, size int64, dedup bool) error {
+	limits := s.Limits()
+
+	if limits.MaxFileSize > 0 && size > limits.MaxFileSize {
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("file size %d exceeds the maximum file size of %d bytes", size, limits.MaxFileSize))
+	}
+
+	var active int
+	var reserved int64
+	var pending int64
+	for _, up := range s.UploadManager.GetUploads() {
+		if up.Owner == owner {
+			active++
+			reserved += up.Size
+		}
+		pending += up.Size - up.Offset()
+	}
+
+	if limits.Quota > 0 {
+		used := s.usage.get(owner)
+		if used+reserved+size > limits.Quota {
+			return status.Error(codes.ResourceExhausted, fmt.Sprintf("upload of %d bytes would exceed the quota of %d bytes for [%s], which has %d bytes stored and %d bytes in uploads in progress",
+				size, limits.Quota, principalLabel(owner), used, reserved))
+		}
+	}
+
+	if dedup {
+		return nil
+	}
+
+	if limits.MaxConcurrentUploads > 0 && active >= limits.MaxConcurrentUploads {
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("[%s] already has %d uploads in progress, which is the maximum", principalLabel(owner), active))
+	}
+
+	free, err := diskFree(s.config.IncomingDir)
+	if err != nil {
+		slog.Debug("unable to check free disk space", "dir", s.config.IncomingDir, "err", err)
+		return nil
+	}
+
+	if free-pending-size < limits.MinFreeSpace {
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("not enough disk space for %d bytes, %d bytes are free, uploads in progress need %d bytes and %d bytes must be kept free",
+			size, free, pending, limits.MinFreeSpace))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package transfer
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestQuota(t *testing.T) {
+	incoming := path.Join(t.TempDir(), "incoming")
+	auth := &Authentication{
+		Authenticators: []Authenticator{NewBearerTokenAuthenticator(map[string]string{"alice-token": "alice", "bob-token": "bob"})},
+	}
+
+	config := Config{
+		IncomingDir:          incoming,
+		PreferredBlockSize:   minBlockSize,
+		MaxFileSize:          4 * minBlockSize,
+		Quota:                5 * minBlockSize,
+		MaxConcurrentUploads: 2,
+	}
+
+	service, addr := startServer(t, config, auth.ServerOptions()...)
+
+	alice := ContextWithPrincipal(context.Background(), &Principal{Name: "alice"})
+	bob := ContextWithPrincipal(context.Background(), &Principal{Name: "bob"})
+
+	// too big
+	_, err := service.CreateUpload(alice, &tv1.CreateUploadRequest{Size: 4*minBlockSize + 1})
+	requireCode(t, codes.ResourceExhausted, err)
+
+	// a negative size doesn't make room for anything
+	_, err = service.CreateUpload(alice, &tv1.CreateUploadRequest{Size: -1 << 62})
+	requireCode(t, codes.InvalidArgument, err)
+	require.Empty(t, service.UploadManager.GetUploads())
+
+	// uploads in progress count towards the quota and the concurrency limit
+	_, err = service.CreateUpload(alice, &tv1.CreateUploadRequest{Size: 2 * minBlockSize})
+	require.NoError(t, err)
+	_, err = service.CreateUpload(alice, &tv1.CreateUploadRequest{Size: 4 * minBlockSize})
+	requireCode(t, codes.ResourceExhausted, err)
+	_, err = service.CreateUpload(alice, &tv1.CreateUploadRequest{Size: minBlockSize})
+	require.NoError(t, err)
+	_, err = service.CreateUpload(alice, &tv1.CreateUploadRequest{Size: 1})
+	requireCode(t, codes.ResourceExhausted, err)
+
+	// other principals have their own quota
+	_, err = service.CreateUpload(bob, &tv1.CreateUploadRequest{Size: 4 * minBlockSize})
+	require.NoError(t, err)
+
+	// finished files count towards the quota
+	client, err := CreateClient(ClientConfig{ServerAddr: addr, Token: "bob-token"})
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Upload(randomFile(t, minBlockSize))
+	require.NoError(t, err)
+	require.Equal(t, int64(minBlockSize), service.usage.get("bob"))
+
+	_, err = client.Upload(randomFile(t, minBlockSize))
+	requireCode(t, codes.ResourceExhausted, err)
+
+	// usage is computed from the store on startup
+	restarted, err := NewService(config)
+	require.NoError(t, err)
+	require.Equal(t, int64(minBlockSize), restarted.usage.get("bob"))
+	require.Equal(t, int64(0), restarted.usage.get("alice"))
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	incoming := path.Join(t.TempDir(), "incoming")
+
+	free, err := diskFree(t.TempDir())
+	if err != nil {
+		t.Skip("free disk space is not supported on this platform")
+	}
+
+	service, err := NewService(Config{IncomingDir: incoming, MinFreeSpace: free})
+	require.NoError(t, err)
+
+	_, err = service.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 1 << 30})
+	requireCode(t, codes.ResourceExhausted, err)
+
+	service, err = NewService(Config{IncomingDir: incoming})
+	require.NoError(t, err)
+
+	_, err = service.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: minBlockSize})
+	require.NoError(t, err)
+
+	_, err = service.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 2 * free})
+	requireCode(t, codes.ResourceExhausted, err)
+}
+
+func TestSetLimits(t *testing.T) {
+	service, _ := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		MaxFileSize:        minBlockSize,
+		Quarantine:         true,
+	})
+
+	ctx := context.Background()
+	_, err := service.CreateUpload(ctx, &tv1.CreateUploadRequest{Size: 2 * minBlockSize})
+	requireCode(t, codes.ResourceExhausted, err)
+
+	limits := service.Limits()
+	limits.MaxFileSize = 2 * minBlockSize
+	limits.MaxConcurrentUploads = 1
+	limits.QuarantineRetention = time.Hour
+	require.NoError(t, service.SetLimits(limits))
+	require.Equal(t, limits, service.Limits())
+	require.Equal(t, time.Hour, service.quarantine.retention)
+
+	_, err = service.CreateUpload(ctx, &tv1.CreateUploadRequest{Size: 2 * minBlockSize})
+	require.NoError(t, err)
+	_, err = service.CreateUpload(ctx, &tv1.CreateUploadRequest{Size: 1})
+	requireCode(t, codes.ResourceExhausted, err)
+
+	// invalid limits are rejected and the old ones kept
+	require.Error(t, service.SetLimits(Limits{Quota: -1}))
+	require.Equal(t, limits, service.Limits())
+}
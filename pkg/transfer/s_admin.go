@@ -0,0 +1,103 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ListQuarantine lists the files in quarantine.
+func (s *Service) ListQuarantine(ctx context.Context, _ *tv1.ListQuarantineRequest) (*tv1.ListQuarantineResponse, error) {
+	err := s.authorize(ctx, ActionAdmin, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	if s.quarantine == nil {
+		return nil, status.Error(codes.FailedPrecondition, "quarantine is not enabled")
+	}
+
+	reports, err := s.quarantine.List()
+	if err != nil {
+		slog.Error("error listing quarantine", "err", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	files := make([]*tv1.QuarantinedFile, 0, len(reports))
+	for _, report := range reports {
+		files = append(files, &tv1.QuarantinedFile{
+			Id:             report.ID.String(),
+			Size:           report.Size,
+			ExpectedSha256: report.ExpectedSHA256,
+			ActualSha256:   report.ActualSHA256,
+			Peer:           report.Peer,
+			QuarantinedAt:  timestamppb.New(report.QuarantinedAt),
+			NumBlocks:      int64(len(report.Blocks)),
+		})
+	}
+
+	return &tv1.ListQuarantineResponse{Files: files}, nil
+}
+
+// PurgeQuarantine removes files from quarantine.
+func (s *Service) PurgeQuarantine(ctx context.Context, req *tv1.PurgeQuarantineRequest) (*tv1.PurgeQuarantineResponse, error) {
+	err := s.authorize(ctx, ActionAdmin, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	if s.quarantine == nil {
+		return nil, status.Error(codes.FailedPrecondition, "quarantine is not enabled")
+	}
+
+	ids := req.Ids
+	if req.All {
+		reports, err := s.quarantine.List()
+		if err != nil {
+			slog.Error("error listing quarantine", "err", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		ids = nil
+		for _, report := range reports {
+			ids = append(ids, report.ID.String())
+		}
+	}
+
+	var purged []string
+	for _, idString := range ids {
+		id, err := ParseID(idString)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		err = s.quarantine.Purge(id)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("[%s] is not in quarantine", id))
+		}
+
+		if err != nil {
+			slog.Error("error purging quarantined file", "id", id, "err", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		slog.Info("purged quarantined file", "id", id)
+		s.hooks.send(ctx, Event{Type: EventDeleted, ID: id, Principal: PrincipalFromContext(ctx), Peer: peerAddress(ctx)})
+		purged = append(purged, id.String())
+	}
+
+	return &tv1.PurgeQuarantineResponse{Ids: purged}, nil
+}
+
+// quarantineExpired notifies the hooks that a quarantined file was purged
+// because it had been kept for the retention period.
+func (s *Service) quarantineExpired(id ID) {
+	s.hooks.send(context.Background(), Event{Type: EventExpired, ID: id})
+}
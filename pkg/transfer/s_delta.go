@@ -0,0 +1,70 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PlanDelta compares the block checksums of a delta upload with its base and
+// returns the blocks the client has to send.
+func (s *Service) PlanDelta(ctx context.Context, req *tv1.PlanDeltaRequest) (*tv1.PlanDeltaResponse, error) {
+	id, err := ParseID(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	up := s.UploadManager.GetUpload(id)
+	if up == nil {
+		return nil, status.Error(codes.NotFound, "upload not found")
+	}
+
+	err = s.authorize(ctx, ActionWrite, id, up.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	if up.BaseID == "" {
+		return nil, status.Error(codes.FailedPrecondition, "upload has no base")
+	}
+
+	if req.Blocksize != s.blocks.clamp(req.Blocksize) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("block size must be between %d and %d", s.blocks.min, s.blocks.max))
+	}
+
+	numBlocks := (up.Size + req.Blocksize - 1) / req.Blocksize
+	if int64(len(req.BlockSha256)) != numBlocks {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("expected %d block checksums, got %d", numBlocks, len(req.BlockSha256)))
+	}
+
+	base, err := s.fileStore.OpenReadOnly(up.BaseID)
+	if err != nil {
+		slog.Error("error opening base", "id", id, "base", up.BaseID, "err", err)
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("error opening base [%s]", up.BaseID))
+	}
+	defer base.Close()
+
+	plan, err := planDelta(base, req.Blocksize, req.BlockSha256)
+	if err != nil {
+		slog.Error("error planning delta", "id", id, "base", up.BaseID, "err", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	up.SetDeltaPlan(plan)
+
+	// copy any leading blocks we already have
+	err = s.fillFromBase(up)
+	if err != nil {
+		slog.Error("error copying blocks from base", "id", id, "base", up.BaseID, "err", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	missing := plan.missing()
+	slog.Info("delta planned", "id", id, "base", up.BaseID, "blocks", numBlocks, "missing", len(missing))
+
+	return &tv1.PlanDeltaResponse{MissingBlocks: missing}, nil
+}
@@ -1,10 +1,12 @@
 package transfer
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 
 	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
@@ -12,46 +14,129 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-// Download file by id starting at offset.
+// Download file by id starting at offset.  If the request has a length only
+// that many bytes are sent.
 func (s *Service) Download(req *tv1.DownloadRequest, stream tv1.TransferService_DownloadServer) error {
-	req.PreferredBlocksize = clampBlockSize(req.PreferredBlocksize)
+	ctx, span := s.startSpan(stream.Context(), "Download",
+		attrID.String(req.Id), attrOffset.Int64(req.Offset), attrLength.Int64(req.Length))
 
-	slog.Info("download", "id", req.Id, "offset", req.Offset, "blocksize", req.PreferredBlocksize)
+	sent, err := s.download(ctx, req, stream)
+	if err != nil {
+		s.metrics.downloadFailed(status.Code(err))
+	}
+
+	span.SetAttributes(attrBytes.Int64(sent))
+	endSpan(span, err)
+	return err
+}
+
+// download sends the file and returns the number of bytes of file data sent.
+func (s *Service) download(ctx context.Context, req *tv1.DownloadRequest, stream tv1.TransferService_DownloadServer) (int64, error) {
+	req.PreferredBlocksize = min(s.blocks.clamp(req.PreferredBlocksize), s.maxBlockSize())
+
+	slog.Info("download", "id", req.Id, "offset", req.Offset, "length", req.Length, "blocksize", req.PreferredBlocksize)
+
+	if s.isDraining() {
+		return 0, errShuttingDown
+	}
+
+	if req.Offset < 0 || req.Length < 0 {
+		return 0, status.Error(codes.InvalidArgument, "offset and length cannot be negative")
+	}
 
 	id, err := ParseID(req.Id)
 	if err != nil {
 		slog.Error("error parsing id", "id", req.Id, "err", err)
-		status.Error(codes.InvalidArgument, fmt.Sprintf("invalid id: %v", err))
+		return 0, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid id: %v", err))
+	}
+
+	// only finished files have info so uploads in progress are not found
+	info, err := s.fileStore.ReadInfo(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, status.Error(codes.NotFound, fmt.Sprintf("file not found for id [%s]", id))
+	}
+
+	if err != nil {
+		slog.Error("error reading file info", "id", id, "err", err)
+		return 0, status.Error(codes.Internal, fmt.Sprintf("error reading file info for id [%s]: %v", id, err))
+	}
+
+	err = s.authorize(ctx, ActionRead, id, info.Owner)
+	if err != nil {
+		return 0, err
+	}
+
+	// files are only served once they have made it through processing
+	if info.Processing != nil && info.Processing.State != ProcessingComplete {
+		return 0, status.Error(codes.FailedPrecondition, fmt.Sprintf("processing of [%s] is %s", id, info.Processing.State))
 	}
 
 	in, err := s.fileStore.OpenReadOnly(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, status.Error(codes.NotFound, fmt.Sprintf("file not found for id [%s]", id))
+	}
+
 	if err != nil {
 		slog.Error("error opening file", "id", id, "err", err)
-		status.Error(codes.Internal, fmt.Sprintf("error opening file for id [%s]: %v", id, err))
+		return 0, status.Error(codes.Internal, fmt.Sprintf("error opening file for id [%s]: %v", id, err))
 	}
 	defer in.Close()
 
+	_, err = in.Seek(req.Offset, io.SeekStart)
+	if err != nil {
+		slog.Error("error seeking in file", "id", id, "offset", req.Offset, "err", err)
+		return 0, status.Error(codes.Internal, fmt.Sprintf("error seeking to offset %d for id [%s]: %v", req.Offset, id, err))
+	}
+
+	var reader io.Reader = in
+	if req.Length > 0 {
+		reader = io.LimitReader(in, req.Length)
+	}
+
+	compression := s.negotiateCompression(req.Compression)
 	buffer := make([]byte, req.PreferredBlocksize)
 
+	bw := s.bandwidth.open(principalName(ctx))
+	defer bw.close()
+
+	var sent int64
+
 	for {
-		n, err := in.Read(buffer)
+		if s.isDraining() {
+			return sent, errShuttingDown
+		}
+
+		n, err := reader.Read(buffer)
 		if errors.Is(err, io.EOF) {
 			break
 		}
 
 		if err != nil {
 			slog.Error("error reading file", "id", id, "err", err)
-			return status.Error(codes.Internal, fmt.Sprintf("error reading file for id [%s]: %v", id, err))
+			return sent, status.Error(codes.Internal, fmt.Sprintf("error reading file for id [%s]: %v", id, err))
 		}
 
 		checksum := sha256.Sum256(buffer[:n])
 
-		err = stream.Send(&tv1.DownloadResponse{Sha256: checksum[:], Data: buffer[:n]})
+		data, compressed, err := compressBlock(compression, buffer[:n])
+		if err != nil {
+			slog.Error("error compressing block", "id", id, "err", err)
+			return sent, status.Error(codes.Internal, fmt.Sprintf("error compressing block for id [%s]: %v", id, err))
+		}
+
+		err = s.throttle(ctx, bw, len(data))
+		if err != nil {
+			return sent, err
+		}
+
+		err = stream.Send(&tv1.DownloadResponse{Sha256: checksum[:], Data: data, Compressed: compressed})
 		if err != nil {
 			slog.Error("error sending block", "id", id, "path", in.Name(), "err", err)
-			return status.Error(codes.Internal, fmt.Sprintf("error sending block for id [%s]: %v", id, err))
+			return sent, status.Error(codes.Internal, fmt.Sprintf("error sending block for id [%s]: %v", id, err))
 		}
+		s.metrics.sentBytes.Add(float64(len(data)))
+		sent += int64(n)
 	}
 
-	return nil
+	return sent, nil
 }
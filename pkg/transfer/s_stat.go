@@ -0,0 +1,53 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Stat returns information about a finished file.
+func (s *Service) Stat(ctx context.Context, req *tv1.StatRequest) (*tv1.StatResponse, error) {
+	id, err := ParseID(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid id: %v", err))
+	}
+
+	info, err := s.fileStore.ReadInfo(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("file not found for id [%s]", id))
+	}
+
+	if err != nil {
+		slog.Error("error reading file info", "id", id, "err", err)
+		return nil, status.Error(codes.Internal, fmt.Sprintf("error reading file info for id [%s]: %v", id, err))
+	}
+
+	err = s.authorize(ctx, ActionRead, id, info.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &tv1.StatResponse{
+		Id:           info.ID.String(),
+		Size:         info.Size,
+		Sha256:       info.SHA256,
+		Metadata:     info.Metadata,
+		Created:      timestamppb.New(info.Created),
+		StorageClass: info.StorageClass,
+	}
+
+	if info.Processing != nil {
+		resp.ProcessingState = tv1.ProcessingState(info.Processing.State)
+		resp.ProcessingStep = info.Processing.Step
+		resp.ProcessingError = info.Processing.Error
+	}
+	return resp, nil
+}
@@ -9,134 +9,627 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"time"
 
 	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 // CreateUpload creates a new upload and assigns it an ID.
-func (s *Service) CreateUpload(_ context.Context, req *tv1.CreateUploadRequest) (*tv1.CreateUploadResponse, error) {
-	upload, err := s.UploadManager.CreateUpload(req.Size, req.FileSha256, []byte{0})
+func (s *Service) CreateUpload(ctx context.Context, req *tv1.CreateUploadRequest) (resp *tv1.CreateUploadResponse, err error) {
+	ctx, span := s.startSpan(ctx, "CreateUpload", attrSize.Int64(req.Size), attrBaseID.String(req.BaseId))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attrID.String(resp.Id))
+		}
+		endSpan(span, err)
+	}()
+
+	c := capabilityFromContext(ctx)
+	if c == nil {
+		return s.createUpload(ctx, req)
+	}
+
+	// capability tokens can only be used for a single upload
+	err = s.checkCreateCapability(c, req.Size, req.BaseId)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	resp, err = s.createUpload(ctx, req)
+	if err != nil {
+		s.capabilityUses.release(c)
+		return nil, err
+	}
+
+	s.capabilityUses.bind(c, ID(resp.Id))
+	return resp, nil
+}
+
+func (s *Service) createUpload(ctx context.Context, req *tv1.CreateUploadRequest) (*tv1.CreateUploadResponse, error) {
+	if s.isDraining() {
+		return nil, errShuttingDown
+	}
+
+	// a negative size would give back quota and disk space to the owner
+	if req.Size < 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid size %d", req.Size))
+	}
+
+	owner := principalName(ctx)
+
+	admitted, storageClass, err := s.admitRequest(ctx, req)
 	if err != nil {
+		slog.Info("upload rejected by admission hook", "owner", owner, "size", req.Size, "err", err)
+		return nil, err
+	}
+	req = admitted
+
+	if s.config.Dedup && len(req.FileSha256) == sha256.Size && s.fileStore.HasContent(req.FileSha256, req.Size) && s.canReadContent(ctx, req.FileSha256) {
+		id, err := s.createFromContent(ctx, req, owner, storageClass)
+		if status.Code(err) == codes.ResourceExhausted {
+			return nil, err
+		}
+
+		if err == nil {
+			return &tv1.CreateUploadResponse{
+				Id:                 id.String(),
+				PreferredBlocksize: s.preferredBlockSize(),
+				Complete:           true,
+				MinBlocksize:       s.blocks.min,
+				MaxBlocksize:       s.maxBlockSize(),
+			}, nil
+		}
+
+		// if that didn't work we just do a regular upload
+		slog.Error("error creating upload from existing content", "err", err)
+	}
+
+	var baseID ID
+	if req.BaseId != "" {
+		id, err := ParseID(req.BaseId)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid base id: %v", err))
+		}
+
+		info, err := s.fileStore.ReadInfo(id)
+		if err != nil {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("base [%s] not found", id))
+		}
+
+		err = s.authorize(ctx, ActionRead, id, info.Owner)
+		if err != nil {
+			return nil, err
+		}
+		baseID = id
+	}
+
+	s.admission.Lock()
+	err = s.admit(owner, req.Size, false)
+	if err != nil {
+		s.admission.Unlock()
+		slog.Info("upload rejected", "owner", owner, "size", req.Size, "err", err)
+		return nil, err
+	}
+
+	upload, err := s.UploadManager.CreateUpload(req.Size, req.FileSha256, req.Metadata)
+	if err != nil {
+		s.admission.Unlock()
 		slog.Error("error creating upload", "err", err)
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("error creating upload: %v", err))
 	}
+	upload.BaseID = baseID
+	upload.Owner = owner
+	upload.StorageClass = storageClass
+	upload.Compression = s.negotiateCompression(req.Compression)
+	s.admission.Unlock()
 
-	if s.config.UploadCreatedHook != nil {
-		s.config.UploadCreatedHook(upload.Filename(), upload.Size, upload.Offset(), upload.Metadata)
-	}
+	s.hooks.send(ctx, s.uploadEvent(ctx, EventCreated, upload, nil))
 
 	return &tv1.CreateUploadResponse{
 		Id:                 upload.ID.String(),
-		PreferredBlocksize: s.config.PreferredBlockSize,
+		PreferredBlocksize: s.preferredBlockSize(),
+		Compression:        upload.Compression,
+		MinBlocksize:       s.blocks.min,
+		MaxBlocksize:       s.maxBlockSize(),
 	}, nil
 }
 
+// canReadContent returns true if the caller may read one of the files with
+// checksum sha.  Knowing the checksum of a file isn't enough to get a copy of
+// it, so we only share content with callers that could download it anyway.
+// Everyone else does a regular upload, which doesn't reveal that we already
+// have the content.  Without an authorizer anyone may read any file, but only
+// if they know its ID, so then we only share the content of the caller's own
+// files.
+func (s *Service) canReadContent(ctx context.Context, sha []byte) bool {
+	ids, err := s.fileStore.ContentRefs(sha)
+	if err != nil {
+		return false
+	}
+
+	for _, id := range ids {
+		info, err := s.fileStore.ReadInfo(id)
+		if err != nil {
+			continue
+		}
+
+		if s.config.Authorizer == nil {
+			if info.Owner == principalName(ctx) {
+				return true
+			}
+			continue
+		}
+
+		if s.authorize(ctx, ActionRead, id, info.Owner) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// createFromContent creates a finished file sharing the content we already
+// have for the checksum in the request.
+func (s *Service) createFromContent(ctx context.Context, req *tv1.CreateUploadRequest, owner string, storageClass string) (ID, error) {
+	id, err := NewID()
+	if err != nil {
+		return "", err
+	}
+
+	s.admission.Lock()
+	defer s.admission.Unlock()
+
+	err = s.admit(owner, req.Size, true)
+	if err != nil {
+		slog.Info("upload rejected", "owner", owner, "size", req.Size, "err", err)
+		return "", err
+	}
+
+	err = s.fileStore.LinkContent(req.FileSha256, id, FileInfo{
+		ID:           id,
+		Size:         req.Size,
+		SHA256:       req.FileSha256,
+		Metadata:     req.Metadata,
+		Owner:        owner,
+		StorageClass: storageClass,
+		Created:      time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	s.usage.add(owner, req.Size)
+
+	slog.Info("upload deduplicated", "id", id, "sha256", hex.EncodeToString(req.FileSha256))
+
+	filename, _ := s.fileStore.Map(id)
+	event := Event{
+		ID:           id,
+		Filename:     filename,
+		Size:         req.Size,
+		Offset:       req.Size,
+		SHA256:       req.FileSha256,
+		Metadata:     req.Metadata,
+		StorageClass: storageClass,
+		Owner:        owner,
+		Principal:    PrincipalFromContext(ctx),
+		Peer:         peerAddress(ctx),
+	}
+
+	event.Type = EventCreated
+	s.hooks.send(ctx, event)
+
+	event.Type = EventFinished
+	s.hooks.send(ctx, event)
+	s.startProcessing(id)
+
+	return id, nil
+}
+
 // Upload creates an upload stream.
-func (s *Service) Upload(stream tv1.TransferService_UploadServer) error {
+func (s *Service) Upload(stream tv1.TransferService_UploadServer) (err error) {
 	var up *upload
 
-	var peerAddr string
-	peer, ok := peer.FromContext(stream.Context())
-	if ok {
-		peerAddr = peer.Addr.String()
-	}
+	ctx, span := s.startSpan(stream.Context(), "Upload")
+	defer func() { endUploadSpan(span, up, err) }()
 
-	for {
+	recv := func() (uploadBlock, error) {
 		req, err := stream.Recv()
+		if err != nil {
+			return uploadBlock{}, err
+		}
+		return uploadBlock{id: req.Id, offset: req.Offset, sha: req.Sha256, data: req.Data, compressed: req.Compressed}, nil
+	}
 
-		if err == io.EOF {
-			// if the stream ends before we have the entire file, that's an error condition.
-			if up == nil {
-				slog.Error("transfer stopped on first block from", "peer", peerAddr)
-				return status.Error(codes.FailedPrecondition, "upload failed on first block")
-			}
+	up, err = s.receiveUpload(ctx, span, recv, nil)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&tv1.UploadResponse{})
+}
 
-			// we did not get whole file
-			if up.Offset() != up.Size {
-				slog.Error("transfer stopped (EOF)", "id", up.ID, "peer", peerAddr)
-				return status.Error(codes.FailedPrecondition, "upload incomplete")
-			}
+// uploadBlock is a block received on an upload stream.
+type uploadBlock struct {
+	id         string
+	offset     int64
+	sha        []byte
+	data       []byte
+	compressed bool
+}
 
-			// Invariant: if we are here the upload succeeded
+// receiveUpload receives the blocks of an upload stream with recv and writes
+// them to the upload, calling ack, if set, after every block and before
+// stopping because the service is draining.  Once recv returns io.EOF the
+// upload is finished.  It returns the upload, which is nil if the stream
+// ended before we got that far.
+func (s *Service) receiveUpload(ctx context.Context, span trace.Span, recv func() (uploadBlock, error), ack func(up *upload) error) (up *upload, err error) {
+	peerAddr := peerAddress(ctx)
 
-			if s.config.UploadFinishedHook != nil {
-				s.config.UploadFinishedHook(up.Filename(), up.Size, up.Offset(), up.Metadata)
-			}
+	defer func() { s.syncInterruptedUpload(up) }()
 
-			// finish the upload and verify checksum if present
-			err := s.UploadManager.Finish(up.ID)
+	bw := s.bandwidth.open(principalName(ctx))
+	defer bw.close()
 
-			// if the checksum didn't match we remove the file and return an error
-			if errors.Is(ErrChecksumForFileMismatch, err) {
-				err2 := s.fileStore.Remove(up.ID)
-				if err2 != nil {
-					slog.Info("failed to remove upload after failed checksum", "id", up.ID, "filename", up.Filename(), "err", err)
-				}
+	// every way the stream can break is reported to the hooks
+	fail := func(err error) (*upload, error) {
+		s.uploadAborted(ctx, up, err)
+		return up, err
+	}
 
-				return status.Error(codes.FailedPrecondition, err.Error())
+	for {
+		// let the client know how far we got before we stop
+		if s.isDraining() {
+			if up != nil && ack != nil {
+				s.syncInterruptedUpload(up)
+				ack(up)
 			}
+			return fail(errShuttingDown)
+		}
 
-			if err != nil {
-				// not much we can do about this except report it
-				slog.Error("error finishing upload", "err", err)
+		block, err := s.receive(ctx, recv)
+		if err == errShuttingDown {
+			continue
+		}
+
+		if err == io.EOF {
+			// if the stream ends before we have the entire file, that's an error condition.
+			if up == nil {
+				slog.Error("transfer stopped on first block from", "peer", peerAddr)
+				return nil, status.Error(codes.FailedPrecondition, "upload failed on first block")
 			}
 
-			return stream.SendAndClose(&tv1.UploadResponse{})
+			// completeUpload reports how it went itself
+			return up, s.completeUpload(ctx, up, peerAddr)
 		}
 
 		if err != nil {
 			slog.Error("transfer stopped", "peer", peerAddr, "err", err)
-			return status.Error(codes.Unknown, err.Error())
+			return fail(status.Error(codes.Unknown, err.Error()))
 		}
 
 		// if this is the first message we have to get the upload instance
 		if up == nil {
-			id, err := ParseID(req.Id)
+			up, err = s.resumeUpload(ctx, block.id, block.offset)
 			if err != nil {
-				return err
+				return fail(err)
 			}
+			span.SetAttributes(attrID.String(up.ID.String()), attrSize.Int64(up.Size), attrOffset.Int64(block.offset))
+		}
 
-			up = s.UploadManager.GetUpload(id)
-			if up == nil {
-				return status.Error(codes.NotFound, "upload id not found")
-			}
+		err = s.throttle(ctx, bw, len(block.data))
+		if err != nil {
+			return fail(err)
 		}
 
-		// ensure the offset is correct
-		if up.Offset() != req.Offset {
-			return status.Error(codes.FailedPrecondition, fmt.Sprintf("offset mismatch, server=%d, client=%d", up.Offset(), req.Offset))
+		err = s.writeBlock(ctx, up, block.offset, block.sha, block.data, block.compressed)
+		if err != nil {
+			return fail(err)
 		}
 
-		// ensure checksum is correct
-		verifyChecksum := sha256.Sum256(req.Data)
-		if !bytes.Equal(verifyChecksum[:], req.Sha256) {
-			return status.Error(codes.DataLoss, "checksums did not match")
+		if ack == nil {
+			continue
 		}
 
-		// write the data to the file
-		n, err := up.Write(req.Data)
+		err = ack(up)
 		if err != nil {
-			return status.Error(codes.Unknown, fmt.Sprintf("write error: %v", err))
+			slog.Error("error sending ack", "id", up.ID, "peer", peerAddr, "err", err)
+			return fail(status.Error(codes.Unknown, err.Error()))
 		}
+	}
+}
+
+// receive returns what recv returns, unless the service starts draining or
+// the stream is canceled first, so streams waiting for an idle client stop
+// right away.  recv is then left to return once the handler has returned and
+// the stream is closed.
+func (s *Service) receive(ctx context.Context, recv func() (uploadBlock, error)) (uploadBlock, error) {
+	type received struct {
+		block uploadBlock
+		err   error
+	}
+
+	ch := make(chan received, 1)
+	go func() {
+		block, err := recv()
+		ch <- received{block: block, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.block, r.err
+	case <-s.draining:
+		return uploadBlock{}, errShuttingDown
+	case <-ctx.Done():
+		return uploadBlock{}, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// resumeUpload looks up the upload identified by idString for a new upload
+// stream.  If the stream starts at an earlier offset than what we have written
+// we truncate the upload back to that offset so that clients can resume from
+// the last offset they know was acknowledged.  If that fails the upload is
+// returned along with the error.
+func (s *Service) resumeUpload(ctx context.Context, idString string, offset int64) (*upload, error) {
+	id, err := ParseID(idString)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	up := s.UploadManager.GetUpload(id)
+	if up == nil {
+		return nil, status.Error(codes.NotFound, "upload id not found")
+	}
 
-		// validate that we wrote the data
-		if n != len(req.Data) {
-			return status.Error(codes.Unknown, fmt.Sprintf("wrote too few bytes, should write %d but wrote %d", len(req.Data), n))
+	err = s.authorize(ctx, ActionWrite, id, up.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < up.Offset() {
+		slog.Info("rewinding upload", "id", id, "from", up.Offset(), "to", offset)
+
+		err := up.Rewind(offset)
+		if err != nil {
+			return up, status.Error(codes.FailedPrecondition, fmt.Sprintf("unable to rewind to offset %d: %v", offset, err))
 		}
+	}
 
-		if s.config.UploadProgressHook != nil {
-			s.config.UploadProgressHook(up.Filename(), up.Size, up.Offset(), up.Metadata)
+	return up, nil
+}
+
+// writeBlock decompresses the block if needed, verifies the offset and checksum
+// of the block and writes it to the upload.
+func (s *Service) writeBlock(ctx context.Context, up *upload, offset int64, sha []byte, data []byte, compressed bool) error {
+	s.metrics.receivedBytes.Add(float64(len(data)))
+
+	// for delta uploads we copy whatever blocks we have from the base before
+	// the client's next block.
+	err := s.fillFromBase(up)
+	if err != nil {
+		slog.Error("error copying blocks from base", "id", up.ID, "base", up.BaseID, "err", err)
+		return status.Error(codes.Internal, fmt.Sprintf("error copying blocks from base: %v", err))
+	}
+
+	if compressed {
+		data, err = decompressBlock(up.Compression, data, s.blocks.max)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("error decompressing block: %v", err))
 		}
+	}
+
+	// ensure the offset is correct
+	if up.Offset() != offset {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("offset mismatch, server=%d, client=%d", up.Offset(), offset))
+	}
 
-		slog.Debug("wrote block", "id", req.Id, "offset", up.Offset(), "size", n, "checksum", hex.EncodeToString(verifyChecksum[:]))
+	// ensure checksum is correct
+	verifyChecksum := sha256.Sum256(data)
+	if !bytes.Equal(verifyChecksum[:], sha) {
+		s.metrics.blockChecksumFailures.Inc()
+		return status.Error(codes.DataLoss, "checksums did not match")
 	}
+
+	// write the data to the file
+	n, err := up.Write(data)
+	if err != nil {
+		return status.Error(codes.Unknown, fmt.Sprintf("write error: %v", err))
+	}
+
+	// validate that we wrote the data
+	if n != len(data) {
+		return status.Error(codes.Unknown, fmt.Sprintf("wrote too few bytes, should write %d but wrote %d", len(data), n))
+	}
+
+	up.LogBlock(offset, n, verifyChecksum[:])
+
+	err = s.fillFromBase(up)
+	if err != nil {
+		slog.Error("error copying blocks from base", "id", up.ID, "base", up.BaseID, "err", err)
+		return status.Error(codes.Internal, fmt.Sprintf("error copying blocks from base: %v", err))
+	}
+
+	s.hooks.send(ctx, s.uploadEvent(ctx, EventProgress, up, nil))
+
+	slog.Debug("wrote block", "id", up.ID, "offset", up.Offset(), "size", n, "checksum", hex.EncodeToString(verifyChecksum[:]))
+	return nil
+}
+
+// completeUpload is called when the client has closed the upload stream. It
+// verifies that we have the whole file and finishes the upload.
+func (s *Service) completeUpload(ctx context.Context, up *upload, peerAddr string) error {
+	// we did not get whole file
+	if up.Offset() != up.Size {
+		slog.Error("transfer stopped (EOF)", "id", up.ID, "peer", peerAddr)
+		err := status.Error(codes.FailedPrecondition, "upload incomplete")
+		s.hooks.send(ctx, s.uploadEvent(ctx, EventFailed, up, err))
+		return err
+	}
+
+	// finish the upload, verify checksum if present and move the file out of
+	// staging.
+	finishCtx, span := startChildSpan(ctx, "Finish", attrID.String(up.ID.String()), attrSize.Int64(up.Size))
+	err := s.UploadManager.Finish(finishCtx, up.ID)
+	endSpan(span, err)
+
+	// if the checksum didn't match we get rid of the file and return an error
+	var mismatch *ChecksumMismatchError
+	if errors.As(err, &mismatch) {
+		s.metrics.fileChecksumFailures.Inc()
+		s.discardUpload(up, mismatch, peerAddr)
+		s.hooks.send(ctx, s.uploadEvent(ctx, EventFailed, up, mismatch))
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	if err != nil {
+		slog.Error("error finishing upload", "id", up.ID, "err", err)
+		s.hooks.send(ctx, s.uploadEvent(ctx, EventFailed, up, err))
+		return status.Error(codes.Internal, fmt.Sprintf("error finishing upload: %v", err))
+	}
+
+	// Invariant: if we are here the upload succeeded
+	s.metrics.uploadDuration.Observe(time.Since(up.created).Seconds())
+	s.metrics.uploadSize.Observe(float64(up.Size))
+	s.usage.add(up.Owner, up.Size)
+
+	if s.config.Dedup && len(up.FileSHA256) == sha256.Size {
+		err := s.fileStore.AddContent(up.ID, up.FileSHA256)
+		if err != nil {
+			slog.Error("error adding upload to content index", "id", up.ID, "err", err)
+		}
+	}
+
+	// processing is started after the event so the hooks see it finish first
+	s.hooks.send(ctx, s.uploadEvent(ctx, EventFinished, up, nil))
+	s.startProcessing(up.ID)
+
+	return nil
+}
+
+// discardUpload gets rid of an upload that failed checksum verification by
+// either putting it in quarantine or removing it.
+func (s *Service) discardUpload(up *upload, mismatch *ChecksumMismatchError, peerAddr string) {
+	if s.quarantine != nil {
+		filename, err := s.fileStore.MapStaging(up.ID)
+		if err == nil {
+			err = s.quarantine.Add(filename, QuarantineReport{
+				ID:             up.ID,
+				Size:           up.Size,
+				ExpectedSHA256: mismatch.Expected,
+				ActualSHA256:   mismatch.Actual,
+				Peer:           peerAddr,
+				Metadata:       up.Metadata,
+				QuarantinedAt:  time.Now(),
+				Blocks:         up.Blocks(),
+				Encrypted:      up.Encrypted,
+			})
+		}
+
+		if err == nil {
+			slog.Warn("upload quarantined after failed checksum", "id", up.ID, "peer", peerAddr)
+			return
+		}
+
+		slog.Error("failed to quarantine upload, removing it", "id", up.ID, "err", err)
+	}
+
+	err := s.fileStore.RemoveStaging(up.ID)
+	if err != nil {
+		slog.Info("failed to remove upload after failed checksum", "id", up.ID, "filename", up.Filename(), "err", err)
+	}
+}
+
+// syncInterruptedUpload flushes an upload to disk if the upload stream ended
+// before the upload was finished so the client can resume from as far as we
+// got.
+func (s *Service) syncInterruptedUpload(up *upload) {
+	if up == nil || s.UploadManager.GetUpload(up.ID) != up {
+		return
+	}
+
+	err := up.Sync()
+	if err != nil {
+		slog.Error("error syncing interrupted upload", "id", up.ID, "err", err)
+	}
+}
+
+// startProcessing runs the processing pipeline, if there is one, on the
+// finished file id.
+func (s *Service) startProcessing(id ID) {
+	if s.pipeline == nil {
+		return
+	}
+
+	err := s.pipeline.submit(id)
+	if err != nil {
+		slog.Error("error starting processing", "id", id, "err", err)
+	}
+}
+
+// processingDone notifies the hooks that the pipeline has finished with id.
+func (s *Service) processingDone(id ID, status ProcessingStatus) {
+	info, err := s.fileStore.ReadInfo(id)
+	if err != nil {
+		slog.Error("error reading file info", "id", id, "err", err)
+		return
+	}
+
+	filename, _ := s.fileStore.Map(id)
+	event := Event{
+		Type:         EventProcessed,
+		ID:           id,
+		Filename:     filename,
+		Size:         info.Size,
+		Offset:       info.Size,
+		SHA256:       info.SHA256,
+		Metadata:     info.Metadata,
+		StorageClass: info.StorageClass,
+		Owner:        info.Owner,
+	}
+
+	if status.State == ProcessingFailed {
+		event.Type = EventProcessingFailed
+		event.Err = fmt.Errorf("%w: step %s: %s", ErrProcessingFailed, status.Step, status.Error)
+	}
+	s.hooks.send(context.Background(), event)
+}
+
+// endUploadSpan ends the span of an upload stream.
+func endUploadSpan(span trace.Span, up *upload, err error) {
+	if up != nil {
+		span.SetAttributes(attrBytes.Int64(up.Offset()), attrBlocks.Int(len(up.Blocks())))
+	}
+	endSpan(span, err)
+}
+
+// uploadAborted notifies the hooks that the upload stream for up broke.
+func (s *Service) uploadAborted(ctx context.Context, up *upload, err error) {
+	if up == nil {
+		return
+	}
+	s.hooks.send(ctx, s.uploadEvent(ctx, EventFailed, up, err))
+}
+
+// peerAddress returns the address of the peer or "" if it is unknown.
+func peerAddress(ctx context.Context) string {
+	peer, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return peer.Addr.String()
 }
 
 // GetOffset returns the current offset for an active upload identified by req.Id.
-func (s *Service) GetOffset(_ context.Context, req *tv1.GetOffsetRequest) (*tv1.GetOffsetResponse, error) {
+func (s *Service) GetOffset(ctx context.Context, req *tv1.GetOffsetRequest) (resp *tv1.GetOffsetResponse, err error) {
+	ctx, span := s.startSpan(ctx, "GetOffset", attrID.String(req.Id))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attrOffset.Int64(resp.Offset))
+		}
+		endSpan(span, err)
+	}()
+
 	id, err := ParseID(req.Id)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
@@ -147,5 +640,16 @@ func (s *Service) GetOffset(_ context.Context, req *tv1.GetOffsetRequest) (*tv1.
 		return nil, status.Error(codes.NotFound, "upload not found")
 	}
 
-	return &tv1.GetOffsetResponse{Offset: upload.Offset(), PreferredBlocksize: s.config.PreferredBlockSize}, nil
+	err = s.authorize(ctx, ActionWrite, id, upload.Owner)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.resumes.Inc()
+
+	return &tv1.GetOffsetResponse{
+		Offset:             upload.SyncedOffset(),
+		PreferredBlocksize: s.preferredBlockSize(),
+		MinBlocksize:       s.blocks.min,
+		MaxBlocksize:       s.maxBlockSize(),
+	}, nil
 }
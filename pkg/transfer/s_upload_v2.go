@@ -0,0 +1,34 @@
+package transfer
+
+import (
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+)
+
+// UploadV2 creates a bidirectional upload stream.  It behaves like Upload, but
+// acknowledges the synced and written offsets after every block it has written,
+// along with the largest block it wants right now, and sends a final
+// acknowledgement with Complete set once the upload has been finished.
+func (s *Service) UploadV2(stream tv1.TransferService_UploadV2Server) (err error) {
+	var up *upload
+
+	ctx, span := s.startSpan(stream.Context(), "UploadV2")
+	defer func() { endUploadSpan(span, up, err) }()
+
+	recv := func() (uploadBlock, error) {
+		req, err := stream.Recv()
+		if err != nil {
+			return uploadBlock{}, err
+		}
+		return uploadBlock{id: req.Id, offset: req.Offset, sha: req.Sha256, data: req.Data, compressed: req.Compressed}, nil
+	}
+
+	ack := func(up *upload) error {
+		return stream.Send(&tv1.UploadV2Response{Offset: up.SyncedOffset(), WrittenOffset: up.Offset(), MaxBlocksize: s.maxBlockSize()})
+	}
+
+	up, err = s.receiveUpload(ctx, span, recv, ack)
+	if err != nil {
+		return err
+	}
+	return stream.Send(&tv1.UploadV2Response{Offset: up.Size, WrittenOffset: up.Size, Complete: true})
+}
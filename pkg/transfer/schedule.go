@@ -0,0 +1,245 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BandwidthSchedule is the bandwidth the client may use for uploads and
+// downloads at different times of the day.
+type BandwidthSchedule struct {
+	// Rate is the bytes per second outside the windows.  Zero means no limit.
+	Rate int64
+
+	// Windows are the times of day with a different rate.  If windows
+	// overlap the first one applies.
+	Windows []BandwidthWindow
+}
+
+// BandwidthWindow is a time of day with its own bandwidth.  Start and End are
+// the time since midnight in local time.  If End is before Start the window
+// wraps around midnight, and if they are the same it covers the whole day.
+type BandwidthWindow struct {
+	Start time.Duration
+	End   time.Duration
+
+	// Rate is the bytes per second in the window.  Zero means no limit.
+	Rate int64
+
+	// Pause stops transfers during the window.  They resume from where they
+	// left off once the window ends.
+	Pause bool
+}
+
+const day = 24 * time.Hour
+
+// pausedError is returned by transfers that were stopped because the
+// schedule pauses them.
+type pausedError struct {
+	until time.Time
+}
+
+func (e *pausedError) Error() string {
+	return fmt.Sprintf("transfers paused until %s", e.until.Format(time.DateTime))
+}
+
+// ParseBandwidth parses a rate in bytes per second, which may have a K, M or
+// G suffix for KiB, MiB or GiB.
+func ParseBandwidth(s string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-min(len(s), 1):]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+
+	number := s
+	if multiplier > 1 {
+		number = s[:len(s)-1]
+	}
+
+	rate, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid bandwidth [%s], expected bytes per second with an optional K, M or G suffix", s)
+	}
+	return rate * multiplier, nil
+}
+
+// ParseBandwidthWindow parses a window like "08:00-17:00=1M", or
+// "08:00-17:00=pause" for a window in which transfers are paused.  The times
+// are in local time and the rate is parsed by ParseBandwidth.
+func ParseBandwidthWindow(s string) (BandwidthWindow, error) {
+	times, rate, ok := strings.Cut(s, "=")
+	start, end, ok2 := strings.Cut(times, "-")
+	if !ok || !ok2 {
+		return BandwidthWindow{}, fmt.Errorf("invalid bandwidth window [%s], expected <HH:MM>-<HH:MM>=<rate>", s)
+	}
+
+	var w BandwidthWindow
+	var err error
+	w.Start, err = parseTimeOfDay(start)
+	if err != nil {
+		return BandwidthWindow{}, err
+	}
+
+	w.End, err = parseTimeOfDay(end)
+	if err != nil {
+		return BandwidthWindow{}, err
+	}
+
+	if rate == "pause" {
+		w.Pause = true
+		return w, nil
+	}
+
+	w.Rate, err = ParseBandwidth(rate)
+	if err != nil {
+		return BandwidthWindow{}, err
+	}
+	return w, nil
+}
+
+// parseTimeOfDay parses HH:MM, from 00:00 to 24:00, into the time since
+// midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	h, err := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err != nil || err2 != nil || len(minutes) != 2 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day [%s], expected HH:MM", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Validate checks that the rates aren't negative and the windows are within
+// a day.
+func (s BandwidthSchedule) Validate() error {
+	if s.Rate < 0 {
+		return fmt.Errorf("bandwidth cannot be negative")
+	}
+
+	for _, w := range s.Windows {
+		if w.Start < 0 || w.Start > day || w.End < 0 || w.End > day {
+			return fmt.Errorf("bandwidth window %s-%s is not within a day", w.Start, w.End)
+		}
+
+		if w.Rate < 0 {
+			return fmt.Errorf("bandwidth cannot be negative")
+		}
+	}
+	return nil
+}
+
+// contains returns true if the window contains tod, the time since midnight.
+func (w BandwidthWindow) contains(tod time.Duration) bool {
+	start, end := w.Start%day, w.End%day
+	switch {
+	case start == end:
+		return true
+	case start < end:
+		return tod >= start && tod < end
+	default:
+		return tod >= start || tod < end
+	}
+}
+
+// at returns the rate at t, whether transfers are paused, and when the next
+// window starts or ends.
+func (s BandwidthSchedule) at(t time.Time) (rate int64, pause bool, next time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	tomorrow := midnight.AddDate(0, 0, 1)
+	tod := t.Sub(midnight)
+
+	rate = s.Rate
+	found := false
+	next = t.Add(day)
+	for _, w := range s.Windows {
+		if !found && w.contains(tod) {
+			rate, pause, found = w.Rate, w.Pause, true
+		}
+
+		for _, boundary := range []time.Duration{w.Start % day, w.End % day} {
+			at := midnight.Add(boundary)
+			if !at.After(t) {
+				at = tomorrow.Add(boundary)
+			}
+			next = minTime(next, at)
+		}
+	}
+	return rate, pause, next
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// clientBandwidth throttles the transfers of a client according to its
+// schedule.  All the transfers of the client share the bandwidth, and mu
+// guards the bucket they take it from.
+type clientBandwidth struct {
+	schedule BandwidthSchedule
+	mu       sync.Mutex
+	bucket   bucket
+}
+
+// wait waits until n bytes may be transferred.  If the schedule pauses
+// transfers a *pausedError is returned right away.
+func (b *clientBandwidth) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	rate, pause, next := b.schedule.at(now)
+	var wait time.Duration
+	if !pause {
+		wait = b.bucket.reserve(rate, n, now)
+	}
+	b.mu.Unlock()
+
+	if pause {
+		return &pausedError{until: next}
+	}
+	return sleep(ctx, wait)
+}
+
+// resumed waits until the schedule doesn't pause transfers.
+func (b *clientBandwidth) resumed(ctx context.Context) error {
+	for {
+		_, pause, next := b.schedule.at(time.Now())
+		if !pause {
+			return nil
+		}
+
+		slog.Info("transfers paused", "until", next)
+		err := sleep(ctx, time.Until(next))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
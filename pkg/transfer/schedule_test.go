@@ -0,0 +1,147 @@
+package transfer
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{s: "0", want: 0},
+		{s: "1500", want: 1500},
+		{s: "10K", want: 10 << 10},
+		{s: "2m", want: 2 << 20},
+		{s: "1G", want: 1 << 30},
+		{s: "", wantErr: true},
+		{s: "M", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "1T", wantErr: true},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			rate, err := ParseBandwidth(tc.s)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, rate)
+		})
+	}
+}
+
+func TestParseBandwidthWindow(t *testing.T) {
+	w, err := ParseBandwidthWindow("08:00-17:30=1M")
+	require.NoError(t, err)
+	require.Equal(t, BandwidthWindow{Start: 8 * time.Hour, End: 17*time.Hour + 30*time.Minute, Rate: 1 << 20}, w)
+
+	w, err = ParseBandwidthWindow("22:00-24:00=pause")
+	require.NoError(t, err)
+	require.Equal(t, BandwidthWindow{Start: 22 * time.Hour, End: 24 * time.Hour, Pause: true}, w)
+
+	for _, s := range []string{"08:00-17:00", "08:00=1M", "8-17=1M", "08:60-17:00=1M", "24:01-01:00=1M", "08:00-17:00=fast"} {
+		_, err := ParseBandwidthWindow(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestBandwidthScheduleAt(t *testing.T) {
+	schedule := BandwidthSchedule{
+		Rate: 1000,
+		Windows: []BandwidthWindow{
+			{Start: 8 * time.Hour, End: 17 * time.Hour, Pause: true},
+			{Start: 7 * time.Hour, End: 18 * time.Hour, Rate: 100},
+			{Start: 22 * time.Hour, End: 2 * time.Hour, Rate: 0},
+		},
+	}
+	require.NoError(t, schedule.Validate())
+
+	loc := time.FixedZone("test", 3600)
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2026, 3, 10, hour, minute, 0, 0, loc)
+	}
+
+	for _, tc := range []struct {
+		t     time.Time
+		rate  int64
+		pause bool
+		next  time.Time
+	}{
+		{t: at(6, 0), rate: 1000, next: at(7, 0)},
+		{t: at(7, 30), rate: 100, next: at(8, 0)},
+		{t: at(8, 0), pause: true, next: at(17, 0)},
+		{t: at(17, 0), rate: 100, next: at(18, 0)},
+		{t: at(20, 0), rate: 1000, next: at(22, 0)},
+		{t: at(23, 0), rate: 0, next: at(26, 0)},
+		{t: at(1, 0), rate: 0, next: at(2, 0)},
+	} {
+		rate, pause, next := schedule.at(tc.t)
+		require.Equal(t, tc.rate, rate, tc.t)
+		require.Equal(t, tc.pause, pause, tc.t)
+		require.True(t, tc.next.Equal(next), "%s: next %s, expected %s", tc.t, next, tc.next)
+	}
+
+	require.Error(t, BandwidthSchedule{Rate: -1}.Validate())
+	require.Error(t, BandwidthSchedule{Windows: []BandwidthWindow{{Start: 25 * time.Hour}}}.Validate())
+}
+
+// pausedSoon returns a schedule of 20 blocks per second that pauses
+// transfers from 200ms to 700ms from now.
+func pausedSoon() BandwidthSchedule {
+	now := time.Now()
+	tod := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+	return BandwidthSchedule{
+		Rate: 20 * minBlockSize,
+		Windows: []BandwidthWindow{{
+			Start: (tod + 200*time.Millisecond) % day,
+			End:   (tod + 700*time.Millisecond) % day,
+			Pause: true,
+		}},
+	}
+}
+
+func TestClientBandwidthPause(t *testing.T) {
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		MaxBlockSize:       minBlockSize,
+	})
+
+	filename := randomFile(t, 30*minBlockSize)
+	expect, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	// the upload is paused after the first second worth of blocks and a few
+	// more, and resumed once the pause is over
+	client, err := CreateClient(ClientConfig{ServerAddr: addr, Bandwidth: pausedSoon()})
+	require.NoError(t, err)
+	defer client.Close()
+
+	start := time.Now()
+	id, err := client.Upload(filename)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 700*time.Millisecond)
+
+	// the upload state file is gone once the upload is done
+	_, err = os.Stat(client.stateFilename(filename))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// the same goes for downloads
+	client, err = CreateClient(ClientConfig{ServerAddr: addr, Bandwidth: pausedSoon()})
+	require.NoError(t, err)
+	defer client.Close()
+
+	var got bytes.Buffer
+	start = time.Now()
+	require.NoError(t, client.DownloadRange(ID(id), &got, 0, 0))
+	require.GreaterOrEqual(t, time.Since(start), 700*time.Millisecond)
+	require.Equal(t, expect, got.Bytes())
+}
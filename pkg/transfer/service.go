@@ -1,43 +1,435 @@
 // Package transfer implements the gRPC service for uploads.
 package transfer
 
-import "fmt"
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
 
 // Service implements the upload service
 type Service struct {
-	UploadManager *uploadManager
-	fileStore     *FileStore
-	config        Config
+	UploadManager  *uploadManager
+	fileStore      *FileStore
+	quarantine     *quarantine
+	config         Config
+	capabilityUses *capabilityUses
+	usage          *usage
+	hooks          *hooks
+	pipeline       *pipeline
+	metrics        *metrics
+	tracer         trace.Tracer
+	admission      sync.Mutex
+	limitsMu       sync.RWMutex
+	limits         Limits
+	blocks         blockBounds
+	bandwidth      *bandwidth
+	heapSize       func() int64
+	streams        chan struct{}
+	drainOnce      sync.Once
+	draining       chan struct{}
+	done           chan struct{}
 }
 
-// Config for transfer service. Make sure that the PreferredBlockSize is set to something
-// sensible.
+// errShuttingDown is returned to clients when the service is draining.  They
+// can resume their transfers once the server is back.
+var errShuttingDown = status.Error(codes.Unavailable, "server is shutting down")
+
+// Config for transfer service.
 type Config struct {
-	IncomingDir        string
+	IncomingDir string
+
+	// PreferredBlockSize is the block size we ask clients to use.  It must be
+	// between the min and max block size, and defaults to defaultBlockSize
+	// clamped to them if zero.
 	PreferredBlockSize int64
-	UploadFinishedHook HookFunc
-	UploadProgressHook HookFunc
-	UploadCreatedHook  HookFunc
+
+	// MaxRecvMsgSize and MaxSendMsgSize are the largest gRPC messages the
+	// server receives and sends.  They default to the gRPC default of 4 MiB
+	// if zero.  Pass the options from ServerOptions to grpc.NewServer to
+	// apply them.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+
+	// MinBlockSize and MaxBlockSize bound the block sizes used for uploads,
+	// downloads and deltas.  If zero they default to minBlockSize and the
+	// largest block that fits in both the max message sizes.
+	MinBlockSize int64
+	MaxBlockSize int64
+
+	// KeepaliveTime is how long a connection may be idle before the server
+	// pings the client, and KeepaliveTimeout how long the server waits for
+	// the reply before closing the connection.  Zero means the gRPC defaults
+	// of two hours and 20 seconds.
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+
+	// KeepaliveMinTime is how often clients may ping the server.  Clients
+	// that ping more often are disconnected.  Zero means the gRPC default of
+	// five minutes.
+	KeepaliveMinTime time.Duration
+
+	// MaxConcurrentStreams is how many uploads and downloads the server
+	// handles at the same time across all connections.  Streams beyond that
+	// are rejected with ResourceExhausted.  Zero means no limit.
+	MaxConcurrentStreams int
+
+	// MaxStreamsPerConnection is how many calls each client connection may
+	// have in progress at the same time.  Zero means no limit.
+	MaxStreamsPerConnection uint32
+
+	// SyncMode determines when uploaded data is flushed to disk.  The zero
+	// value is SyncAlways.  SyncBytes and SyncInterval are the thresholds for
+	// SyncPeriodic and default to defaultSyncBytes and defaultSyncInterval.
+	SyncMode     SyncMode
+	SyncBytes    int64
+	SyncInterval time.Duration
+
+	// Quarantine files that fail whole-file checksum verification instead of
+	// deleting them.  Quarantined files are purged after QuarantineRetention,
+	// or never if it is zero.
+	Quarantine          bool
+	QuarantineRetention time.Duration
+
+	// Dedup enables the content-addressed store.  When a client creates an
+	// upload for a file with the same checksum and size as a file we already
+	// have, the new upload shares the existing content and is complete
+	// immediately.  Content is only shared with callers the Authorizer lets
+	// read a file that has it, or without an Authorizer, with the owner of
+	// such a file.
+	Dedup bool
+
+	// EncryptionKeys are the master keys used for encrypting files at rest.
+	// New files are encrypted with the first key and the remaining keys are
+	// used for reading files encrypted with older keys.  If there are no keys
+	// files are stored unencrypted.
+	EncryptionKeys []*MasterKey
+
+	// DisableCompression makes the server refuse compressed uploads and send
+	// downloads uncompressed.
+	DisableCompression bool
+
+	// MaxFileSize is the largest file we accept.  Zero means no limit.  This
+	// and the other limits, along with QuarantineRetention, can be changed
+	// while the service is running with SetLimits.
+	MaxFileSize int64
+
+	// Quota is how many bytes each principal may store, counting the full
+	// size of their uploads in progress.  Zero means no quota.
+	Quota int64
+
+	// MaxConcurrentUploads is how many uploads each principal may have in
+	// progress.  Zero means no limit.
+	MaxConcurrentUploads int
+
+	// MinFreeSpace is how many bytes must be left free in the incoming
+	// directory after making room for the uploads in progress and the new
+	// upload.  Uploads that don't fit are always rejected.
+	MinFreeSpace int64
+
+	// MaxBandwidth is how many bytes per second all uploads and downloads
+	// together may transfer, MaxPrincipalBandwidth how many the transfers of
+	// each principal may, and MaxStreamBandwidth how many each transfer may.
+	// Zero means no limit.  The transfers in progress share the bandwidth,
+	// so each gets a fair share and what one doesn't use goes to the others.
+	MaxBandwidth          int64
+	MaxPrincipalBandwidth int64
+	MaxStreamBandwidth    int64
+
+	// MemoryLimit is the heap size in bytes at which the server asks clients
+	// for the smallest blocks.  As the heap grows towards the limit the max
+	// block size advertised to clients shrinks in proportion.  Zero means
+	// the max block size is always advertised.
+	MemoryLimit int64
+
+	// Authorizer, if set, decides who may access which files.  The owner of
+	// a file is the principal that uploaded it, as authenticated by
+	// Authentication.  If nil every caller may access every file, but nobody
+	// may use the admin service.
+	Authorizer Authorizer
+
+	// AdmissionHook, if set, is called before an upload is created and can
+	// reject it, replace its metadata or pick its storage class.
+	AdmissionHook AdmissionFunc
+
+	// Metrics, if set, is where the Prometheus metrics of the service are
+	// registered.
+	Metrics prometheus.Registerer
+
+	// TracerProvider is used for tracing calls to the service.  If nil the
+	// global OpenTelemetry tracer provider is used.
+	TracerProvider trace.TracerProvider
+
+	// Processing are the steps run on every file after it has been
+	// uploaded, in order.  The processing status of each file is reported by
+	// Stat.  At most ProcessingConcurrency files, 1 if zero, are processed at
+	// the same time.
+	Processing            []ProcessingStep
+	ProcessingConcurrency int
+
+	// Hooks are notified of upload events.  Each hook has a queue of
+	// HookQueueSize events, 1024 if zero.  For hooks that fall that far
+	// behind EventCreated and EventProgress are dropped to make room for
+	// the other events, which are only dropped when there is no such room.
+	Hooks         []Hook
+	HookQueueSize int
+}
+
+// Validate returns an error if the limits, block sizes or gRPC settings of
+// the config are invalid.
+func (c Config) Validate() error {
+	err := c.limits().Validate()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.blockBounds()
+	if err != nil {
+		return err
+	}
+
+	if c.KeepaliveTime < 0 || c.KeepaliveTimeout < 0 || c.KeepaliveMinTime < 0 {
+		return fmt.Errorf("keepalive times cannot be negative")
+	}
+
+	if c.MaxConcurrentStreams < 0 {
+		return fmt.Errorf("max concurrent streams cannot be negative")
+	}
+	return nil
 }
 
-// HookFunc defines the callback hook function type.
-type HookFunc func(filename string, size int64, offset int64, metadata []byte)
+// limits returns the limits of the config.
+func (c Config) limits() Limits {
+	return Limits{
+		MaxFileSize:           c.MaxFileSize,
+		Quota:                 c.Quota,
+		MaxConcurrentUploads:  c.MaxConcurrentUploads,
+		MinFreeSpace:          c.MinFreeSpace,
+		QuarantineRetention:   c.QuarantineRetention,
+		MaxBandwidth:          c.MaxBandwidth,
+		MaxPrincipalBandwidth: c.MaxPrincipalBandwidth,
+		MaxStreamBandwidth:    c.MaxStreamBandwidth,
+		MemoryLimit:           c.MemoryLimit,
+	}
+}
+
+// blockBounds returns the block bounds of the config and checks that the
+// preferred block size is within them.
+func (c Config) blockBounds() (blockBounds, error) {
+	if c.MaxRecvMsgSize < 0 || c.MaxSendMsgSize < 0 {
+		return blockBounds{}, fmt.Errorf("max message sizes cannot be negative")
+	}
+
+	msgSize := min(cmp.Or(c.MaxRecvMsgSize, defaultMaxMsgSize), cmp.Or(c.MaxSendMsgSize, defaultMaxMsgSize))
+	b, err := newBlockBounds(msgSize, c.MinBlockSize, c.MaxBlockSize)
+	if err != nil {
+		return blockBounds{}, err
+	}
+
+	if c.PreferredBlockSize != 0 && c.PreferredBlockSize != b.clamp(c.PreferredBlockSize) {
+		return blockBounds{}, fmt.Errorf("preferred block size %d must be between %d and %d", c.PreferredBlockSize, b.min, b.max)
+	}
+	return b, nil
+}
 
 // NewService creates a new transfer service
 func NewService(c Config) (*Service, error) {
-	fileStore, err := CreateFileStore(c.IncomingDir)
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	limits := c.limits()
+	blocks, _ := c.blockBounds()
+	c.PreferredBlockSize = blocks.clamp(c.PreferredBlockSize)
+
+	fileStore, err := CreateFileStore(c.IncomingDir, c.EncryptionKeys...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create filestore: %w", err)
 	}
 
-	uploadManager, err := newManager(fileStore)
+	sync := syncPolicy{
+		mode:     c.SyncMode,
+		bytes:    c.SyncBytes,
+		interval: c.SyncInterval,
+	}
+
+	if sync.bytes == 0 {
+		sync.bytes = defaultSyncBytes
+	}
+
+	if sync.interval == 0 {
+		sync.interval = defaultSyncInterval
+	}
+
+	uploadManager, err := newManager(fileStore, sync)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Service{
-		UploadManager: uploadManager,
-		config:        c,
-		fileStore:     fileStore,
-	}, nil
+	usage, err := newUsage(fileStore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute storage usage: %w", err)
+	}
+
+	capabilityUses, err := newCapabilityUses(path.Join(c.IncomingDir, capabilityUsesFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load capability uses: %w", err)
+	}
+
+	service := &Service{
+		UploadManager:  uploadManager,
+		config:         c,
+		fileStore:      fileStore,
+		capabilityUses: capabilityUses,
+		usage:          usage,
+		limits:         limits,
+		blocks:         blocks,
+		bandwidth:      newBandwidth(),
+		heapSize:       newHeapSampler().size,
+		hooks:          newHooks(c.Hooks, c.HookQueueSize),
+		tracer:         newTracer(c.TracerProvider),
+		draining:       make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+
+	if c.MaxConcurrentStreams > 0 {
+		service.streams = make(chan struct{}, c.MaxConcurrentStreams)
+	}
+
+	service.metrics, err = newMetrics(service, c.Metrics)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %w", err)
+	}
+
+	service.pipeline, err = newPipeline(c.Processing, c.ProcessingConcurrency, fileStore, service.processingDone)
+	if err != nil {
+		return nil, err
+	}
+
+	if service.pipeline != nil {
+		err = service.pipeline.resume()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resume processing: %w", err)
+		}
+	}
+
+	if c.Quarantine {
+		service.quarantine, err = newQuarantine(path.Join(c.IncomingDir, quarantineDir), c.QuarantineRetention)
+		if err != nil {
+			return nil, err
+		}
+
+		go service.quarantine.expireLoop(service.done, service.quarantineExpired)
+	}
+
+	// restore the saved uploads last, so that they are still saved if
+	// anything above fails
+	err = uploadManager.restore()
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore uploads: %w", err)
+	}
+
+	return service, nil
+}
+
+// Drain makes the service refuse new uploads and downloads, and makes the
+// streams in progress stop after the block they are working on, or right away
+// if they are waiting for the client.  Clients get
+// an Unavailable error and can resume once the server is back.  The gRPC
+// server should be stopped after draining and before calling Shutdown, with
+// the options from ServerOptions so that Stop waits for the calls to return.
+func (s *Service) Drain() {
+	s.drainOnce.Do(func() { close(s.draining) })
+}
+
+// isDraining returns true once Drain has been called.
+func (s *Service) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the background tasks of the service and shuts down the
+// upload manager.  Uploads in progress are saved rather than finished, and
+// are resumed when a new service is created for the same directory.  Hooks
+// get a few seconds to handle the events they have queued.
+func (s *Service) Shutdown() error {
+	s.Drain()
+	close(s.done)
+	if s.pipeline != nil {
+		s.pipeline.shutdown()
+	}
+	err := s.UploadManager.Shutdown()
+	s.hooks.close(hookDrainTimeout)
+	return err
+}
+
+// negotiateCompression returns the compression we accept when the client asks
+// for c.
+func (s *Service) negotiateCompression(c tv1.Compression) tv1.Compression {
+	if s.config.DisableCompression {
+		return tv1.Compression_COMPRESSION_UNSPECIFIED
+	}
+	return supportedCompression(c)
+}
+
+// ServerOptions returns the gRPC server options for the message sizes,
+// keepalive and stream limits of the config.  They also make the server wait
+// for the calls in progress to return when it is stopped, so that Shutdown
+// doesn't save uploads that are still being written to.
+func (s *Service) ServerOptions() []grpc.ServerOption {
+	c := s.config
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(cmp.Or(c.MaxRecvMsgSize, defaultMaxMsgSize)),
+		grpc.MaxSendMsgSize(cmp.Or(c.MaxSendMsgSize, defaultMaxMsgSize)),
+		grpc.WaitForHandlers(true),
+	}
+
+	if c.KeepaliveTime > 0 || c.KeepaliveTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    c.KeepaliveTime,
+			Timeout: c.KeepaliveTimeout,
+		}))
+	}
+
+	if c.KeepaliveMinTime > 0 {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime: c.KeepaliveMinTime,
+		}))
+	}
+
+	if c.MaxStreamsPerConnection > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.MaxStreamsPerConnection))
+	}
+
+	if s.streams != nil {
+		opts = append(opts, grpc.ChainStreamInterceptor(s.streamLimitInterceptor))
+	}
+	return opts
+}
+
+// streamLimitInterceptor rejects streams when MaxConcurrentStreams streams
+// are already in progress.
+func (s *Service) streamLimitInterceptor(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	select {
+	case s.streams <- struct{}{}:
+		defer func() { <-s.streams }()
+		return handler(srv, stream)
+	default:
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("too many streams in progress, the limit is %d", cap(s.streams)))
+	}
 }
@@ -0,0 +1,224 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestDrain(t *testing.T) {
+	service, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+	})
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := tv1.NewTransferServiceClient(conn)
+
+	resp, err := client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 3 * minBlockSize})
+	require.NoError(t, err)
+
+	stream, err := client.UploadV2(context.Background())
+	require.NoError(t, err)
+
+	block := make([]byte, minBlockSize)
+	sum := sha256.Sum256(block)
+	require.NoError(t, stream.Send(&tv1.UploadV2Request{Id: resp.Id, Data: block, Sha256: sum[:]}))
+	ack, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(minBlockSize), ack.Offset)
+
+	// a block in flight is written and acknowledged before the stream stops
+	require.NoError(t, stream.Send(&tv1.UploadV2Request{Id: resp.Id, Offset: minBlockSize, Data: block, Sha256: sum[:]}))
+	ack, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(2*minBlockSize), ack.Offset)
+
+	// the stream is idle, but stops right away
+	service.Drain()
+	for {
+		ack, err = stream.Recv()
+		if err != nil {
+			break
+		}
+		require.Equal(t, int64(2*minBlockSize), ack.Offset)
+	}
+	requireCode(t, codes.Unavailable, err)
+
+	// new transfers are refused
+	_, err = client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 100})
+	requireCode(t, codes.Unavailable, err)
+
+	download, err := client.Download(context.Background(), &tv1.DownloadRequest{Id: resp.Id})
+	require.NoError(t, err)
+	_, err = download.Recv()
+	requireCode(t, codes.Unavailable, err)
+
+	// the offset is still there for clients to resume from
+	offset, err := client.GetOffset(context.Background(), &tv1.GetOffsetRequest{Id: resp.Id})
+	require.NoError(t, err)
+	require.Equal(t, int64(2*minBlockSize), offset.Offset)
+}
+
+func TestShutdownResume(t *testing.T) {
+	config := Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		EncryptionKeys:     []*MasterKey{newTestKey(t)},
+	}
+	service, addr := startServer(t, config)
+
+	filename := randomFile(t, 10*minBlockSize)
+
+	// quit prematurely, leaving the state file behind
+	client, err := CreateClient(ClientConfig{ServerAddr: addr, QuitAfter: 6, UploadWindow: 2 * minBlockSize})
+	require.NoError(t, err)
+	id, err := client.Upload(filename)
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	service.Drain()
+	require.NoError(t, service.Shutdown())
+
+	// the upload wasn't finished
+	_, err = service.fileStore.ReadInfo(ID(id))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// a server that fails to start leaves the saved upload alone
+	registry := prometheus.NewRegistry()
+	other, err := NewService(Config{IncomingDir: path.Join(t.TempDir(), "incoming"), Metrics: registry})
+	require.NoError(t, err)
+	require.NoError(t, other.Shutdown())
+
+	failing := config
+	failing.Metrics = registry
+	_, err = NewService(failing)
+	require.Error(t, err)
+
+	// a new server continues the upload
+	_, addr = startServer(t, config)
+
+	client, err = CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	resumedID, err := client.Upload(filename)
+	require.NoError(t, err)
+	require.Equal(t, id, resumedID)
+
+	dst := path.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.Download(ID(id), dst))
+
+	expect, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, expect, got)
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	_, addr := startServer(t, Config{
+		IncomingDir:          path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize:   minBlockSize,
+		MaxConcurrentStreams: 1,
+	})
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := tv1.NewTransferServiceClient(conn)
+
+	resp, err := client.CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 2 * minBlockSize})
+	require.NoError(t, err)
+
+	stream, err := client.UploadV2(context.Background())
+	require.NoError(t, err)
+
+	block := make([]byte, minBlockSize)
+	sum := sha256.Sum256(block)
+	require.NoError(t, stream.Send(&tv1.UploadV2Request{Id: resp.Id, Data: block, Sha256: sum[:]}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// the upload takes the only stream
+	download, err := client.Download(context.Background(), &tv1.DownloadRequest{Id: resp.Id})
+	require.NoError(t, err)
+	_, err = download.Recv()
+	requireCode(t, codes.ResourceExhausted, err)
+
+	// unary calls are not limited
+	_, err = client.GetOffset(context.Background(), &tv1.GetOffsetRequest{Id: resp.Id})
+	require.NoError(t, err)
+
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Error(t, err)
+
+	// the stream is free once the upload is done
+	require.Eventually(t, func() bool {
+		download, err := client.Download(context.Background(), &tv1.DownloadRequest{Id: resp.Id})
+		if err != nil {
+			return false
+		}
+		_, err = download.Recv()
+		return status.Code(err) != codes.ResourceExhausted
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMessageSize(t *testing.T) {
+	const msgSize = 64 * 1024
+
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: msgSize - blockOverhead,
+		MaxRecvMsgSize:     msgSize,
+		MaxSendMsgSize:     msgSize,
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr, MaxMsgSize: msgSize})
+	require.NoError(t, err)
+	defer client.Close()
+
+	filename := randomFile(t, 5*msgSize)
+	id, err := client.Upload(filename)
+	require.NoError(t, err)
+
+	// the client asks for download blocks that fit in its messages
+	dst := path.Join(t.TempDir(), "downloaded")
+	require.NoError(t, client.Download(ID(id), dst))
+
+	expect, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, expect, got)
+
+	// blocks larger than the max message size are rejected
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	resp, err := tv1.NewTransferServiceClient(conn).CreateUpload(context.Background(), &tv1.CreateUploadRequest{Size: 2 * msgSize})
+	require.NoError(t, err)
+
+	stream, err := tv1.NewTransferServiceClient(conn).UploadV2(context.Background())
+	require.NoError(t, err)
+	block := make([]byte, msgSize)
+	sum := sha256.Sum256(block)
+	require.NoError(t, stream.Send(&tv1.UploadV2Request{Id: resp.Id, Data: block, Sha256: sum[:]}))
+	_, err = stream.Recv()
+	requireCode(t, codes.ResourceExhausted, err)
+}
@@ -0,0 +1,68 @@
+package transfer
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncMode determines how and when uploaded data is flushed to disk.  Only
+// data that has been flushed to disk is reported as the upload offset to
+// clients so that uploads can be resumed correctly after a crash.
+type SyncMode int
+
+// Sync modes
+const (
+	// SyncAlways opens files with O_SYNC so every write is flushed to disk
+	// before it returns.  This is the safest and slowest mode.
+	SyncAlways SyncMode = iota
+
+	// SyncPeriodic flushes the file to disk every SyncBytes bytes or every
+	// SyncInterval, whichever comes first.
+	SyncPeriodic
+
+	// SyncOnFinish only flushes the file to disk when the upload is finished
+	// or the upload stream is interrupted.
+	SyncOnFinish
+
+	// SyncNone never explicitly flushes files to disk.  Since nothing is
+	// guaranteed to be durable in this mode, the offset reported stays at 0
+	// and interrupted uploads start over.
+	SyncNone
+)
+
+const (
+	defaultSyncBytes    = 16 * 1024 * 1024
+	defaultSyncInterval = 5 * time.Second
+)
+
+// syncPolicy is the sync mode along with the thresholds for periodic syncing.
+type syncPolicy struct {
+	mode     SyncMode
+	bytes    int64
+	interval time.Duration
+}
+
+var syncModeNames = map[SyncMode]string{
+	SyncAlways:   "always",
+	SyncPeriodic: "periodic",
+	SyncOnFinish: "finish",
+	SyncNone:     "none",
+}
+
+// ParseSyncMode parses the name of a sync mode as returned by String().
+func ParseSyncMode(s string) (SyncMode, error) {
+	for mode, name := range syncModeNames {
+		if name == s {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync mode [%s]", s)
+}
+
+func (m SyncMode) String() string {
+	name, ok := syncModeNames[m]
+	if !ok {
+		return fmt.Sprintf("SyncMode(%d)", m)
+	}
+	return name
+}
@@ -0,0 +1,197 @@
+package transfer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSConfig is the TLS configuration of the server or the client.
+//
+// On the server CertFile and KeyFile are the server certificate and key, and
+// CAFile is the CA bundle used to verify client certificates when
+// VerifyClientCerts is set.
+//
+// On the client CAFile is the CA bundle used to verify the server, and if it
+// is empty the system roots are used.  CertFile and KeyFile are the optional
+// client certificate for mutual TLS.  ServerName overrides the name we expect
+// in the server certificate.
+type TLSConfig struct {
+	CertFile          string
+	KeyFile           string
+	CAFile            string
+	VerifyClientCerts bool
+	ServerName        string
+}
+
+// ServerCredentials returns gRPC transport credentials for the server.  The
+// certificate, key and CA bundle are reloaded when the files change, so
+// certificates can be renewed without restarting the server.  Connections
+// that are already established keep using the old certificate.
+func ServerCredentials(c TLSConfig) (credentials.TransportCredentials, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("TLS needs both a certificate and a key")
+	}
+
+	if c.VerifyClientCerts && c.CAFile == "" {
+		return nil, errors.New("verifying client certificates needs a CA bundle")
+	}
+
+	reloader := &certReloader{config: c}
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials.NewTLS(&tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: reloader.getConfigForClient,
+	}), nil
+}
+
+// ClientCredentials returns gRPC transport credentials for the client.
+func ClientCredentials(c TLSConfig) (credentials.TransportCredentials, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return credentials.NewTLS(config), nil
+}
+
+// certReloader keeps the server TLS configuration up to date with the files
+// it was loaded from.  The modification times of the files are checked on
+// every handshake.
+type certReloader struct {
+	config TLSConfig
+
+	mu      sync.Mutex
+	loaded  []time.Time
+	current *tls.Config
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes, err := r.modTimes()
+	if err == nil && !equalTimes(modTimes, r.loaded) {
+		err = r.reloadLocked(modTimes)
+		if err == nil {
+			slog.Info("reloaded TLS certificates", "cert", r.config.CertFile)
+		}
+	}
+
+	// if the files are being replaced they may be inconsistent for a moment,
+	// so we keep using what we have and try again on the next handshake.
+	if err != nil {
+		slog.Error("error reloading TLS certificates, using previous certificates", "err", err)
+	}
+	return r.current, nil
+}
+
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	return r.reloadLocked(modTimes)
+}
+
+func (r *certReloader) reloadLocked(modTimes []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading server certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if r.config.CAFile != "" {
+		pool, err := loadCertPool(r.config.CAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = pool
+	}
+
+	if r.config.VerifyClientCerts {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.current = config
+	r.loaded = modTimes
+	return nil
+}
+
+// modTimes returns the modification times of the files we have loaded.
+func (r *certReloader) modTimes() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, filename := range []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile} {
+		if filename == "" {
+			continue
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func equalTimes(a []time.Time, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadCertPool loads a PEM encoded CA bundle.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle [%s]", filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,163 @@
+package transfer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// testCA is a certificate authority for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	file := path.Join(dir, name+".pem")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue creates a certificate for name valid for 127.0.0.1 and writes the
+// certificate and key to dir.
+func (ca *testCA) issue(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := path.Join(dir, name+".crt")
+	keyFile := path.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+// uploadAndDownload uploads a small file and downloads it again.
+func uploadAndDownload(config ClientConfig, filename string) error {
+	client, err := CreateClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	id, err := client.Upload(filename)
+	if err != nil {
+		return err
+	}
+	return client.Download(ID(id), filename+".downloaded."+id)
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	certFile, keyFile := ca.issue(t, dir, "server")
+
+	creds, err := ServerCredentials(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+
+	_, addr := startServer(t, Config{IncomingDir: path.Join(dir, "incoming")}, grpc.Creds(creds))
+
+	filename := randomFile(t, 3*minBlockSize)
+
+	require.NoError(t, uploadAndDownload(ClientConfig{ServerAddr: addr, TLS: &TLSConfig{CAFile: ca.file}}, filename))
+
+	// plaintext clients and clients that don't trust the CA are refused
+	require.Error(t, uploadAndDownload(ClientConfig{ServerAddr: addr}, filename))
+	require.Error(t, uploadAndDownload(ClientConfig{ServerAddr: addr, TLS: &TLSConfig{CAFile: newTestCA(t, dir, "other").file}}, filename))
+
+	// replace the server certificate with one from a new CA.  Make sure the
+	// modification time changes even on file systems with coarse timestamps.
+	newCA := newTestCA(t, t.TempDir(), "new")
+	newCert, newKey := newCA.issue(t, t.TempDir(), "server")
+	for _, f := range [][2]string{{newCert, certFile}, {newKey, keyFile}} {
+		data, err := os.ReadFile(f[0])
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(f[1], data, 0600))
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(f[1], later, later))
+	}
+
+	require.NoError(t, uploadAndDownload(ClientConfig{ServerAddr: addr, TLS: &TLSConfig{CAFile: newCA.file}}, filename))
+	require.Error(t, uploadAndDownload(ClientConfig{ServerAddr: addr, TLS: &TLSConfig{CAFile: ca.file}}, filename))
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	certFile, keyFile := ca.issue(t, dir, "server")
+	clientCert, clientKey := ca.issue(t, dir, "client")
+
+	_, err := ServerCredentials(TLSConfig{CertFile: certFile, KeyFile: keyFile, VerifyClientCerts: true})
+	require.Error(t, err)
+
+	creds, err := ServerCredentials(TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: ca.file, VerifyClientCerts: true})
+	require.NoError(t, err)
+
+	_, addr := startServer(t, Config{IncomingDir: path.Join(dir, "incoming")}, grpc.Creds(creds))
+
+	filename := randomFile(t, 3*minBlockSize)
+
+	require.NoError(t, uploadAndDownload(ClientConfig{
+		ServerAddr: addr,
+		TLS:        &TLSConfig{CAFile: ca.file, CertFile: clientCert, KeyFile: clientKey},
+	}, filename))
+
+	// clients without a certificate, or with one from another CA, are refused
+	require.Error(t, uploadAndDownload(ClientConfig{ServerAddr: addr, TLS: &TLSConfig{CAFile: ca.file}}, filename))
+
+	otherCert, otherKey := newTestCA(t, dir, "other").issue(t, t.TempDir(), "client")
+	require.Error(t, uploadAndDownload(ClientConfig{
+		ServerAddr: addr,
+		TLS:        &TLSConfig{CAFile: ca.file, CertFile: otherCert, KeyFile: otherKey},
+	}, filename))
+}
@@ -0,0 +1,119 @@
+package transfer
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// The client and the server trace transfers with OpenTelemetry.  The client
+// sends the trace context of each call in the gRPC metadata using the W3C
+// trace context headers, and the server continues the trace from there.
+
+const tracerName = "github.com/borud/large-file-upload/pkg/transfer"
+
+// span attributes
+const (
+	attrID     = attribute.Key("transfer.id")
+	attrBaseID = attribute.Key("transfer.base_id")
+	attrSize   = attribute.Key("transfer.size")
+	attrOffset = attribute.Key("transfer.offset")
+	attrLength = attribute.Key("transfer.length")
+	attrBytes  = attribute.Key("transfer.bytes")
+	attrBlocks = attribute.Key("transfer.blocks")
+	attrEvent  = attribute.Key("transfer.event")
+	attrStep   = attribute.Key("transfer.step")
+)
+
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// newTracer returns the tracer from provider, or from the global provider if
+// provider is nil.
+func newTracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// metadataCarrier lets the propagator read and write gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startSpan starts a server span.  If ctx doesn't have a span already the
+// trace is continued from the trace context sent by the client, if any.
+func (s *Service) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			ctx = propagator.Extract(ctx, metadataCarrier(md))
+		}
+	}
+	return s.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// startSpan starts a client span.
+func (c *Client) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return c.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// startChildSpan starts a span as a child of the span in ctx using the same
+// tracer provider.  If ctx has no span the span isn't recorded.
+func startChildSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTrace adds the trace context of ctx to the outgoing metadata.
+func injectTrace(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	propagator.Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// tracingUnaryInterceptor sends the trace context with unary calls.
+func tracingUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(injectTrace(ctx), method, req, reply, cc, opts...)
+}
+
+// tracingStreamInterceptor sends the trace context with streaming calls.
+func tracingStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(injectTrace(ctx), desc, cc, method, opts...)
+}
@@ -0,0 +1,112 @@
+package transfer
+
+import (
+	"context"
+	"io"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// findSpan returns the first span named name.
+func findSpan(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+// spanAttr returns the value of attribute key of span.
+func spanAttr(span *tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	serverSpans := tracetest.NewInMemoryExporter()
+	clientSpans := tracetest.NewInMemoryExporter()
+
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		TracerProvider:     sdktrace.NewTracerProvider(sdktrace.WithSyncer(serverSpans)),
+		Hooks:              []Hook{HookFunc(func(context.Context, Event) {})},
+	})
+
+	client, err := CreateClient(ClientConfig{
+		ServerAddr:     addr,
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(clientSpans)),
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	size := 3 * minBlockSize
+	id, err := client.Upload(randomFile(t, size))
+	require.NoError(t, err)
+	require.NoError(t, client.DownloadRange(ID(id), io.Discard, 100, 1000))
+
+	// client spans
+	spans := clientSpans.GetSpans()
+	upload := findSpan(spans, "Upload")
+	require.NotNil(t, upload)
+	require.Equal(t, trace.SpanKindClient, upload.SpanKind)
+	require.Equal(t, id, spanAttr(upload, attrID).AsString())
+	require.Equal(t, int64(size), spanAttr(upload, attrSize).AsInt64())
+
+	create := findSpan(spans, "CreateUpload")
+	require.NotNil(t, create)
+	require.Equal(t, upload.SpanContext.SpanID(), create.Parent.SpanID())
+
+	download := findSpan(spans, "Download")
+	require.NotNil(t, download)
+	require.Equal(t, int64(100), spanAttr(download, attrOffset).AsInt64())
+
+	// server spans continue the traces of the client
+	require.Eventually(t, func() bool {
+		return findSpan(serverSpans.GetSpans(), "hook finished") != nil
+	}, time.Second, 10*time.Millisecond)
+	spans = serverSpans.GetSpans()
+
+	serverCreate := findSpan(spans, "CreateUpload")
+	require.NotNil(t, serverCreate)
+	require.Equal(t, trace.SpanKindServer, serverCreate.SpanKind)
+	require.Equal(t, create.SpanContext.TraceID(), serverCreate.SpanContext.TraceID())
+	require.Equal(t, create.SpanContext.SpanID(), serverCreate.Parent.SpanID())
+	require.Equal(t, id, spanAttr(serverCreate, attrID).AsString())
+	require.Equal(t, int64(size), spanAttr(serverCreate, attrSize).AsInt64())
+
+	serverUpload := findSpan(spans, "UploadV2")
+	require.NotNil(t, serverUpload)
+	require.Equal(t, upload.SpanContext.TraceID(), serverUpload.SpanContext.TraceID())
+	require.Equal(t, int64(size), spanAttr(serverUpload, attrBytes).AsInt64())
+	require.Equal(t, int64(3), spanAttr(serverUpload, attrBlocks).AsInt64())
+
+	finish := findSpan(spans, "Finish")
+	require.NotNil(t, finish)
+	require.Equal(t, serverUpload.SpanContext.SpanID(), finish.Parent.SpanID())
+
+	verify := findSpan(spans, "VerifyChecksum")
+	require.NotNil(t, verify)
+	require.Equal(t, finish.SpanContext.SpanID(), verify.Parent.SpanID())
+
+	hook := findSpan(spans, "hook finished")
+	require.Equal(t, serverUpload.SpanContext.TraceID(), hook.SpanContext.TraceID())
+	require.Equal(t, "finished", spanAttr(hook, attrEvent).AsString())
+
+	serverDownload := findSpan(spans, "Download")
+	require.NotNil(t, serverDownload)
+	require.Equal(t, download.SpanContext.TraceID(), serverDownload.SpanContext.TraceID())
+	require.Equal(t, int64(1000), spanAttr(serverDownload, attrBytes).AsInt64())
+}
@@ -1,22 +1,70 @@
 package transfer
 
 import (
+	"encoding/hex"
 	"errors"
-	"os"
+	"fmt"
 	"sync"
+	"time"
+
+	tv1 "github.com/borud/large-file-upload/gen/transfer/v1"
 )
 
 // upload represents an active upload.  It keeps track of the offset of the upload.
 // The offset is protected by a mutex so any changes to the underlying file will
-// be in sync with the writeOffset.
+// be in sync with the writeOffset.  The syncedOffset is how much of the file
+// we know has been flushed to disk.
 type upload struct {
-	ID          ID
-	Size        int64
-	Metadata    []byte
-	FileSHA256  []byte
-	mu          sync.RWMutex
-	file        *os.File
-	writeOffset int64
+	ID           ID
+	BaseID       ID
+	Owner        string
+	StorageClass string
+	Compression  tv1.Compression
+	Size         int64
+	Metadata     []byte
+	FileSHA256   []byte
+	Encrypted    bool
+	mu           sync.RWMutex
+	file         WriteFile
+	writeOffset  int64
+	syncedOffset int64
+	sync         syncPolicy
+	lastSync     time.Time
+	created      time.Time
+	blocks       []BlockLogEntry
+	delta        *deltaPlan
+
+	// finishing is set while the upload manager is finishing the upload,
+	// and is protected by its mutex
+	finishing bool
+}
+
+// BlockLogEntry records a block that was written to an upload.
+type BlockLogEntry struct {
+	Offset int64     `json:"offset"`
+	Size   int       `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Time   time.Time `json:"time"`
+}
+
+// uploadRecord is what we save of an upload in progress when the server shuts
+// down so that the upload can be resumed once the server is back.  Offset is
+// how much of the staged file we know is on disk.
+type uploadRecord struct {
+	ID           ID              `json:"id"`
+	BaseID       ID              `json:"base_id,omitempty"`
+	Owner        string          `json:"owner,omitempty"`
+	StorageClass string          `json:"storage_class,omitempty"`
+	Compression  tv1.Compression `json:"compression,omitempty"`
+	Size         int64           `json:"size"`
+	Metadata     []byte          `json:"metadata,omitempty"`
+	FileSHA256   []byte          `json:"sha256,omitempty"`
+	Offset       int64           `json:"offset"`
+	Created      time.Time       `json:"created"`
+	Blocks       []BlockLogEntry `json:"blocks,omitempty"`
+	DeltaBlock   int64           `json:"delta_blocksize,omitempty"`
+	DeltaHave    []bool          `json:"delta_have,omitempty"`
+	Encrypted    bool            `json:"encrypted,omitempty"`
 }
 
 var (
@@ -41,7 +89,146 @@ func (u *upload) Write(b []byte) (int, error) {
 	}
 
 	u.writeOffset += int64(n)
-	return n, nil
+
+	switch u.sync.mode {
+	case SyncAlways:
+		u.syncedOffset = u.writeOffset
+
+	case SyncPeriodic:
+		if u.writeOffset-u.syncedOffset >= u.sync.bytes || time.Since(u.lastSync) >= u.sync.interval {
+			err = u.syncLocked()
+		}
+	}
+
+	return n, err
+}
+
+// suspend flushes the upload file to disk, closes it and returns the record
+// needed to resume the upload later.
+func (u *upload) suspend() (uploadRecord, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	err := u.syncLocked()
+	if err != nil {
+		u.file.Close()
+		return uploadRecord{}, err
+	}
+
+	err = u.file.Close()
+	if err != nil {
+		return uploadRecord{}, err
+	}
+
+	r := uploadRecord{
+		ID:           u.ID,
+		BaseID:       u.BaseID,
+		Owner:        u.Owner,
+		StorageClass: u.StorageClass,
+		Compression:  u.Compression,
+		Size:         u.Size,
+		Metadata:     u.Metadata,
+		FileSHA256:   u.FileSHA256,
+		Offset:       u.syncedOffset,
+		Created:      u.created,
+		Blocks:       u.blocks,
+		Encrypted:    u.Encrypted,
+	}
+
+	if u.delta != nil {
+		r.DeltaBlock = u.delta.blockSize
+		r.DeltaHave = u.delta.have
+	}
+	return r, nil
+}
+
+// Sync flushes the upload file to disk and updates the synced offset.
+func (u *upload) Sync() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.syncLocked()
+}
+
+func (u *upload) syncLocked() error {
+	// nothing is flushed, so nothing is known to be on disk
+	if u.sync.mode == SyncNone {
+		return nil
+	}
+
+	err := u.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	u.syncedOffset = u.writeOffset
+	u.lastSync = time.Now()
+	return nil
+}
+
+// Rewind truncates the upload to offset so that writing can be resumed from
+// there.  The offset cannot be beyond what has already been written.
+func (u *upload) Rewind(offset int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if offset < 0 || offset > u.writeOffset {
+		return fmt.Errorf("offset %d outside written range [0,%d]", offset, u.writeOffset)
+	}
+
+	err := u.file.Rewind(offset)
+	if err != nil {
+		return err
+	}
+
+	u.writeOffset = offset
+	u.syncedOffset = min(u.syncedOffset, offset)
+
+	// forget the blocks we just truncated away
+	for i, block := range u.blocks {
+		if block.Offset >= offset {
+			u.blocks = u.blocks[:i]
+			break
+		}
+	}
+	return nil
+}
+
+// LogBlock records a block in the block log of the upload.
+func (u *upload) LogBlock(offset int64, size int, sha []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.blocks = append(u.blocks, BlockLogEntry{
+		Offset: offset,
+		Size:   size,
+		SHA256: hex.EncodeToString(sha),
+		Time:   time.Now(),
+	})
+}
+
+// SetDeltaPlan sets the delta plan for a delta upload.
+func (u *upload) SetDeltaPlan(plan *deltaPlan) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.delta = plan
+}
+
+// DeltaPlan returns the delta plan or nil if the upload has no delta plan.
+func (u *upload) DeltaPlan() *deltaPlan {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return u.delta
+}
+
+// Blocks returns a copy of the block log.
+func (u *upload) Blocks() []BlockLogEntry {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return append([]BlockLogEntry(nil), u.blocks...)
 }
 
 // Offset returns the current offset of the upload.
@@ -52,6 +239,15 @@ func (u *upload) Offset() int64 {
 	return u.writeOffset
 }
 
+// SyncedOffset returns how much of the upload has been flushed to disk. This
+// is where uploads have to be resumed from.
+func (u *upload) SyncedOffset() int64 {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return u.syncedOffset
+}
+
 // Filename returns the name of the file we are writing to and "" if there is
 // no file. The name returned is the same that was presented to the Open()
 // call.
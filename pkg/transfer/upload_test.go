@@ -0,0 +1,61 @@
+package transfer
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadSync(t *testing.T) {
+	fs, err := CreateFileStore(path.Join(t.TempDir(), "incoming"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 100)
+
+	for _, tc := range []struct {
+		sync    syncPolicy
+		synced  []int64
+		flushed int64
+	}{
+		{syncPolicy{mode: SyncAlways}, []int64{100, 200, 300, 400}, 400},
+		{syncPolicy{mode: SyncNone}, []int64{0, 0, 0, 0}, 0},
+		{syncPolicy{mode: SyncOnFinish}, []int64{0, 0, 0, 0}, 400},
+		{syncPolicy{mode: SyncPeriodic, bytes: 200, interval: time.Hour}, []int64{0, 200, 200, 400}, 400},
+	} {
+		t.Run(tc.sync.mode.String(), func(t *testing.T) {
+			m, err := newManager(fs, tc.sync)
+			require.NoError(t, err)
+
+			upload, err := m.CreateUpload(1000, nil, nil)
+			require.NoError(t, err)
+
+			for _, synced := range tc.synced {
+				_, err = upload.Write(buf)
+				require.NoError(t, err)
+				require.Equal(t, synced, upload.SyncedOffset())
+			}
+
+			require.NoError(t, upload.Sync())
+			require.Equal(t, tc.flushed, upload.SyncedOffset())
+
+			// rewinding below the synced offset moves the synced offset too
+			require.NoError(t, upload.Rewind(150))
+			require.Equal(t, int64(150), upload.Offset())
+			require.Equal(t, min(tc.flushed, 150), upload.SyncedOffset())
+			require.Error(t, upload.Rewind(151))
+
+			// only complete uploads can be finished
+			require.ErrorIs(t, m.Finish(context.Background(), upload.ID), ErrUploadIncomplete)
+		})
+	}
+
+	mode, err := ParseSyncMode("periodic")
+	require.NoError(t, err)
+	require.Equal(t, SyncPeriodic, mode)
+
+	_, err = ParseSyncMode("sometimes")
+	require.Error(t, err)
+}
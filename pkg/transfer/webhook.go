@@ -0,0 +1,489 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhooks POST every event as JSON to each of the configured URLs.  The
+// request carries the headers
+//
+//	X-Transfer-Event:     the event type
+//	X-Transfer-Delivery:  unique ID of the delivery, the same for every retry
+//	X-Transfer-Timestamp: unix time when the request was signed
+//	X-Transfer-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// Any 2xx response means the event was delivered.  Deliveries are stored in
+// the queue directory until they succeed, so they survive restarts, and are
+// retried with exponential backoff.  Deliveries that still fail after
+// MaxAttempts are appended to the dead letter log and dropped.  Events may
+// arrive out of order when deliveries are retried.
+
+const (
+	webhookEventHeader     = "X-Transfer-Event"
+	webhookDeliveryHeader  = "X-Transfer-Delivery"
+	webhookTimestampHeader = "X-Transfer-Timestamp"
+	webhookSignatureHeader = "X-Transfer-Signature"
+	webhookSignaturePrefix = "sha256="
+
+	webhookDeliverySuffix = ".json"
+	webhookDeadLetterFile = "dead-letter.log"
+
+	defaultWebhookMaxAttempts      = 10
+	defaultWebhookTimeout          = 10 * time.Second
+	defaultWebhookRetryInterval    = time.Second
+	defaultWebhookMaxRetryInterval = 10 * time.Minute
+)
+
+// ErrInvalidWebhookSignature is returned by VerifyWebhookSignature if the
+// signature is missing or wrong.
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// WebhookConfig configures a Webhook.  Only URLs, Secret and QueueDir are
+// required.
+type WebhookConfig struct {
+	// URLs the events are posted to.
+	URLs []string
+
+	// Secret is the key used to sign requests.
+	Secret []byte
+
+	// QueueDir is where deliveries are kept until they succeed.
+	QueueDir string
+
+	// DeadLetterFile is where deliveries that failed MaxAttempts times are
+	// logged, one JSON object per line.  Defaults to dead-letter.log in
+	// QueueDir.
+	DeadLetterFile string
+
+	// Events are the event types that are posted.  If empty every event
+	// except EventProgress is posted.
+	Events []EventType
+
+	// MaxAttempts is how many times a delivery is tried, 10 if zero.
+	MaxAttempts int
+
+	// Timeout for each request, 10 seconds if zero.
+	Timeout time.Duration
+
+	// RetryInterval is how long to wait after the first failed attempt, 1
+	// second if zero.  It doubles after every failed attempt up to
+	// MaxRetryInterval, 10 minutes if zero.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+}
+
+// Webhook is a Hook that posts events to HTTP endpoints.
+type Webhook struct {
+	config  WebhookConfig
+	client  *http.Client
+	deadMu  sync.Mutex
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// WebhookPayload is the body of a webhook request.  State is what the event
+// means for the file: uploading, finished, failed, expired or deleted.
+type WebhookPayload struct {
+	Event        string    `json:"event"`
+	State        string    `json:"state"`
+	ID           ID        `json:"id"`
+	Size         int64     `json:"size"`
+	Offset       int64     `json:"offset"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Metadata     []byte    `json:"metadata,omitempty"`
+	StorageClass string    `json:"storage_class,omitempty"`
+	Owner        string    `json:"owner,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// webhookDelivery is an event waiting to be posted to one URL.
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Event       string          `json:"event"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// NewWebhook creates a webhook and starts delivering events, including any
+// left in the queue directory, which are retried right away.
+func NewWebhook(c WebhookConfig) (*Webhook, error) {
+	if len(c.URLs) == 0 {
+		return nil, errors.New("no webhook URLs")
+	}
+
+	if len(c.Secret) == 0 {
+		return nil, errors.New("webhook secret is required")
+	}
+
+	if c.QueueDir == "" {
+		return nil, errors.New("webhook queue dir is required")
+	}
+
+	err := os.MkdirAll(c.QueueDir, dirPermissions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create webhook queue dir: %w", err)
+	}
+
+	if c.DeadLetterFile == "" {
+		c.DeadLetterFile = path.Join(c.QueueDir, webhookDeadLetterFile)
+	}
+
+	if len(c.Events) == 0 {
+		c.Events = []EventType{EventCreated, EventFinished, EventFailed, EventExpired, EventDeleted, EventProcessed, EventProcessingFailed}
+	}
+
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = defaultWebhookMaxAttempts
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = defaultWebhookTimeout
+	}
+
+	if c.RetryInterval == 0 {
+		c.RetryInterval = defaultWebhookRetryInterval
+	}
+
+	if c.MaxRetryInterval == 0 {
+		c.MaxRetryInterval = defaultWebhookMaxRetryInterval
+	}
+
+	w := &Webhook{
+		config:  c,
+		client:  &http.Client{Timeout: c.Timeout},
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// HandleEvent implements Hook.  The event is queued on disk for every URL.
+func (w *Webhook) HandleEvent(_ context.Context, e Event) {
+	if !slices.Contains(w.config.Events, e.Type) {
+		return
+	}
+
+	body, err := json.Marshal(newWebhookPayload(e))
+	if err != nil {
+		slog.Error("error encoding webhook payload", "id", e.ID, "err", err)
+		return
+	}
+
+	for _, url := range w.config.URLs {
+		id, err := newDeliveryID()
+		if err != nil {
+			slog.Error("error creating webhook delivery", "id", e.ID, "err", err)
+			return
+		}
+
+		err = w.save(webhookDelivery{ID: id, URL: url, Event: e.Type.String(), Body: body, NextAttempt: e.Time})
+		if err != nil {
+			slog.Error("error queueing webhook delivery", "id", e.ID, "url", url, "err", err)
+		}
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops delivering events.  Deliveries that haven't succeeded stay in
+// the queue directory and are retried by the next Webhook using it.
+func (w *Webhook) Close() error {
+	w.once.Do(func() { close(w.done) })
+	<-w.stopped
+	return nil
+}
+
+func newWebhookPayload(e Event) WebhookPayload {
+	p := WebhookPayload{
+		Event:        e.Type.String(),
+		State:        e.Type.String(),
+		ID:           e.ID,
+		Size:         e.Size,
+		Offset:       e.Offset,
+		Metadata:     e.Metadata,
+		StorageClass: e.StorageClass,
+		Owner:        e.Owner,
+		Time:         e.Time,
+	}
+
+	if e.Type == EventCreated || e.Type == EventProgress {
+		p.State = "uploading"
+	}
+
+	if len(e.SHA256) > 0 {
+		p.SHA256 = hex.EncodeToString(e.SHA256)
+	}
+
+	if e.Err != nil {
+		p.Error = e.Err.Error()
+	}
+	return p
+}
+
+// newDeliveryID returns an ID that sorts by creation time so deliveries are
+// attempted in the order they were queued.
+func newDeliveryID() (string, error) {
+	random := make([]byte, 8)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(random)), nil
+}
+
+func (w *Webhook) filename(id string) string {
+	return path.Join(w.config.QueueDir, id+webhookDeliverySuffix)
+}
+
+// save writes d to the queue directory, replacing any earlier version.
+func (w *Webhook) save(d webhookDelivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	tmp := w.filename(d.ID) + ".tmp"
+	err = os.WriteFile(tmp, data, filePermissions)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.filename(d.ID))
+}
+
+// pending returns the queued deliveries in the order they were queued.
+func (w *Webhook) pending() ([]webhookDelivery, error) {
+	entries, err := os.ReadDir(w.config.QueueDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), webhookDeliverySuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var deliveries []webhookDelivery
+	for _, name := range names {
+		data, err := os.ReadFile(path.Join(w.config.QueueDir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		var d webhookDelivery
+		err = json.Unmarshal(data, &d)
+		if err != nil {
+			slog.Error("dropping unreadable webhook delivery", "file", name, "err", err)
+			os.Remove(path.Join(w.config.QueueDir, name))
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+func (w *Webhook) run() {
+	defer close(w.stopped)
+
+	// deliveries left from before are retried right away
+	next := w.deliverDue(true)
+
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-w.done:
+			timer.Stop()
+			return
+		case <-w.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		next = w.deliverDue(false)
+	}
+}
+
+// deliverDue attempts every delivery that is due, or every delivery if all is
+// set, and returns when the next delivery is due.
+func (w *Webhook) deliverDue(all bool) time.Time {
+	now := time.Now()
+	next := now.Add(w.config.MaxRetryInterval)
+
+	deliveries, err := w.pending()
+	if err != nil {
+		slog.Error("error reading webhook queue", "dir", w.config.QueueDir, "err", err)
+		return time.Now().Add(w.config.RetryInterval)
+	}
+
+	for _, d := range deliveries {
+		select {
+		case <-w.done:
+			return next
+		default:
+		}
+
+		if !all && d.NextAttempt.After(now) {
+			if d.NextAttempt.Before(next) {
+				next = d.NextAttempt
+			}
+			continue
+		}
+
+		err := w.post(d)
+		if err == nil {
+			os.Remove(w.filename(d.ID))
+			continue
+		}
+
+		d.Attempts++
+		d.LastError = err.Error()
+		slog.Warn("webhook delivery failed", "delivery", d.ID, "url", d.URL, "attempts", d.Attempts, "err", err)
+
+		if d.Attempts >= w.config.MaxAttempts {
+			w.deadLetter(d)
+			continue
+		}
+
+		d.NextAttempt = time.Now().Add(w.backoff(d.Attempts))
+		if d.NextAttempt.Before(next) {
+			next = d.NextAttempt
+		}
+
+		err = w.save(d)
+		if err != nil {
+			slog.Error("error updating webhook delivery", "delivery", d.ID, "err", err)
+		}
+	}
+	return next
+}
+
+// backoff returns how long to wait after the given number of failed attempts.
+func (w *Webhook) backoff(attempts int) time.Duration {
+	interval := w.config.RetryInterval
+	for i := 1; i < attempts && interval < w.config.MaxRetryInterval; i++ {
+		interval *= 2
+	}
+	return min(interval, w.config.MaxRetryInterval)
+}
+
+// post sends d once.
+func (w *Webhook) post(d webhookDelivery) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, d.ID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, webhookSignaturePrefix+hex.EncodeToString(signWebhook(w.config.Secret, timestamp, d.Body)))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// deadLetter logs d to the dead letter log and removes it from the queue.
+func (w *Webhook) deadLetter(d webhookDelivery) {
+	w.deadMu.Lock()
+	defer w.deadMu.Unlock()
+
+	slog.Error("giving up on webhook delivery", "delivery", d.ID, "url", d.URL, "attempts", d.Attempts, "err", d.LastError)
+
+	line, err := json.Marshal(d)
+	if err == nil {
+		var file *os.File
+		file, err = os.OpenFile(w.config.DeadLetterFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePermissions)
+		if err == nil {
+			_, err = file.Write(append(line, '\n'))
+			err = errors.Join(err, file.Close())
+		}
+	}
+
+	if err != nil {
+		slog.Error("error writing to dead letter log, keeping delivery in queue", "file", w.config.DeadLetterFile, "err", err)
+		d.NextAttempt = time.Now().Add(w.config.MaxRetryInterval)
+		w.save(d)
+		return
+	}
+	os.Remove(w.filename(d.ID))
+}
+
+func signWebhook(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// VerifyWebhookSignature checks the signature of a webhook request with the
+// given header and body.  Receivers should also check that the timestamp is
+// recent to guard against replayed requests.
+func VerifyWebhookSignature(secret []byte, header http.Header, body []byte) error {
+	timestamp := header.Get(webhookTimestampHeader)
+	signature, ok := strings.CutPrefix(header.Get(webhookSignatureHeader), webhookSignaturePrefix)
+	if timestamp == "" || !ok {
+		return ErrInvalidWebhookSignature
+	}
+
+	mac, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, signWebhook(secret, timestamp, body)) {
+		return ErrInvalidWebhookSignature
+	}
+	return nil
+}
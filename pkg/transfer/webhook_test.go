@@ -0,0 +1,199 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver records the webhook requests it gets after failing the
+// first few.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	payloads []WebhookPayload
+	header   http.Header
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := io.ReadAll(req.Body)
+	err := VerifyWebhookSignature([]byte("webhook secret"), req.Header, body)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var p WebhookPayload
+	_ = json.Unmarshal(body, &p)
+	r.payloads = append(r.payloads, p)
+	r.header = req.Header
+}
+
+func (r *webhookReceiver) received() []WebhookPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.payloads)
+}
+
+func TestWebhook(t *testing.T) {
+	receiver := &webhookReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	webhook, err := NewWebhook(WebhookConfig{
+		URLs:          []string{server.URL},
+		Secret:        []byte("webhook secret"),
+		QueueDir:      t.TempDir(),
+		RetryInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer webhook.Close()
+
+	_, addr := startServer(t, Config{
+		IncomingDir:        path.Join(t.TempDir(), "incoming"),
+		PreferredBlockSize: minBlockSize,
+		Hooks:              []Hook{webhook},
+	})
+
+	client, err := CreateClient(ClientConfig{ServerAddr: addr})
+	require.NoError(t, err)
+	defer client.Close()
+
+	id, err := client.Upload(randomFile(t, 2*minBlockSize))
+	require.NoError(t, err)
+
+	// progress events aren't posted by default
+	require.Eventually(t, func() bool { return len(receiver.received()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	payloads := receiver.received()
+	require.Equal(t, "created", payloads[0].Event)
+	require.Equal(t, "uploading", payloads[0].State)
+	require.Equal(t, "finished", payloads[1].Event)
+	require.Equal(t, "finished", payloads[1].State)
+	require.Equal(t, ID(id), payloads[1].ID)
+	require.Equal(t, int64(2*minBlockSize), payloads[1].Size)
+	require.Len(t, payloads[1].SHA256, 64)
+	require.Equal(t, "finished", receiver.header.Get(webhookEventHeader))
+	require.NotEmpty(t, receiver.header.Get(webhookDeliveryHeader))
+
+	// tampered bodies don't verify
+	require.ErrorIs(t, VerifyWebhookSignature([]byte("webhook secret"), receiver.header, []byte("{}")), ErrInvalidWebhookSignature)
+	require.ErrorIs(t, VerifyWebhookSignature([]byte("webhook secret"), http.Header{}, []byte("{}")), ErrInvalidWebhookSignature)
+}
+
+func TestWebhookRetryQueue(t *testing.T) {
+	var up atomic.Bool
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		receiver.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	queueDir := t.TempDir()
+	config := WebhookConfig{
+		URLs:          []string{server.URL},
+		Secret:        []byte("webhook secret"),
+		QueueDir:      queueDir,
+		RetryInterval: time.Hour,
+	}
+
+	webhook, err := NewWebhook(config)
+	require.NoError(t, err)
+
+	webhook.HandleEvent(context.Background(), Event{Type: EventFinished, ID: "1234", Size: 10, Time: time.Now()})
+
+	// the delivery fails and is kept for later
+	require.Eventually(t, func() bool {
+		deliveries, err := webhook.pending()
+		return err == nil && len(deliveries) == 1 && deliveries[0].Attempts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, webhook.Close())
+
+	// a new webhook picks up the queue and delivers it right away
+	up.Store(true)
+	webhook, err = NewWebhook(config)
+	require.NoError(t, err)
+	defer webhook.Close()
+
+	require.Eventually(t, func() bool { return len(receiver.received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, ID("1234"), receiver.received()[0].ID)
+
+	require.Eventually(t, func() bool {
+		deliveries, err := webhook.pending()
+		return err == nil && len(deliveries) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	deadLetterFile := path.Join(t.TempDir(), "dead.log")
+	webhook, err := NewWebhook(WebhookConfig{
+		URLs:           []string{server.URL},
+		Secret:         []byte("webhook secret"),
+		QueueDir:       t.TempDir(),
+		DeadLetterFile: deadLetterFile,
+		Events:         []EventType{EventFailed},
+		MaxAttempts:    3,
+		RetryInterval:  time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer webhook.Close()
+
+	webhook.HandleEvent(context.Background(), Event{Type: EventFinished, ID: "1"})
+	webhook.HandleEvent(context.Background(), Event{Type: EventFailed, ID: "2"})
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(deadLetterFile)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(3), attempts.Load())
+
+	file, err := os.Open(deadLetterFile)
+	require.NoError(t, err)
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	require.True(t, scanner.Scan())
+
+	var d webhookDelivery
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &d))
+	require.Equal(t, 3, d.Attempts)
+	require.Equal(t, "failed", d.Event)
+	require.Contains(t, d.LastError, "500")
+	require.False(t, scanner.Scan())
+
+	deliveries, err := webhook.pending()
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+}